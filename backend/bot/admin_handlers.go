@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// ============================================================================
+// Admin Handlers (require the admin token)
+// ============================================================================
+
+// DeadLettersHandler lists dead-lettered events
+// Query params: status (pending|replayed, default all), limit (default 50, max 500)
+func (h *APIHandlers) DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "dead_letters").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	status := r.URL.Query().Get("status")
+	if status != "" && status != DeadLetterPending && status != DeadLetterReplayed {
+		http.Error(w, "status must be pending or replayed", http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 500 {
+			limit = v
+		}
+	}
+
+	list, err := h.store.ListDeadLetters(r.Context(), status, limit)
+	if err != nil {
+		h.logger.Error().Str("handler", "dead_letters").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info().Str("handler", "dead_letters").Int("count", len(list)).Msg("request completed")
+	writeJSON(w, h.logger, "dead_letters", http.StatusOK, list)
+}
+
+// DeadLetterHandler returns a single dead-lettered event including its raw payload
+// Path params: id
+func (h *APIHandlers) DeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "dead_letter").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	dl, err := h.store.GetDeadLetter(r.Context(), id)
+	if err != nil {
+		h.logger.Error().Str("handler", "dead_letter").Int64("id", id).Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dl == nil {
+		http.Error(w, "dead-letter event not found", http.StatusNotFound)
+		return
+	}
+
+	h.logger.Info().Str("handler", "dead_letter").Int64("id", id).Msg("request completed")
+	writeJSON(w, h.logger, "dead_letter", http.StatusOK, dl)
+}
+
+// ReplayDeadLetterHandler replays a dead-lettered event through the event processor
+// Path params: id
+func (h *APIHandlers) ReplayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "replay_dead_letter").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	if h.eventProcessor == nil {
+		http.Error(w, "event processor not available; replay dead letters on the bot (run-bot)", http.StatusServiceUnavailable)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.processorFor(r.Context(), id).ReplayDeadLetter(r.Context(), id); err != nil {
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		h.logger.Warn().Str("handler", "replay_dead_letter").Int64("id", id).Err(err).Msg("replay failed")
+		writeJSON(w, h.logger, "replay_dead_letter", http.StatusUnprocessableEntity, map[string]interface{}{
+			"id":       id,
+			"replayed": false,
+			"error":    err.Error(),
+		})
+		return
+	}
+
+	h.logger.Info().Str("handler", "replay_dead_letter").Int64("id", id).Msg("request completed")
+	writeJSON(w, h.logger, "replay_dead_letter", http.StatusOK, map[string]interface{}{
+		"id":       id,
+		"replayed": true,
+	})
+}
+
+// BackupHandler takes an on-demand database snapshot into the backup directory
+func (h *APIHandlers) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "backup").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	if h.backups == nil {
+		http.Error(w, "backups are not configured (set BACKUP_DIR on a SQLite database)", http.StatusServiceUnavailable)
+		return
+	}
+
+	b, err := h.backups.Snapshot(r.Context())
+	if err != nil {
+		h.logger.Error().Str("handler", "backup").Err(err).Msg("backup failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info().Str("handler", "backup").Str("path", b.Path).Int64("size", b.Size).Msg("request completed")
+	writeJSON(w, h.logger, "backup", http.StatusCreated, b)
+}
+
+// maxCorrectionBytes caps the body of a beer correction request
+const maxCorrectionBytes = 1 << 16
+
+// beerCorrection is the body of the beer correction and user erase and
+// merge endpoints. Reason is required; Actor names the person making the
+// change in the audit log.
+type beerCorrection struct {
+	Giver     string `json:"giver"`
+	Recipient string `json:"recipient"`
+	Time      string `json:"time"`
+	Count     *int   `json:"count"`
+	Into      string `json:"into"`
+	Workspace string `json:"workspace"`
+	Reason    string `json:"reason"`
+	Actor     string `json:"actor"`
+}
+
+// auditActor is how the correction's author is recorded in the audit log
+func (c *beerCorrection) auditActor() string {
+	if actor := strings.TrimSpace(c.Actor); actor != "" {
+		return "admin:" + actor
+	}
+	return "admin"
+}
+
+// decodeBeerCorrection reads a correction body, rejecting it without a reason
+func decodeBeerCorrection(w http.ResponseWriter, r *http.Request) (*beerCorrection, error) {
+	var c beerCorrection
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCorrectionBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+	c.Reason = strings.TrimSpace(c.Reason)
+	if c.Reason == "" {
+		return nil, errors.New("a reason is required")
+	}
+	return &c, nil
+}
+
+// applyCorrectionToCache moves a corrected beer's delta into the Redis leaderboards
+func (h *APIHandlers) applyCorrectionToCache(r *http.Request, handler string, entry *AuditEntry) {
+	if h.redisCache == nil || entry.Delta() == 0 || entry.BeerTime == nil {
+		return
+	}
+	giverID := canonicalID(r.Context(), h.store, h.logger, entry.GiverID)
+	recipientID := canonicalID(r.Context(), h.store, h.logger, entry.RecipientID)
+	if err := h.redisCache.AdjustStats(r.Context(), giverID, recipientID, *entry.BeerTime, entry.Delta()); err != nil {
+		h.logger.Warn().Str("handler", handler).Int64("beer_id", entry.BeerID).Err(err).Msg("failed to adjust redis leaderboards")
+	}
+}
+
+// writeCorrectionError maps a store correction error to a response
+func (h *APIHandlers) writeCorrectionError(w http.ResponseWriter, handler string, id int64, err error) {
+	if errors.Is(err, ErrBeerNotFound) {
+		http.Error(w, ErrBeerNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrBeerRevoked) {
+		http.Error(w, ErrBeerRevoked.Error(), http.StatusConflict)
+		return
+	}
+	h.logger.Error().Str("handler", handler).Int64("beer_id", id).Err(err).Msg("database error")
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// BeersHandler lists beers with their ids so they can be corrected
+// Query params: user (giver or recipient), start, end (YYYY-MM-DD, optional), limit (default 100, max 1000), include_revoked
+func (h *APIHandlers) BeersHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "beers").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	q := r.URL.Query()
+	f := BeerFilter{UserID: q.Get("user"), Workspace: q.Get("workspace"), Limit: 100, IncludeRevoked: statsOptionsFromParams(r).IncludeRevoked}
+	for param, dst := range map[string]*time.Time{"start": &f.Start, "end": &f.End} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				http.Error(w, param+" must be YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= 1000 {
+		f.Limit = v
+	}
+
+	list, err := h.store.ListBeers(r.Context(), f)
+	if err != nil {
+		h.logger.Error().Str("handler", "beers").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info().Str("handler", "beers").Int("count", len(list)).Msg("request completed")
+	writeJSON(w, h.logger, "beers", http.StatusOK, list)
+}
+
+// AddBeerHandler records a beer that was missed
+// Body: {"giver", "recipient", "time" (optional, default now), "count" (default 1), "workspace" (default the bot's first workspace), "reason", "actor"}
+func (h *APIHandlers) AddBeerHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "add_beer").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	c, err := decodeBeerCorrection(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slackUserIDPattern.MatchString(c.Giver) || !slackUserIDPattern.MatchString(c.Recipient) {
+		http.Error(w, "giver and recipient must be Slack user IDs", http.StatusBadRequest)
+		return
+	}
+	if c.Giver == c.Recipient {
+		http.Error(w, "giver and recipient must differ", http.StatusBadRequest)
+		return
+	}
+	count := 1
+	if c.Count != nil {
+		count = *c.Count
+	}
+	if count <= 0 {
+		http.Error(w, "count must be positive", http.StatusBadRequest)
+		return
+	}
+	at := time.Now()
+	if c.Time != "" {
+		if at, err = parseImportTime(c.Time, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	workspace := c.Workspace
+	if workspace == "" {
+		workspace = h.defaultWorkspace(r.Context())
+	} else if !strings.HasPrefix(workspace, "T") || !workspaceIDPattern.MatchString(workspace) {
+		http.Error(w, "workspace must be a Slack workspace ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.store.AdminAddBeer(r.Context(), workspace, c.Giver, c.Recipient, at, count, c.auditActor(), c.Reason)
+	if err != nil {
+		h.writeCorrectionError(w, "add_beer", 0, err)
+		return
+	}
+	h.applyCorrectionToCache(r, "add_beer", entry)
+
+	h.logger.Info().Str("handler", "add_beer").Int64("beer_id", entry.BeerID).Str("actor", entry.Actor).Msg("request completed")
+	writeJSON(w, h.logger, "add_beer", http.StatusCreated, entry)
+}
+
+// AdjustBeerHandler changes the count of a beer
+// Path params: id. Body: {"count", "reason", "actor"}
+func (h *APIHandlers) AdjustBeerHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "adjust_beer").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	c, err := decodeBeerCorrection(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Count == nil || *c.Count <= 0 {
+		http.Error(w, "count must be positive; revoke the beer to remove it", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.store.AdjustBeer(r.Context(), id, *c.Count, c.auditActor(), c.Reason)
+	if err != nil {
+		h.writeCorrectionError(w, "adjust_beer", id, err)
+		return
+	}
+	h.applyCorrectionToCache(r, "adjust_beer", entry)
+
+	h.logger.Info().Str("handler", "adjust_beer").Int64("beer_id", id).Int("delta", entry.Delta()).Str("actor", entry.Actor).Msg("request completed")
+	writeJSON(w, h.logger, "adjust_beer", http.StatusOK, entry)
+}
+
+// RevokeBeerHandler revokes a beer, keeping its row
+// Path params: id. Body: {"reason", "actor"}
+func (h *APIHandlers) RevokeBeerHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "revoke_beer").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	c, err := decodeBeerCorrection(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.store.RevokeBeer(r.Context(), id, c.auditActor(), c.Reason)
+	if err != nil {
+		h.writeCorrectionError(w, "revoke_beer", id, err)
+		return
+	}
+	h.applyCorrectionToCache(r, "revoke_beer", entry)
+
+	h.logger.Info().Str("handler", "revoke_beer").Int64("beer_id", id).Str("actor", entry.Actor).Msg("request completed")
+	writeJSON(w, h.logger, "revoke_beer", http.StatusOK, entry)
+}
+
+// AuditLogHandler lists audit log entries, newest first
+// Query params: action, actor, user, beer_id, before (id, for paging), limit (default 100, max 1000)
+func (h *APIHandlers) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "audit_log").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	q := r.URL.Query()
+	f := AuditFilter{Action: q.Get("action"), Actor: q.Get("actor"), UserID: q.Get("user"), Limit: 100}
+	for param, dst := range map[string]*int64{"beer_id": &f.BeerID, "before": &f.Before} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid "+param, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= 1000 {
+		f.Limit = v
+	}
+
+	list, err := h.store.ListAuditLog(r.Context(), f)
+	if err != nil {
+		h.logger.Error().Str("handler", "audit_log").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info().Str("handler", "audit_log").Int("count", len(list)).Msg("request completed")
+	writeJSON(w, h.logger, "audit_log", http.StatusOK, list)
+}
+
+// RefreshUserHandler fetches a user from Slack and overwrites its cached record
+// Path params: id (Slack user ID)
+func (h *APIHandlers) RefreshUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "refresh_user").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	if h.slackClient == nil {
+		http.Error(w, "slack client not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	su, err := h.slackClient.GetUserInfoContext(r.Context(), userID)
+	if err != nil {
+		var slackErr slack.SlackErrorResponse
+		if errors.As(err, &slackErr) && slackErr.Err == "user_not_found" {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Str("handler", "refresh_user").Str("userID", userID).Err(err).Msg("slack API error")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if _, err := saveSlackUser(r.Context(), h.store, h.redisCache, *su); err != nil {
+		h.logger.Error().Str("handler", "refresh_user").Str("userID", userID).Err(err).Msg("failed to store user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, err := h.store.GetCachedUser(r.Context(), userID)
+	if err != nil {
+		h.logger.Error().Str("handler", "refresh_user").Str("userID", userID).Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info().Str("handler", "refresh_user").Str("userID", userID).Msg("request completed")
+	writeJSON(w, h.logger, "refresh_user", http.StatusOK, u)
+}
+
+// PurgeUserHandler removes a user from the database and Redis caches. The
+// next lookup or directory sync fetches the user again.
+// Path params: id (Slack user ID)
+func (h *APIHandlers) PurgeUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "purge_user").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	if err := h.store.DeleteCachedUser(r.Context(), userID); err != nil {
+		h.logger.Error().Str("handler", "purge_user").Str("userID", userID).Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if h.redisCache != nil {
+		if err := h.redisCache.DeleteUser(r.Context(), userID); err != nil {
+			h.logger.Warn().Str("handler", "purge_user").Str("userID", userID).Err(err).Msg("failed to purge user from redis")
+		}
+	}
+
+	h.logger.Info().Str("handler", "purge_user").Str("userID", userID).Msg("request completed")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+// canonicalID resolves a merged user ID for the Redis leaderboards, falling
+// back to userID when the store can't be read
+func canonicalID(ctx context.Context, store Store, logger zerolog.Logger, userID string) string {
+	id, err := store.CanonicalUserID(ctx, userID)
+	if err != nil {
+		logger.Warn().Err(err).Str("userID", userID).Msg("failed to resolve user alias")
+		return userID
+	}
+	return id
+}
+
+// refreshLeaderboards rebuilds the Redis leaderboards after a merge changed
+// which user beers count for
+func (h *APIHandlers) refreshLeaderboards(r *http.Request, handler string) {
+	if h.redisCache == nil {
+		return
+	}
+	if err := h.redisCache.PopulateFromDB(r.Context(), h.store); err != nil {
+		h.logger.Warn().Str("handler", handler).Err(err).Msg("failed to refresh redis leaderboards")
+	}
+}
+
+// UserAliasesHandler lists every merged user ID
+func (h *APIHandlers) UserAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "user_aliases").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	aliases, err := h.store.GetUserAliases(r.Context())
+	if err != nil {
+		h.logger.Error().Str("handler", "user_aliases").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if aliases == nil {
+		aliases = []UserAlias{}
+	}
+
+	h.logger.Info().Str("handler", "user_aliases").Int("count", len(aliases)).Msg("request completed")
+	writeJSON(w, h.logger, "user_aliases", http.StatusOK, aliases)
+}
+
+// MergeUserHandler merges a user ID into another and rebuilds the Redis
+// leaderboards
+// Path params: id (the Slack user ID to merge). Body: {"into", "reason", "actor"}
+func (h *APIHandlers) MergeUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "merge_user").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	c, err := decodeBeerCorrection(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slackUserIDPattern.MatchString(c.Into) {
+		http.Error(w, "into must be a Slack user ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.store.MergeUsers(r.Context(), userID, c.Into, c.auditActor(), c.Reason)
+	if errors.Is(err, ErrInvalidMerge) {
+		http.Error(w, ErrInvalidMerge.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Str("handler", "merge_user").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.refreshLeaderboards(r, "merge_user")
+
+	h.logger.Info().Str("handler", "merge_user").Str("alias", userID).Str("canonical", entry.RecipientID).Msg("request completed")
+	writeJSON(w, h.logger, "merge_user", http.StatusOK, entry)
+}
+
+// UnmergeUserHandler undoes a merge and rebuilds the Redis leaderboards
+// Path params: id (the merged Slack user ID). Body: {"reason", "actor"}
+func (h *APIHandlers) UnmergeUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "unmerge_user").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	c, err := decodeBeerCorrection(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.store.UnmergeUser(r.Context(), userID, c.auditActor(), c.Reason)
+	if errors.Is(err, ErrAliasNotFound) {
+		http.Error(w, ErrAliasNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Str("handler", "unmerge_user").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.refreshLeaderboards(r, "unmerge_user")
+
+	h.logger.Info().Str("handler", "unmerge_user").Str("alias", userID).Msg("request completed")
+	writeJSON(w, h.logger, "unmerge_user", http.StatusOK, entry)
+}
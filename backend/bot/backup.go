@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	backupPrefix     = "beerbot-"
+	backupSuffix     = ".db"
+	backupTimeLayout = "20060102T150405Z"
+)
+
+// Backup is a snapshot file written by the BackupManager
+type Backup struct {
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// BackupManager takes online snapshots of the store into a directory and
+// prunes them down to the newest snapshot of each of the last KeepDaily days
+// and KeepWeekly ISO weeks
+type BackupManager struct {
+	store      Store
+	dir        string
+	keepDaily  int
+	keepWeekly int
+	interval   time.Duration
+	logger     zerolog.Logger
+
+	mu sync.Mutex // one snapshot at a time
+
+	failures prometheus.Counter
+	lastRun  prometheus.Gauge
+	duration prometheus.Histogram
+	size     prometheus.Gauge
+}
+
+// NewBackupManager creates a backup manager. Metrics are registered on reg when non-nil.
+func NewBackupManager(store Store, dir string, keepDaily, keepWeekly int, interval time.Duration, logger zerolog.Logger, reg prometheus.Registerer) *BackupManager {
+	m := &BackupManager{
+		store:      store,
+		dir:        dir,
+		keepDaily:  keepDaily,
+		keepWeekly: keepWeekly,
+		interval:   interval,
+		logger:     logger,
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bwm_backup_failures_total",
+			Help: "Number of failed database backups",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bwm_backup_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful database backup",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_backup_duration_seconds",
+			Help:    "Duration of database backups",
+			Buckets: prometheus.DefBuckets,
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bwm_backup_size_bytes",
+			Help: "Size of the last database backup",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.failures, m.lastRun, m.duration, m.size)
+	}
+	return m
+}
+
+// Snapshot writes a new backup, verifies it and applies retention
+func (m *BackupManager) Snapshot(ctx context.Context) (*Backup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := time.Now().UTC()
+	b, err := m.snapshot(ctx, start)
+	if err != nil {
+		m.failures.Inc()
+		return nil, err
+	}
+	m.duration.Observe(time.Since(start).Seconds())
+	m.lastRun.SetToCurrentTime()
+	m.size.Set(float64(b.Size))
+
+	if pruned, err := m.Prune(); err != nil {
+		m.logger.Error().Err(err).Msg("backup retention failed")
+	} else if len(pruned) > 0 {
+		m.logger.Info().Strs("removed", pruned).Msg("pruned old backups")
+	}
+	return b, nil
+}
+
+func (m *BackupManager) snapshot(ctx context.Context, at time.Time) (*Backup, error) {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create backup dir: %w", err)
+	}
+	final := filepath.Join(m.dir, backupPrefix+at.Format(backupTimeLayout)+backupSuffix)
+	partial := final + ".partial"
+	defer os.Remove(partial)
+
+	if err := m.store.BackupTo(ctx, partial); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	if _, err := validateSnapshot(partial); err != nil {
+		return nil, fmt.Errorf("verify backup: %w", err)
+	}
+	if err := os.Rename(partial, final); err != nil {
+		return nil, fmt.Errorf("finalize backup: %w", err)
+	}
+	info, err := os.Stat(final)
+	if err != nil {
+		return nil, err
+	}
+	return &Backup{Path: final, CreatedAt: at, Size: info.Size()}, nil
+}
+
+// List returns the snapshots in the backup directory, newest first
+func (m *BackupManager) List() ([]Backup, error) {
+	entries, err := os.ReadDir(m.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []Backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		at, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		b := Backup{Path: filepath.Join(m.dir, name), CreatedAt: at}
+		if info, err := e.Info(); err == nil {
+			b.Size = info.Size()
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// Prune deletes snapshots outside the retention policy and returns their paths
+func (m *BackupManager) Prune() ([]string, error) {
+	backups, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	keep := backupsToKeep(backups, m.keepDaily, m.keepWeekly)
+	var removed []string
+	for _, b := range backups {
+		if keep[b.Path] {
+			continue
+		}
+		if err := os.Remove(b.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, b.Path)
+	}
+	return removed, nil
+}
+
+// backupsToKeep applies the retention policy to backups sorted newest first:
+// the newest snapshot of each of the last daily days and of each of the last
+// weekly ISO weeks is kept. The newest snapshot is always kept.
+func backupsToKeep(backups []Backup, daily, weekly int) map[string]bool {
+	keep := map[string]bool{}
+	if len(backups) > 0 {
+		keep[backups[0].Path] = true
+	}
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	for _, b := range backups {
+		day := b.CreatedAt.Format("2006-01-02")
+		if !days[day] && len(days) < daily {
+			days[day] = true
+			keep[b.Path] = true
+		}
+		year, w := b.CreatedAt.ISOWeek()
+		week := fmt.Sprintf("%d-W%02d", year, w)
+		if !weeks[week] && len(weeks) < weekly {
+			weeks[week] = true
+			keep[b.Path] = true
+		}
+	}
+	return keep
+}
+
+// Run takes a snapshot whenever the newest one is older than the interval,
+// checking once per interval until ctx is done
+func (m *BackupManager) Run(ctx context.Context) {
+	m.logger.Info().Str("dir", m.dir).Dur("interval", m.interval).Int("keep_daily", m.keepDaily).Int("keep_weekly", m.keepWeekly).Msg("starting scheduled backups")
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		if m.due() {
+			if b, err := m.Snapshot(ctx); err != nil {
+				m.logger.Error().Err(err).Msg("scheduled backup failed")
+			} else {
+				m.logger.Info().Str("path", b.Path).Int64("size", b.Size).Msg("backup written")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			m.logger.Info().Msg("scheduled backups stopping")
+			return
+		}
+	}
+}
+
+// due reports whether the newest backup is older than the interval; restarts
+// therefore don't add extra snapshots
+func (m *BackupManager) due() bool {
+	backups, err := m.List()
+	if err != nil || len(backups) == 0 {
+		return true
+	}
+	return time.Since(backups[0].CreatedAt) >= m.interval
+}
+
+// validateSnapshot checks that path is an intact SQLite database with a
+// schema this build can run, and returns its schema version
+func validateSnapshot(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return 0, fmt.Errorf("integrity check: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("integrity check: %s", result)
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	if version < 1 || version > sqliteDialect.latestVersion() {
+		return version, fmt.Errorf("schema version %d is not supported by this build (latest %d)", version, sqliteDialect.latestVersion())
+	}
+	var beers int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM beers`).Scan(&beers); err != nil {
+		return version, fmt.Errorf("read beers: %w", err)
+	}
+	return version, nil
+}
+
+// restoreSnapshot validates the snapshot and swaps it in as dbPath. The
+// current database is first copied next to it as <db>.pre-restore-<ts>.bak;
+// that path is returned. The bot must not be running.
+func restoreSnapshot(snapshot, dbPath string) (string, error) {
+	if _, err := validateSnapshot(snapshot); err != nil {
+		return "", fmt.Errorf("snapshot %s is not usable: %w", snapshot, err)
+	}
+
+	// stage the copy in the target directory so the final rename is atomic
+	staged := dbPath + ".restore"
+	if err := copyFile(snapshot, staged); err != nil {
+		os.Remove(staged)
+		return "", fmt.Errorf("stage snapshot: %w", err)
+	}
+
+	previous := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			os.Remove(staged)
+			return "", err
+		}
+		previous, err = backupDatabase(db, "", "pre-restore")
+		db.Close()
+		if err != nil {
+			os.Remove(staged)
+			return "", fmt.Errorf("back up current database: %w", err)
+		}
+	}
+
+	// a stale WAL would be replayed on top of the restored file
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(staged)
+			return previous, err
+		}
+	}
+	if err := os.Rename(staged, dbPath); err != nil {
+		os.Remove(staged)
+		return previous, fmt.Errorf("swap in snapshot: %w", err)
+	}
+	return previous, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// runRestoreCommand implements `bot restore`: it validates a snapshot and
+// replaces the SQLite database with it. Stop the bot first.
+func runRestoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := fs.String("db", os.Getenv("DB_PATH"), "sqlite database path to restore into")
+	from := fs.String("from", "", "snapshot file to restore")
+	verifyOnly := fs.Bool("verify", false, "only validate the snapshot")
+	_ = fs.Parse(args)
+
+	if *from == "" {
+		log.Fatal("usage: bot restore -from snapshot.db [-db path] [-verify]")
+	}
+	if *verifyOnly {
+		version, err := validateSnapshot(*from)
+		if err != nil {
+			log.Fatalf("snapshot %s is not usable: %v", *from, err)
+		}
+		fmt.Printf("snapshot %s is valid (schema version %d)\n", *from, version)
+		return
+	}
+	if *dbPath == "" || sqliteIsTemporary(*dbPath) {
+		log.Fatal("db must be a SQLite file path, via -db or DB_PATH")
+	}
+
+	previous, err := restoreSnapshot(*from, *dbPath)
+	if previous != "" {
+		fmt.Printf("previous database saved to %s\n", previous)
+	}
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	fmt.Printf("restored %s from %s; pending migrations run when the bot starts\n", *dbPath, *from)
+}
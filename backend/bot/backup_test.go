@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBackupsToKeep(t *testing.T) {
+	base := time.Date(2024, 3, 20, 3, 0, 0, 0, time.UTC) // a Wednesday
+	var backups []Backup
+	// two snapshots a day for 30 days, newest first
+	for i := 0; i < 60; i++ {
+		at := base.Add(-time.Duration(i) * 12 * time.Hour)
+		backups = append(backups, Backup{Path: at.Format(backupTimeLayout), CreatedAt: at})
+	}
+
+	keep := backupsToKeep(backups, 3, 2)
+	want := []string{
+		"20240320T030000Z", // newest, today
+		"20240319T150000Z", // yesterday
+		"20240318T150000Z", // day before, and newest of this ISO week
+		"20240317T150000Z", // newest of the previous ISO week
+	}
+	if len(keep) != len(want) {
+		t.Fatalf("kept %v, want %v", keep, want)
+	}
+	for _, p := range want {
+		if !keep[p] {
+			t.Fatalf("expected %s kept, got %v", p, keep)
+		}
+	}
+
+	if keep := backupsToKeep(backups[:1], 0, 0); !keep[backups[0].Path] {
+		t.Fatalf("newest backup must always be kept")
+	}
+}
+
+func TestBackupManager_SnapshotAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "bot.db")
+	store, err := openStore(dbPath, storeOptionsFromEnv(), nil)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	at := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+	if err := store.AddBeer(t.Context(), "", "U1", "U2", "1710936000.000100", at, 2); err != nil {
+		t.Fatalf("add beer: %v", err)
+	}
+
+	backups := NewBackupManager(store, filepath.Join(dir, "backups"), 7, 4, time.Hour, zerolog.Nop(), nil)
+	b, err := backups.Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if b.Size == 0 {
+		t.Fatalf("empty snapshot: %+v", b)
+	}
+	if list, _ := backups.List(); len(list) != 1 || list[0].Path != b.Path {
+		t.Fatalf("unexpected backups: %+v", list)
+	}
+	if partials, _ := filepath.Glob(filepath.Join(dir, "backups", "*.partial")); len(partials) != 0 {
+		t.Fatalf("partial files left behind: %v", partials)
+	}
+	if backups.due() {
+		t.Fatalf("a fresh snapshot should not be due again")
+	}
+
+	// changes after the snapshot are lost by restoring it
+	if err := store.AddBeer(t.Context(), "", "U1", "U3", "1710936100.000100", at, 1); err != nil {
+		t.Fatalf("add beer: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	previous, err := restoreSnapshot(b.Path, dbPath)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := os.Stat(previous); err != nil {
+		t.Fatalf("expected the replaced database saved, got %q %v", previous, err)
+	}
+
+	restored, err := openStore(dbPath, storeOptionsFromEnv(), nil)
+	if err != nil {
+		t.Fatalf("open restored: %v", err)
+	}
+	defer restored.Close()
+	if got, _ := restored.CountGivenOnDate(t.Context(), "U1", "2024-03-20"); got != 2 {
+		t.Fatalf("expected the snapshot's 2 beers, got %d", got)
+	}
+}
+
+func TestRestoreSnapshot_RejectsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.db")
+	if err := os.WriteFile(bad, []byte("not a database"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	target := filepath.Join(dir, "bot.db")
+	if err := os.WriteFile(target, []byte("current"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := restoreSnapshot(bad, target); err == nil {
+		t.Fatalf("expected an invalid snapshot to be rejected")
+	}
+	if data, _ := os.ReadFile(target); string(data) != "current" {
+		t.Fatalf("target changed after a rejected restore")
+	}
+	if _, err := validateSnapshot(filepath.Join(dir, "missing.db")); err == nil {
+		t.Fatalf("expected a missing snapshot to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// EligibilityRules decides which users may give and receive beers. Users missing from
+// the user cache are always eligible.
+type EligibilityRules struct {
+	RejectBots        bool
+	RejectGuests      bool
+	RejectDeactivated bool
+}
+
+// ineligibleReason returns why u may not receive beers, or "" if it may
+func (r EligibilityRules) ineligibleReason(u *CachedUser) string {
+	switch {
+	case u == nil:
+		return ""
+	case r.RejectBots && u.IsBot:
+		return "is a bot"
+	case r.RejectDeactivated && u.Deleted:
+		return "is no longer in this workspace"
+	case r.RejectGuests && u.Guest:
+		return "is a guest"
+	}
+	return ""
+}
+
+// registerEligibilityFlags adds the REJECT_* settings to fs, so the bot and
+// `bot rebuild` read the same configuration
+func registerEligibilityFlags(fs *flag.FlagSet, rules *EligibilityRules) {
+	for _, rule := range []struct {
+		env, flag, usage string
+		dst              *bool
+	}{
+		{"REJECT_BOTS", "reject-bots", "reject beers for bots", &rules.RejectBots},
+		{"REJECT_GUESTS", "reject-guests", "reject beers for guests and Slack Connect users", &rules.RejectGuests},
+		{"REJECT_DEACTIVATED", "reject-deactivated", "reject beers for deactivated users", &rules.RejectDeactivated},
+	} {
+		def := false
+		if env := os.Getenv(rule.env); env != "" {
+			if v, err := strconv.ParseBool(env); err == nil {
+				def = v
+			}
+		}
+		fs.BoolVar(rule.dst, rule.flag, def, rule.usage)
+	}
+}
+
+// SetEligibility sets the rules for who may give and receive beers. By default anyone can.
+func (ep *EventProcessor) SetEligibility(rules EligibilityRules) {
+	ep.eligibility = rules
+}
+
+// filterEligible empties recipientBeers if the giver is a bot or deactivated,
+// and otherwise removes the recipients the rules reject. It returns why the
+// giver was rejected, or why each removed recipient was. Guests may still
+// give beers.
+func (ep *EventProcessor) filterEligible(ctx context.Context, giver string, recipientBeers map[string]int) (string, map[string]string, error) {
+	if ep.eligibility == (EligibilityRules{}) || len(recipientBeers) == 0 {
+		return "", nil, nil
+	}
+	ids := []string{giver}
+	for id := range recipientBeers {
+		ids = append(ids, id)
+	}
+	users, err := ep.store.GetCachedUsers(ctx, ids)
+	if err != nil {
+		return "", nil, fmt.Errorf("look up users: %w", err)
+	}
+	giverRules := EligibilityRules{RejectBots: ep.eligibility.RejectBots, RejectDeactivated: ep.eligibility.RejectDeactivated}
+	if reason := giverRules.ineligibleReason(users[giver]); reason != "" {
+		clear(recipientBeers)
+		return reason, nil, nil
+	}
+	rejected := map[string]string{}
+	for _, id := range ids[1:] {
+		if reason := ep.eligibility.ineligibleReason(users[id]); reason != "" {
+			delete(recipientBeers, id)
+			rejected[id] = reason
+		}
+	}
+	return "", rejected, nil
+}
+
+// applyEligibility filters recipientBeers like filterEligible and tells the
+// giver about each recipient that was removed
+func (ep *EventProcessor) applyEligibility(ctx context.Context, ev *slackevents.MessageEvent, recipientBeers map[string]int) error {
+	giverReason, rejected, err := ep.filterEligible(ctx, ev.User, recipientBeers)
+	if err != nil {
+		return err
+	}
+	if giverReason != "" {
+		ep.logger.Info().Str("giver", ev.User).Str("reason", giverReason).Msg("giver not eligible")
+		return nil
+	}
+	for id, reason := range rejected {
+		ep.logger.Info().Str("giver", ev.User).Str("recipient", id).Str("reason", reason).Msg("recipient not eligible")
+		message := fmt.Sprintf("Sorry <@%s>, <@%s> %s, so they can't receive beers.", ev.User, id, reason)
+		if _, _, err := ep.slack.PostMessage(ev.Channel, slack.MsgOptionText(message, false)); err != nil {
+			ep.logger.Error().Err(err).Str("channel", ev.Channel).Msg("failed to post ineligible recipient message")
+		}
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"time"
@@ -13,10 +15,19 @@ import (
 	"github.com/slack-go/slack/socketmode"
 )
 
+// SlackAPI is the part of the Slack connection the event processor depends on.
+// SlackConnectionManager implements it; replay mode swaps in a recording fake.
+type SlackAPI interface {
+	Ack(req socketmode.Request) error
+	// Respond acks a request with a message, e.g. the reply to a slash command
+	Respond(req socketmode.Request, msg slack.Msg) error
+	PostMessage(channelID string, options ...slack.MsgOption) (string, string, error)
+}
+
 // EventProcessor handles Slack event processing
 type EventProcessor struct {
-	store         *SQLiteStore
-	slackManager  *SlackConnectionManager
+	store         Store
+	slack         SlackAPI
 	redisCache    *RedisUserCache
 	channelID     string
 	emoji         string
@@ -25,13 +36,18 @@ type EventProcessor struct {
 	mentionRe     *regexp.Regexp
 	emojiRe       *regexp.Regexp
 	msgsProcessed *prometheus.CounterVec
+	pool          *EventWorkerPool
+	// queued is set when events arrive already queued on pool
+	queued      bool
+	eligibility EligibilityRules
+	workspace   string
 }
 
 // NewEventProcessor creates a new EventProcessor
-func NewEventProcessor(store *SQLiteStore, slackManager *SlackConnectionManager, redisCache *RedisUserCache, channelID, emoji string, maxPerDay int, logger zerolog.Logger, msgsProcessed *prometheus.CounterVec) *EventProcessor {
+func NewEventProcessor(store Store, slackAPI SlackAPI, redisCache *RedisUserCache, channelID, emoji string, maxPerDay int, logger zerolog.Logger, msgsProcessed *prometheus.CounterVec, pool *EventWorkerPool) *EventProcessor {
 	return &EventProcessor{
 		store:         store,
-		slackManager:  slackManager,
+		slack:         slackAPI,
 		redisCache:    redisCache,
 		channelID:     channelID,
 		emoji:         emoji,
@@ -40,26 +56,34 @@ func NewEventProcessor(store *SQLiteStore, slackManager *SlackConnectionManager,
 		mentionRe:     regexp.MustCompile(`<@([A-Z0-9]+)>`),
 		emojiRe:       regexp.MustCompile(regexp.QuoteMeta(emoji)),
 		msgsProcessed: msgsProcessed,
+		pool:          pool,
 	}
 }
 
+// UseHTTPEvents tells the processor that events arrive already queued on the
+// worker pool by the EventsHTTPReceiver, so message events are handled on
+// the calling worker instead of being queued again
+func (ep *EventProcessor) UseHTTPEvents() {
+	ep.queued = true
+}
+
+// SetWorkspace sets the Slack workspace the processor receives events from.
+// Beers, events and the event log are recorded under it.
+func (ep *EventProcessor) SetWorkspace(teamID string) {
+	ep.workspace = teamID
+}
+
 // HandleEvent processes a socketmode event
 func (ep *EventProcessor) HandleEvent(evt socketmode.Event) {
+	ctx := context.Background()
 	switch evt.Type {
 	case socketmode.EventTypeEventsAPI:
 		if evt.Request == nil {
 			ep.logger.Warn().Msg("received EventTypeEventsAPI with nil request")
 			return
 		}
-		if socketClient := ep.slackManager.GetSocketClient(); socketClient != nil {
-			socketClient.Ack(*evt.Request)
-		} else {
-			ep.logger.Warn().Msg("socket client is nil, cannot ack event")
-			return
-		}
-		eventsAPIEvent, ok := evt.Data.(slackevents.EventsAPIEvent)
-		if !ok {
-			ep.logger.Warn().Str("type", fmt.Sprintf("%T", evt.Data)).Msg("unexpected event data type")
+		if err := ep.slack.Ack(*evt.Request); err != nil {
+			ep.logger.Warn().Err(err).Msg("cannot ack event")
 			return
 		}
 		// Deduplicate based on the Events API envelope ID when available.
@@ -68,69 +92,252 @@ func (ep *EventProcessor) HandleEvent(evt socketmode.Event) {
 		if evt.Request.EnvelopeID != "" {
 			envelopeID = evt.Request.EnvelopeID
 		}
+		eventsAPIEvent, ok := evt.Data.(slackevents.EventsAPIEvent)
+		if !ok {
+			ep.logger.Warn().Str("type", fmt.Sprintf("%T", evt.Data)).Msg("unexpected event data type")
+			ep.deadLetter(ctx, envelopeID, evt.Request.Payload, fmt.Errorf("unexpected event data type %T", evt.Data))
+			return
+		}
 		if eventsAPIEvent.Type == slackevents.CallbackEvent {
 			inner := eventsAPIEvent.InnerEvent
 			switch ev := inner.Data.(type) {
 			case *slackevents.MessageEvent:
-				ep.handleMessageEvent(ev, envelopeID)
+				ep.dispatchMessageEvent(ctx, ev, envelopeID, evt.Request.Payload)
+			case *slackevents.UserChangeEvent, *slackevents.TeamJoinEvent:
+				ep.handleUserEvent(ctx, inner.Type, evt.Request.Payload)
 			default:
-				// ignore non-message events
+				// ignore other events
 			}
 		}
+	case socketmode.EventTypeSlashCommand:
+		if evt.Request == nil {
+			ep.logger.Warn().Msg("received slash command with nil request")
+			return
+		}
+		cmd, ok := evt.Data.(slack.SlashCommand)
+		if !ok {
+			ep.logger.Warn().Str("type", fmt.Sprintf("%T", evt.Data)).Msg("unexpected slash command data type")
+			_ = ep.slack.Ack(*evt.Request)
+			return
+		}
+		ep.handleSlashCommand(ctx, *evt.Request, cmd)
 	default:
 		// Handle other event types if needed
 	}
 }
 
-// handleMessageEvent processes a Slack message event
-func (ep *EventProcessor) handleMessageEvent(ev *slackevents.MessageEvent, envelopeID string) {
+// eventSubmitTimeout bounds how long an event waits for room in a full worker
+// queue before it is dead-lettered, so a backlog can't stall event delivery
+const eventSubmitTimeout = 2 * time.Second
+
+// dispatchMessageEvent hands a message event to the worker pool, keyed by the
+// giver so each user's messages are processed in order. Without a pool the
+// event is handled inline. Failures are kept in the dead-letter table together
+// with the raw payload so they can be replayed later.
+func (ep *EventProcessor) dispatchMessageEvent(ctx context.Context, ev *slackevents.MessageEvent, envelopeID string, payload json.RawMessage) {
+	run := func() {
+		if err := ep.handleMessageEvent(ctx, ev, envelopeID, payload); err != nil {
+			ep.deadLetter(ctx, messageEventID(ev, envelopeID), payload, err)
+		}
+	}
+	if ep.pool == nil || ep.queued {
+		run()
+		return
+	}
+	submitCtx, cancel := context.WithTimeout(ctx, eventSubmitTimeout)
+	defer cancel()
+	if err := ep.pool.Submit(submitCtx, ev.User, run); err != nil {
+		ep.logger.Error().Err(err).Str("user", ev.User).Str("ts", ev.TimeStamp).Msg("failed to queue message event")
+		ep.deadLetter(ctx, messageEventID(ev, envelopeID), payload, err)
+	}
+}
+
+// DropEvent records an event that could not be queued. Message events are
+// dead-lettered so they can be replayed; anything else is only logged.
+func (ep *EventProcessor) DropEvent(evt socketmode.Event, cause error) {
+	if api, ok := evt.Data.(slackevents.EventsAPIEvent); ok && evt.Request != nil {
+		if ev, ok := api.InnerEvent.Data.(*slackevents.MessageEvent); ok {
+			ep.deadLetter(context.Background(), messageEventID(ev, evt.Request.EnvelopeID), evt.Request.Payload, cause)
+			return
+		}
+	}
+	ep.logger.Error().Err(cause).Str("type", string(evt.Type)).Msg("dropped event")
+}
+
+// deadLetter records a failed event so it can be inspected and replayed
+func (ep *EventProcessor) deadLetter(ctx context.Context, eventID string, payload json.RawMessage, cause error) {
+	if len(payload) == 0 {
+		ep.logger.Error().Err(cause).Str("eventID", eventID).Msg("event failed without payload, not dead-lettered")
+		return
+	}
+	if _, err := ep.store.AddDeadLetter(ctx, eventID, payload, cause.Error()); err != nil {
+		ep.logger.Error().Err(err).Str("eventID", eventID).AnErr("cause", cause).Msg("failed to store dead-letter event")
+		return
+	}
+	ep.logger.Warn().Err(cause).Str("eventID", eventID).Msg("event moved to dead-letter store")
+}
+
+// handleUserEvent stores the user carried by a user_change or team_join
+// event. The event is decoded again from the raw payload because the typed
+// event leaves out fields such as the email.
+func (ep *EventProcessor) handleUserEvent(ctx context.Context, eventType string, payload json.RawMessage) {
+	var envelope struct {
+		Event struct {
+			User slack.User `json:"user"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Event.User.ID == "" {
+		ep.logger.Warn().Err(err).Str("type", eventType).Msg("cannot decode user from event")
+		return
+	}
+	u, err := saveSlackUser(ctx, ep.store, ep.redisCache, envelope.Event.User)
+	if err != nil {
+		ep.logger.Error().Err(err).Str("type", eventType).Str("user", u.UserID).Msg("failed to update cached user")
+		return
+	}
+	ep.logger.Info().Str("type", eventType).Str("user", u.UserID).Msg("cached user updated")
+}
+
+// ErrDeadLetterNotFound is returned when replaying an unknown dead-letter id
+var ErrDeadLetterNotFound = errors.New("dead-letter event not found")
+
+// ReplayDeadLetter re-runs a dead-lettered event through the message pipeline.
+// The event is already recorded in processed_events, so deduplication is
+// skipped; it runs on the giver's worker so limit checks stay serialized.
+func (ep *EventProcessor) ReplayDeadLetter(ctx context.Context, id int64) error {
+	dl, err := ep.store.GetDeadLetter(ctx, id)
+	if err != nil {
+		return fmt.Errorf("load dead-letter %d: %w", id, err)
+	}
+	if dl == nil {
+		return ErrDeadLetterNotFound
+	}
+
+	ev, err := parseMessageEventPayload(dl.Payload)
+	if err != nil {
+		if recErr := ep.store.RecordDeadLetterAttempt(ctx, id, err); recErr != nil {
+			ep.logger.Error().Err(recErr).Int64("id", id).Msg("failed to record dead-letter attempt")
+		}
+		return err
+	}
+
+	run := func() error {
+		if !ep.acceptsMessage(ev) {
+			return nil
+		}
+		// the original attempt may have failed before the event was logged
+		if err := ep.store.AppendEventLog(ctx, ep.workspace, dl.EventID, ev.Channel, ev.User, ev.TimeStamp, dl.Payload); err != nil {
+			return fmt.Errorf("append event log: %w", err)
+		}
+		return ep.processMessage(ctx, ev, true)
+	}
+
+	var replayErr error
+	if ep.pool == nil {
+		replayErr = run()
+	} else {
+		done := make(chan error, 1)
+		if err := ep.pool.Submit(ctx, ev.User, func() { done <- run() }); err != nil {
+			return err
+		}
+		select {
+		case replayErr = <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := ep.store.RecordDeadLetterAttempt(ctx, id, replayErr); err != nil {
+		ep.logger.Error().Err(err).Int64("id", id).Msg("failed to record dead-letter attempt")
+	}
+	if replayErr != nil {
+		ep.logger.Warn().Err(replayErr).Int64("id", id).Str("eventID", dl.EventID).Msg("dead-letter replay failed")
+		return replayErr
+	}
+	ep.logger.Info().Int64("id", id).Str("eventID", dl.EventID).Msg("dead-letter event replayed")
+	return nil
+}
+
+// parseMessageEventPayload decodes a raw Events API payload into a message event
+func parseMessageEventPayload(payload json.RawMessage) (*slackevents.MessageEvent, error) {
+	eventsAPIEvent, err := slackevents.ParseEvent(payload, slackevents.OptionNoVerifyToken())
+	if err != nil {
+		return nil, fmt.Errorf("parse event payload: %w", err)
+	}
+	if eventsAPIEvent.Type != slackevents.CallbackEvent {
+		return nil, fmt.Errorf("unsupported event type %q", eventsAPIEvent.Type)
+	}
+	ev, ok := eventsAPIEvent.InnerEvent.Data.(*slackevents.MessageEvent)
+	if !ok {
+		return nil, fmt.Errorf("unsupported inner event %T", eventsAPIEvent.InnerEvent.Data)
+	}
+	return ev, nil
+}
+
+// messageEventID computes a stable event id for message events: prefer the
+// envelope id if present, otherwise build one from channel|user|ts which is
+// stable across redeliveries
+func messageEventID(ev *slackevents.MessageEvent, envelopeID string) string {
+	if envelopeID != "" {
+		return envelopeID
+	}
+	return fmt.Sprintf("msg|%s|%s|%s", ev.Channel, ev.User, ev.TimeStamp)
+}
+
+// acceptsMessage reports whether a message event should be considered at all
+func (ep *EventProcessor) acceptsMessage(ev *slackevents.MessageEvent) bool {
 	// limit to the configured channel and only user messages
 	if ev.Channel != ep.channelID || ev.User == "" {
-		return
+		return false
 	}
 	// ignore message subtypes (edits, bot messages, etc.) -- only plain messages
 	// SubType is empty for normal user messages
-	if ev.SubType != "" {
-		return
-	}
+	return ev.SubType == ""
+}
 
-	// compute a stable event id for message events: prefer envelopeID if present,
-	// otherwise build one from channel|user|ts which is stable across redeliveries
-	eventID := envelopeID
-	if eventID == "" {
-		eventID = fmt.Sprintf("msg|%s|%s|%s", ev.Channel, ev.User, ev.TimeStamp)
+// handleMessageEvent deduplicates and processes a Slack message event
+func (ep *EventProcessor) handleMessageEvent(ctx context.Context, ev *slackevents.MessageEvent, envelopeID string, payload json.RawMessage) error {
+	if !ep.acceptsMessage(ev) {
+		return nil
 	}
+
+	eventID := messageEventID(ev, envelopeID)
 	// Attempt to mark the event as processed before doing work.
 	// INSERT OR IGNORE will return 0 affected rows if the event
 	// already exists; in that case we skip processing. This
 	// avoids the race where two deliveries check IsEventProcessed
 	// concurrently and both proceed to write/Log.
-	if eventID != "" {
-		if ok, err := ep.store.TryMarkEventProcessed(eventID, time.Now()); err != nil {
-			ep.logger.Error().Err(err).Str("eventID", eventID).Msg("failed to try-mark event processed")
-			return
-		} else if !ok {
-			ep.logger.Debug().Str("eventID", eventID).Msg("event already processed, skipping")
-			return
-		}
+	if ok, err := ep.store.TryMarkEventProcessed(ctx, ep.workspace, eventID, time.Now()); err != nil {
+		ep.logger.Error().Err(err).Str("eventID", eventID).Msg("failed to try-mark event processed")
+		return fmt.Errorf("mark event processed: %w", err)
+	} else if !ok {
+		ep.logger.Debug().Str("eventID", eventID).Msg("event already processed, skipping")
+		return nil
 	}
 	ep.logger.Debug().Str("eventID", eventID).Str("user", ev.User).Str("channel", ev.Channel).Msg("processing message event")
 
-	// Increment Prometheus counter
-	if ep.msgsProcessed != nil {
-		ep.msgsProcessed.WithLabelValues(ev.Channel).Inc()
+	// Keep the raw event so beers can be re-derived later (see rebuild)
+	if err := ep.store.AppendEventLog(ctx, ep.workspace, eventID, ev.Channel, ev.User, ev.TimeStamp, payload); err != nil {
+		ep.logger.Error().Err(err).Str("eventID", eventID).Msg("failed to append event log")
+		return fmt.Errorf("append event log: %w", err)
 	}
 
-	// New logic: associate beers with the last seen mention
-	mentions := ep.mentionRe.FindAllStringSubmatch(ev.Text, -1)
-	mentionIndices := ep.mentionRe.FindAllStringSubmatchIndex(ev.Text, -1)
-	emojiIndices := ep.emojiRe.FindAllStringIndex(ev.Text, -1)
+	return ep.processMessage(ctx, ev, false)
+}
+
+// attributeBeers maps each beer emoji in text to the closest preceding
+// mention and returns the number of beers per recipient. Self-gifts are dropped.
+func (ep *EventProcessor) attributeBeers(giver, text string) map[string]int {
+	// associate beers with the last seen mention
+	mentions := ep.mentionRe.FindAllStringSubmatch(text, -1)
+	mentionIndices := ep.mentionRe.FindAllStringSubmatchIndex(text, -1)
+	emojiIndices := ep.emojiRe.FindAllStringIndex(text, -1)
 
+	recipientBeers := make(map[string]int)
 	if len(mentions) == 0 || len(emojiIndices) == 0 {
-		return
+		return recipientBeers
 	}
 
-	recipientBeers := make(map[string]int)
 	for _, emojiIdx := range emojiIndices {
 		lastMentionIdx := -1
 		var recipientID string
@@ -143,26 +350,69 @@ func (ep *EventProcessor) handleMessageEvent(ev *slackevents.MessageEvent, envel
 			}
 		}
 		// Prevent self-gifting
-		if recipientID != "" && recipientID != ev.User {
+		if recipientID != "" && recipientID != giver {
 			recipientBeers[recipientID]++
 		}
 	}
+	return recipientBeers
+}
+
+// messageTime parses a Slack message ts, falling back to the current time
+func (ep *EventProcessor) messageTime(ts string) time.Time {
+	if ts == "" {
+		return time.Now()
+	}
+	t, err := parseSlackTimestamp(ts)
+	if err != nil {
+		ep.logger.Warn().Err(err).Str("timestamp", ts).Msg("failed to parse slack timestamp, using current time")
+		return time.Now()
+	}
+	return t
+}
+
+// processMessage attributes beers in a message and records them. It does not
+// consult processed_events, so it is also used to replay dead-lettered events;
+// replays only record the recipients the failed attempt did not.
+func (ep *EventProcessor) processMessage(ctx context.Context, ev *slackevents.MessageEvent, replay bool) error {
+	// Increment Prometheus counter
+	if ep.msgsProcessed != nil {
+		ep.msgsProcessed.WithLabelValues(ev.Channel).Inc()
+	}
 
+	recipientBeers := ep.attributeBeers(ev.User, ev.Text)
+	if err := ep.applyEligibility(ctx, ev, recipientBeers); err != nil {
+		return err
+	}
+	if replay {
+		// recipients recorded by the failed attempt already count towards
+		// the day's total and were confirmed and added to Redis then
+		recorded, err := ep.store.GetMessageBeers(ctx, ev.User, ev.TimeStamp)
+		if err != nil {
+			return fmt.Errorf("load recorded beers: %w", err)
+		}
+		for recipient := range recorded {
+			delete(recipientBeers, recipient)
+		}
+	}
 	totalBeersToGive := 0
 	for _, count := range recipientBeers {
 		totalBeersToGive += count
 	}
 
 	if totalBeersToGive == 0 {
-		return
+		return nil
 	}
 
-	client := ep.slackManager.GetClient()
-	today := time.Now().UTC().Format("2006-01-02")
-	givenToday, err := ep.store.CountGivenOnDate(ev.User, today)
+	eventTime := ep.messageTime(ev.TimeStamp)
+
+	// The daily limit applies to the day the message was sent, so a replayed
+	// event is checked against the same day as the original delivery.
+	client := ep.slack
+	today := eventTime.UTC().Format("2006-01-02")
+	givenToday, err := ep.store.CountGivenOnDate(ctx, ev.User, today)
 	if err != nil {
 		ep.logger.Error().Err(err).Str("user", ev.User).Str("date", today).Msg("count given on date failed")
-		return
+		return fmt.Errorf("count given on %s: %w", today, err)
 	}
 
 	if givenToday >= ep.maxPerDay {
@@ -171,7 +421,7 @@ func (ep *EventProcessor) handleMessageEvent(ev *slackevents.MessageEvent, envel
 		if _, _, err := client.PostMessage(ev.Channel, slack.MsgOptionText(message, false)); err != nil {
 			ep.logger.Error().Err(err).Str("channel", ev.Channel).Msg("failed to post daily limit message")
 		}
-		return
+		return nil
 	}
 
 	allowed := ep.maxPerDay - givenToday
@@ -181,35 +431,24 @@ func (ep *EventProcessor) handleMessageEvent(ev *slackevents.MessageEvent, envel
 		if _, _, err := client.PostMessage(ev.Channel, slack.MsgOptionText(message, false)); err != nil {
 			ep.logger.Error().Err(err).Str("channel", ev.Channel).Msg("failed to post limit exceeded message")
 		}
-		return
+		return nil
 	}
 
+	var errs []error
 	for recipient, count := range recipientBeers {
-		var eventTime time.Time
-		if ev.TimeStamp != "" {
-			if t, err := parseSlackTimestamp(ev.TimeStamp); err == nil {
-				eventTime = t
-			} else {
-				ep.logger.Warn().Err(err).Str("timestamp", ev.TimeStamp).Msg("failed to parse slack timestamp, using current time")
-				eventTime = time.Now()
-			}
-		} else {
-			eventTime = time.Now()
-		}
-		if err := ep.store.AddBeer(ev.User, recipient, ev.TimeStamp, eventTime, count); err != nil {
+		if err := ep.store.AddBeer(ctx, ep.workspace, ev.User, recipient, ev.TimeStamp, eventTime, count); err != nil {
 			ep.logger.Error().Err(err).Str("giver", ev.User).Str("recipient", recipient).Int("count", count).Msg("failed to add beer")
+			errs = append(errs, fmt.Errorf("add beer for %s: %w", recipient, err))
 		} else {
 			ep.logger.Info().Str("giver", ev.User).Str("recipient", recipient).Int("count", count).Msg("beer given")
 
-			// Update Redis beer stats (write-through cache)
+			// Update Redis beer stats (write-through cache), which count
+			// merged users under their canonical ID
 			if ep.redisCache != nil {
-				ctx := context.Background()
-
-				// Increment beer stats in Redis (write-through cache)
-				if err := ep.redisCache.IncrementGivenStats(ctx, ev.User, count); err != nil {
+				if err := ep.redisCache.IncrementGivenStats(ctx, canonicalID(ctx, ep.store, ep.logger, ev.User), count); err != nil {
 					ep.logger.Warn().Err(err).Str("giver", ev.User).Int("count", count).Msg("failed to increment given stats in redis")
 				}
-				if err := ep.redisCache.IncrementReceivedStats(ctx, recipient, count); err != nil {
+				if err := ep.redisCache.IncrementReceivedStats(ctx, canonicalID(ctx, ep.store, ep.logger, recipient), count); err != nil {
 					ep.logger.Warn().Err(err).Str("recipient", recipient).Int("count", count).Msg("failed to increment received stats in redis")
 				}
 			}
@@ -226,5 +465,5 @@ func (ep *EventProcessor) handleMessageEvent(ev *slackevents.MessageEvent, envel
 			}
 		}
 	}
-	// event was pre-marked via TryMarkEventProcessed
+	return errors.Join(errs...)
 }
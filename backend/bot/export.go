@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Export formats accepted by the export endpoint and command
+const (
+	exportCSV   = "csv"
+	exportJSONL = "jsonl"
+	// exportParquet is recognised but not implemented: no Parquet writer is
+	// vendored yet, so it is rejected with errExportParquetUnsupported
+	exportParquet = "parquet"
+)
+
+var errExportParquetUnsupported = errors.New("parquet export is not supported yet; export csv or jsonl instead")
+
+var exportContentTypes = map[string]string{
+	exportCSV:   "text/csv; charset=utf-8",
+	exportJSONL: "application/x-ndjson",
+}
+
+var exportCSVHeader = []string{"ts", "time", "giver_id", "giver_name", "recipient_id", "recipient_name", "count", "source"}
+
+// beerExporter writes beers in one export format. Output is buffered, so
+// nothing reaches the underlying writer until enough rows are written or
+// Close is called.
+type beerExporter interface {
+	Write(b ExportBeer) error
+	Close() error
+}
+
+// newBeerExporter returns an exporter writing format to w
+func newBeerExporter(w io.Writer, format string) (beerExporter, error) {
+	switch format {
+	case exportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return nil, err
+		}
+		return &csvExporter{w: cw}, nil
+	case exportJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlExporter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case exportParquet:
+		return nil, errExportParquetUnsupported
+	}
+	return nil, fmt.Errorf("unknown export format %q (want csv or jsonl)", format)
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) Write(b ExportBeer) error {
+	return e.w.Write([]string{
+		b.Ts, b.Time.UTC().Format(time.RFC3339), b.GiverID, b.GiverName, b.RecipientID, b.RecipientName, strconv.Itoa(b.Count), b.Source,
+	})
+}
+
+func (e *csvExporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlExporter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonlExporter) Write(b ExportBeer) error {
+	return e.enc.Encode(b)
+}
+
+func (e *jsonlExporter) Close() error {
+	return e.w.Flush()
+}
+
+// exportBeers streams the beers between start and end, in workspace if it is
+// set, to w in format and returns the number of rows written
+func exportBeers(ctx context.Context, store Store, w io.Writer, format string, start, end time.Time, workspace string) (int, error) {
+	exporter, err := newBeerExporter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	rows := 0
+	err = store.ForEachBeer(ctx, start, end, workspace, func(b ExportBeer) error {
+		rows++
+		return exporter.Write(b)
+	})
+	if err != nil {
+		return rows, err
+	}
+	return rows, exporter.Close()
+}
+
+// ExportBeersHandler streams raw beer history as a file download
+// Query params: start, end (YYYY-MM-DD), format (csv|jsonl, default csv), workspace
+func (h *APIHandlers) ExportBeersHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "export_beers").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	start, end, err := parseDateRangeFromParams(r)
+	if err != nil {
+		h.logger.Warn().Str("handler", "export_beers").Err(err).Msg("invalid date range")
+		http.Error(w, "invalid or missing date range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportCSV
+	}
+	if format == exportParquet {
+		http.Error(w, errExportParquetUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="beers-%s-%s.%s"`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"), format))
+
+	began := time.Now()
+	rows, err := exportBeers(r.Context(), h.store, w, format, start, end, r.URL.Query().Get("workspace"))
+	if err != nil {
+		h.logger.Error().Str("handler", "export_beers").Int("rows", rows).Err(err).Msg("export failed")
+		// exporters buffer their output, so before the first row nothing has
+		// been sent and the error can still become a 500
+		if rows == 0 {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	h.logger.Info().Str("handler", "export_beers").Str("format", format).Int("rows", rows).Dur("duration", time.Since(began)).Msg("request completed")
+}
+
+// runExportCommand implements `bot export`, writing beer history to a file or stdout
+func runExportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dsn := fs.String("db", databaseDSN(), "sqlite database path or postgres:// URL")
+	format := fs.String("format", exportCSV, "output format: csv or jsonl")
+	startStr := fs.String("start", "", "first day to export, YYYY-MM-DD (default: all history)")
+	endStr := fs.String("end", "", "last day to export, YYYY-MM-DD (default: today)")
+	out := fs.String("o", "", "output file (default: stdout)")
+	workspace := fs.String("workspace", "", "only export beers of this workspace or Enterprise Grid org id (default: all)")
+	_ = fs.Parse(args)
+
+	var start time.Time
+	end := time.Now().UTC()
+	if *startStr != "" {
+		t, err := time.Parse("2006-01-02", *startStr)
+		if err != nil {
+			log.Fatalf("invalid -start: %v", err)
+		}
+		start = t
+	}
+	if *endStr != "" {
+		t, err := time.Parse("2006-01-02", *endStr)
+		if err != nil {
+			log.Fatalf("invalid -end: %v", err)
+		}
+		end = t
+	}
+	if *format == exportParquet {
+		log.Fatal(errExportParquetUnsupported)
+	}
+	if _, ok := exportContentTypes[*format]; !ok {
+		log.Fatalf("unknown format %q (want csv or jsonl)", *format)
+	}
+	if *workspace != "" && !workspaceIDPattern.MatchString(*workspace) {
+		log.Fatalf("invalid -workspace %q", *workspace)
+	}
+
+	store, err := openStore(*dsn, storeOptionsFromEnv(), nil)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if *out == "" {
+		if _, err := exportBeers(ctx, store, os.Stdout, *format, start, end, *workspace); err != nil {
+			log.Fatalf("export: %v", err)
+		}
+		return
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("create output: %v", err)
+	}
+	rows, err := exportBeers(ctx, store, f, *format, start, end, *workspace)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	fmt.Printf("exported %d beers to %s\n", rows, *out)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func seedExportStore(t *testing.T) *SQLStore {
+	t.Helper()
+	store := newTestStore(t)
+	beers := []struct {
+		giver, recipient, ts string
+		at                   time.Time
+		count                int
+	}{
+		{"U1", "U2", "1704110400.000100", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), 2},
+		{"U2", "U3", "1704196800.000100", time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), 1},
+		{"U1", "U3", "1706788800.000100", time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC), 3},
+	}
+	for _, b := range beers {
+		if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, b.at, b.count); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+	}
+	if err := store.SetCachedUser(t.Context(), "U1", "Ada", ""); err != nil {
+		t.Fatalf("cache user: %v", err)
+	}
+	if err := store.SetCachedUser(t.Context(), "U2", "Grace, \"Amazing\"", ""); err != nil {
+		t.Fatalf("cache user: %v", err)
+	}
+	return store
+}
+
+func TestForEachBeer(t *testing.T) {
+	store := seedExportStore(t)
+	var got []ExportBeer
+	err := store.ForEachBeer(t.Context(), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), "", func(b ExportBeer) error {
+		got = append(got, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected the two January beers, got %+v", got)
+	}
+	if got[0].GiverName != "Ada" || got[0].RecipientName != "Grace, \"Amazing\"" || got[0].Count != 2 || !got[0].Time.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected first row: %+v", got[0])
+	}
+	if got[1].RecipientID != "U3" || got[1].RecipientName != "" {
+		t.Fatalf("expected an unresolved recipient to have no name: %+v", got[1])
+	}
+}
+
+func TestExportBeers_CSVAndJSONL(t *testing.T) {
+	store := seedExportStore(t)
+	start, end := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	n, err := exportBeers(t.Context(), store, &buf, exportCSV, start, end, "")
+	if err != nil || n != 3 {
+		t.Fatalf("csv export: %d %v", n, err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != strings.Join(exportCSVHeader, ",") {
+		t.Fatalf("unexpected csv: %v", records)
+	}
+	want := []string{"1704110400.000100", "2024-01-01T12:00:00Z", "U1", "Ada", "U2", "Grace, \"Amazing\"", "2", "slack"}
+	if strings.Join(records[1], "|") != strings.Join(want, "|") {
+		t.Fatalf("csv row = %v, want %v", records[1], want)
+	}
+
+	buf.Reset()
+	if n, err := exportBeers(t.Context(), store, &buf, exportJSONL, start, end, ""); err != nil || n != 3 {
+		t.Fatalf("jsonl export: %d %v", n, err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", buf.String())
+	}
+	var last ExportBeer
+	if err := json.Unmarshal([]byte(lines[2]), &last); err != nil || last.GiverName != "Ada" || last.Count != 3 {
+		t.Fatalf("unexpected jsonl row: %+v %v", last, err)
+	}
+
+	if _, err := exportBeers(t.Context(), store, &buf, "xlsx", start, end, ""); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+	if _, err := exportBeers(t.Context(), store, &buf, exportParquet, start, end, ""); !errors.Is(err, errExportParquetUnsupported) {
+		t.Fatalf("expected parquet to be rejected as unsupported, got %v", err)
+	}
+}
+
+func TestExportBeersHandler_ParquetNotImplemented(t *testing.T) {
+	handlers := NewAPIHandlers(seedExportStore(t), nil, nil, nil, nil, nil, zerolog.Nop())
+	rec := httptest.NewRecorder()
+	handlers.ExportBeersHandler(rec, httptest.NewRequest(http.MethodGet, "/api/admin/export/beers?start=2024-01-01&end=2024-12-31&format=parquet", nil))
+	if rec.Code != http.StatusNotImplemented || !strings.Contains(rec.Body.String(), "parquet") {
+		t.Fatalf("expected parquet to be answered with 501, got %d %q", rec.Code, rec.Body.String())
+	}
+}
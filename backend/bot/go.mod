@@ -3,6 +3,7 @@ module github.com/BeerBILabs/BeerBI/bot
 go 1.25.6
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/prometheus/client_golang v1.23.2
 	github.com/redis/go-redis/v9 v9.17.3
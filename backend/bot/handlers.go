@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -15,21 +16,26 @@ import (
 
 // APIHandlers holds dependencies for HTTP handlers
 type APIHandlers struct {
-	store        *SQLiteStore
-	slackClient  *slack.Client
-	slackManager *SlackConnectionManager
-	redisCache   *RedisUserCache
-	logger       zerolog.Logger
+	store          Store
+	slackClient    *slack.Client
+	slackManager   *SlackConnectionManager
+	redisCache     *RedisUserCache
+	eventProcessor *EventProcessor
+	processors     map[string]*EventProcessor
+	backups        *BackupManager
+	logger         zerolog.Logger
 }
 
 // NewAPIHandlers creates a new APIHandlers instance
-func NewAPIHandlers(store *SQLiteStore, slackClient *slack.Client, slackManager *SlackConnectionManager, redisCache *RedisUserCache, logger zerolog.Logger) *APIHandlers {
+func NewAPIHandlers(store Store, slackClient *slack.Client, slackManager *SlackConnectionManager, redisCache *RedisUserCache, eventProcessor *EventProcessor, backups *BackupManager, logger zerolog.Logger) *APIHandlers {
 	return &APIHandlers{
-		store:        store,
-		slackClient:  slackClient,
-		slackManager: slackManager,
-		redisCache:   redisCache,
-		logger:       logger,
+		store:          store,
+		slackClient:    slackClient,
+		slackManager:   slackManager,
+		redisCache:     redisCache,
+		eventProcessor: eventProcessor,
+		backups:        backups,
+		logger:         logger,
 	}
 }
 
@@ -49,7 +55,7 @@ func (h *APIHandlers) GivenHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid or missing date range: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	c, err := h.store.CountGivenInDateRange(user, start, end)
+	c, err := h.store.CountGivenInDateRange(r.Context(), user, start, end, statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "given").Str("user", user).Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -78,7 +84,7 @@ func (h *APIHandlers) ReceivedHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid or missing date range: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	c, err := h.store.CountReceivedInDateRange(user, start, end)
+	c, err := h.store.CountReceivedInDateRange(r.Context(), user, start, end, statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "received").Str("user", user).Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -91,7 +97,7 @@ func (h *APIHandlers) ReceivedHandler(w http.ResponseWriter, r *http.Request) {
 		user, start.Format("2006-01-02"), end.Format("2006-01-02"), c)))
 }
 
-// UserHandler returns user information from Slack (with database caching)
+// UserHandler returns a user's name and avatar from the cache, asking Slack only for users not synced yet
 func (h *APIHandlers) UserHandler(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug().Str("handler", "user").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
 
@@ -123,15 +129,32 @@ func (h *APIHandlers) UserHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Try Slack API to get fresh data
-	user, err := h.slackClient.GetUserInfo(userID)
-	if err != nil {
-		h.logger.Warn().Str("handler", "user").Str("userID", userID).Err(err).Msg("slack API error, checking cache")
+	// The user directory sync keeps the database cache complete
+	cached, cacheErr := h.store.GetCachedUser(ctx, userID)
+	if cacheErr != nil {
+		h.logger.Error().Str("handler", "user").Str("userID", userID).Err(cacheErr).Msg("cache lookup error")
 	}
-
-	// Check if we got valid data from Slack (non-empty real_name)
-	// Deactivated users may return empty real_name even on successful API call
-	if err == nil && user.RealName != "" {
+	if cached != nil && cached.Name() != "" {
+		realName = cached.Name()
+		profileImage = cached.ProfileImage
+		if h.redisCache != nil {
+			if err := h.redisCache.SetUser(ctx, userID, realName, profileImage); err != nil {
+				h.logger.Warn().Str("handler", "user").Str("userID", userID).Err(err).Msg("failed to cache user to redis")
+			}
+		}
+	} else if h.slackClient == nil {
+		// API-only processes without a bot token rely on the synced cache
+		h.logger.Info().Str("handler", "user").Str("userID", userID).Msg("user not in cache")
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	} else {
+		// Not synced yet - ask Slack
+		user, err := h.slackClient.GetUserInfo(userID)
+		if err != nil || user.RealName == "" {
+			h.logger.Error().Str("handler", "user").Str("userID", userID).Err(err).Msg("user not found in cache or Slack")
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
 		realName = user.RealName
 		profileImage = user.Profile.Image192
 
@@ -142,31 +165,9 @@ func (h *APIHandlers) UserHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// Cache to SQLite
-		if cacheErr := h.store.SetCachedUser(userID, realName, profileImage); cacheErr != nil {
-			h.logger.Warn().Str("handler", "user").Str("userID", userID).Err(cacheErr).Msg("failed to cache user to sqlite")
-		}
-	} else {
-		// Slack API failed or returned empty name - try SQLite cache
-		cached, cacheErr := h.store.GetCachedUser(userID)
-		if cacheErr != nil {
-			h.logger.Error().Str("handler", "user").Str("userID", userID).Err(cacheErr).Msg("cache lookup error")
-		}
-		if cached != nil && cached.RealName != "" {
-			h.logger.Info().Str("handler", "user").Str("userID", userID).Str("real_name", cached.RealName).Msg("returning cached user")
-			realName = cached.RealName
-			profileImage = cached.ProfileImage
-		} else if err == nil && user != nil {
-			// API succeeded but no cache - return what Slack gave us (even if empty)
-			// Also use profile image from Slack if available
-			realName = user.RealName
-			profileImage = user.Profile.Image192
-			h.logger.Warn().Str("handler", "user").Str("userID", userID).Msg("slack returned empty name, no cache available")
-		} else {
-			// No cache available and API failed, return error
-			h.logger.Error().Str("handler", "user").Str("userID", userID).Msg("user not found in Slack or cache")
-			http.Error(w, "user not found", http.StatusNotFound)
-			return
+		// Cache to the database
+		if cacheErr := h.store.SetCachedUser(ctx, userID, realName, profileImage); cacheErr != nil {
+			h.logger.Warn().Str("handler", "user").Str("userID", userID).Err(cacheErr).Msg("failed to cache user to database")
 		}
 	}
 
@@ -189,7 +190,7 @@ func (h *APIHandlers) UserHandler(w http.ResponseWriter, r *http.Request) {
 func (h *APIHandlers) GiversHandler(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug().Str("handler", "givers").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
 
-	list, err := h.store.GetAllGivers()
+	list, err := h.store.GetAllGivers(r.Context(), statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "givers").Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -211,7 +212,7 @@ func (h *APIHandlers) GiversHandler(w http.ResponseWriter, r *http.Request) {
 func (h *APIHandlers) RecipientsHandler(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug().Str("handler", "recipients").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
 
-	list, err := h.store.GetAllRecipients()
+	list, err := h.store.GetAllRecipients(r.Context(), statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "recipients").Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -236,14 +237,17 @@ func (h *APIHandlers) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	health := map[string]interface{}{
-		"status":          "healthy",
-		"service":         "beerbot-backend",
-		"slack_connected": h.slackManager.IsConnected(),
-		"timestamp":       time.Now().UTC().Format(time.RFC3339),
+		"status":    "healthy",
+		"service":   "beerbot-backend",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	// API-only processes hold no Slack connection
+	if h.slackManager != nil {
+		health["slack_connected"] = h.slackManager.IsConnected()
 	}
 
 	// Test Slack connection if requested
-	if r.URL.Query().Get("check_slack") == "true" {
+	if r.URL.Query().Get("check_slack") == "true" && h.slackManager != nil {
 		if err := h.slackManager.TestConnection(r.Context()); err != nil {
 			h.logger.Warn().Str("handler", "health").Err(err).Msg("slack connection test failed")
 			health["slack_connection_error"] = err.Error()
@@ -292,7 +296,7 @@ func (h *APIHandlers) TimelineHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := h.store.GetTimelineStats(start, end, granularity)
+	data, err := h.store.GetTimelineStats(r.Context(), start, end, granularity, statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "timeline").Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -333,7 +337,7 @@ func (h *APIHandlers) QuarterlyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := h.store.GetQuarterlyStats(startYear, endYear)
+	data, err := h.store.GetQuarterlyStats(r.Context(), startYear, endYear, statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "quarterly").Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -371,27 +375,21 @@ func (h *APIHandlers) TopUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Try to match date range to a common cached range
+	opts := statsOptionsFromParams(r)
 	rangeKey := h.matchDateRangeToCache(start, end)
 	var data *TopUsersResult
 
 	// Try Redis cache first for common ranges
-	if rangeKey != "" && h.redisCache != nil {
-		givers, errG := h.redisCache.GetTopGivers(r.Context(), rangeKey, limit)
-		recipients, errR := h.redisCache.GetTopRecipients(r.Context(), rangeKey, limit)
-
-		if errG == nil && errR == nil && givers != nil && recipients != nil {
+	if rangeKey != "" && h.redisCache != nil && opts.cacheable() {
+		if data = h.cachedTopUsers(r.Context(), rangeKey, limit); data != nil {
 			h.logger.Info().Str("handler", "top").Str("range", rangeKey).Msg("redis cache hit")
-			data = &TopUsersResult{
-				Givers:     givers,
-				Recipients: recipients,
-			}
 		}
 	}
 
 	// Fall back to database if cache miss or error
 	if data == nil {
 		h.logger.Debug().Str("handler", "top").Msg("falling back to database")
-		dbData, err := h.store.GetTopUsers(start, end, limit)
+		dbData, err := h.store.GetTopUsers(r.Context(), start, end, limit, opts)
 		if err != nil {
 			h.logger.Error().Str("handler", "top").Err(err).Msg("database error")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -399,6 +397,7 @@ func (h *APIHandlers) TopUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		data = dbData
 	}
+	h.flagDeparted(r.Context(), nil, data.Givers, data.Recipients)
 
 	h.logger.Info().Str("handler", "top").Int("givers", len(data.Givers)).Int("recipients", len(data.Recipients)).Msg("request completed")
 	w.Header().Set("Content-Type", "application/json")
@@ -423,7 +422,7 @@ func (h *APIHandlers) HeatmapHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := h.store.GetHeatmapStats(start, end)
+	data, err := h.store.GetHeatmapStats(r.Context(), start, end, statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "heatmap").Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -460,12 +459,13 @@ func (h *APIHandlers) PairsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	data, err := h.store.GetPairStats(start, end, limit)
+	data, err := h.store.GetPairStats(r.Context(), start, end, limit, statsOptionsFromParams(r))
 	if err != nil {
 		h.logger.Error().Str("handler", "pairs").Err(err).Msg("database error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.flagDeparted(r.Context(), data)
 
 	h.logger.Info().Str("handler", "pairs").Int("pairs", len(data)).Msg("request completed")
 	w.Header().Set("Content-Type", "application/json")
@@ -540,61 +540,63 @@ func (h *APIHandlers) BatchUsersHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	// Fetch missing users from Slack API
+	toCache := make(map[string]UserCacheData)
+
+	// Then the database cache, which the user directory sync keeps complete
 	if len(missing) > 0 {
-		h.logger.Debug().Str("handler", "batch_users").Int("missing", len(missing)).Msg("fetching missing users from Slack")
+		cached, err := h.store.GetCachedUsers(ctx, missing)
+		if err != nil {
+			h.logger.Error().Str("handler", "batch_users").Err(err).Msg("cache lookup error")
+		}
+		stillMissing := missing[:0]
+		for _, userID := range missing {
+			if u := cached[userID]; u != nil && u.Name() != "" {
+				results[userID] = map[string]string{
+					"real_name":     u.Name(),
+					"profile_image": u.ProfileImage,
+				}
+				toCache[userID] = UserCacheData{RealName: u.Name(), ProfileImage: u.ProfileImage}
+				continue
+			}
+			stillMissing = append(stillMissing, userID)
+		}
+		missing = stillMissing
+	}
 
-		toCache := make(map[string]UserCacheData)
+	// Fetch users not synced yet from Slack API
+	if len(missing) > 0 && h.slackClient != nil {
+		h.logger.Debug().Str("handler", "batch_users").Int("missing", len(missing)).Msg("fetching missing users from Slack")
 
 		for _, userID := range missing {
 			user, err := h.slackClient.GetUserInfo(userID)
 			if err != nil {
 				h.logger.Warn().Str("handler", "batch_users").Str("userID", userID).Err(err).Msg("slack API error for user")
-
-				// Try SQLite cache as fallback
-				cached, cacheErr := h.store.GetCachedUser(userID)
-				if cacheErr == nil && cached != nil && cached.RealName != "" {
-					results[userID] = map[string]string{
-						"real_name":     cached.RealName,
-						"profile_image": cached.ProfileImage,
-					}
-				}
+				continue
+			}
+			if user.RealName == "" {
 				continue
 			}
 
-			if user.RealName != "" {
-				results[userID] = map[string]string{
-					"real_name":     user.RealName,
-					"profile_image": user.Profile.Image192,
-				}
-
-				// Prepare for caching
-				toCache[userID] = UserCacheData{
-					RealName:     user.RealName,
-					ProfileImage: user.Profile.Image192,
-				}
+			results[userID] = map[string]string{
+				"real_name":     user.RealName,
+				"profile_image": user.Profile.Image192,
+			}
+			toCache[userID] = UserCacheData{
+				RealName:     user.RealName,
+				ProfileImage: user.Profile.Image192,
+			}
 
-				// Cache to SQLite
-				if err := h.store.SetCachedUser(userID, user.RealName, user.Profile.Image192); err != nil {
-					h.logger.Warn().Str("handler", "batch_users").Str("userID", userID).Err(err).Msg("failed to cache user to sqlite")
-				}
-			} else {
-				// Try SQLite cache for deactivated users
-				cached, cacheErr := h.store.GetCachedUser(userID)
-				if cacheErr == nil && cached != nil && cached.RealName != "" {
-					results[userID] = map[string]string{
-						"real_name":     cached.RealName,
-						"profile_image": cached.ProfileImage,
-					}
-				}
+			// Cache to the database
+			if err := h.store.SetCachedUser(ctx, userID, user.RealName, user.Profile.Image192); err != nil {
+				h.logger.Warn().Str("handler", "batch_users").Str("userID", userID).Err(err).Msg("failed to cache user to database")
 			}
 		}
+	}
 
-		// Batch cache to Redis
-		if h.redisCache != nil && len(toCache) > 0 {
-			if err := h.redisCache.SetUsers(ctx, toCache); err != nil {
-				h.logger.Warn().Str("handler", "batch_users").Err(err).Msg("failed to batch cache users to redis")
-			}
+	// Batch cache to Redis
+	if h.redisCache != nil && len(toCache) > 0 {
+		if err := h.redisCache.SetUsers(ctx, toCache); err != nil {
+			h.logger.Warn().Str("handler", "batch_users").Err(err).Msg("failed to batch cache users to redis")
 		}
 	}
 
@@ -607,6 +609,38 @@ func (h *APIHandlers) BatchUsersHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// flagDeparted marks deactivated users in pairs and user lists, in place.
+// Users missing from the user cache are left unmarked.
+func (h *APIHandlers) flagDeparted(ctx context.Context, pairs []PairStats, lists ...[]TopUserStats) {
+	var ids []string
+	for _, p := range pairs {
+		ids = append(ids, p.Giver, p.Recipient)
+	}
+	for _, list := range lists {
+		for _, u := range list {
+			ids = append(ids, u.UserID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	users, err := h.store.GetCachedUsers(ctx, ids)
+	if err != nil {
+		h.logger.Warn().Err(err).Msg("failed to look up departed users")
+		return
+	}
+	departed := func(id string) bool { return users[id] != nil && users[id].Deleted }
+	for i := range pairs {
+		pairs[i].GiverDeparted = departed(pairs[i].Giver)
+		pairs[i].RecipientDeparted = departed(pairs[i].Recipient)
+	}
+	for _, list := range lists {
+		for i := range list {
+			list[i].Departed = departed(list[i].UserID)
+		}
+	}
+}
+
 // matchDateRangeToCache attempts to match a date range to a cached range key
 // Returns empty string if no match (caller should fall back to database)
 func (h *APIHandlers) matchDateRangeToCache(start, end time.Time) string {
@@ -717,10 +751,11 @@ func (h *APIHandlers) CombinedAnalyticsHandler(w http.ResponseWriter, r *http.Re
 		}
 	}
 
+	opts := statsOptionsFromParams(r)
 	response := CombinedAnalyticsResponse{}
 
 	// Fetch timeline data
-	timelineData, err := h.store.GetTimelineStats(start, end, granularity)
+	timelineData, err := h.store.GetTimelineStats(r.Context(), start, end, granularity, opts)
 	if err != nil {
 		h.logger.Error().Str("handler", "combined_analytics").Err(err).Msg("failed to fetch timeline")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -730,17 +765,14 @@ func (h *APIHandlers) CombinedAnalyticsHandler(w http.ResponseWriter, r *http.Re
 
 	// Fetch top users (try Redis cache first for common ranges)
 	rangeKey := h.matchDateRangeToCache(start, end)
-	if rangeKey != "" && h.redisCache != nil {
-		givers, errG := h.redisCache.GetTopGivers(r.Context(), rangeKey, limit)
-		recipients, errR := h.redisCache.GetTopRecipients(r.Context(), rangeKey, limit)
-
-		if errG == nil && errR == nil && givers != nil && recipients != nil {
+	if rangeKey != "" && h.redisCache != nil && opts.cacheable() {
+		if cached := h.cachedTopUsers(r.Context(), rangeKey, limit); cached != nil {
 			h.logger.Debug().Str("handler", "combined_analytics").Str("range", rangeKey).Msg("redis cache hit for top users")
-			response.TopGivers = givers
-			response.TopRecipients = recipients
+			response.TopGivers = cached.Givers
+			response.TopRecipients = cached.Recipients
 		} else {
 			// Fall back to database
-			topUsers, err := h.store.GetTopUsers(start, end, limit)
+			topUsers, err := h.store.GetTopUsers(r.Context(), start, end, limit, opts)
 			if err != nil {
 				h.logger.Error().Str("handler", "combined_analytics").Err(err).Msg("failed to fetch top users")
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -751,7 +783,7 @@ func (h *APIHandlers) CombinedAnalyticsHandler(w http.ResponseWriter, r *http.Re
 		}
 	} else {
 		// Fetch from database
-		topUsers, err := h.store.GetTopUsers(start, end, limit)
+		topUsers, err := h.store.GetTopUsers(r.Context(), start, end, limit, opts)
 		if err != nil {
 			h.logger.Error().Str("handler", "combined_analytics").Err(err).Msg("failed to fetch top users")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -762,7 +794,7 @@ func (h *APIHandlers) CombinedAnalyticsHandler(w http.ResponseWriter, r *http.Re
 	}
 
 	// Fetch heatmap data
-	heatmapData, err := h.store.GetHeatmapStats(start, end)
+	heatmapData, err := h.store.GetHeatmapStats(r.Context(), start, end, opts)
 	if err != nil {
 		h.logger.Error().Str("handler", "combined_analytics").Err(err).Msg("failed to fetch heatmap")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -771,13 +803,14 @@ func (h *APIHandlers) CombinedAnalyticsHandler(w http.ResponseWriter, r *http.Re
 	response.Heatmap = heatmapData
 
 	// Fetch pairs data
-	pairsData, err := h.store.GetPairStats(start, end, pairsLimit)
+	pairsData, err := h.store.GetPairStats(r.Context(), start, end, pairsLimit, opts)
 	if err != nil {
 		h.logger.Error().Str("handler", "combined_analytics").Err(err).Msg("failed to fetch pairs")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	response.Pairs = pairsData
+	h.flagDeparted(r.Context(), response.Pairs, response.TopGivers, response.TopRecipients)
 
 	h.logger.Info().
 		Str("handler", "combined_analytics").
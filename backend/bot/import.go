@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Import formats accepted by the import endpoint and command
+const (
+	importCSV  = "csv"
+	importJSON = "json"
+)
+
+// maxImportBytes bounds the request body of the import endpoint
+const maxImportBytes = 32 << 20
+
+// ImportMapping names the input columns (CSV header or JSON keys) holding
+// each field. Ts and Count are optional: without a ts column imported beers
+// are keyed by their time, and count defaults to 1.
+type ImportMapping struct {
+	Giver      string
+	Recipient  string
+	Time       string
+	Count      string
+	Ts         string
+	TimeLayout string
+}
+
+func defaultImportMapping() ImportMapping {
+	return ImportMapping{Giver: "giver", Recipient: "recipient", Time: "time", Count: "count", Ts: "ts"}
+}
+
+// ImportOptions configures one import run
+type ImportOptions struct {
+	Format  string
+	Source  string
+	Mapping ImportMapping
+	DryRun  bool
+	// Workspace is the workspace the imported beers are recorded in
+	Workspace string
+}
+
+// ImportProblem is an input row that could not be imported. Rows are
+// numbered from 1, not counting the CSV header.
+type ImportProblem struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportReport summarises an import. On a dry run Imported is how many beers
+// would have been inserted.
+type ImportReport struct {
+	Source     string          `json:"source"`
+	DryRun     bool            `json:"dry_run"`
+	Rows       int             `json:"rows"`
+	Imported   int             `json:"imported"`
+	Duplicates int             `json:"duplicates"`
+	Invalid    []ImportProblem `json:"invalid,omitempty"`
+	Unresolved []string        `json:"unresolved,omitempty"`
+}
+
+// emailLookup finds Slack users by email (users.lookupByEmail); *slack.Client
+// implements it
+type emailLookup interface {
+	GetUserByEmail(email string) (*slack.User, error)
+}
+
+var slackUserIDPattern = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
+
+// userResolver maps the user values found in an import (Slack IDs, emails or
+// display names) to Slack user IDs, remembering each answer
+type userResolver struct {
+	store   Store
+	slack   emailLookup
+	results map[string]userResolution
+}
+
+type userResolution struct {
+	id  string
+	err error
+}
+
+func newUserResolver(store Store, slack emailLookup) *userResolver {
+	return &userResolver{store: store, slack: slack, results: map[string]userResolution{}}
+}
+
+func (r *userResolver) resolve(ctx context.Context, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("missing user")
+	}
+	if res, ok := r.results[value]; ok {
+		return res.id, res.err
+	}
+	id, err := r.lookup(ctx, value)
+	r.results[value] = userResolution{id: id, err: err}
+	return id, err
+}
+
+func (r *userResolver) lookup(ctx context.Context, value string) (string, error) {
+	if slackUserIDPattern.MatchString(value) {
+		return value, nil
+	}
+	if strings.Contains(value, "@") {
+		if r.slack == nil {
+			return "", fmt.Errorf("cannot look up %s: no Slack token", value)
+		}
+		user, err := r.slack.GetUserByEmail(value)
+		if err != nil {
+			return "", fmt.Errorf("no Slack user with email %s: %w", value, err)
+		}
+		// cache the name so the imported beers show up with it
+		_ = r.store.SetCachedUser(ctx, user.ID, user.RealName, user.Profile.Image192)
+		return user.ID, nil
+	}
+	ids, err := r.store.FindCachedUsersByName(ctx, value)
+	if err != nil {
+		return "", err
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("unknown user %q", value)
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("ambiguous user %q matches %s", value, strings.Join(ids, ", "))
+}
+
+// readImportRecords reads every input row as column -> value
+func readImportRecords(r io.Reader, format string) ([]map[string]string, error) {
+	switch format {
+	case importCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read csv header: %w", err)
+		}
+		for i := range header {
+			header[i] = strings.TrimSpace(header[i])
+		}
+		var out []map[string]string
+		for {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return out, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read csv: %w", err)
+			}
+			row := make(map[string]string, len(header))
+			for i, v := range rec {
+				if i < len(header) {
+					row[header[i]] = v
+				}
+			}
+			out = append(out, row)
+		}
+	case importJSON:
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		var objects []map[string]interface{}
+		if err := dec.Decode(&objects); err != nil {
+			return nil, fmt.Errorf("read json (want an array of objects): %w", err)
+		}
+		out := make([]map[string]string, 0, len(objects))
+		for _, obj := range objects {
+			row := make(map[string]string, len(obj))
+			for k, v := range obj {
+				if v != nil {
+					row[k] = fmt.Sprint(v)
+				}
+			}
+			out = append(out, row)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown import format %q (want csv or json)", format)
+}
+
+// importTimeLayouts are tried in order when no time layout is configured;
+// plain numbers are read as Unix or Slack timestamps
+var importTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+func parseImportTime(value, layout string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if layout != "" {
+		return time.ParseInLocation(layout, value, time.UTC)
+	}
+	for _, l := range importTimeLayouts {
+		if t, err := time.ParseInLocation(l, value, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := parseSlackTimestamp(value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", value)
+}
+
+// importBeers reads beers from r, resolves their users and stores them tagged
+// with opts.Source. Rows that can't be parsed or resolved are reported and
+// skipped; the rest are imported together.
+func importBeers(ctx context.Context, store Store, users emailLookup, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	source := strings.TrimSpace(opts.Source)
+	if source == "" {
+		return nil, fmt.Errorf("an import source is required")
+	}
+	if source == beerSourceSlack {
+		return nil, fmt.Errorf("source %q is reserved for beers from Slack", beerSourceSlack)
+	}
+	if opts.Workspace != "" && (!strings.HasPrefix(opts.Workspace, "T") || !workspaceIDPattern.MatchString(opts.Workspace)) {
+		return nil, fmt.Errorf("invalid workspace %q", opts.Workspace)
+	}
+	m := opts.Mapping
+	if m.Giver == "" || m.Recipient == "" || m.Time == "" {
+		return nil, fmt.Errorf("giver, recipient and time columns must be mapped")
+	}
+
+	records, err := readImportRecords(r, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{Source: source, DryRun: opts.DryRun, Rows: len(records)}
+	resolver := newUserResolver(store, users)
+	unresolved := map[string]bool{}
+	// rows without a ts are keyed by their second; repeats get the next fraction
+	seen := map[string]int{}
+	var beers []BeerRow
+
+	for i, rec := range records {
+		problem := func(err error) {
+			report.Invalid = append(report.Invalid, ImportProblem{Row: i + 1, Error: err.Error()})
+		}
+
+		giver, err := resolver.resolve(ctx, rec[m.Giver])
+		if err != nil {
+			unresolved[strings.TrimSpace(rec[m.Giver])] = true
+			problem(fmt.Errorf("giver: %w", err))
+			continue
+		}
+		recipient, err := resolver.resolve(ctx, rec[m.Recipient])
+		if err != nil {
+			unresolved[strings.TrimSpace(rec[m.Recipient])] = true
+			problem(fmt.Errorf("recipient: %w", err))
+			continue
+		}
+		if giver == recipient {
+			problem(fmt.Errorf("giver and recipient are both %s", giver))
+			continue
+		}
+		at, err := parseImportTime(rec[m.Time], m.TimeLayout)
+		if err != nil {
+			problem(err)
+			continue
+		}
+		count := 1
+		if v := strings.TrimSpace(rec[m.Count]); m.Count != "" && v != "" {
+			if count, err = strconv.Atoi(v); err != nil || count <= 0 {
+				problem(fmt.Errorf("invalid count %q", v))
+				continue
+			}
+		}
+		ts := ""
+		if m.Ts != "" {
+			ts = strings.TrimSpace(rec[m.Ts])
+		}
+		if ts == "" {
+			key := fmt.Sprintf("%s|%s|%d", giver, recipient, at.Unix())
+			ts = fmt.Sprintf("%d.%06d", at.Unix(), seen[key])
+			seen[key]++
+		}
+		beers = append(beers, BeerRow{TeamID: opts.Workspace, GiverID: giver, RecipientID: recipient, Ts: ts, TsRFC: at.UTC(), Count: count})
+	}
+
+	for v := range unresolved {
+		if v != "" {
+			report.Unresolved = append(report.Unresolved, v)
+		}
+	}
+	sort.Strings(report.Unresolved)
+
+	report.Imported, err = store.ImportBeers(ctx, beers, source, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	report.Duplicates = len(beers) - report.Imported
+	return report, nil
+}
+
+// printImportReport writes a human readable import summary
+func printImportReport(w io.Writer, report *ImportReport) {
+	verb := "imported"
+	if report.DryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(w, "source %s: %d rows, %s %d beers, %d duplicates, %d invalid\n",
+		report.Source, report.Rows, verb, report.Imported, report.Duplicates, len(report.Invalid))
+	for _, p := range report.Invalid {
+		fmt.Fprintf(w, "  row %d: %s\n", p.Row, p.Error)
+	}
+	if len(report.Unresolved) > 0 {
+		fmt.Fprintf(w, "unresolved users: %s\n", strings.Join(report.Unresolved, ", "))
+	}
+}
+
+// ImportBeersHandler imports beers from a CSV or JSON request body
+// Query params: source (required), format (csv|json, default from Content-Type),
+// dry_run, workspace, giver, recipient, time, count, ts (column names), time_layout
+func (h *APIHandlers) ImportBeersHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "import_beers").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = importCSV
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			format = importJSON
+		}
+	}
+	mapping := defaultImportMapping()
+	for param, field := range map[string]*string{
+		"giver": &mapping.Giver, "recipient": &mapping.Recipient, "time": &mapping.Time,
+		"count": &mapping.Count, "ts": &mapping.Ts, "time_layout": &mapping.TimeLayout,
+	} {
+		if v := q.Get(param); v != "" {
+			*field = v
+		}
+	}
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+	workspace := q.Get("workspace")
+	if workspace == "" {
+		workspace = h.defaultWorkspace(r.Context())
+	}
+
+	var users emailLookup
+	if h.slackClient != nil {
+		users = h.slackClient
+	}
+	report, err := importBeers(r.Context(), h.store, users, http.MaxBytesReader(w, r.Body, maxImportBytes), ImportOptions{
+		Format:    format,
+		Source:    q.Get("source"),
+		Mapping:   mapping,
+		DryRun:    dryRun,
+		Workspace: workspace,
+	})
+	if err != nil {
+		h.logger.Warn().Str("handler", "import_beers").Err(err).Msg("import failed")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// leaderboards in Redis are rebuilt from the database rather than adjusted
+	if !dryRun && report.Imported > 0 && h.redisCache != nil {
+		if err := h.redisCache.PopulateFromDB(r.Context(), h.store); err != nil {
+			h.logger.Warn().Str("handler", "import_beers").Err(err).Msg("failed to refresh redis leaderboards")
+		}
+	}
+
+	h.logger.Info().Str("handler", "import_beers").Str("source", report.Source).Bool("dry_run", dryRun).
+		Int("rows", report.Rows).Int("imported", report.Imported).Int("duplicates", report.Duplicates).
+		Int("invalid", len(report.Invalid)).Msg("request completed")
+	status := http.StatusCreated
+	if dryRun {
+		status = http.StatusOK
+	}
+	writeJSON(w, h.logger, "import_beers", status, report)
+}
+
+// runImportCommand implements `bot import`
+func runImportCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dsn := fs.String("db", databaseDSN(), "sqlite database path or postgres:// URL")
+	file := fs.String("file", "", "CSV or JSON file to import")
+	format := fs.String("format", "", "input format: csv or json (default: from the file extension)")
+	source := fs.String("source", "", "tag stored with the imported beers, e.g. spreadsheet")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without writing")
+	workspace := fs.String("workspace", "", "workspace (team) id to record the beers in")
+	mapping := defaultImportMapping()
+	fs.StringVar(&mapping.Giver, "giver", mapping.Giver, "column holding the giver (Slack ID, email or name)")
+	fs.StringVar(&mapping.Recipient, "recipient", mapping.Recipient, "column holding the recipient (Slack ID, email or name)")
+	fs.StringVar(&mapping.Time, "time", mapping.Time, "column holding when the beer was given")
+	fs.StringVar(&mapping.Count, "count", mapping.Count, "column holding the number of beers (optional)")
+	fs.StringVar(&mapping.Ts, "ts", mapping.Ts, "column holding a unique Slack-style ts (optional)")
+	fs.StringVar(&mapping.TimeLayout, "time-layout", "", "Go time layout of the time column (default: RFC3339, dates or Unix seconds)")
+	_ = fs.Parse(args)
+
+	if *file == "" || *source == "" {
+		log.Fatal("usage: bot import -file beers.csv -source name [-dry-run] [-format csv|json] [-giver col] [-recipient col] [-time col] [-count col] [-ts col]")
+	}
+	if *format == "" {
+		*format = importCSV
+		if strings.EqualFold(filepath.Ext(*file), ".json") {
+			*format = importJSON
+		}
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("open input: %v", err)
+	}
+	defer f.Close()
+
+	store, err := openStore(*dsn, storeOptionsFromEnv(), nil)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+
+	// emails can only be resolved with a bot token (users:read.email scope)
+	var users emailLookup
+	if token := os.Getenv("BOT_TOKEN"); token != "" {
+		users = slack.New(token)
+	}
+
+	report, err := importBeers(context.Background(), store, users, f, ImportOptions{Format: *format, Source: *source, Mapping: mapping, DryRun: *dryRun, Workspace: *workspace})
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	printImportReport(os.Stdout, report)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+type fakeEmailLookup map[string]string
+
+func (f fakeEmailLookup) GetUserByEmail(email string) (*slack.User, error) {
+	id, ok := f[email]
+	if !ok {
+		return nil, errors.New("users_not_found")
+	}
+	return &slack.User{ID: id, RealName: "Looked Up " + id}, nil
+}
+
+const importTestCSV = `Date,From,To,Beers
+2024-03-01,ada@example.com,U2,2
+2024-03-01,ada@example.com,U2,1
+2024-03-02,Grace Hopper,ada@example.com,
+2024-03-03,nobody@example.com,U2,1
+2024-03-04,U2,U3,zero
+not a date,U2,U3,1
+`
+
+func TestImportBeers_CSV(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.SetCachedUser(t.Context(), "U2", "Grace Hopper", ""); err != nil {
+		t.Fatalf("cache user: %v", err)
+	}
+	slackUsers := fakeEmailLookup{"ada@example.com": "U1"}
+	opts := ImportOptions{
+		Format:  importCSV,
+		Source:  "spreadsheet",
+		Mapping: ImportMapping{Giver: "From", Recipient: "To", Time: "Date", Count: "Beers"},
+		DryRun:  true,
+	}
+
+	dry, err := importBeers(t.Context(), store, slackUsers, strings.NewReader(importTestCSV), opts)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if dry.Rows != 6 || dry.Imported != 3 || dry.Duplicates != 0 || len(dry.Invalid) != 3 {
+		t.Fatalf("unexpected dry run report: %+v", dry)
+	}
+	if len(dry.Unresolved) != 1 || dry.Unresolved[0] != "nobody@example.com" {
+		t.Fatalf("unexpected unresolved users: %v", dry.Unresolved)
+	}
+	if got, _ := store.CountGivenInDateRange(t.Context(), "U1", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), StatsOptions{}); got != 0 {
+		t.Fatalf("dry run wrote %d beers", got)
+	}
+
+	opts.DryRun = false
+	report, err := importBeers(t.Context(), store, slackUsers, strings.NewReader(importTestCSV), opts)
+	if err != nil || report.Imported != 3 {
+		t.Fatalf("import: %+v %v", report, err)
+	}
+	// two identical rows on the same day are separate beers
+	if got, _ := store.CountGivenOnDate(t.Context(), "U1", "2024-03-01"); got != 3 {
+		t.Fatalf("expected 3 beers from U1, got %d", got)
+	}
+	if got, _ := store.CountReceived(t.Context(), "U1", "2024-03-02"); got != 1 {
+		t.Fatalf("expected the default count of 1, got %d", got)
+	}
+	if u, _ := store.GetCachedUser(t.Context(), "U1"); u == nil || u.RealName != "Looked Up U1" {
+		t.Fatalf("expected the looked up user cached, got %+v", u)
+	}
+
+	// importing the same file again only finds duplicates
+	again, err := importBeers(t.Context(), store, slackUsers, strings.NewReader(importTestCSV), opts)
+	if err != nil || again.Imported != 0 || again.Duplicates != 3 {
+		t.Fatalf("re-import: %+v %v", again, err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("rollup drift: %d %v", drift, err)
+	}
+
+	var sources []string
+	if err := store.ForEachBeer(t.Context(), time.Time{}, time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC), "", func(b ExportBeer) error {
+		sources = append(sources, b.Source)
+		return nil
+	}); err != nil || strings.Join(sources, ",") != "spreadsheet,spreadsheet,spreadsheet" {
+		t.Fatalf("unexpected sources: %v %v", sources, err)
+	}
+}
+
+func TestImportBeers_JSONAndValidation(t *testing.T) {
+	store := newTestStore(t)
+	input := `[{"giver": "U1", "recipient": "U2", "time": 1709294400, "ts": "1709294400.000100", "count": 2}]`
+	opts := ImportOptions{Format: importJSON, Source: "kudosbot", Mapping: defaultImportMapping()}
+
+	report, err := importBeers(t.Context(), store, nil, strings.NewReader(input), opts)
+	if err != nil || report.Imported != 1 || len(report.Invalid) != 0 {
+		t.Fatalf("json import: %+v %v", report, err)
+	}
+	if got, _ := store.CountGivenOnDate(t.Context(), "U1", "2024-03-01"); got != 2 {
+		t.Fatalf("expected 2 beers, got %d", got)
+	}
+
+	// a rebuild from the event log leaves imported beers alone
+	if err := store.ReplaceBeersSince(t.Context(), "", "0", nil); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if got, _ := store.CountGivenOnDate(t.Context(), "U1", "2024-03-01"); got != 2 {
+		t.Fatalf("rebuild removed imported beers, %d left", got)
+	}
+
+	if _, err := importBeers(t.Context(), store, nil, strings.NewReader(input), ImportOptions{Format: importJSON, Source: "slack", Mapping: defaultImportMapping()}); err == nil {
+		t.Fatalf("expected the slack source to be reserved")
+	}
+	if _, err := importBeers(t.Context(), store, nil, strings.NewReader(input), ImportOptions{Format: "xml", Source: "x", Mapping: defaultImportMapping()}); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+	report, err = importBeers(t.Context(), store, nil, strings.NewReader(`[{"giver": "ada@example.com", "recipient": "U2", "time": "2024-03-01"}]`), opts)
+	if err != nil || len(report.Invalid) != 1 || !strings.Contains(report.Invalid[0].Error, "no Slack token") {
+		t.Fatalf("expected emails to need a Slack client: %+v %v", report, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -13,24 +14,86 @@ import (
 	"syscall"
 	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
 )
 
+// Roles a process can run; without a role subcommand it runs all of them
+const (
+	roleAll = "all"
+	roleAPI = "serve-api"
+	roleBot = "run-bot"
+)
+
+// parseRole splits the role subcommand, if any, from the command line arguments
+func parseRole(args []string) (string, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case roleAll, roleAPI, roleBot:
+			return args[0], args[1:]
+		}
+	}
+	return roleAll, args
+}
+
 func main() {
+	// subcommands; without one the bot runs as usual
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rebuild":
+			runRebuildCommand(os.Args[2:])
+			return
+		case "replay":
+			runReplayCommand(os.Args[2:])
+			return
+		case "migrate":
+			runMigrateCommand(os.Args[2:])
+			return
+		case "rollup":
+			runRollupCommand(os.Args[2:])
+			return
+		case "restore":
+			runRestoreCommand(os.Args[2:])
+			return
+		case "export":
+			runExportCommand(os.Args[2:])
+			return
+		case "import":
+			runImportCommand(os.Args[2:])
+			return
+		}
+	}
+
+	// serve-api answers HTTP API requests only; run-bot consumes Slack events
+	// and runs the background workers, serving just health and metrics
+	role, args := parseRole(os.Args[1:])
+	servesAPI := role != roleBot
+	runsBot := role != roleAPI
+
 	emoji := ":beer:" //nolint:typecheck // Used in regexp compilation below
 	if env := os.Getenv("EMOJI"); env != "" {
 		emoji = env
 	}
-	dbPath := flag.String("db", os.Getenv("DB_PATH"), "sqlite database path")
-	botToken := flag.String("bot-token", os.Getenv("BOT_TOKEN"), "slack bot token (xoxb-...)")
+	dsn := flag.String("db", databaseDSN(), "sqlite database path or postgres:// URL (DATABASE_URL, DB_PATH)")
+	botToken := flag.String("bot-token", os.Getenv("BOT_TOKEN"), "slack bot token (xoxb-...); optional for serve-api, where it enables user lookups")
 	appToken := flag.String("app-token", os.Getenv("APP_TOKEN"), "slack app-level token (xapp-...)")
 	channelID := flag.String("channel", os.Getenv("CHANNEL"), "channel id to monitor")
+	slackModeDefault := slackModeSocket
+	if env := os.Getenv("SLACK_MODE"); env != "" {
+		slackModeDefault = env
+	}
+	slackMode := flag.String("slack-mode", slackModeDefault, `how Slack events arrive: "socket" (Socket Mode) or "http" (Events API request URL)`)
+	signingSecret := flag.String("signing-secret", os.Getenv("SIGNING_SECRET"), "slack signing secret verifying Events API requests (http mode)")
+	workspacesFile := flag.String("workspaces-file", os.Getenv("WORKSPACES_FILE"), `JSON file listing further workspace installs as [{"bot_token", "app_token", "channel"}]`)
 	apiToken := flag.String("api-token", os.Getenv("API_TOKEN"), "api token for authentication")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "api token for admin endpoints (admin API disabled if empty)")
 	logLevel := flag.String("log-level", os.Getenv("LOG_LEVEL"), "log level")
+	recordPath := flag.String("record-events", os.Getenv("RECORD_EVENTS"), "append incoming slack events to this JSON Lines file")
 
 	addrDefault := ":8080"
 	if env := os.Getenv("ADDR"); env != "" {
@@ -45,38 +108,117 @@ func main() {
 		}
 	}
 	maxPerDay := flag.Int("max-per-day", maxPerDayDefault, "max beers a user may give per day") //nolint:typecheck // Used in daily limit checks
-	flag.Parse()
 
-	if *botToken == "" || *appToken == "" || *channelID == "" {
-		log.Fatal("bot-token, app-token and channel must be provided via flags or env (BOT_TOKEN, APP_TOKEN, CHANNEL)")
+	eventWorkersDefault := 4
+	if env := os.Getenv("EVENT_WORKERS"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			eventWorkersDefault = v
+		}
 	}
+	eventWorkers := flag.Int("event-workers", eventWorkersDefault, "number of event worker goroutines")
 
-	// open sqlite
-	dbDir := ""
-	dbFile := *dbPath
-	if idx := strings.LastIndex(dbFile, "/"); idx != -1 {
-		dbDir = dbFile[:idx]
+	eventQueueSizeDefault := 100
+	if env := os.Getenv("EVENT_QUEUE_SIZE"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			eventQueueSizeDefault = v
+		}
 	}
-	if dbDir != "" {
-		if _, err := os.Stat(dbDir); os.IsNotExist(err) {
-			if err := os.MkdirAll(dbDir, 0o755); err != nil {
-				log.Fatalf("Failed to create DB directory: %v", err)
-			}
+	eventQueueSize := flag.Int("event-queue-size", eventQueueSizeDefault, "max queued events per worker")
+
+	drainTimeoutDefault := 30 * time.Second
+	if env := os.Getenv("EVENT_DRAIN_TIMEOUT"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			drainTimeoutDefault = v
 		}
 	}
-	db, err := sql.Open("sqlite3", dbFile)
-	if err != nil {
-		log.Fatalf("open db: %v", err)
+	drainTimeout := flag.Duration("event-drain-timeout", drainTimeoutDefault, "how long to wait for queued events on shutdown")
+
+	processedRetentionDefault := 7 * 24 * time.Hour
+	if env := os.Getenv("PROCESSED_EVENTS_RETENTION"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			processedRetentionDefault = v
+		}
 	}
-	defer db.Close()
+	processedRetention := flag.Duration("processed-events-retention", processedRetentionDefault, "how long to keep event dedupe markers (0 disables pruning)")
 
-	store, err := NewSQLiteStore(db)
-	if err != nil {
-		log.Fatalf("init store: %v", err)
+	pruneIntervalDefault := time.Hour
+	if env := os.Getenv("PRUNE_INTERVAL"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			pruneIntervalDefault = v
+		}
 	}
+	pruneInterval := flag.Duration("prune-interval", pruneIntervalDefault, "how often to prune processed events")
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var eligibility EligibilityRules
+	registerEligibilityFlags(flag.CommandLine, &eligibility)
+
+	userSyncIntervalDefault := 6 * time.Hour
+	if env := os.Getenv("USER_SYNC_INTERVAL"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			userSyncIntervalDefault = v
+		}
+	}
+	userSyncInterval := flag.Duration("user-sync-interval", userSyncIntervalDefault, "how often to sync the Slack user directory (0 disables it)")
+	teamProfileField := flag.String("team-profile-field", os.Getenv("TEAM_PROFILE_FIELD"), `Slack profile field holding each user's team: "title", or a custom field's label or ID (empty disables it)`)
+
+	backupDir := flag.String("backup-dir", os.Getenv("BACKUP_DIR"), "directory for scheduled and on-demand SQLite backups (backups disabled if empty)")
+
+	backupIntervalDefault := 24 * time.Hour
+	if env := os.Getenv("BACKUP_INTERVAL"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			backupIntervalDefault = v
+		}
+	}
+	backupInterval := flag.Duration("backup-interval", backupIntervalDefault, "how often to take a scheduled backup")
+
+	backupKeepDailyDefault := 7
+	if env := os.Getenv("BACKUP_KEEP_DAILY"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			backupKeepDailyDefault = v
+		}
+	}
+	backupKeepDaily := flag.Int("backup-keep-daily", backupKeepDailyDefault, "number of daily backups to keep")
+
+	backupKeepWeeklyDefault := 4
+	if env := os.Getenv("BACKUP_KEEP_WEEKLY"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			backupKeepWeeklyDefault = v
+		}
+	}
+	backupKeepWeekly := flag.Int("backup-keep-weekly", backupKeepWeeklyDefault, "number of weekly backups to keep")
+
+	storeOpts := storeOptionsFromEnv()
+	flag.BoolVar(&storeOpts.SQLite.WAL, "sqlite-wal", storeOpts.SQLite.WAL, "use SQLite write-ahead logging")
+	flag.DurationVar(&storeOpts.SQLite.BusyTimeout, "sqlite-busy-timeout", storeOpts.SQLite.BusyTimeout, "how long SQLite waits for a lock")
+	flag.IntVar(&storeOpts.SQLite.ReadConns, "sqlite-read-conns", storeOpts.SQLite.ReadConns, "max SQLite read connections")
+	flag.IntVar(&storeOpts.SQLite.WriteQueue, "sqlite-write-queue", storeOpts.SQLite.WriteQueue, "max SQLite writes waiting for the writer")
+	flag.IntVar(&storeOpts.SQLite.WriteBatch, "sqlite-write-batch", storeOpts.SQLite.WriteBatch, "max SQLite writes per transaction (0 disables the writer goroutine)")
+	flag.DurationVar(&storeOpts.SQLite.WriteBatchWait, "sqlite-write-batch-wait", storeOpts.SQLite.WriteBatchWait, "how long the SQLite writer waits to fill a batch")
+	flag.DurationVar(&storeOpts.Query.Timeout, "db-query-timeout", storeOpts.Query.Timeout, "max time for a database query or write (0 disables it)")
+	flag.DurationVar(&storeOpts.Query.SlowThreshold, "db-slow-query", storeOpts.Query.SlowThreshold, "log database calls slower than this (0 disables it)")
+	_ = flag.CommandLine.Parse(args)
+
+	// Slack tokens and channels are only needed by the event consumer
+	var configs []WorkspaceConfig
+	if runsBot {
+		switch *slackMode {
+		case slackModeSocket:
+		case slackModeHTTP:
+			if *signingSecret == "" {
+				log.Fatal("signing-secret must be provided via flag or env (SIGNING_SECRET) in http mode")
+			}
+		default:
+			log.Fatalf("unknown slack-mode %q (want socket or http)", *slackMode)
+		}
+		var err error
+		configs, err = loadWorkspaceConfigs(*workspacesFile, WorkspaceConfig{BotToken: *botToken, AppToken: *appToken, Channel: *channelID}, *slackMode == slackModeSocket)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if len(configs) == 0 {
+			log.Fatal("bot-token, app-token and channel must be provided via flags or env (BOT_TOKEN, APP_TOKEN, CHANNEL), or listed in WORKSPACES_FILE")
+		}
+	}
 
 	// structured logger (zerolog)
 	zerolog.TimeFieldFormat = time.RFC3339
@@ -90,6 +232,16 @@ func main() {
 	zlogger = zlogger.Level(level)
 	zlog.Logger = zlogger
 
+	storeOpts.Logger = zlogger.With().Str("component", "store").Logger()
+	store, err := openStore(*dsn, storeOpts, prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Initialize Redis cache
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
@@ -103,18 +255,64 @@ func main() {
 		defer redisCache.Close()
 	}
 
-	// init Slack connection manager
-	slackManager := NewSlackConnectionManager(*botToken, *appToken, zlogger)
+	// One Slack connection manager and event processor per workspace install,
+	// sharing one event worker pool
+	var (
+		msgsProcessed *prometheus.CounterVec
+		eventPool     *EventWorkerPool
+		installs      []workspaceInstall
+		processors    = map[string]*EventProcessor{}
+	)
+	if runsBot {
+		msgsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bwm_messages_processed_total",
+			Help: "Number of messages processed by the bot",
+		}, []string{"channel"})
+		prometheus.MustRegister(msgsProcessed)
+		eventPool = NewEventWorkerPool(*eventWorkers, *eventQueueSize, zlogger, prometheus.DefaultRegisterer)
+	}
+	for _, c := range configs {
+		ws, err := identifyWorkspace(ctx, slack.New(c.BotToken))
+		if err != nil {
+			log.Fatalf("identify workspace of channel %s: %v", c.Channel, err)
+		}
+		if _, ok := processors[ws.TeamID]; ok {
+			log.Fatalf("workspace %s (%s) is configured more than once", ws.TeamID, ws.Name)
+		}
+		if err := store.SaveWorkspace(ctx, ws); err != nil {
+			log.Fatalf("save workspace %s: %v", ws.TeamID, err)
+		}
+		wsLogger := zlogger.With().Str("workspace", ws.TeamID).Logger()
+		manager := NewSlackConnectionManager(c.BotToken, c.AppToken, wsLogger)
+		processor := NewEventProcessor(store, manager, redisCache, c.Channel, emoji, *maxPerDay, wsLogger, msgsProcessed, eventPool)
+		if *slackMode == slackModeHTTP {
+			manager.UseHTTPEvents()
+			processor.UseHTTPEvents()
+		}
+		processor.SetEligibility(eligibility)
+		processor.SetWorkspace(ws.TeamID)
+		processors[ws.TeamID] = processor
+		installs = append(installs, workspaceInstall{Workspace: ws, manager: manager, processor: processor})
+		zlogger.Info().Str("workspace", ws.TeamID).Str("name", ws.Name).Str("enterprise", ws.EnterpriseID).Str("channel", c.Channel).Msg("workspace configured")
+	}
 
-	// Prometheus metrics
-	msgsProcessed := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "bwm_messages_processed_total",
-		Help: "Number of messages processed by the bot",
-	}, []string{"channel"})
-	prometheus.MustRegister(msgsProcessed)
+	// Rows recorded before workspaces were tracked belong to the first install
+	if len(installs) > 0 {
+		primary := installs[0]
+		if claimed, err := store.ClaimUnscopedRows(ctx, primary.TeamID); err != nil {
+			log.Fatalf("%v", err)
+		} else if claimed > 0 {
+			zlogger.Info().Str("workspace", primary.TeamID).Int64("beers", claimed).Msg("assigned beers without a workspace")
+		}
+	}
 
-	// Setup HTTP handlers
-	handlers := NewAPIHandlers(store, slackManager.GetClient(), slackManager, redisCache, zlogger)
+	// Online backups (SQLite only; PostgreSQL relies on the server's backups)
+	var backups *BackupManager
+	if dialect, _ := dialectForDSN(*dsn); *backupDir != "" && dialect == sqliteDialect {
+		backups = NewBackupManager(store, *backupDir, *backupKeepDaily, *backupKeepWeekly, *backupInterval, zlogger, prometheus.DefaultRegisterer)
+	} else if *backupDir != "" {
+		zlogger.Warn().Msg("BACKUP_DIR is ignored for PostgreSQL; use the server's backups")
+	}
 
 	// HTTP server for health + metrics
 	mux := http.NewServeMux()
@@ -124,27 +322,38 @@ func main() {
 	})
 	mux.Handle("/metrics", promhttp.Handler())
 
-	// REST API endpoints
-	mux.Handle("/api/given", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.GivenHandler)))
-	mux.Handle("/api/received", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.ReceivedHandler)))
-	mux.Handle("/api/user", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.UserHandler)))
-	mux.Handle("/api/users", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.BatchUsersHandler)))
-	// Public endpoints (no auth required)
-	mux.Handle("/api/givers", http.HandlerFunc(handlers.GiversHandler))
-	mux.Handle("/api/recipients", http.HandlerFunc(handlers.RecipientsHandler))
-	mux.HandleFunc("/api/health", handlers.HealthHandler)
+	// Slack Events API, slash commands and interactivity (http mode); requests
+	// are authenticated by their signature
+	var receiver *EventsHTTPReceiver
+	if runsBot && *slackMode == slackModeHTTP {
+		receiver = NewEventsHTTPReceiver(*signingSecret, eventPool, zlogger.With().Str("component", "slack_http").Logger())
+		mux.Handle("POST /slack/events", receiver)
+	}
 
-	// Stats/Analytics endpoints (auth required)
-	mux.Handle("/api/stats/combined", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.CombinedAnalyticsHandler)))
-	mux.Handle("/api/stats/timeline", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.TimelineHandler)))
-	mux.Handle("/api/stats/quarterly", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.QuarterlyHandler)))
-	mux.Handle("/api/stats/top", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.TopUsersHandler)))
-	mux.Handle("/api/stats/heatmap", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.HeatmapHandler)))
-	mux.Handle("/api/stats/pairs", authMiddleware(*apiToken, zlogger, http.HandlerFunc(handlers.PairsHandler)))
-
-	srv := &http.Server{Addr: *addr, Handler: mux}
+	// Setup HTTP handlers. Without a local bot, user lookups fall back to
+	// Slack only when a bot token is given.
+	var handlers *APIHandlers
+	if len(installs) > 0 {
+		primary := installs[0]
+		handlers = NewAPIHandlers(store, primary.manager.GetClient(), primary.manager, redisCache, primary.processor, backups, zlogger)
+		handlers.SetWorkspaceProcessors(processors)
+	} else {
+		var client *slack.Client
+		if *botToken != "" {
+			client = slack.New(*botToken)
+		}
+		handlers = NewAPIHandlers(store, client, nil, redisCache, nil, backups, zlogger)
+	}
+	if servesAPI {
+		registerAPIRoutes(mux, handlers, *apiToken, *adminToken, zlogger)
+	} else if *adminToken != "" {
+		// only the bot has event processors, so it serves the dead letters
+		registerDeadLetterRoutes(mux, handlers, *adminToken, zlogger)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: workspaceMiddleware(zlogger, mux)}
 	go func() {
-		zlogger.Info().Str("addr", *addr).Msg("HTTP server listening")
+		zlogger.Info().Str("addr", *addr).Str("role", role).Msg("HTTP server listening")
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			zlogger.Fatal().Err(err).Msg("HTTP server failed")
 		}
@@ -154,40 +363,85 @@ func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	// Create event processor and handler
-	eventProcessor := NewEventProcessor(store, slackManager, redisCache, *channelID, emoji, *maxPerDay, zlogger, msgsProcessed)
+	// Event consumption and background workers run in the bot role only, so
+	// API replicas can be scaled without duplicating them
+	if runsBot {
+		// Optionally record raw events for offline replay
+		var recorder *EventRecorder
+		if *recordPath != "" {
+			recorder, err = NewEventRecorder(*recordPath, zlogger)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			defer recorder.Close()
+		}
 
-	// Start Slack connection manager with automatic reconnection
-	slackManager.StartWithReconnection(ctx, eventProcessor.HandleEvent)
+		// Start each workspace's Slack connection with automatic reconnection, or
+		// route its HTTP requests to it
+		for _, in := range installs {
+			eventHandler := in.processor.HandleEvent
+			if recorder != nil {
+				eventHandler = recorder.Wrap(eventHandler)
+			}
+			if receiver != nil {
+				receiver.AddWorkspace(in.TeamID, eventHandler, in.processor.DropEvent)
+				continue
+			}
+			in.manager.StartWithReconnection(ctx, eventHandler)
+		}
 
-	// Start Redis sync worker (if Redis is available)
-	if redisCache != nil {
-		go redisCache.StartSyncWorker(ctx, store, 5*time.Minute)
-	}
+		// Start Redis sync worker (if Redis is available)
+		if redisCache != nil {
+			go redisCache.StartSyncWorker(ctx, store, 5*time.Minute)
+		}
 
-	// Connection health monitor
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				connected := slackManager.IsConnected()
-				if !connected {
-					zlogger.Warn().Msg("Slack connection monitor: DISCONNECTED")
-				} else {
-					// Test actual API connection periodically
-					if err := slackManager.TestConnection(ctx); err != nil {
-						zlogger.Error().Err(err).Msg("Slack connection monitor: API test failed")
+		// Prune old event dedupe markers
+		if *processedRetention > 0 {
+			pruner := NewProcessedEventsPruner(store, *processedRetention, *pruneInterval, zlogger, prometheus.DefaultRegisterer)
+			go pruner.Run(ctx)
+		}
+
+		// Sync each workspace's Slack user directory into the user cache
+		if *userSyncInterval > 0 {
+			for _, in := range installs {
+				reg := prometheus.WrapRegistererWith(prometheus.Labels{"workspace": in.TeamID}, prometheus.DefaultRegisterer)
+				userSync := NewUserDirectorySync(store, in.manager.GetClient(), redisCache, *userSyncInterval, zlogger.With().Str("workspace", in.TeamID).Logger(), reg)
+				userSync.SetTeamField(*teamProfileField)
+				go userSync.Run(ctx)
+			}
+		}
+
+		// Scheduled backups
+		if backups != nil && *backupInterval > 0 {
+			go backups.Run(ctx)
+		}
+
+		// Connection health monitor
+		go func() {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					for _, in := range installs {
+						connected := in.manager.IsConnected()
+						if !connected {
+							zlogger.Warn().Str("workspace", in.TeamID).Msg("Slack connection monitor: DISCONNECTED")
+						} else {
+							// Test actual API connection periodically
+							if err := in.manager.TestConnection(ctx); err != nil {
+								zlogger.Error().Str("workspace", in.TeamID).Err(err).Msg("Slack connection monitor: API test failed")
+							}
+						}
 					}
+				case <-ctx.Done():
+					zlogger.Info().Msg("Connection monitor stopping")
+					return
 				}
-			case <-ctx.Done():
-				zlogger.Info().Msg("Connection monitor stopping")
-				return
 			}
-		}
-	}()
+		}()
+	}
 
 	select {
 	case sig := <-sigs:
@@ -197,7 +451,8 @@ func main() {
 		zlogger.Info().Msg("context cancelled, shutting down")
 	}
 
-	// shutdown http
+	// stop accepting requests, so no Slack event is acknowledged that the
+	// draining pool can no longer take
 	zlogger.Info().Msg("initiating graceful shutdown")
 	ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelShutdown()
@@ -206,6 +461,153 @@ func main() {
 	} else {
 		zlogger.Info().Msg("HTTP server shutdown completed")
 	}
+
+	// drain queued events before closing the database
+	ctxDrain, cancelDrain := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancelDrain()
+	if receiver != nil {
+		receiver.Wait()
+	}
+	if eventPool != nil {
+		if err := eventPool.Shutdown(ctxDrain); err != nil {
+			zlogger.Error().Err(err).Msg("event worker pool drain incomplete")
+		}
+	}
 	zlogger.Info().Msg("shutdown complete")
 	// socketmode client will stop when context is cancelled / RunContext returns
 }
+
+// registerDeadLetterRoutes registers the admin endpoints for failed events.
+// The bot role serves them on its own, since replays need its event
+// processors.
+func registerDeadLetterRoutes(mux *http.ServeMux, handlers *APIHandlers, adminToken string, logger zerolog.Logger) {
+	mux.Handle("GET /api/admin/dead-letters", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.DeadLettersHandler)))
+	mux.Handle("GET /api/admin/dead-letters/{id}", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.DeadLetterHandler)))
+	mux.Handle("POST /api/admin/dead-letters/{id}/replay", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.ReplayDeadLetterHandler)))
+}
+
+// registerAPIRoutes registers the REST API on mux. Admin endpoints are only
+// registered when adminToken is set.
+func registerAPIRoutes(mux *http.ServeMux, handlers *APIHandlers, apiToken, adminToken string, logger zerolog.Logger) {
+	// REST API endpoints
+	mux.Handle("/api/given", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.GivenHandler)))
+	mux.Handle("/api/received", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.ReceivedHandler)))
+	mux.Handle("/api/user", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.UserHandler)))
+	mux.Handle("/api/users", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.BatchUsersHandler)))
+	// Public endpoints (no auth required)
+	mux.Handle("/api/givers", http.HandlerFunc(handlers.GiversHandler))
+	mux.Handle("/api/recipients", http.HandlerFunc(handlers.RecipientsHandler))
+	mux.HandleFunc("/api/health", handlers.HealthHandler)
+
+	// Stats/Analytics endpoints (auth required)
+	mux.Handle("/api/stats/combined", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.CombinedAnalyticsHandler)))
+	mux.Handle("/api/stats/timeline", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.TimelineHandler)))
+	mux.Handle("/api/stats/quarterly", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.QuarterlyHandler)))
+	mux.Handle("/api/stats/top", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.TopUsersHandler)))
+	mux.Handle("/api/stats/heatmap", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.HeatmapHandler)))
+	mux.Handle("/api/stats/pairs", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.PairsHandler)))
+	mux.Handle("GET /api/workspaces", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.WorkspacesHandler)))
+	mux.Handle("GET /api/teams", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.TeamsHandler)))
+	mux.Handle("/api/stats/teams/top", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.TopTeamsHandler)))
+	mux.Handle("/api/stats/teams/timeline", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.TeamTimelineHandler)))
+	mux.Handle("/api/stats/team-matrix", authMiddleware(apiToken, logger, http.HandlerFunc(handlers.TeamMatrixHandler)))
+
+	// Admin endpoints (admin token required)
+	if adminToken != "" {
+		registerDeadLetterRoutes(mux, handlers, adminToken, logger)
+		mux.Handle("POST /api/admin/backup", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.BackupHandler)))
+		mux.Handle("POST /api/admin/import", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.ImportBeersHandler)))
+		mux.Handle("GET /api/admin/beers", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.BeersHandler)))
+		mux.Handle("POST /api/admin/beers", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.AddBeerHandler)))
+		mux.Handle("PATCH /api/admin/beers/{id}", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.AdjustBeerHandler)))
+		mux.Handle("POST /api/admin/beers/{id}/revoke", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.RevokeBeerHandler)))
+		mux.Handle("GET /api/admin/audit", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.AuditLogHandler)))
+		mux.Handle("GET /api/admin/export/beers", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.ExportBeersHandler)))
+		mux.Handle("POST /api/admin/users/{id}/refresh", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.RefreshUserHandler)))
+		mux.Handle("DELETE /api/admin/users/{id}", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.PurgeUserHandler)))
+		mux.Handle("GET /api/admin/users/{id}/export", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.UserExportHandler)))
+		mux.Handle("POST /api/admin/users/{id}/erase", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.EraseUserHandler)))
+		mux.Handle("POST /api/admin/users/{id}/merge", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.MergeUserHandler)))
+		mux.Handle("DELETE /api/admin/users/{id}/merge", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.UnmergeUserHandler)))
+		mux.Handle("GET /api/admin/aliases", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.UserAliasesHandler)))
+		mux.Handle("GET /api/admin/users/{id}/teams", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.UserTeamsHandler)))
+		mux.Handle("PUT /api/admin/users/{id}/team", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.SetUserTeamHandler)))
+		mux.Handle("POST /api/admin/teams/import", authMiddleware(adminToken, logger, http.HandlerFunc(handlers.ImportTeamsHandler)))
+	} else {
+		logger.Warn().Msg("ADMIN_TOKEN not set, admin API disabled")
+	}
+}
+
+// databaseDSN returns the configured database: DATABASE_URL when set, else DB_PATH
+func databaseDSN() string {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return dsn
+	}
+	return os.Getenv("DB_PATH")
+}
+
+// openDatabase opens the database for dsn: a PostgreSQL server for postgres://
+// URLs, otherwise the SQLite file at that path, creating its directory if needed
+func openDatabase(dsn string, opts SQLiteOptions) (*sql.DB, *sqlDialect, error) {
+	dialect, driver := dialectForDSN(dsn)
+	if dialect == postgresDialect {
+		db, err := sql.Open(driver, dsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open db: %w", err)
+		}
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("connect db: %w", err)
+		}
+		return db, dialect, nil
+	}
+
+	dbDir := ""
+	dbFile := dsn
+	if idx := strings.LastIndex(dbFile, "/"); idx != -1 {
+		dbDir = dbFile[:idx]
+	}
+	if dbDir != "" {
+		if _, err := os.Stat(dbDir); os.IsNotExist(err) {
+			if err := os.MkdirAll(dbDir, 0o755); err != nil {
+				return nil, nil, fmt.Errorf("create DB directory: %w", err)
+			}
+		}
+	}
+	if sqliteIsTemporary(dbFile) {
+		db, err := sql.Open(driver, dbFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open db: %w", err)
+		}
+		// every connection to a temporary database is a different database
+		db.SetMaxOpenConns(1)
+		return db, dialect, nil
+	}
+	db, err := sql.Open(driver, sqliteDSN(dbFile, opts, false))
+	if err != nil {
+		return nil, nil, fmt.Errorf("open db: %w", err)
+	}
+	return db, dialect, nil
+}
+
+// openStore opens the database for dsn and runs the store migrations. SQLite
+// files get a read pool and a writer goroutine as configured by opts; writer
+// and query metrics are registered on reg when non-nil.
+func openStore(dsn string, opts StoreOptions, reg prometheus.Registerer) (Store, error) {
+	db, dialect, err := openDatabase(dsn, opts.SQLite)
+	if err != nil {
+		return nil, err
+	}
+	var store *SQLStore
+	if dialect == sqliteDialect && !sqliteIsTemporary(dsn) {
+		store, err = openSQLiteStore(db, dsn, opts.SQLite, reg)
+	} else {
+		store, err = newSQLStore(db, dialect)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init store: %w", err)
+	}
+	store.instrument(opts.Query, opts.Logger, reg)
+	return store, nil
+}
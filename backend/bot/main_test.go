@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		role     string
+		flagArgs []string
+	}{
+		{nil, roleAll, nil},
+		{[]string{"-addr", ":9090"}, roleAll, []string{"-addr", ":9090"}},
+		{[]string{"serve-api", "-addr", ":9090"}, roleAPI, []string{"-addr", ":9090"}},
+		{[]string{"run-bot"}, roleBot, []string{}},
+		{[]string{"all"}, roleAll, []string{}},
+	} {
+		role, rest := parseRole(tc.args)
+		if role != tc.role || !slices.Equal(rest, tc.flagArgs) {
+			t.Errorf("parseRole(%q) = %q %q, want %q %q", tc.args, role, rest, tc.role, tc.flagArgs)
+		}
+	}
+}
+
+// TestAPIWithoutSlack runs the API the way serve-api does without a bot token
+func TestAPIWithoutSlack(t *testing.T) {
+	store := newTestStore(t)
+	ctx := t.Context()
+	if err := store.SaveWorkspace(ctx, Workspace{TeamID: "T1", Name: "Acme"}); err != nil {
+		t.Fatal(err)
+	}
+	handlers := NewAPIHandlers(store, nil, nil, nil, nil, nil, zerolog.Nop())
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, handlers, "api", "admin", zerolog.Nop())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health?check_slack=true", nil))
+	var health map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil || rec.Code != http.StatusOK || health["status"] != "healthy" {
+		t.Fatalf("unexpected health response: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := health["slack_connected"]; ok {
+		t.Fatal("expected no slack_connected without a Slack connection")
+	}
+
+	// users not synced yet can't be looked up
+	req := httptest.NewRequest(http.MethodGet, "/api/user?user=U404", nil)
+	req.Header.Set("Authorization", "Bearer api")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an uncached user, got %d", rec.Code)
+	}
+
+	// corrections default to the only recorded workspace
+	if got := handlers.defaultWorkspace(ctx); got != "T1" {
+		t.Fatalf("expected default workspace T1, got %q", got)
+	}
+	if err := store.SaveWorkspace(ctx, Workspace{TeamID: "T2", Name: "Beta"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := handlers.defaultWorkspace(ctx); got != "" {
+		t.Fatalf("expected no default workspace with several, got %q", got)
+	}
+
+	// replays need the bot's event processors
+	req = httptest.NewRequest(http.MethodPost, "/api/admin/dead-letters/1/replay", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected replay to be unavailable, got %d", rec.Code)
+	}
+}
+
+// TestBotDeadLetterRoutes serves dead letter replays the way run-bot does
+func TestBotDeadLetterRoutes(t *testing.T) {
+	store := newTestStore(t)
+	ep := NewEventProcessor(store, &RecordingSlack{}, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, nil)
+	ep.SetWorkspace("T1")
+	id, err := store.AddDeadLetter(t.Context(), "Ev1", []byte(testMessagePayload), "boom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerDeadLetterRoutes(mux, NewAPIHandlers(store, nil, nil, nil, ep, nil, zerolog.Nop()), "admin", zerolog.Nop())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/dead-letters/"+strconv.FormatInt(id, 10)+"/replay", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the bot to replay the dead letter, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the rest of the API stays with serve-api
+	req = httptest.NewRequest(http.MethodGet, "/api/admin/beers", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no other admin routes on the bot, got %d", rec.Code)
+	}
+}
@@ -35,3 +35,16 @@ func authMiddleware(apiToken string, logger zerolog.Logger, next http.Handler) h
 		next.ServeHTTP(w, r)
 	})
 }
+
+// workspaceMiddleware rejects requests whose workspace= query param is not a
+// Slack workspace or Enterprise Grid org id
+func workspaceMiddleware(logger zerolog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws := r.URL.Query().Get("workspace"); ws != "" && !workspaceIDPattern.MatchString(ws) {
+			logger.Warn().Str("path", r.URL.Path).Str("workspace", ws).Msg("invalid workspace parameter")
+			http.Error(w, "invalid workspace", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaMigration is a numbered, reversible schema change. Up and Down run
+// inside a transaction together with the schema_migrations bookkeeping, so a
+// failed migration leaves the database at the previous version.
+type schemaMigration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// MigrationState describes a known migration and whether it has been applied
+type MigrationState struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"applied_at,omitempty"`
+}
+
+// schemaMigrations is the ordered list of schema changes. Append new
+// migrations at the end with the next version number; never edit or reorder
+// migrations that have shipped.
+var schemaMigrations = []schemaMigration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      migrateInitialSchema,
+		Down: execStatements(
+			`DROP TABLE IF EXISTS beers;`,
+			`DROP TABLE IF EXISTS user_cache;`,
+			`DROP TABLE IF EXISTS processed_events;`,
+			`DROP TABLE IF EXISTS emoji_counts;`,
+		),
+	},
+	{
+		Version: 2,
+		Name:    "dead letter events",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS dead_letter_events (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				event_id TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				error TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL,
+				updated_at DATETIME NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_dead_letter_events_status ON dead_letter_events (status, id);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS dead_letter_events;`),
+	},
+	{
+		Version: 3,
+		Name:    "raw event log",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS event_log (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				event_id TEXT NOT NULL UNIQUE,
+				channel TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				ts TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				received_at DATETIME NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_event_log_ts ON event_log (ts);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS event_log;`),
+	},
+	{
+		Version: 4,
+		Name:    "processed events ts index",
+		Up:      execStatements(`CREATE INDEX IF NOT EXISTS idx_processed_events_ts ON processed_events (ts);`),
+		Down:    execStatements(`DROP INDEX IF EXISTS idx_processed_events_ts;`),
+	},
+	{
+		Version: 5,
+		Name:    "beer daily rollup",
+		Up:      execStatements(beerDailyRollupStatements...),
+		Down:    execStatements(`DROP TABLE IF EXISTS beer_daily;`),
+	},
+	{
+		Version: 6,
+		Name:    "beer source",
+		Up:      execStatements(`ALTER TABLE beers ADD COLUMN source TEXT NOT NULL DEFAULT 'slack';`),
+		Down:    execStatements(`ALTER TABLE beers DROP COLUMN source;`),
+	},
+	{
+		Version: 7,
+		Name:    "audit log",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS audit_log (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				created_at DATETIME NOT NULL,
+				actor TEXT NOT NULL,
+				action TEXT NOT NULL,
+				beer_id INTEGER,
+				giver_id TEXT NOT NULL DEFAULT '',
+				recipient_id TEXT NOT NULL DEFAULT '',
+				ts TEXT NOT NULL DEFAULT '',
+				beer_time TEXT NOT NULL DEFAULT '',
+				old_count INTEGER NOT NULL DEFAULT 0,
+				new_count INTEGER NOT NULL DEFAULT 0,
+				reason TEXT NOT NULL DEFAULT ''
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_audit_log_beer_id ON audit_log (beer_id);`,
+			`CREATE INDEX IF NOT EXISTS idx_audit_log_action_ts ON audit_log (action, ts);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS audit_log;`),
+	},
+	{
+		Version: 8,
+		Name:    "beer revocation",
+		Up: execStatements(
+			`ALTER TABLE beers ADD COLUMN revoked_at DATETIME;`,
+			`ALTER TABLE beers ADD COLUMN revoked_by TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE beers ADD COLUMN revoke_reason TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE beer_daily ADD COLUMN revoked INTEGER NOT NULL DEFAULT 0;`,
+		),
+		// older versions can't tell revoked beers apart, so they are dropped
+		Down: execStatements(
+			`DELETE FROM beer_daily WHERE count = 0;`,
+			`ALTER TABLE beer_daily DROP COLUMN revoked;`,
+			`DELETE FROM beers WHERE revoked_at IS NOT NULL;`,
+			`ALTER TABLE beers DROP COLUMN revoke_reason;`,
+			`ALTER TABLE beers DROP COLUMN revoked_by;`,
+			`ALTER TABLE beers DROP COLUMN revoked_at;`,
+		),
+	},
+	{
+		Version: 9,
+		Name:    "user directory",
+		Up: execStatements(
+			`ALTER TABLE user_cache ADD COLUMN display_name TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN title TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN tz TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN email TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN is_bot INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE user_cache ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE user_cache ADD COLUMN profile TEXT NOT NULL DEFAULT '{}';`,
+			`ALTER TABLE user_cache ADD COLUMN synced_at TEXT NOT NULL DEFAULT '';`,
+		),
+		Down: execStatements(
+			`ALTER TABLE user_cache DROP COLUMN synced_at;`,
+			`ALTER TABLE user_cache DROP COLUMN profile;`,
+			`ALTER TABLE user_cache DROP COLUMN deleted;`,
+			`ALTER TABLE user_cache DROP COLUMN is_bot;`,
+			`ALTER TABLE user_cache DROP COLUMN email;`,
+			`ALTER TABLE user_cache DROP COLUMN tz;`,
+			`ALTER TABLE user_cache DROP COLUMN title;`,
+			`ALTER TABLE user_cache DROP COLUMN display_name;`,
+		),
+	},
+	{
+		Version: 10,
+		Name:    "guest users",
+		Up: execStatements(
+			`ALTER TABLE user_cache ADD COLUMN guest INTEGER NOT NULL DEFAULT 0;`,
+			`CREATE INDEX IF NOT EXISTS idx_user_cache_deleted ON user_cache (deleted);`,
+		),
+		Down: execStatements(
+			`DROP INDEX IF EXISTS idx_user_cache_deleted;`,
+			`ALTER TABLE user_cache DROP COLUMN guest;`,
+		),
+	},
+	{
+		Version: 11,
+		Name:    "team memberships",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS team_members (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT NOT NULL,
+				team TEXT NOT NULL,
+				valid_from TEXT NOT NULL,
+				valid_to TEXT,
+				source TEXT NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_team_members_user_from ON team_members (user_id, valid_from);`,
+			`CREATE INDEX IF NOT EXISTS idx_team_members_team ON team_members (team);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS team_members;`),
+	},
+	{
+		Version: 12,
+		Name:    "privacy opt-outs",
+		Up: execStatements(`CREATE TABLE IF NOT EXISTS user_privacy (
+			user_id TEXT PRIMARY KEY,
+			opted_out_at TEXT NOT NULL
+		);`),
+		Down: execStatements(`DROP TABLE IF EXISTS user_privacy;`),
+	},
+	{
+		Version: 13,
+		Name:    "user aliases",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS user_aliases (
+				alias_id TEXT PRIMARY KEY,
+				canonical_id TEXT NOT NULL,
+				merged_at TEXT NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_user_aliases_canonical ON user_aliases (canonical_id);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS user_aliases;`),
+	},
+	{
+		Version: 14,
+		Name:    "workspaces",
+		Up: execStatements(
+			`ALTER TABLE beers ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE processed_events ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE event_log ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`CREATE TABLE IF NOT EXISTS workspaces (
+				team_id TEXT PRIMARY KEY,
+				name TEXT NOT NULL DEFAULT '',
+				enterprise_id TEXT NOT NULL DEFAULT '',
+				updated_at TEXT NOT NULL
+			);`,
+			// the rollup is keyed by workspace too; it is derived, so rebuild it
+			`DROP TABLE IF EXISTS beer_daily;`,
+			`CREATE TABLE beer_daily (
+				day TEXT NOT NULL,
+				team_id TEXT NOT NULL,
+				giver_id TEXT NOT NULL,
+				recipient_id TEXT NOT NULL,
+				count INTEGER NOT NULL,
+				revoked INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (day, team_id, giver_id, recipient_id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_giver_day ON beer_daily (giver_id, day);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_recipient_day ON beer_daily (recipient_id, day);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_team_day ON beer_daily (team_id, day);`,
+			`INSERT INTO beer_daily (day, team_id, giver_id, recipient_id, count, revoked)
+				SELECT substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id),
+					SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END),
+					SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END)
+				FROM beers
+				LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+				LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+				GROUP BY substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+				HAVING SUM(count) <> 0;`,
+		),
+		Down: execStatements(
+			`DROP TABLE IF EXISTS beer_daily;`,
+			`CREATE TABLE beer_daily (
+				day TEXT NOT NULL,
+				giver_id TEXT NOT NULL,
+				recipient_id TEXT NOT NULL,
+				count INTEGER NOT NULL,
+				revoked INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (day, giver_id, recipient_id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_giver_day ON beer_daily (giver_id, day);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_recipient_day ON beer_daily (recipient_id, day);`,
+			`INSERT INTO beer_daily (day, giver_id, recipient_id, count, revoked)
+				SELECT substr(ts_rfc, 1, 10), COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id),
+					SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END),
+					SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END)
+				FROM beers
+				LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+				LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+				GROUP BY substr(ts_rfc, 1, 10), COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+				HAVING SUM(count) <> 0;`,
+			`DROP TABLE IF EXISTS workspaces;`,
+			`ALTER TABLE event_log DROP COLUMN team_id;`,
+			`ALTER TABLE processed_events DROP COLUMN team_id;`,
+			`ALTER TABLE user_cache DROP COLUMN team_id;`,
+			`ALTER TABLE beers DROP COLUMN team_id;`,
+		),
+	},
+	{
+		Version: 15,
+		Name:    "event log user index",
+		Up:      execStatements(`CREATE INDEX IF NOT EXISTS idx_event_log_user_ts ON event_log (user_id, ts);`),
+		Down:    execStatements(`DROP INDEX IF EXISTS idx_event_log_user_ts;`),
+	},
+	{
+		Version: 16,
+		Name:    "drop merged self pairs",
+		// beers between two IDs of a merged user are not a gift to oneself;
+		// down puts their rollup rows back
+		Up: execStatements(`DELETE FROM beer_daily WHERE giver_id = recipient_id;`),
+		Down: execStatements(`INSERT INTO beer_daily (day, team_id, giver_id, recipient_id, count, revoked)
+			SELECT substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id),
+				SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END),
+				SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END)
+			FROM beers
+			LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+			LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+			WHERE COALESCE(ga.canonical_id, giver_id) = COALESCE(ra.canonical_id, recipient_id)
+			GROUP BY substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+			HAVING SUM(count) <> 0;`),
+	},
+}
+
+// execStatements returns a migration step that runs each statement in order
+func execStatements(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, st := range stmts {
+			if _, err := tx.Exec(st); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// beersCreateStatement creates the beers table under the given name
+func beersCreateStatement(table string) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		giver_id TEXT NOT NULL,
+		recipient_id TEXT NOT NULL,
+		ts TEXT NOT NULL, -- original Slack ts string (with fraction)
+		ts_rfc DATETIME NOT NULL, -- parsed RFC3339 time for date queries
+		count INTEGER NOT NULL DEFAULT 1,
+		UNIQUE (giver_id, recipient_id, ts)
+	);`, table)
+}
+
+// slackTsToRFC3339 is the SQL expression deriving ts_rfc from a Slack ts column
+const slackTsToRFC3339 = `strftime('%Y-%m-%dT%H:%M:%SZ', CAST(substr(ts, 1, instr(ts || '.', '.') - 1) AS INTEGER), 'unixepoch')`
+
+// migrateInitialSchema creates the original tables. Databases created before
+// versioned migrations existed may already have them, possibly with an older
+// beers layout; those are brought up to the current layout here, once.
+func migrateInitialSchema(tx *sql.Tx) error {
+	aux := []string{
+		`CREATE TABLE IF NOT EXISTS emoji_counts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			emoji TEXT NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			UNIQUE(user_id, emoji)
+		);`,
+		`CREATE TABLE IF NOT EXISTS processed_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id TEXT NOT NULL UNIQUE,
+			ts TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_cache (
+			user_id TEXT PRIMARY KEY,
+			real_name TEXT NOT NULL,
+			profile_image TEXT,
+			updated_at DATETIME NOT NULL
+		);`,
+	}
+	if err := execStatements(aux...)(tx); err != nil {
+		return fmt.Errorf("create aux tables: %w", err)
+	}
+
+	var createSQL sql.NullString
+	err := tx.QueryRow(`SELECT sql FROM sqlite_master WHERE type='table' AND name='beers'`).Scan(&createSQL)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.Exec(beersCreateStatement("beers")); err != nil {
+			return fmt.Errorf("create beers: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("check beers exists: %w", err)
+	default:
+		if err := adoptLegacyBeers(tx, createSQL.String); err != nil {
+			return err
+		}
+	}
+
+	return execStatements(
+		`CREATE INDEX IF NOT EXISTS idx_beers_giver_id_ts_rfc ON beers (giver_id, ts_rfc);`,
+		`CREATE INDEX IF NOT EXISTS idx_beers_recipient_id_ts_rfc ON beers (recipient_id, ts_rfc);`,
+		`CREATE INDEX IF NOT EXISTS idx_beers_emoji_ts_rfc ON beers (ts_rfc);`,
+		`CREATE INDEX IF NOT EXISTS idx_emoji_counts_user_id_emoji ON emoji_counts (user_id, emoji);`,
+	)(tx)
+}
+
+// adoptLegacyBeers upgrades a pre-existing beers table: it adds missing
+// columns and, if the UNIQUE(giver_id, recipient_id, ts) constraint is
+// missing, rebuilds the table with duplicate rows aggregated.
+func adoptLegacyBeers(tx *sql.Tx, createSQL string) error {
+	cols := map[string]bool{}
+	rows, err := tx.Query(`PRAGMA table_info(beers);`)
+	if err != nil {
+		return fmt.Errorf("beers table info: %w", err)
+	}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("beers table info scan: %w", err)
+		}
+		cols[name] = true
+	}
+	rows.Close()
+
+	if !cols["ts_rfc"] {
+		if _, err := tx.Exec(`ALTER TABLE beers ADD COLUMN ts_rfc DATETIME;`); err != nil {
+			return fmt.Errorf("add ts_rfc: %w", err)
+		}
+	}
+	if !cols["count"] {
+		if _, err := tx.Exec(`ALTER TABLE beers ADD COLUMN count INTEGER NOT NULL DEFAULT 1;`); err != nil {
+			return fmt.Errorf("add count: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE beers SET ts_rfc = ` + slackTsToRFC3339 + ` WHERE ts_rfc IS NULL;`); err != nil {
+		return fmt.Errorf("backfill ts_rfc: %w", err)
+	}
+
+	if strings.Contains(strings.ToUpper(createSQL), "UNIQUE") {
+		return nil
+	}
+
+	// SQLite can't add a UNIQUE constraint with ALTER, so build the new table
+	// alongside, copy the aggregated rows, and swap it in under the old name.
+	steps := []string{
+		beersCreateStatement("beers_new"),
+		`INSERT INTO beers_new (giver_id, recipient_id, ts, ts_rfc, count)
+			SELECT giver_id, recipient_id, ts, MAX(ts_rfc), SUM(count)
+			FROM beers GROUP BY giver_id, recipient_id, ts;`,
+		`DROP TABLE beers;`,
+		`ALTER TABLE beers_new RENAME TO beers;`,
+	}
+	if err := execStatements(steps...)(tx); err != nil {
+		return fmt.Errorf("rebuild beers with unique constraint: %w", err)
+	}
+	return nil
+}
+
+// ensureMigrationsTable creates the schema_migrations bookkeeping table
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);`)
+	return err
+}
+
+// appliedMigrations returns the applied versions and when they were applied
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version], _ = time.Parse(time.RFC3339, appliedAt)
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every migration known to the dialect and whether it is applied
+func MigrationStatus(db *sql.DB, d *sqlDialect) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]MigrationState, 0, len(d.migrations))
+	for _, m := range d.migrations {
+		at, ok := applied[m.Version]
+		out = append(out, MigrationState{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: at})
+	}
+	return out, nil
+}
+
+// MigrateTo moves the schema to the target version, applying pending up
+// migrations in order or reverting applied ones in reverse order. If any
+// migration will run and the database already holds tables, the dialect's
+// backup is taken first; for SQLite that is a copy written to backupDir
+// (default: next to the database file). It returns the backup path, if one
+// was written. Processes starting together may both call it: PostgreSQL
+// holds an advisory lock for the whole run, and on SQLite each migration
+// checks again in its transaction whether another process applied it.
+func MigrateTo(db *sql.DB, d *sqlDialect, target int, backupDir string) (string, error) {
+	if target < 0 || target > d.latestVersion() {
+		return "", fmt.Errorf("unknown schema version %d (latest is %d)", target, d.latestVersion())
+	}
+	if d.lockMigrations != nil {
+		unlock, err := d.lockMigrations(db)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return "", err
+	}
+
+	var plan []schemaMigration
+	down := false
+	for _, m := range d.migrations {
+		if _, ok := applied[m.Version]; !ok && m.Version <= target {
+			plan = append(plan, m)
+		}
+	}
+	if len(plan) == 0 {
+		for _, m := range d.migrations {
+			if _, ok := applied[m.Version]; ok && m.Version > target {
+				plan = append(plan, m)
+			}
+		}
+		sort.Slice(plan, func(i, j int) bool { return plan[i].Version > plan[j].Version })
+		down = true
+	}
+	if len(plan) == 0 {
+		return "", nil
+	}
+
+	backupPath := ""
+	if d.hasUserTables(db) {
+		label := fmt.Sprintf("pre-migrate-v%d", currentVersion(applied))
+		if backupPath, err = d.backup(db, backupDir, label); err != nil {
+			return "", fmt.Errorf("pre-migration backup: %w", err)
+		}
+	}
+
+	for _, m := range plan {
+		if err := runMigration(db, d, m, down); err != nil {
+			return backupPath, err
+		}
+	}
+	return backupPath, nil
+}
+
+// runMigration applies or reverts a single migration in its own transaction
+func runMigration(db *sql.DB, d *sqlDialect, m schemaMigration, down bool) error {
+	direction := "up"
+	step := m.Up
+	if down {
+		direction = "down"
+		step = m.Down
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("migration %d begin: %w", m.Version, err)
+	}
+	defer tx.Rollback()
+
+	// another process may have run the migration since the plan was made
+	var done int
+	if err := tx.QueryRow(d.rebind(`SELECT COUNT(1) FROM schema_migrations WHERE version = ?`), m.Version).Scan(&done); err != nil {
+		return fmt.Errorf("migration %d check: %w", m.Version, err)
+	}
+	if (done > 0) != down {
+		return nil
+	}
+
+	if err := step(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) %s: %w", m.Version, m.Name, direction, err)
+	}
+	if down {
+		_, err = tx.Exec(d.rebind(`DELETE FROM schema_migrations WHERE version = ?`), m.Version)
+	} else {
+		_, err = tx.Exec(d.rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`), m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d record: %w", m.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d commit: %w", m.Version, err)
+	}
+	return nil
+}
+
+// currentVersion returns the highest applied version, or 0
+func currentVersion(applied map[int]time.Time) int {
+	v := 0
+	for version := range applied {
+		if version > v {
+			v = version
+		}
+	}
+	return v
+}
+
+// sqliteHasUserTables reports whether the database holds any tables besides
+// the migration bookkeeping, i.e. whether there is anything worth backing up
+func sqliteHasUserTables(db *sql.DB) bool {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name <> 'schema_migrations'`).Scan(&n)
+	return err == nil && n > 0
+}
+
+// databaseFile returns the path of the main database file, or "" for in-memory databases
+func databaseFile(db *sql.DB) (string, error) {
+	var seq int
+	var name, file string
+	if err := db.QueryRow(`PRAGMA database_list`).Scan(&seq, &name, &file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// backupDatabase writes a consistent copy of the database using VACUUM INTO.
+// The copy is named <db>.<label>-<timestamp>.bak and placed in dir, or next
+// to the database file when dir is empty. In-memory databases are skipped.
+func backupDatabase(db *sql.DB, dir, label string) (string, error) {
+	file, err := databaseFile(db)
+	if err != nil {
+		return "", err
+	}
+	if file == "" {
+		return "", nil
+	}
+	if dir == "" {
+		dir = filepath.Dir(file)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, fmt.Sprintf("%s.%s-%s.bak", filepath.Base(file), label, time.Now().UTC().Format("20060102T150405Z")))
+	if _, err := db.Exec(`VACUUM INTO ?`, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// runMigrateCommand implements `bot migrate status|up|down`
+func runMigrateCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: bot migrate status|up|down [flags]")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("migrate "+action, flag.ExitOnError)
+	dsn := fs.String("db", databaseDSN(), "sqlite database path or postgres:// URL")
+	to := fs.Int("to", -1, "target schema version (up: default latest, down: default one step back)")
+	backupDir := fs.String("backup-dir", os.Getenv("BACKUP_DIR"), "directory for the pre-migration backup (default: next to the database)")
+	_ = fs.Parse(args[1:])
+
+	db, dialect, err := openDatabase(*dsn, sqliteOptionsFromEnv())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer db.Close()
+
+	states, err := MigrationStatus(db, dialect)
+	if err != nil {
+		log.Fatalf("migration status: %v", err)
+	}
+	current := 0
+	for _, st := range states {
+		if st.Applied && st.Version > current {
+			current = st.Version
+		}
+	}
+
+	var target int
+	switch action {
+	case "status":
+		fmt.Printf("schema version %d (latest %d)\n", current, dialect.latestVersion())
+		for _, st := range states {
+			if st.Applied {
+				fmt.Printf("  [x] %3d %-30s applied %s\n", st.Version, st.Name, st.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("  [ ] %3d %s\n", st.Version, st.Name)
+			}
+		}
+		return
+	case "up":
+		target = dialect.latestVersion()
+		if *to >= 0 {
+			target = *to
+		}
+		if target < current {
+			log.Fatalf("target version %d is below current version %d; use migrate down", target, current)
+		}
+	case "down":
+		target = current - 1
+		if *to >= 0 {
+			target = *to
+		}
+		if target < 0 || target > current {
+			log.Fatalf("target version %d must be between 0 and current version %d", target, current)
+		}
+	default:
+		log.Fatalf("unknown migrate action %q (want status, up or down)", action)
+	}
+
+	if target == current {
+		fmt.Printf("schema already at version %d\n", current)
+		return
+	}
+	backup, err := MigrateTo(db, dialect, target, *backupDir)
+	if backup != "" {
+		fmt.Printf("backup written to %s\n", backup)
+	}
+	if err != nil {
+		log.Fatalf("migrate %s: %v", action, err)
+	}
+	fmt.Printf("schema migrated from version %d to %d\n", current, target)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// postgresMigrations mirrors schemaMigrations for PostgreSQL: same versions
+// and names, so both backends report the same schema version. Timestamps are
+// stored as RFC3339 text like on SQLite, which keeps the store queries portable.
+var postgresMigrations = []schemaMigration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS emoji_counts (
+				id BIGSERIAL PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				emoji TEXT NOT NULL,
+				count INTEGER NOT NULL DEFAULT 0,
+				UNIQUE (user_id, emoji)
+			);`,
+			`CREATE TABLE IF NOT EXISTS processed_events (
+				id BIGSERIAL PRIMARY KEY,
+				event_id TEXT NOT NULL UNIQUE,
+				ts TEXT NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS user_cache (
+				user_id TEXT PRIMARY KEY,
+				real_name TEXT NOT NULL,
+				profile_image TEXT,
+				updated_at TEXT NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS beers (
+				id BIGSERIAL PRIMARY KEY,
+				giver_id TEXT NOT NULL,
+				recipient_id TEXT NOT NULL,
+				ts TEXT NOT NULL,
+				ts_rfc TEXT NOT NULL,
+				count INTEGER NOT NULL DEFAULT 1,
+				UNIQUE (giver_id, recipient_id, ts)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_beers_giver_id_ts_rfc ON beers (giver_id, ts_rfc);`,
+			`CREATE INDEX IF NOT EXISTS idx_beers_recipient_id_ts_rfc ON beers (recipient_id, ts_rfc);`,
+			`CREATE INDEX IF NOT EXISTS idx_beers_emoji_ts_rfc ON beers (ts_rfc);`,
+		),
+		Down: execStatements(
+			`DROP TABLE IF EXISTS beers;`,
+			`DROP TABLE IF EXISTS user_cache;`,
+			`DROP TABLE IF EXISTS processed_events;`,
+			`DROP TABLE IF EXISTS emoji_counts;`,
+		),
+	},
+	{
+		Version: 2,
+		Name:    "dead letter events",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS dead_letter_events (
+				id BIGSERIAL PRIMARY KEY,
+				event_id TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				error TEXT NOT NULL,
+				status TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				created_at TEXT NOT NULL,
+				updated_at TEXT NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_dead_letter_events_status ON dead_letter_events (status, id);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS dead_letter_events;`),
+	},
+	{
+		Version: 3,
+		Name:    "raw event log",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS event_log (
+				id BIGSERIAL PRIMARY KEY,
+				event_id TEXT NOT NULL UNIQUE,
+				channel TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				ts TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				received_at TEXT NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_event_log_ts ON event_log (ts);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS event_log;`),
+	},
+	{
+		Version: 4,
+		Name:    "processed events ts index",
+		Up:      execStatements(`CREATE INDEX IF NOT EXISTS idx_processed_events_ts ON processed_events (ts);`),
+		Down:    execStatements(`DROP INDEX IF EXISTS idx_processed_events_ts;`),
+	},
+	{
+		Version: 5,
+		Name:    "beer daily rollup",
+		Up:      execStatements(beerDailyRollupStatements...),
+		Down:    execStatements(`DROP TABLE IF EXISTS beer_daily;`),
+	},
+	{
+		Version: 6,
+		Name:    "beer source",
+		Up:      execStatements(`ALTER TABLE beers ADD COLUMN source TEXT NOT NULL DEFAULT 'slack';`),
+		Down:    execStatements(`ALTER TABLE beers DROP COLUMN source;`),
+	},
+	{
+		Version: 7,
+		Name:    "audit log",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS audit_log (
+				id BIGSERIAL PRIMARY KEY,
+				created_at TEXT NOT NULL,
+				actor TEXT NOT NULL,
+				action TEXT NOT NULL,
+				beer_id BIGINT,
+				giver_id TEXT NOT NULL DEFAULT '',
+				recipient_id TEXT NOT NULL DEFAULT '',
+				ts TEXT NOT NULL DEFAULT '',
+				beer_time TEXT NOT NULL DEFAULT '',
+				old_count INTEGER NOT NULL DEFAULT 0,
+				new_count INTEGER NOT NULL DEFAULT 0,
+				reason TEXT NOT NULL DEFAULT ''
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_audit_log_beer_id ON audit_log (beer_id);`,
+			`CREATE INDEX IF NOT EXISTS idx_audit_log_action_ts ON audit_log (action, ts);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS audit_log;`),
+	},
+	{
+		Version: 8,
+		Name:    "beer revocation",
+		Up: execStatements(
+			`ALTER TABLE beers ADD COLUMN revoked_at TEXT;`,
+			`ALTER TABLE beers ADD COLUMN revoked_by TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE beers ADD COLUMN revoke_reason TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE beer_daily ADD COLUMN revoked INTEGER NOT NULL DEFAULT 0;`,
+		),
+		// older versions can't tell revoked beers apart, so they are dropped
+		Down: execStatements(
+			`DELETE FROM beer_daily WHERE count = 0;`,
+			`ALTER TABLE beer_daily DROP COLUMN revoked;`,
+			`DELETE FROM beers WHERE revoked_at IS NOT NULL;`,
+			`ALTER TABLE beers DROP COLUMN revoke_reason;`,
+			`ALTER TABLE beers DROP COLUMN revoked_by;`,
+			`ALTER TABLE beers DROP COLUMN revoked_at;`,
+		),
+	},
+	{
+		Version: 9,
+		Name:    "user directory",
+		Up: execStatements(
+			`ALTER TABLE user_cache ADD COLUMN display_name TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN title TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN tz TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN email TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;`,
+			`ALTER TABLE user_cache ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT FALSE;`,
+			`ALTER TABLE user_cache ADD COLUMN profile TEXT NOT NULL DEFAULT '{}';`,
+			`ALTER TABLE user_cache ADD COLUMN synced_at TEXT NOT NULL DEFAULT '';`,
+		),
+		Down: execStatements(
+			`ALTER TABLE user_cache DROP COLUMN synced_at;`,
+			`ALTER TABLE user_cache DROP COLUMN profile;`,
+			`ALTER TABLE user_cache DROP COLUMN deleted;`,
+			`ALTER TABLE user_cache DROP COLUMN is_bot;`,
+			`ALTER TABLE user_cache DROP COLUMN email;`,
+			`ALTER TABLE user_cache DROP COLUMN tz;`,
+			`ALTER TABLE user_cache DROP COLUMN title;`,
+			`ALTER TABLE user_cache DROP COLUMN display_name;`,
+		),
+	},
+	{
+		Version: 10,
+		Name:    "guest users",
+		Up: execStatements(
+			`ALTER TABLE user_cache ADD COLUMN guest BOOLEAN NOT NULL DEFAULT FALSE;`,
+			`CREATE INDEX IF NOT EXISTS idx_user_cache_deleted ON user_cache (deleted);`,
+		),
+		Down: execStatements(
+			`DROP INDEX IF EXISTS idx_user_cache_deleted;`,
+			`ALTER TABLE user_cache DROP COLUMN guest;`,
+		),
+	},
+	{
+		Version: 11,
+		Name:    "team memberships",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS team_members (
+				id BIGSERIAL PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				team TEXT NOT NULL,
+				valid_from TEXT NOT NULL,
+				valid_to TEXT,
+				source TEXT NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_team_members_user_from ON team_members (user_id, valid_from);`,
+			`CREATE INDEX IF NOT EXISTS idx_team_members_team ON team_members (team);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS team_members;`),
+	},
+	{
+		Version: 12,
+		Name:    "privacy opt-outs",
+		Up: execStatements(`CREATE TABLE IF NOT EXISTS user_privacy (
+			user_id TEXT PRIMARY KEY,
+			opted_out_at TEXT NOT NULL
+		);`),
+		Down: execStatements(`DROP TABLE IF EXISTS user_privacy;`),
+	},
+	{
+		Version: 13,
+		Name:    "user aliases",
+		Up: execStatements(
+			`CREATE TABLE IF NOT EXISTS user_aliases (
+				alias_id TEXT PRIMARY KEY,
+				canonical_id TEXT NOT NULL,
+				merged_at TEXT NOT NULL
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_user_aliases_canonical ON user_aliases (canonical_id);`,
+		),
+		Down: execStatements(`DROP TABLE IF EXISTS user_aliases;`),
+	},
+	{
+		Version: 14,
+		Name:    "workspaces",
+		Up: execStatements(
+			`ALTER TABLE beers ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE user_cache ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE processed_events ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE event_log ADD COLUMN team_id TEXT NOT NULL DEFAULT '';`,
+			`CREATE TABLE IF NOT EXISTS workspaces (
+				team_id TEXT PRIMARY KEY,
+				name TEXT NOT NULL DEFAULT '',
+				enterprise_id TEXT NOT NULL DEFAULT '',
+				updated_at TEXT NOT NULL
+			);`,
+			// the rollup is keyed by workspace too; it is derived, so rebuild it
+			`DROP TABLE IF EXISTS beer_daily;`,
+			`CREATE TABLE beer_daily (
+				day TEXT NOT NULL,
+				team_id TEXT NOT NULL,
+				giver_id TEXT NOT NULL,
+				recipient_id TEXT NOT NULL,
+				count INTEGER NOT NULL,
+				revoked INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (day, team_id, giver_id, recipient_id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_giver_day ON beer_daily (giver_id, day);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_recipient_day ON beer_daily (recipient_id, day);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_team_day ON beer_daily (team_id, day);`,
+			`INSERT INTO beer_daily (day, team_id, giver_id, recipient_id, count, revoked)
+				SELECT substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id),
+					SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END),
+					SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END)
+				FROM beers
+				LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+				LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+				GROUP BY substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+				HAVING SUM(count) <> 0;`,
+		),
+		Down: execStatements(
+			`DROP TABLE IF EXISTS beer_daily;`,
+			`CREATE TABLE beer_daily (
+				day TEXT NOT NULL,
+				giver_id TEXT NOT NULL,
+				recipient_id TEXT NOT NULL,
+				count INTEGER NOT NULL,
+				revoked INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (day, giver_id, recipient_id)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_giver_day ON beer_daily (giver_id, day);`,
+			`CREATE INDEX IF NOT EXISTS idx_beer_daily_recipient_day ON beer_daily (recipient_id, day);`,
+			`INSERT INTO beer_daily (day, giver_id, recipient_id, count, revoked)
+				SELECT substr(ts_rfc, 1, 10), COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id),
+					SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END),
+					SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END)
+				FROM beers
+				LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+				LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+				GROUP BY substr(ts_rfc, 1, 10), COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+				HAVING SUM(count) <> 0;`,
+			`DROP TABLE IF EXISTS workspaces;`,
+			`ALTER TABLE event_log DROP COLUMN team_id;`,
+			`ALTER TABLE processed_events DROP COLUMN team_id;`,
+			`ALTER TABLE user_cache DROP COLUMN team_id;`,
+			`ALTER TABLE beers DROP COLUMN team_id;`,
+		),
+	},
+	{
+		Version: 15,
+		Name:    "event log user index",
+		Up:      execStatements(`CREATE INDEX IF NOT EXISTS idx_event_log_user_ts ON event_log (user_id, ts);`),
+		Down:    execStatements(`DROP INDEX IF EXISTS idx_event_log_user_ts;`),
+	},
+	{
+		Version: 16,
+		Name:    "drop merged self pairs",
+		// beers between two IDs of a merged user are not a gift to oneself;
+		// down puts their rollup rows back
+		Up: execStatements(`DELETE FROM beer_daily WHERE giver_id = recipient_id;`),
+		Down: execStatements(`INSERT INTO beer_daily (day, team_id, giver_id, recipient_id, count, revoked)
+			SELECT substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id),
+				SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END),
+				SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END)
+			FROM beers
+			LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+			LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+			WHERE COALESCE(ga.canonical_id, giver_id) = COALESCE(ra.canonical_id, recipient_id)
+			GROUP BY substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+			HAVING SUM(count) <> 0;`),
+	},
+}
+
+// postgresMigrationLock is the advisory lock key held while migrating. The
+// value is arbitrary but must stay the same across releases.
+const postgresMigrationLock = 4242_1337
+
+// postgresLockMigrations takes a session advisory lock on a connection of its
+// own, so replicas starting together apply migrations one at a time
+func postgresLockMigrations(db *sql.DB) (func(), error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("lock migrations: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("lock migrations: %w", err)
+	}
+	return func() {
+		_, _ = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+		conn.Close()
+	}, nil
+}
+
+// postgresHasUserTables reports whether the current schema holds any tables
+// besides the migration bookkeeping
+func postgresHasUserTables(db *sql.DB) bool {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`).Scan(&n)
+	return err == nil && n > 0
+}
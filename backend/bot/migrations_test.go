@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrations_AdoptLegacyBeers(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "legacy.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	// a database from before ts_rfc, count and the unique constraint existed
+	legacy := []string{
+		`CREATE TABLE beers (id INTEGER PRIMARY KEY AUTOINCREMENT, giver_id TEXT NOT NULL, recipient_id TEXT NOT NULL, ts TEXT NOT NULL);`,
+		`INSERT INTO beers (giver_id, recipient_id, ts) VALUES ('U1', 'U2', '1700000000.000100');`,
+		`INSERT INTO beers (giver_id, recipient_id, ts) VALUES ('U1', 'U2', '1700000000.000100');`,
+		`INSERT INTO beers (giver_id, recipient_id, ts) VALUES ('U1', 'U3', '1700000000.000100');`,
+	}
+	for _, st := range legacy {
+		if _, err := db.Exec(st); err != nil {
+			t.Fatalf("legacy setup: %v", err)
+		}
+	}
+
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	day, _ := time.Parse("2006-01-02", "2023-11-14")
+	if got, err := store.CountReceivedInDateRange(t.Context(), "U2", day, day, StatsOptions{}); err != nil || got != 2 {
+		t.Fatalf("expected duplicates aggregated to 2, got %d %v", got, err)
+	}
+	if err := store.AddBeer(t.Context(), "", "U1", "U2", "1700000000.000100", day, 5); err != nil {
+		t.Fatalf("upsert after adoption: %v", err)
+	}
+
+	var leftovers int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE name IN ('beers_new', 'beers_old')`).Scan(&leftovers); err != nil || leftovers != 0 {
+		t.Fatalf("expected no leftover tables, got %d %v", leftovers, err)
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "legacy.db.pre-migrate-v0-*.bak"))
+	if len(backups) != 1 {
+		t.Fatalf("expected one pre-migration backup, got %v", backups)
+	}
+}
+
+func TestMigrations_DownAndUp(t *testing.T) {
+	store := newTestStore(t)
+
+	states, err := MigrationStatus(store.db, sqliteDialect)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	for _, st := range states {
+		if !st.Applied {
+			t.Fatalf("migration %d not applied on a fresh store", st.Version)
+		}
+	}
+
+	backupDir := t.TempDir()
+	if _, err := MigrateTo(store.db, sqliteDialect, 1, backupDir); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	var n int
+	if err := store.db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='event_log'`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("event_log should be dropped, got %d %v", n, err)
+	}
+	if entries, _ := os.ReadDir(backupDir); len(entries) != 1 {
+		t.Fatalf("expected a backup before migrating down, got %d files", len(entries))
+	}
+
+	if _, err := MigrateTo(store.db, sqliteDialect, sqliteDialect.latestVersion(), backupDir); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	if err := store.AppendEventLog(t.Context(), "", "e1", "C1", "U1", "1.0", []byte(`{}`)); err != nil {
+		t.Fatalf("event log after re-applying: %v", err)
+	}
+
+	if _, err := MigrateTo(store.db, sqliteDialect, sqliteDialect.latestVersion()+1, ""); err == nil {
+		t.Fatalf("expected error for unknown version")
+	}
+}
+
+func TestMigrations_MergedSelfPairs(t *testing.T) {
+	store := newTestStore(t)
+	day, _ := time.Parse("2006-01-02", "2023-11-14")
+	for _, b := range []struct{ giver, recipient, ts string }{{"U1", "U2", "1700000000.000100"}, {"U1", "U3", "1700000000.000200"}} {
+		if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, day, 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+	}
+	if _, err := store.MergeUsers(t.Context(), "U1", "U2", "admin", "new account"); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	selfPairs := func() int {
+		var n int
+		if err := store.db.QueryRow(`SELECT COUNT(1) FROM beer_daily WHERE giver_id = recipient_id`).Scan(&n); err != nil {
+			t.Fatalf("count self pairs: %v", err)
+		}
+		return n
+	}
+
+	// before v16 the rollup kept the merged beer as a U2→U2 row
+	if _, err := MigrateTo(store.db, sqliteDialect, 15, ""); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	if n := selfPairs(); n != 1 {
+		t.Fatalf("expected the self pair restored, got %d", n)
+	}
+	if _, err := MigrateTo(store.db, sqliteDialect, 16, ""); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	if n := selfPairs(); n != 0 {
+		t.Fatalf("expected no self pairs, got %d", n)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("unexpected drift %d: %v", drift, err)
+	}
+}
+
+func TestMigrations_ConcurrentStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.db")
+	opts := SQLiteOptions{BusyTimeout: 5 * time.Second}
+
+	// two processes starting against the same database at once
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		db, err := sql.Open("sqlite3", sqliteDSN(path, opts, false))
+		if err != nil {
+			t.Fatalf("open db: %v", err)
+		}
+		defer db.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = MigrateTo(db, sqliteDialect, sqliteDialect.latestVersion(), t.TempDir())
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", sqliteDSN(path, opts, false))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM schema_migrations`).Scan(&n); err != nil || n != len(sqliteDialect.migrations) {
+		t.Fatalf("expected every migration recorded once, got %d %v", n, err)
+	}
+}
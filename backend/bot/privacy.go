@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// handleSlashCommand answers the bot's slash command, which lets users opt
+// out of public leaderboards: `/beer opt-out`, `/beer opt-in` or `/beer status`
+func (ep *EventProcessor) handleSlashCommand(ctx context.Context, req socketmode.Request, cmd slack.SlashCommand) {
+	var text string
+	fields := strings.Fields(strings.ToLower(cmd.Text))
+	sub := ""
+	if len(fields) > 0 {
+		sub = fields[0]
+	}
+	switch sub {
+	case "opt-out", "optout":
+		if err := ep.store.SetOptOut(ctx, cmd.UserID, true); err != nil {
+			ep.logger.Error().Err(err).Str("user", cmd.UserID).Msg("failed to opt out")
+			text = "Sorry, something went wrong. Please try again later."
+			break
+		}
+		ep.logger.Info().Str("user", cmd.UserID).Msg("user opted out of leaderboards")
+		text = fmt.Sprintf("You're now hidden from public leaderboards. Your beers still count in overall and team stats. Use `%s opt-in` to show up again.", cmd.Command)
+	case "opt-in", "optin":
+		if err := ep.store.SetOptOut(ctx, cmd.UserID, false); err != nil {
+			ep.logger.Error().Err(err).Str("user", cmd.UserID).Msg("failed to opt in")
+			text = "Sorry, something went wrong. Please try again later."
+			break
+		}
+		ep.logger.Info().Str("user", cmd.UserID).Msg("user opted in to leaderboards")
+		text = "You're back on the public leaderboards."
+	case "status", "":
+		optedOut, err := ep.store.IsOptedOut(ctx, cmd.UserID)
+		if err != nil {
+			ep.logger.Error().Err(err).Str("user", cmd.UserID).Msg("failed to read opt-out")
+			text = "Sorry, something went wrong. Please try again later."
+			break
+		}
+		if optedOut {
+			text = fmt.Sprintf("You're hidden from public leaderboards. Use `%s opt-in` to show up again.", cmd.Command)
+		} else {
+			text = fmt.Sprintf("You're shown on public leaderboards. Use `%s opt-out` to hide.", cmd.Command)
+		}
+	default:
+		text = fmt.Sprintf("Usage: `%[1]s opt-out`, `%[1]s opt-in` or `%[1]s status`", cmd.Command)
+	}
+
+	if err := ep.slack.Respond(req, slack.Msg{ResponseType: slack.ResponseTypeEphemeral, Text: text}); err != nil {
+		ep.logger.Warn().Err(err).Msg("cannot respond to slash command")
+	}
+}
+
+// cachedTopUsers reads the Redis leaderboards for rangeKey. Users who opted
+// out may still be there until the next sync, so they are filtered out here.
+// Returns nil on a cache miss.
+func (h *APIHandlers) cachedTopUsers(ctx context.Context, rangeKey string, limit int) *TopUsersResult {
+	optedOut, err := h.store.GetOptedOutUsers(ctx)
+	if err != nil {
+		h.logger.Warn().Err(err).Msg("failed to read opted out users")
+		return nil
+	}
+	givers, errG := h.redisCache.GetTopGivers(ctx, rangeKey, limit+len(optedOut))
+	recipients, errR := h.redisCache.GetTopRecipients(ctx, rangeKey, limit+len(optedOut))
+	if errG != nil || errR != nil || givers == nil || recipients == nil {
+		return nil
+	}
+	visible := func(list []TopUserStats) []TopUserStats {
+		out := make([]TopUserStats, 0, limit)
+		for _, u := range list {
+			if !optedOut[u.UserID] && len(out) < limit {
+				out = append(out, u)
+			}
+		}
+		return out
+	}
+	return &TopUsersResult{Givers: visible(givers), Recipients: visible(recipients)}
+}
+
+// UserDataExport is everything stored about a single user
+type UserDataExport struct {
+	UserID     string           `json:"user_id"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Profile    *CachedUser      `json:"profile"`
+	OptedOut   bool             `json:"opted_out"`
+	Teams      []TeamMembership `json:"teams"`
+	Beers      []Beer           `json:"beers"`
+	Messages   []LoggedEvent    `json:"messages"`
+}
+
+// UserExportHandler returns everything stored about a user as a JSON download
+// Path params: id (Slack user ID)
+func (h *APIHandlers) UserExportHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "user_export").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	fail := func(err error) {
+		h.logger.Error().Str("handler", "user_export").Str("userID", userID).Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	ctx := r.Context()
+	export := UserDataExport{UserID: userID, ExportedAt: time.Now().UTC(), Teams: []TeamMembership{}, Messages: []LoggedEvent{}}
+	var err error
+	if export.Profile, err = h.store.GetCachedUser(ctx, userID); err != nil {
+		fail(err)
+		return
+	}
+	if export.OptedOut, err = h.store.IsOptedOut(ctx, userID); err != nil {
+		fail(err)
+		return
+	}
+	if teams, err := h.store.GetTeamHistory(ctx, userID); err != nil {
+		fail(err)
+		return
+	} else if teams != nil {
+		export.Teams = teams
+	}
+	if export.Beers, err = h.store.ListBeers(ctx, BeerFilter{UserID: userID, IncludeRevoked: true, Limit: -1}); err != nil {
+		fail(err)
+		return
+	}
+	if messages, err := h.store.GetUserLoggedEvents(ctx, userID); err != nil {
+		fail(err)
+		return
+	} else if messages != nil {
+		export.Messages = messages
+	}
+
+	h.logger.Info().Str("handler", "user_export").Str("userID", userID).Int("beers", len(export.Beers)).Int("messages", len(export.Messages)).Msg("request completed")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="beers-%s.json"`, userID))
+	writeJSON(w, h.logger, "user_export", http.StatusOK, export)
+}
+
+// EraseUserHandler anonymizes a user in the database and drops them from Redis
+// Path params: id (Slack user ID). Body: {"reason", "actor"}
+func (h *APIHandlers) EraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "erase_user").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	c, err := decodeBeerCorrection(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	erasure, err := h.store.EraseUser(r.Context(), userID, c.auditActor(), c.Reason)
+	if err != nil {
+		h.logger.Error().Str("handler", "erase_user").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if h.redisCache != nil {
+		if err := h.redisCache.DeleteUser(r.Context(), userID); err != nil {
+			h.logger.Warn().Str("handler", "erase_user").Err(err).Msg("failed to purge user from redis")
+		}
+		if err := h.redisCache.PopulateFromDB(r.Context(), h.store); err != nil {
+			h.logger.Warn().Str("handler", "erase_user").Err(err).Msg("failed to refresh redis leaderboards")
+		}
+	}
+
+	h.logger.Info().Str("handler", "erase_user").Str("pseudonym", erasure.Pseudonym).Int64("beers", erasure.Beers).Msg("request completed")
+	writeJSON(w, h.logger, "erase_user", http.StatusOK, erasure)
+}
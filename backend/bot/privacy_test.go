@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+)
+
+func TestSlashCommandOptOut(t *testing.T) {
+	store := newTestStore(t)
+	fake := &RecordingSlack{}
+	ep := NewEventProcessor(store, fake, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, nil)
+
+	run := func(text string) string {
+		t.Helper()
+		ep.HandleEvent(socketmode.Event{
+			Type:    socketmode.EventTypeSlashCommand,
+			Data:    slack.SlashCommand{Command: "/beer", Text: text, UserID: "U1"},
+			Request: &socketmode.Request{Type: string(socketmode.EventTypeSlashCommand)},
+		})
+		responses := fake.Responses()
+		if len(responses) == 0 {
+			t.Fatalf("no response to %q", text)
+		}
+		last := responses[len(responses)-1]
+		if last.ResponseType != slack.ResponseTypeEphemeral {
+			t.Fatalf("expected an ephemeral response, got %q", last.ResponseType)
+		}
+		return last.Text
+	}
+
+	if got := run("opt-out"); !strings.Contains(got, "hidden from public leaderboards") {
+		t.Fatalf("unexpected opt-out reply: %q", got)
+	}
+	if out, _ := store.IsOptedOut(t.Context(), "U1"); !out {
+		t.Fatal("expected U1 opted out")
+	}
+	if got := run("status"); !strings.Contains(got, "/beer opt-in") {
+		t.Fatalf("unexpected status reply: %q", got)
+	}
+	if got := run("OPT-IN"); !strings.Contains(got, "back on the public leaderboards") {
+		t.Fatalf("unexpected opt-in reply: %q", got)
+	}
+	if out, _ := store.IsOptedOut(t.Context(), "U1"); out {
+		t.Fatal("expected U1 opted in")
+	}
+	if got := run("help"); !strings.HasPrefix(got, "Usage:") {
+		t.Fatalf("unexpected usage reply: %q", got)
+	}
+}
+
+func TestExportsRequireAdminToken(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.AppendEventLog(t.Context(), "T1", "Ev1", "C1", "U1", "1700000000.000100", []byte(testMessagePayload)); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux, NewAPIHandlers(store, nil, nil, nil, nil, nil, zerolog.Nop()), "api", "admin", zerolog.Nop())
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get("/api/users/U1/export", "api"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no export under the API token, got %d", rec.Code)
+	}
+	if rec := get("/api/admin/users/U1/export", "api"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the API token to be refused, got %d", rec.Code)
+	}
+	rec := get("/api/admin/users/U1/export", "admin")
+	var export UserDataExport
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil || rec.Code != http.StatusOK || len(export.Messages) != 1 || export.Messages[0].EventID != "Ev1" {
+		t.Fatalf("unexpected export: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the bulk export includes users who opted out
+	if rec := get("/api/export/beers", "api"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected no bulk export under the API token, got %d", rec.Code)
+	}
+	if rec := get("/api/admin/export/beers", "api"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the API token to be refused, got %d", rec.Code)
+	}
+	if rec := get("/api/admin/export/beers?start=2023-01-01&end=2023-12-31", "admin"); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected bulk export: %d %s", rec.Code, rec.Body.String())
+	}
+}
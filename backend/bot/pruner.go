@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// processedEventsPruneBatch bounds how many rows a single DELETE removes so the
+// pruner never holds the write lock for long on a large backlog
+const processedEventsPruneBatch = 5000
+
+// ProcessedEventsPruner periodically deletes processed_events rows older than
+// the retention window. Slack only redelivers events for a short time, so old
+// dedupe markers are never consulted again.
+type ProcessedEventsPruner struct {
+	store     Store
+	retention time.Duration
+	interval  time.Duration
+	logger    zerolog.Logger
+	pruned    prometheus.Counter
+	failures  prometheus.Counter
+	lastRun   prometheus.Gauge
+	duration  prometheus.Histogram
+}
+
+// NewProcessedEventsPruner creates a pruner. Metrics are registered on reg when non-nil.
+func NewProcessedEventsPruner(store Store, retention, interval time.Duration, logger zerolog.Logger, reg prometheus.Registerer) *ProcessedEventsPruner {
+	p := &ProcessedEventsPruner{
+		store:     store,
+		retention: retention,
+		interval:  interval,
+		logger:    logger,
+		pruned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bwm_processed_events_pruned_total",
+			Help: "Number of processed_events rows deleted by retention pruning",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bwm_processed_events_prune_failures_total",
+			Help: "Number of failed processed_events pruning runs",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bwm_processed_events_prune_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful processed_events pruning run",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_processed_events_prune_duration_seconds",
+			Help:    "Duration of processed_events pruning runs",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(p.pruned, p.failures, p.lastRun, p.duration)
+	}
+	return p
+}
+
+// PruneOnce deletes rows older than the retention window and returns how many were removed
+func (p *ProcessedEventsPruner) PruneOnce(ctx context.Context) (int64, error) {
+	start := time.Now()
+	cutoff := start.Add(-p.retention)
+
+	var total int64
+	for {
+		n, err := p.store.PruneProcessedEvents(ctx, cutoff, processedEventsPruneBatch)
+		total += n
+		p.pruned.Add(float64(n))
+		if err != nil {
+			p.failures.Inc()
+			return total, err
+		}
+		if n < processedEventsPruneBatch {
+			break
+		}
+	}
+
+	p.duration.Observe(time.Since(start).Seconds())
+	p.lastRun.SetToCurrentTime()
+	return total, nil
+}
+
+// Run prunes immediately and then on every interval until ctx is done
+func (p *ProcessedEventsPruner) Run(ctx context.Context) {
+	p.logger.Info().Dur("retention", p.retention).Dur("interval", p.interval).Msg("starting processed events pruner")
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := p.PruneOnce(ctx); err != nil {
+			p.logger.Error().Err(err).Int64("pruned", n).Msg("processed events pruning failed")
+		} else if n > 0 {
+			p.logger.Info().Int64("pruned", n).Msg("pruned processed events")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			p.logger.Info().Msg("processed events pruner stopping")
+			return
+		}
+	}
+}
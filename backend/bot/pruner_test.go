@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestProcessedEventsPruner(t *testing.T) {
+	store := newTestStore(t)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := store.MarkEventProcessed(t.Context(), "", fmt.Sprintf("old-%d", i), now.Add(-10*24*time.Hour)); err != nil {
+			t.Fatalf("mark old: %v", err)
+		}
+	}
+	if err := store.MarkEventProcessed(t.Context(), "", "recent", now.Add(-time.Hour)); err != nil {
+		t.Fatalf("mark recent: %v", err)
+	}
+
+	pruner := NewProcessedEventsPruner(store, 7*24*time.Hour, time.Hour, zerolog.Nop(), nil)
+	n, err := pruner.PruneOnce(t.Context())
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 pruned, got %d", n)
+	}
+
+	if ok, _ := store.IsEventProcessed(t.Context(), "old-0"); ok {
+		t.Fatalf("old event should be pruned")
+	}
+	if ok, _ := store.IsEventProcessed(t.Context(), "recent"); !ok {
+		t.Fatalf("recent event should be kept")
+	}
+
+	// batches smaller than the backlog still remove everything eligible
+	for i := 0; i < 5; i++ {
+		_ = store.MarkEventProcessed(t.Context(), "", fmt.Sprintf("batch-%d", i), now.Add(-30*24*time.Hour))
+	}
+	if n, err := store.PruneProcessedEvents(t.Context(), now.Add(-7*24*time.Hour), 2); err != nil || n != 2 {
+		t.Fatalf("expected a batch of 2, got %d %v", n, err)
+	}
+}
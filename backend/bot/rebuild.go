@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// BeerChange is a beer row whose count differs between the table and the rebuild
+type BeerChange struct {
+	BeerRow
+	OldCount int `json:"old_count"`
+}
+
+// RebuildReport describes what re-deriving beers from the event log would change
+type RebuildReport struct {
+	Workspace   string       `json:"workspace,omitempty"`
+	Since       string       `json:"since"`
+	Events      int          `json:"events"`
+	Skipped     int          `json:"skipped"`
+	Ineligible  int          `json:"ineligible"`
+	LimitDenied int          `json:"limit_denied"`
+	Added       []BeerRow    `json:"added"`
+	Removed     []BeerRow    `json:"removed"`
+	Changed     []BeerChange `json:"changed"`
+	Unchanged   int          `json:"unchanged"`
+	derived     []BeerRow
+}
+
+// HasChanges reports whether applying the rebuild would modify the beers table
+func (r *RebuildReport) HasChanges() bool {
+	return len(r.Added) > 0 || len(r.Removed) > 0 || len(r.Changed) > 0
+}
+
+type beerKey struct {
+	giver, recipient, ts string
+}
+
+// RebuildBeers re-derives beers from the event log using the processor's current
+// parser, eligibility rules and daily limit, and diffs the result against the
+// beers table. Eligibility is judged on the users as they are cached now. Only
+// beers at or after the first logged event are in scope; older history that
+// predates the event log is left untouched. Only events and beers of the
+// processor's workspace are considered.
+func RebuildBeers(ctx context.Context, ep *EventProcessor, store Store) (*RebuildReport, error) {
+	report := &RebuildReport{Workspace: ep.workspace}
+	derived := map[beerKey]BeerRow{}
+	givenPerDay := map[string]int{}
+
+	err := store.ForEachLoggedEvent(ctx, func(e LoggedEvent) error {
+		if e.TeamID != ep.workspace {
+			return nil
+		}
+		report.Events++
+		if report.Since == "" || e.Ts < report.Since {
+			report.Since = e.Ts
+		}
+
+		ev, err := parseMessageEventPayload(e.Payload)
+		if err != nil || !ep.acceptsMessage(ev) {
+			report.Skipped++
+			return nil
+		}
+
+		recipientBeers := ep.attributeBeers(ev.User, ev.Text)
+		giverReason, rejected, err := ep.filterEligible(ctx, ev.User, recipientBeers)
+		if err != nil {
+			return err
+		}
+		if giverReason != "" || len(rejected) > 0 {
+			report.Ineligible++
+		}
+		total := 0
+		for _, count := range recipientBeers {
+			total += count
+		}
+		if total == 0 {
+			return nil
+		}
+
+		// fall back to the receive time rather than now so reruns are deterministic
+		eventTime, err := parseSlackTimestamp(ev.TimeStamp)
+		if err != nil {
+			eventTime = e.ReceivedAt
+		}
+		dayKey := ev.User + "|" + eventTime.UTC().Format("2006-01-02")
+		if total > ep.maxPerDay-givenPerDay[dayKey] {
+			report.LimitDenied++
+			return nil
+		}
+		givenPerDay[dayKey] += total
+
+		for recipient, count := range recipientBeers {
+			derived[beerKey{ev.User, recipient, ev.TimeStamp}] = BeerRow{
+				TeamID:      ep.workspace,
+				GiverID:     ev.User,
+				RecipientID: recipient,
+				Ts:          ev.TimeStamp,
+				TsRFC:       eventTime.UTC(),
+				Count:       count,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report.Since == "" {
+		return report, nil
+	}
+
+	current, err := store.GetBeersSince(ctx, report.Workspace, report.Since)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[beerKey]BeerRow{}
+	for _, b := range current {
+		existing[beerKey{b.GiverID, b.RecipientID, b.Ts}] = b
+	}
+
+	for key, b := range derived {
+		report.derived = append(report.derived, b)
+		old, ok := existing[key]
+		switch {
+		case !ok:
+			report.Added = append(report.Added, b)
+		case old.Count != b.Count:
+			report.Changed = append(report.Changed, BeerChange{BeerRow: b, OldCount: old.Count})
+		default:
+			report.Unchanged++
+		}
+	}
+	for key, b := range existing {
+		if _, ok := derived[key]; !ok {
+			report.Removed = append(report.Removed, b)
+		}
+	}
+
+	sortBeerRows(report.derived)
+	sortBeerRows(report.Added)
+	sortBeerRows(report.Removed)
+	sort.Slice(report.Changed, func(i, j int) bool { return beerRowLess(report.Changed[i].BeerRow, report.Changed[j].BeerRow) })
+	return report, nil
+}
+
+// ApplyRebuild replaces the in-scope beers with the re-derived rows
+func ApplyRebuild(ctx context.Context, store Store, report *RebuildReport) error {
+	if report.Since == "" {
+		return fmt.Errorf("event log is empty, nothing to rebuild")
+	}
+	return store.ReplaceBeersSince(ctx, report.Workspace, report.Since, report.derived)
+}
+
+func sortBeerRows(rows []BeerRow) {
+	sort.Slice(rows, func(i, j int) bool { return beerRowLess(rows[i], rows[j]) })
+}
+
+func beerRowLess(a, b BeerRow) bool {
+	if a.Ts != b.Ts {
+		return a.Ts < b.Ts
+	}
+	if a.GiverID != b.GiverID {
+		return a.GiverID < b.GiverID
+	}
+	return a.RecipientID < b.RecipientID
+}
+
+// WriteText prints a human readable diff report
+func (r *RebuildReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "event log: %d events since ts %s (%d skipped, %d with ineligible users, %d denied by daily limit)\n", r.Events, r.Since, r.Skipped, r.Ineligible, r.LimitDenied)
+	fmt.Fprintf(w, "beers: %d added, %d removed, %d changed, %d unchanged\n", len(r.Added), len(r.Removed), len(r.Changed), r.Unchanged)
+	for _, b := range r.Added {
+		fmt.Fprintf(w, "+ %s %s -> %s count=%d\n", b.Ts, b.GiverID, b.RecipientID, b.Count)
+	}
+	for _, b := range r.Removed {
+		fmt.Fprintf(w, "- %s %s -> %s count=%d\n", b.Ts, b.GiverID, b.RecipientID, b.Count)
+	}
+	for _, c := range r.Changed {
+		fmt.Fprintf(w, "~ %s %s -> %s count=%d (was %d)\n", c.Ts, c.GiverID, c.RecipientID, c.Count, c.OldCount)
+	}
+}
+
+// runRebuildCommand implements `bot rebuild`: it prints the diff between the
+// beers table and a rebuild from the event log, and applies it with -apply.
+func runRebuildCommand(args []string) {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	dsn := fs.String("db", databaseDSN(), "sqlite database path or postgres:// URL")
+	channelID := fs.String("channel", os.Getenv("CHANNEL"), "channel id the bot monitors")
+	workspace := fs.String("workspace", "", "workspace (team) id to rebuild; defaults to the only workspace")
+	emojiDefault := ":beer:"
+	if env := os.Getenv("EMOJI"); env != "" {
+		emojiDefault = env
+	}
+	emoji := fs.String("emoji", emojiDefault, "emoji to count")
+	maxPerDayDefault := 10
+	if env := os.Getenv("MAX_PER_DAY"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			maxPerDayDefault = v
+		}
+	}
+	maxPerDay := fs.Int("max-per-day", maxPerDayDefault, "max beers a user may give per day")
+	var eligibility EligibilityRules
+	registerEligibilityFlags(fs, &eligibility)
+	format := fs.String("format", "text", "report format (text|json)")
+	apply := fs.Bool("apply", false, "replace beers with the rebuilt rows")
+	_ = fs.Parse(args)
+
+	if *channelID == "" {
+		log.Fatal("channel must be provided via -channel or CHANNEL")
+	}
+
+	store, err := openStore(*dsn, storeOptionsFromEnv(), nil)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if *workspace == "" {
+		workspaces, err := store.GetWorkspaces(ctx)
+		if err != nil {
+			log.Fatalf("list workspaces: %v", err)
+		}
+		switch len(workspaces) {
+		case 0:
+		case 1:
+			*workspace = workspaces[0].TeamID
+		default:
+			log.Fatal("the bot is installed in several workspaces; pick one with -workspace")
+		}
+	}
+
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger().Level(zerolog.WarnLevel)
+	ep := NewEventProcessor(store, nil, nil, *channelID, *emoji, *maxPerDay, logger, nil, nil)
+	ep.SetWorkspace(*workspace)
+	ep.SetEligibility(eligibility)
+
+	report, err := RebuildBeers(ctx, ep, store)
+	if err != nil {
+		log.Fatalf("rebuild: %v", err)
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("encode report: %v", err)
+		}
+	default:
+		report.WriteText(os.Stdout)
+	}
+
+	if !*apply {
+		return
+	}
+	if !report.HasChanges() {
+		fmt.Fprintln(os.Stderr, "nothing to apply")
+		return
+	}
+	start := time.Now()
+	if err := ApplyRebuild(ctx, store, report); err != nil {
+		log.Fatalf("apply rebuild: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "rebuild applied in %s; redis leaderboards refresh on the next sync\n", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func logMessage(t *testing.T, store *SQLStore, eventID, user, text, ts string) {
+	t.Helper()
+	payload := fmt.Sprintf(`{"type":"event_callback","event":{"type":"message","channel":"C1","user":%q,"text":%q,"ts":%q}}`, user, text, ts)
+	if err := store.AppendEventLog(t.Context(), "", eventID, "C1", user, ts, []byte(payload)); err != nil {
+		t.Fatalf("append event log: %v", err)
+	}
+}
+
+func TestRebuildBeers(t *testing.T) {
+	store := newTestStore(t)
+	ep := NewEventProcessor(store, nil, nil, "C1", ":beer:", 3, zerolog.Nop(), nil, nil)
+
+	// same day, giver U1: 2 beers accepted, then 2 more exceed the limit of 3
+	logMessage(t, store, "e1", "U1", "<@U2> :beer: :beer:", "1700000000.000100")
+	logMessage(t, store, "e2", "U1", "<@U3> :beer: :beer:", "1700000100.000100")
+	logMessage(t, store, "e3", "U4", "<@U2> :beer:", "1700000200.000100")
+	logMessage(t, store, "e4", "U4", "no beer here", "1700000300.000100")
+	// duplicate append is ignored
+	logMessage(t, store, "e3", "U4", "<@U2> :beer:", "1700000200.000100")
+
+	t1, _ := parseSlackTimestamp("1700000000.000100")
+	t2, _ := parseSlackTimestamp("1700000100.000100")
+	// recorded with an old bug: wrong count, and an over-limit message that slipped through
+	if err := store.AddBeer(t.Context(), "", "U1", "U2", "1700000000.000100", t1, 1); err != nil {
+		t.Fatalf("addbeer: %v", err)
+	}
+	if err := store.AddBeer(t.Context(), "", "U1", "U3", "1700000100.000100", t2, 2); err != nil {
+		t.Fatalf("addbeer: %v", err)
+	}
+	// history before the event log is out of scope
+	if err := store.AddBeer(t.Context(), "", "U9", "U2", "1600000000.000100", t1.AddDate(-3, 0, 0), 5); err != nil {
+		t.Fatalf("addbeer: %v", err)
+	}
+
+	report, err := RebuildBeers(t.Context(), ep, store)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if report.Since != "1700000000.000100" || report.Events != 4 || report.LimitDenied != 1 {
+		t.Fatalf("unexpected summary: %+v", report)
+	}
+	if len(report.Added) != 1 || report.Added[0].GiverID != "U4" {
+		t.Fatalf("unexpected added: %+v", report.Added)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].RecipientID != "U3" {
+		t.Fatalf("unexpected removed: %+v", report.Removed)
+	}
+	if len(report.Changed) != 1 || report.Changed[0].Count != 2 || report.Changed[0].OldCount != 1 {
+		t.Fatalf("unexpected changed: %+v", report.Changed)
+	}
+
+	if err := ApplyRebuild(t.Context(), store, report); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	// the beer that is no longer derived is revoked, not deleted
+	kept, err := store.ListBeers(t.Context(), BeerFilter{UserID: "U3", IncludeRevoked: true})
+	if err != nil || len(kept) != 1 || kept[0].RevokedAt == nil || kept[0].RevokedBy != auditActorRebuild {
+		t.Fatalf("expected the removed beer revoked by the rebuild: %+v %v", kept, err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("rollup drift: %d %v", drift, err)
+	}
+	again, err := RebuildBeers(t.Context(), ep, store)
+	if err != nil {
+		t.Fatalf("rebuild again: %v", err)
+	}
+	if again.HasChanges() || again.Unchanged != 2 {
+		t.Fatalf("expected a no-op second rebuild, got %+v", again)
+	}
+	if old, _ := store.CountGivenOnDate(t.Context(), "U9", t1.AddDate(-3, 0, 0).UTC().Format("2006-01-02")); old != 5 {
+		t.Fatalf("history before the event log changed: %d", old)
+	}
+}
+
+func TestApplyRebuild_KeepsCorrections(t *testing.T) {
+	store := newTestStore(t)
+	ep := NewEventProcessor(store, nil, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, nil)
+
+	logMessage(t, store, "e1", "U1", "<@U2> :beer:", "1700000000.000100")
+	logMessage(t, store, "e2", "U1", "<@U3> :beer:", "1700000100.000100")
+	t1, _ := parseSlackTimestamp("1700000000.000100")
+	t2, _ := parseSlackTimestamp("1700000100.000100")
+	for _, b := range []BeerRow{{"", "U1", "U2", "1700000000.000100", t1, 1}, {"", "U1", "U3", "1700000100.000100", t2, 1}} {
+		if err := store.AddBeer(t.Context(), "", b.GiverID, b.RecipientID, b.Ts, b.TsRFC, b.Count); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+	}
+	beers, err := store.ListBeers(t.Context(), BeerFilter{})
+	if err != nil || len(beers) != 2 {
+		t.Fatalf("list beers: %+v %v", beers, err)
+	}
+	if _, err := store.AdjustBeer(t.Context(), beers[1].ID, 4, "admin", "gave four"); err != nil {
+		t.Fatalf("adjust: %v", err)
+	}
+	if _, err := store.RevokeBeer(t.Context(), beers[0].ID, "admin", "joke"); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+
+	report, err := RebuildBeers(t.Context(), ep, store)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if err := ApplyRebuild(t.Context(), store, report); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got, _ := store.CountReceived(t.Context(), "U2", ""); got != 4 {
+		t.Fatalf("expected the adjusted count to survive, got %d", got)
+	}
+	if got, _ := store.CountReceived(t.Context(), "U3", ""); got != 0 {
+		t.Fatalf("expected the revoked beer to stay revoked, got %d", got)
+	}
+	if b, _ := store.GetBeer(t.Context(), beers[0].ID); b == nil || b.RevokedBy != "admin" {
+		t.Fatalf("expected the admin revocation kept: %+v", b)
+	}
+	if rebuilds, _ := store.ListAuditLog(t.Context(), AuditFilter{Action: AuditBeersRebuild}); len(rebuilds) != 1 || rebuilds[0].Actor != auditActorRebuild {
+		t.Fatalf("expected the rebuild in the audit log, got %+v", rebuilds)
+	}
+}
+
+func TestRebuildBeers_Eligibility(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.SyncUserDirectory(t.Context(), []CachedUser{{UserID: "U2"}, {UserID: "B1", IsBot: true}, {UserID: "U3", Guest: true}}); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	// the rebuild must not tell anyone about rejected recipients again
+	ep := NewEventProcessor(store, nil, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, nil)
+	ep.SetEligibility(EligibilityRules{RejectBots: true, RejectGuests: true})
+
+	logMessage(t, store, "e1", "U1", "<@U2> :beer: <@B1> :beer: <@U3> :beer:", "1700000000.000100")
+	logMessage(t, store, "e2", "B1", "<@U2> :beer:", "1700000100.000100")
+
+	report, err := RebuildBeers(t.Context(), ep, store)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if report.Ineligible != 2 || len(report.Added) != 1 || report.Added[0].GiverID != "U1" || report.Added[0].RecipientID != "U2" {
+		t.Fatalf("expected only the beer for U2 rebuilt: %+v", report)
+	}
+}
@@ -330,6 +330,39 @@ func (r *RedisUserCache) IncrementReceivedStats(ctx context.Context, userID stri
 	return nil
 }
 
+// AdjustStats applies a correction of delta beers given at time at to the
+// leaderboards whose range covers that day. Users whose score drops to zero
+// are removed.
+func (r *RedisUserCache) AdjustStats(ctx context.Context, giverID, recipientID string, at time.Time, delta int) error {
+	if r.circuitBreaker.IsOpen() {
+		r.logger.Debug().Msg("circuit breaker open, skipping redis write")
+		return nil
+	}
+
+	day := at.UTC().Format("2006-01-02")
+	pipe := r.client.Pipeline()
+	for rangeKey, span := range leaderboardRanges(time.Now()) {
+		if day < span.start.Format("2006-01-02") || day > span.end.Format("2006-01-02") {
+			continue
+		}
+		givers := fmt.Sprintf("leaderboard:givers:%s", rangeKey)
+		recipients := fmt.Sprintf("leaderboard:recipients:%s", rangeKey)
+		pipe.ZIncrBy(ctx, givers, float64(delta), giverID)
+		pipe.ZIncrBy(ctx, recipients, float64(delta), recipientID)
+		pipe.ZRemRangeByScore(ctx, givers, "-inf", "0")
+		pipe.ZRemRangeByScore(ctx, recipients, "-inf", "0")
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		r.logger.Warn().Err(err).Str("giver", giverID).Str("recipient", recipientID).Msg("failed to adjust stats")
+		r.circuitBreaker.RecordFailure()
+		return err
+	}
+
+	r.circuitBreaker.RecordSuccess()
+	return nil
+}
+
 // GetTopGivers retrieves top givers from Redis cache for a specific range
 func (r *RedisUserCache) GetTopGivers(ctx context.Context, rangeKey string, limit int) ([]TopUserStats, error) {
 	if r.circuitBreaker.IsOpen() {
@@ -420,14 +453,12 @@ func (r *RedisUserCache) calculateActiveRanges() []string {
 	return ranges
 }
 
-// PopulateFromDB rebuilds Redis cache from SQLite database
-func (r *RedisUserCache) PopulateFromDB(ctx context.Context, store *SQLiteStore) error {
-	r.logger.Info().Msg("starting redis cache population from database")
-
-	// Define date ranges
-	now := time.Now()
+// leaderboardRange is the date span a leaderboard range key covers
+type leaderboardRange struct{ start, end time.Time }
 
-	ranges := map[string]struct{ start, end time.Time }{
+// leaderboardRanges returns the span of every leaderboard range key as of now
+func leaderboardRanges(now time.Time) map[string]leaderboardRange {
+	ranges := map[string]leaderboardRange{
 		RangeAllTime: {
 			start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
 			end:   now,
@@ -453,7 +484,7 @@ func (r *RedisUserCache) PopulateFromDB(ctx context.Context, store *SQLiteStore)
 	// Current quarter
 	quarter := getQuarterNumber(now)
 	quarterStart := time.Date(now.Year(), getQuarterStartMonth(quarter), 1, 0, 0, 0, 0, now.Location())
-	ranges[RangeCurrentQuarter] = struct{ start, end time.Time }{start: quarterStart, end: now}
+	ranges[RangeCurrentQuarter] = leaderboardRange{start: quarterStart, end: now}
 
 	// Last quarter
 	lastQuarterNum := quarter - 1
@@ -464,7 +495,16 @@ func (r *RedisUserCache) PopulateFromDB(ctx context.Context, store *SQLiteStore)
 	}
 	lastQuarterStart := time.Date(lastQuarterYear, getQuarterStartMonth(lastQuarterNum), 1, 0, 0, 0, 0, now.Location())
 	lastQuarterEnd := quarterStart.AddDate(0, 0, -1)
-	ranges[RangeLastQuarter] = struct{ start, end time.Time }{start: lastQuarterStart, end: lastQuarterEnd}
+	ranges[RangeLastQuarter] = leaderboardRange{start: lastQuarterStart, end: lastQuarterEnd}
+
+	return ranges
+}
+
+// PopulateFromDB rebuilds Redis cache from SQLite database
+func (r *RedisUserCache) PopulateFromDB(ctx context.Context, store Store) error {
+	r.logger.Info().Msg("starting redis cache population from database")
+
+	ranges := leaderboardRanges(time.Now())
 
 	// Populate each range
 	for rangeKey, dates := range ranges {
@@ -479,11 +519,11 @@ func (r *RedisUserCache) PopulateFromDB(ctx context.Context, store *SQLiteStore)
 }
 
 // populateRange populates a specific date range in Redis from database
-func (r *RedisUserCache) populateRange(ctx context.Context, store *SQLiteStore, rangeKey string, start, end time.Time) error {
+func (r *RedisUserCache) populateRange(ctx context.Context, store Store, rangeKey string, start, end time.Time) error {
 	r.logger.Debug().Str("range", rangeKey).Time("start", start).Time("end", end).Msg("populating range")
 
 	// Get top users from database
-	topUsers, err := store.GetTopUsers(start, end, 100) // Get top 100 for each range
+	topUsers, err := store.GetTopUsers(ctx, start, end, 100, StatsOptions{}) // Get top 100 for each range
 	if err != nil {
 		return fmt.Errorf("failed to get top users: %w", err)
 	}
@@ -520,7 +560,7 @@ func (r *RedisUserCache) populateRange(ctx context.Context, store *SQLiteStore,
 }
 
 // StartSyncWorker starts a background goroutine that periodically syncs Redis from database
-func (r *RedisUserCache) StartSyncWorker(ctx context.Context, store *SQLiteStore, interval time.Duration) {
+func (r *RedisUserCache) StartSyncWorker(ctx context.Context, store Store, interval time.Duration) {
 	r.logger.Info().Dur("interval", interval).Msg("starting redis sync worker")
 
 	// Initial population
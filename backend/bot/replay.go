@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// RecordedEvent is one line of an event recording
+type RecordedEvent struct {
+	RecordedAt time.Time            `json:"recorded_at"`
+	Type       socketmode.EventType `json:"type"`
+	EnvelopeID string               `json:"envelope_id,omitempty"`
+	Payload    json.RawMessage      `json:"payload"`
+}
+
+// EventRecorder appends incoming socket mode events to a JSON Lines file
+type EventRecorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	logger zerolog.Logger
+}
+
+// NewEventRecorder opens (or creates) path for appending recorded events
+func NewEventRecorder(path string, logger zerolog.Logger) (*EventRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+	logger.Info().Str("path", path).Msg("recording slack events")
+	return &EventRecorder{file: f, enc: json.NewEncoder(f), logger: logger}, nil
+}
+
+// Record writes evt if it carries a payload; other events (hello, disconnect) are skipped
+func (r *EventRecorder) Record(evt socketmode.Event) error {
+	if evt.Request == nil || len(evt.Request.Payload) == 0 {
+		return nil
+	}
+	rec := RecordedEvent{
+		RecordedAt: time.Now().UTC(),
+		Type:       evt.Type,
+		EnvelopeID: evt.Request.EnvelopeID,
+		Payload:    evt.Request.Payload,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(rec)
+}
+
+// Wrap returns an event handler that records each event before passing it on
+func (r *EventRecorder) Wrap(next func(socketmode.Event)) func(socketmode.Event) {
+	return func(evt socketmode.Event) {
+		if err := r.Record(evt); err != nil {
+			r.logger.Warn().Err(err).Msg("failed to record event")
+		}
+		next(evt)
+	}
+}
+
+// Close closes the recording file
+func (r *EventRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// PostedMessage is a message the bot would have sent to Slack
+type PostedMessage struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+}
+
+// RecordingSlack is a SlackAPI fake that acks everything and keeps posted
+// messages in memory instead of calling Slack
+type RecordingSlack struct {
+	mu        sync.Mutex
+	messages  []PostedMessage
+	responses []slack.Msg
+}
+
+// Ack implements SlackAPI
+func (f *RecordingSlack) Ack(req socketmode.Request) error {
+	return nil
+}
+
+// Respond implements SlackAPI
+func (f *RecordingSlack) Respond(req socketmode.Request, msg slack.Msg) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, msg)
+	return nil
+}
+
+// PostMessage implements SlackAPI
+func (f *RecordingSlack) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	_, values, err := slack.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, PostedMessage{Channel: channelID, Text: values.Get("text")})
+	return channelID, strconv.Itoa(len(f.messages)), nil
+}
+
+// Messages returns a copy of the messages posted so far
+func (f *RecordingSlack) Messages() []PostedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]PostedMessage(nil), f.messages...)
+}
+
+// Responses returns a copy of the request responses sent so far
+func (f *RecordingSlack) Responses() []slack.Msg {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]slack.Msg(nil), f.responses...)
+}
+
+// ReplayEvents feeds a recording into the event processor in file order and
+// returns the number of events replayed
+func ReplayEvents(r io.Reader, ep *EventProcessor) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+	n := 0
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		evt := socketmode.Event{
+			Type: rec.Type,
+			Request: &socketmode.Request{
+				Type:       string(rec.Type),
+				EnvelopeID: rec.EnvelopeID,
+				Payload:    rec.Payload,
+			},
+		}
+		if rec.Type == socketmode.EventTypeEventsAPI {
+			data, err := slackevents.ParseEvent(rec.Payload, slackevents.OptionNoVerifyToken())
+			if err != nil {
+				return n, fmt.Errorf("line %d: parse payload: %w", line, err)
+			}
+			evt.Data = data
+		}
+
+		ep.HandleEvent(evt)
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// runReplayCommand implements `bot replay`: it replays a recording into a
+// fresh store with Slack replaced by a fake and prints what the bot did.
+func runReplayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "event recording (JSON Lines) to replay")
+	dbPath := fs.String("db", "", "sqlite database path for the replay (default: a temporary file)")
+	channelID := fs.String("channel", os.Getenv("CHANNEL"), "channel id the bot monitors")
+	emojiDefault := ":beer:"
+	if env := os.Getenv("EMOJI"); env != "" {
+		emojiDefault = env
+	}
+	emoji := fs.String("emoji", emojiDefault, "emoji to count")
+	maxPerDayDefault := 10
+	if env := os.Getenv("MAX_PER_DAY"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			maxPerDayDefault = v
+		}
+	}
+	maxPerDay := fs.Int("max-per-day", maxPerDayDefault, "max beers a user may give per day")
+	logLevel := fs.String("log-level", "warn", "log level")
+	_ = fs.Parse(args)
+
+	if *file == "" || *channelID == "" {
+		log.Fatal("replay requires -file and -channel (or CHANNEL)")
+	}
+
+	if *dbPath == "" {
+		dir, err := os.MkdirTemp("", "beerbot-replay-*")
+		if err != nil {
+			log.Fatalf("temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		*dbPath = filepath.Join(dir, "replay.db")
+	} else if _, err := os.Stat(*dbPath); err == nil {
+		log.Fatalf("%s already exists; replay needs a fresh database", *dbPath)
+	}
+
+	store, err := openStore(*dbPath, storeOptionsFromEnv(), nil)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		level = zerolog.WarnLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger().Level(level)
+
+	fake := &RecordingSlack{}
+	ep := NewEventProcessor(store, fake, nil, *channelID, *emoji, *maxPerDay, logger, nil, nil)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("open recording: %v", err)
+	}
+	defer f.Close()
+
+	n, err := ReplayEvents(f, ep)
+	if err != nil {
+		log.Fatalf("replay: %v", err)
+	}
+
+	fmt.Printf("replayed %d events\n", n)
+	for _, m := range fake.Messages() {
+		fmt.Printf("slack #%s: %s\n", m.Channel, m.Text)
+	}
+	pairs, err := store.GetPairStats(context.Background(), time.Time{}, time.Now().AddDate(1, 0, 0), 1000, StatsOptions{})
+	if err != nil {
+		log.Fatalf("pair stats: %v", err)
+	}
+	for _, p := range pairs {
+		fmt.Printf("beers %s -> %s: %d\n", p.Giver, p.Recipient, p.Count)
+	}
+}
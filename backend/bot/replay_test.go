@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack/socketmode"
+)
+
+func recordMessage(t *testing.T, rec *EventRecorder, envelopeID, user, text, ts string) {
+	t.Helper()
+	payload := fmt.Sprintf(`{"type":"event_callback","event":{"type":"message","channel":"C1","user":%q,"text":%q,"ts":%q}}`, user, text, ts)
+	evt := socketmode.Event{
+		Type: socketmode.EventTypeEventsAPI,
+		Request: &socketmode.Request{
+			Type:       string(socketmode.EventTypeEventsAPI),
+			EnvelopeID: envelopeID,
+			Payload:    json.RawMessage(payload),
+		},
+	}
+	if err := rec.Record(evt); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	rec, err := NewEventRecorder(path, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("recorder: %v", err)
+	}
+	// events without a payload are not recorded
+	if err := rec.Record(socketmode.Event{Type: socketmode.EventTypeHello, Request: &socketmode.Request{Type: "hello"}}); err != nil {
+		t.Fatalf("record hello: %v", err)
+	}
+	recordMessage(t, rec, "env-1", "U1", "thanks <@U2> :beer: :beer:", "1700000000.000100")
+	recordMessage(t, rec, "env-2", "U1", "<@U3> :beer: :beer:", "1700000100.000100")
+	// redelivery of the first envelope
+	recordMessage(t, rec, "env-1", "U1", "thanks <@U2> :beer: :beer:", "1700000000.000100")
+	if err := rec.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	store := newTestStore(t)
+	fake := &RecordingSlack{}
+	ep := NewEventProcessor(store, fake, nil, "C1", ":beer:", 3, zerolog.Nop(), nil, nil)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	n, err := ReplayEvents(f, ep)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 replayed events, got %d", n)
+	}
+
+	msgs := fake.Messages()
+	want := []string{
+		"<@U1> gave 2 beers to <@U2>!",
+		"Sorry <@U1>, you are trying to give 2 beers, but you only have 1 left for today.",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	for i, m := range msgs {
+		if m.Channel != "C1" || m.Text != want[i] {
+			t.Fatalf("message %d: got %+v, want %q", i, m, want[i])
+		}
+	}
+
+	t1, _ := parseSlackTimestamp("1700000000.000100")
+	if got, _ := store.CountReceivedInDateRange(t.Context(), "U2", t1, t1, StatsOptions{}); got != 2 {
+		t.Fatalf("expected 2 beers for U2, got %d", got)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"math"
 	"sync"
 	"time"
@@ -23,6 +25,8 @@ type SlackConnectionManager struct {
 	mu               sync.RWMutex
 	logger           zerolog.Logger
 	stopEventProcess context.CancelFunc
+	// httpEvents is set when events arrive over HTTP instead of a socket
+	httpEvents bool
 }
 
 // NewSlackConnectionManager creates a new connection manager
@@ -38,6 +42,25 @@ func NewSlackConnectionManager(botToken, appToken string, logger zerolog.Logger)
 	}
 }
 
+// UseHTTPEvents switches the manager to a workspace whose events arrive over
+// HTTP (see EventsHTTPReceiver) rather than a socket. Requests are then
+// acknowledged by the HTTP response, slash commands are answered through
+// their response_url, and the connection counts as up while the Web API
+// answers.
+func (scm *SlackConnectionManager) UseHTTPEvents() {
+	scm.mu.Lock()
+	scm.httpEvents = true
+	scm.mu.Unlock()
+	scm.setConnected(true)
+}
+
+// usesHTTPEvents reports whether UseHTTPEvents was called
+func (scm *SlackConnectionManager) usesHTTPEvents() bool {
+	scm.mu.RLock()
+	defer scm.mu.RUnlock()
+	return scm.httpEvents
+}
+
 // IsConnected returns the current connection status
 func (scm *SlackConnectionManager) IsConnected() bool {
 	scm.mu.RLock()
@@ -75,12 +98,50 @@ func (scm *SlackConnectionManager) GetSocketClient() *socketmode.Client {
 	return scm.socketClient
 }
 
+// Ack acknowledges a socket mode request on the current connection
+func (scm *SlackConnectionManager) Ack(req socketmode.Request) error {
+	if scm.usesHTTPEvents() {
+		return nil
+	}
+	socketClient := scm.GetSocketClient()
+	if socketClient == nil {
+		return errors.New("socket client is nil")
+	}
+	socketClient.Ack(req)
+	return nil
+}
+
+// Respond acknowledges a socket mode request with a response payload
+func (scm *SlackConnectionManager) Respond(req socketmode.Request, msg slack.Msg) error {
+	if scm.usesHTTPEvents() {
+		var cmd slack.SlashCommand
+		if err := json.Unmarshal(req.Payload, &cmd); err != nil || cmd.ResponseURL == "" {
+			return errors.New("request has no response_url")
+		}
+		return slack.PostWebhook(cmd.ResponseURL, &slack.WebhookMessage{ResponseType: msg.ResponseType, Text: msg.Text})
+	}
+	socketClient := scm.GetSocketClient()
+	if socketClient == nil {
+		return errors.New("socket client is nil")
+	}
+	socketClient.Ack(req, msg)
+	return nil
+}
+
+// PostMessage posts a message to a channel using the bot client
+func (scm *SlackConnectionManager) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	return scm.client.PostMessage(channelID, options...)
+}
+
 // TestConnection tests the Slack API connection
 func (scm *SlackConnectionManager) TestConnection(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	_, err := scm.client.AuthTestContext(ctx)
+	if scm.usesHTTPEvents() && (err == nil) != scm.IsConnected() {
+		scm.setConnected(err == nil)
+	}
 	return err
 }
 
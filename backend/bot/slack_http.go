@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// Ways Slack events reach the bot
+const (
+	slackModeSocket = "socket"
+	slackModeHTTP   = "http"
+)
+
+// maxSlackRequestBytes caps the body of a request from Slack
+const maxSlackRequestBytes = 1 << 20
+
+// EventsHTTPReceiver receives Slack Events API, slash command and
+// interactivity requests over HTTP, for environments where the socket mode
+// websocket can't be opened. Requests must carry a valid signature made with
+// the app's signing secret and a timestamp no older than five minutes. Each
+// request is turned into the socketmode.Event socket mode would have
+// delivered and queued on the worker pool for the handler of the workspace it
+// came from, after the request has been answered so Slack's three second
+// deadline is met.
+type EventsHTTPReceiver struct {
+	signingSecret string
+	pool          *EventWorkerPool
+	logger        zerolog.Logger
+	mu            sync.RWMutex
+	handlers      map[string]workspaceHandler
+	inflight      sync.WaitGroup
+}
+
+// workspaceHandler handles the requests of one workspace. drop is called
+// with the requests that could not be queued.
+type workspaceHandler struct {
+	handle func(socketmode.Event)
+	drop   func(socketmode.Event, error)
+}
+
+// NewEventsHTTPReceiver creates a receiver verifying requests with
+// signingSecret and handling them on pool
+func NewEventsHTTPReceiver(signingSecret string, pool *EventWorkerPool, logger zerolog.Logger) *EventsHTTPReceiver {
+	return &EventsHTTPReceiver{
+		signingSecret: signingSecret,
+		pool:          pool,
+		logger:        logger,
+		handlers:      map[string]workspaceHandler{},
+	}
+}
+
+// AddWorkspace routes the requests of workspace teamID to handler. Requests
+// that can't be queued go to drop, if set.
+func (rcv *EventsHTTPReceiver) AddWorkspace(teamID string, handler func(socketmode.Event), drop func(socketmode.Event, error)) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.handlers[teamID] = workspaceHandler{handle: handler, drop: drop}
+}
+
+// Wait blocks until the requests already answered have been handled. Call it
+// once the HTTP server has stopped accepting requests.
+func (rcv *EventsHTTPReceiver) Wait() {
+	rcv.inflight.Wait()
+}
+
+// ServeHTTP verifies a request from Slack, acknowledges it and dispatches it.
+// JSON bodies are Events API requests; form bodies are interactivity payloads
+// (payload=) or slash commands (command=).
+func (rcv *EventsHTTPReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSlackRequestBytes))
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	if err := rcv.verify(r.Header, body); err != nil {
+		rcv.logger.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected slack request")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		rcv.serveForm(w, r, body)
+		return
+	}
+
+	outer, err := slackevents.ParseEvent(body, slackevents.OptionNoVerifyToken())
+	if err != nil {
+		rcv.logger.Warn().Err(err).Msg("cannot parse slack event")
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+	switch outer.Type {
+	case slackevents.URLVerification:
+		var challenge slackevents.ChallengeResponse
+		if err := json.Unmarshal(body, &challenge); err != nil {
+			http.Error(w, "invalid challenge", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(challenge.Challenge))
+		return
+	case slackevents.CallbackEvent:
+		// the event id stays the same across Slack's retries, so it dedupes
+		// like a socket mode envelope id
+		eventID := ""
+		if cb, ok := outer.Data.(*slackevents.EventsAPICallbackEvent); ok {
+			eventID = cb.EventID
+		}
+		w.WriteHeader(http.StatusOK)
+		rcv.dispatch(outer.TeamID, socketmode.Event{
+			Type:    socketmode.EventTypeEventsAPI,
+			Data:    outer,
+			Request: &socketmode.Request{Type: socketmode.RequestTypeEventsAPI, EnvelopeID: eventID, Payload: body},
+		})
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// serveForm handles interactivity payloads and slash commands
+func (rcv *EventsHTTPReceiver) serveForm(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case form.Get("payload") != "":
+		payload := []byte(form.Get("payload"))
+		var cb slack.InteractionCallback
+		if err := json.Unmarshal(payload, &cb); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		rcv.dispatch(cb.Team.ID, socketmode.Event{
+			Type:    socketmode.EventTypeInteractive,
+			Data:    cb,
+			Request: &socketmode.Request{Type: socketmode.RequestTypeInteractive, Payload: payload},
+		})
+	case form.Get("command") != "":
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		cmd, err := slack.SlashCommandParse(r)
+		if err != nil {
+			http.Error(w, "invalid command", http.StatusBadRequest)
+			return
+		}
+		payload, err := json.Marshal(cmd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the reply goes to the command's response_url, so the ack is empty
+		w.WriteHeader(http.StatusOK)
+		rcv.dispatch(cmd.TeamID, socketmode.Event{
+			Type:    socketmode.EventTypeSlashCommand,
+			Data:    cmd,
+			Request: &socketmode.Request{Type: socketmode.RequestTypeSlashCommands, Payload: payload},
+		})
+	default:
+		http.Error(w, "unknown request", http.StatusBadRequest)
+	}
+}
+
+// verify checks the request's signature and that its timestamp is recent
+func (rcv *EventsHTTPReceiver) verify(header http.Header, body []byte) error {
+	if rcv.signingSecret == "" {
+		return errors.New("no signing secret configured")
+	}
+	sv, err := slack.NewSecretsVerifier(header, rcv.signingSecret)
+	if err != nil {
+		return err
+	}
+	if _, err := sv.Write(body); err != nil {
+		return err
+	}
+	return sv.Ensure()
+}
+
+// dispatch queues evt for the handler of workspace teamID on the worker pool,
+// keyed like the events themselves so one user's requests are handled in
+// order, and returns so the caller can complete the response. Requests from
+// workspaces the bot isn't configured for are dropped.
+func (rcv *EventsHTTPReceiver) dispatch(teamID string, evt socketmode.Event) {
+	rcv.mu.RLock()
+	handler, ok := rcv.handlers[teamID]
+	rcv.mu.RUnlock()
+	if !ok {
+		rcv.logger.Warn().Str("workspace", teamID).Str("type", string(evt.Type)).Msg("slack request from unknown workspace, dropping")
+		return
+	}
+
+	rcv.inflight.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), eventSubmitTimeout)
+	defer cancel()
+	err := rcv.pool.Submit(ctx, dispatchKey(teamID, evt), func() {
+		defer rcv.inflight.Done()
+		handler.handle(evt)
+	})
+	if err == nil {
+		return
+	}
+	rcv.inflight.Done()
+	rcv.logger.Error().Err(err).Str("workspace", teamID).Str("type", string(evt.Type)).Msg("failed to queue slack request")
+	if handler.drop != nil {
+		handler.drop(evt, err)
+	}
+}
+
+// dispatchKey is the worker pool key of evt: the user who sent it, or the
+// workspace for requests without one
+func dispatchKey(teamID string, evt socketmode.Event) string {
+	switch data := evt.Data.(type) {
+	case slackevents.EventsAPIEvent:
+		if ev, ok := data.InnerEvent.Data.(*slackevents.MessageEvent); ok && ev.User != "" {
+			return ev.User
+		}
+	case slack.SlashCommand:
+		return data.UserID
+	case slack.InteractionCallback:
+		return data.User.ID
+	}
+	return teamID
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// signedSlackRequest builds a request signed like Slack signs them, at time at
+func signedSlackRequest(t *testing.T, body, contentType string, at time.Time) *http.Request {
+	t.Helper()
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(testSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	req := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestEventsHTTPReceiver_Verification(t *testing.T) {
+	rcv := NewEventsHTTPReceiver(testSigningSecret, nil, zerolog.Nop())
+	challenge := `{"type":"url_verification","token":"x","challenge":"abc123"}`
+
+	rec := httptest.NewRecorder()
+	rcv.ServeHTTP(rec, signedSlackRequest(t, challenge, "application/json", time.Now()))
+	if rec.Code != http.StatusOK || rec.Body.String() != "abc123" {
+		t.Fatalf("unexpected handshake response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	// a body changed after signing
+	req := signedSlackRequest(t, challenge, "application/json", time.Now())
+	req.Body = io.NopCloser(strings.NewReader(strings.Replace(challenge, "abc123", "evil", 1)))
+	rec = httptest.NewRecorder()
+	rcv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a tampered body to be rejected, got %d", rec.Code)
+	}
+
+	// a correctly signed request replayed after the window
+	rec = httptest.NewRecorder()
+	rcv.ServeHTTP(rec, signedSlackRequest(t, challenge, "application/json", time.Now().Add(-10*time.Minute)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a stale request to be rejected, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	rcv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(challenge)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unsigned request to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestEventsHTTPReceiver_Dispatch(t *testing.T) {
+	store := newTestStore(t)
+	fake := &RecordingSlack{}
+	pool := NewEventWorkerPool(2, 4, zerolog.Nop(), nil)
+	ep := NewEventProcessor(store, fake, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, pool)
+	ep.SetWorkspace("T1")
+	ep.UseHTTPEvents()
+	rcv := NewEventsHTTPReceiver(testSigningSecret, pool, zerolog.Nop())
+	rcv.AddWorkspace("T1", ep.HandleEvent, ep.DropEvent)
+
+	message := `{"type":"event_callback","team_id":"%s","event_id":"Ev1","event":{"type":"message","channel":"C1","user":"U1","text":"<@U2> :beer:","ts":"1700000000.000100"}}`
+	for _, team := range []string{"T1", "T2"} {
+		rec := httptest.NewRecorder()
+		// Slack retries deliver the same event id again
+		for i := 0; i < 2; i++ {
+			rcv.ServeHTTP(rec, signedSlackRequest(t, fmt.Sprintf(message, team), "application/json", time.Now()))
+			rcv.Wait()
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("event from %s: status %d", team, rec.Code)
+		}
+	}
+	beers, err := store.ListBeers(t.Context(), BeerFilter{})
+	if err != nil || len(beers) != 1 || beers[0].TeamID != "T1" || beers[0].Count != 1 {
+		t.Fatalf("expected one beer in T1: %+v %v", beers, err)
+	}
+
+	form := url.Values{"command": {"/beer"}, "text": {"opt-out"}, "user_id": {"U1"}, "team_id": {"T1"}, "response_url": {"https://hooks.slack.com/commands/x"}}
+	rec := httptest.NewRecorder()
+	rcv.ServeHTTP(rec, signedSlackRequest(t, form.Encode(), "application/x-www-form-urlencoded", time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("slash command: status %d", rec.Code)
+	}
+	rcv.Wait()
+	if out, _ := store.IsOptedOut(t.Context(), "U1"); !out {
+		t.Fatal("expected the slash command to opt U1 out")
+	}
+	responses := fake.Responses()
+	if len(responses) != 1 || responses[0].ResponseType != slack.ResponseTypeEphemeral {
+		t.Fatalf("unexpected responses: %+v", responses)
+	}
+
+	var got []socketmode.Event
+	rcv.AddWorkspace("T1", func(evt socketmode.Event) { got = append(got, evt) }, nil)
+	interactive := url.Values{"payload": {`{"type":"block_actions","team":{"id":"T1"},"user":{"id":"U1"}}`}}
+	rec = httptest.NewRecorder()
+	rcv.ServeHTTP(rec, signedSlackRequest(t, interactive.Encode(), "application/x-www-form-urlencoded", time.Now()))
+	rcv.Wait()
+	if rec.Code != http.StatusOK || len(got) != 1 || got[0].Type != socketmode.EventTypeInteractive {
+		t.Fatalf("unexpected interactivity dispatch: %d %+v", rec.Code, got)
+	}
+}
+
+func TestEventsHTTPReceiver_AcksBeforeProcessing(t *testing.T) {
+	store := newTestStore(t)
+	pool := NewEventWorkerPool(1, 1, zerolog.Nop(), nil)
+	ep := NewEventProcessor(store, &RecordingSlack{}, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, pool)
+	ep.SetWorkspace("T1")
+	ep.UseHTTPEvents()
+	rcv := NewEventsHTTPReceiver(testSigningSecret, pool, zerolog.Nop())
+	rcv.AddWorkspace("T1", ep.HandleEvent, ep.DropEvent)
+
+	// keep the only worker busy
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := pool.Submit(t.Context(), "U9", func() { close(started); <-release }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	message := `{"type":"event_callback","team_id":"T1","event_id":"%s","event":{"type":"message","channel":"C1","user":"U1","text":"<@U2> :beer:","ts":"%s"}}`
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	rcv.ServeHTTP(rec, signedSlackRequest(t, fmt.Sprintf(message, "Ev1", "1700000000.000100"), "application/json", time.Now()))
+	if rec.Code != http.StatusOK || time.Since(start) > time.Second {
+		t.Fatalf("expected a prompt ack, got %d after %s", rec.Code, time.Since(start))
+	}
+
+	// the queue is full now; the event is still acked within Slack's
+	// deadline, and dead-lettered
+	start = time.Now()
+	rec = httptest.NewRecorder()
+	rcv.ServeHTTP(rec, signedSlackRequest(t, fmt.Sprintf(message, "Ev2", "1700000000.000200"), "application/json", time.Now()))
+	if rec.Code != http.StatusOK || time.Since(start) > 3*time.Second {
+		t.Fatalf("expected an ack within the deadline, got %d after %s", rec.Code, time.Since(start))
+	}
+
+	close(release)
+	rcv.Wait()
+	if err := pool.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	beers, err := store.ListBeers(t.Context(), BeerFilter{})
+	if err != nil || len(beers) != 1 {
+		t.Fatalf("expected the queued event to be processed once the worker is free: %+v %v", beers, err)
+	}
+	dead, err := store.ListDeadLetters(t.Context(), "", 10)
+	if err != nil || len(dead) != 1 || dead[0].EventID != "Ev2" {
+		t.Fatalf("expected the event that could not be queued dead-lettered: %+v %v", dead, err)
+	}
+}
@@ -1,187 +1,175 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
 )
 
-type SQLiteStore struct {
-	db *sql.DB
+// Store is the persistence layer used by the bot, the API and the commands.
+// SQLStore implements it on SQLite and PostgreSQL.
+type Store interface {
+	MarkEventProcessed(ctx context.Context, teamID, eventID string, ts time.Time) error
+	TryMarkEventProcessed(ctx context.Context, teamID, eventID string, ts time.Time) (bool, error)
+	IsEventProcessed(ctx context.Context, eventID string) (bool, error)
+	PruneProcessedEvents(ctx context.Context, cutoff time.Time, limit int) (int64, error)
+
+	IncEmoji(ctx context.Context, userID, emoji string) error
+	GetCount(ctx context.Context, userID, emoji string) (int, error)
+
+	AddBeer(ctx context.Context, teamID, giverID, recipientID string, slackTs string, t time.Time, count int) error
+	GetMessageBeers(ctx context.Context, giverID, slackTs string) (map[string]int, error)
+	CountGivenInDateRange(ctx context.Context, giverID string, start time.Time, end time.Time, opts StatsOptions) (int, error)
+	CountReceivedInDateRange(ctx context.Context, recipientID string, start time.Time, end time.Time, opts StatsOptions) (int, error)
+	CountGivenOnDate(ctx context.Context, giverID string, date string) (int, error)
+	CountReceived(ctx context.Context, recipientID string, date string) (int, error)
+	GetAllGivers(ctx context.Context, opts StatsOptions) ([]string, error)
+	GetAllRecipients(ctx context.Context, opts StatsOptions) ([]string, error)
+	ForEachBeer(ctx context.Context, start, end time.Time, workspace string, fn func(ExportBeer) error) error
+	ImportBeers(ctx context.Context, rows []BeerRow, source string, dryRun bool) (int, error)
+
+	GetCachedUser(ctx context.Context, userID string) (*CachedUser, error)
+	SetCachedUser(ctx context.Context, userID, realName, profileImage string) error
+	GetCachedUsers(ctx context.Context, userIDs []string) (map[string]*CachedUser, error)
+	SaveCachedUser(ctx context.Context, u CachedUser) error
+	DeleteCachedUser(ctx context.Context, userID string) error
+	SyncUserDirectory(ctx context.Context, users []CachedUser) (int, error)
+	FindCachedUsersByName(ctx context.Context, name string) ([]string, error)
+
+	GetTimelineStats(ctx context.Context, start, end time.Time, granularity string, opts StatsOptions) ([]TimelinePoint, error)
+	GetQuarterlyStats(ctx context.Context, startYear, endYear int, opts StatsOptions) ([]QuarterlyStats, error)
+	GetTopUsers(ctx context.Context, start, end time.Time, limit int, opts StatsOptions) (*TopUsersResult, error)
+	GetHeatmapStats(ctx context.Context, start, end time.Time, opts StatsOptions) ([]HeatmapPoint, error)
+	GetPairStats(ctx context.Context, start, end time.Time, limit int, opts StatsOptions) ([]PairStats, error)
+
+	AssignTeams(ctx context.Context, assignments []TeamAssignment, source string) (int, error)
+	GetTeamHistory(ctx context.Context, userID string) ([]TeamMembership, error)
+	GetTeamSizes(ctx context.Context, start, end time.Time) (map[string]int, error)
+	GetTopTeams(ctx context.Context, start, end time.Time, opts StatsOptions) (*TopTeamsResult, error)
+	GetTeamTimelineStats(ctx context.Context, start, end time.Time, granularity, team string, opts StatsOptions) ([]TeamTimelinePoint, error)
+	GetTeamFlows(ctx context.Context, start, end time.Time, opts StatsOptions) ([]TeamFlow, error)
+
+	SetOptOut(ctx context.Context, userID string, optOut bool) error
+	IsOptedOut(ctx context.Context, userID string) (bool, error)
+	GetOptedOutUsers(ctx context.Context) (map[string]bool, error)
+	EraseUser(ctx context.Context, userID, actor, reason string) (*UserErasure, error)
+
+	CanonicalUserID(ctx context.Context, userID string) (string, error)
+	GetUserAliases(ctx context.Context) ([]UserAlias, error)
+	MergeUsers(ctx context.Context, aliasID, canonicalID, actor, reason string) (*AuditEntry, error)
+	UnmergeUser(ctx context.Context, aliasID, actor, reason string) (*AuditEntry, error)
+
+	SaveWorkspace(ctx context.Context, w Workspace) error
+	GetWorkspaces(ctx context.Context) ([]Workspace, error)
+	ClaimUnscopedRows(ctx context.Context, teamID string) (int64, error)
+
+	AddDeadLetter(ctx context.Context, eventID string, payload json.RawMessage, errMsg string) (int64, error)
+	ListDeadLetters(ctx context.Context, status string, limit int) ([]DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error)
+	RecordDeadLetterAttempt(ctx context.Context, id int64, replayErr error) error
+
+	AppendEventLog(ctx context.Context, teamID, eventID, channel, userID, ts string, payload json.RawMessage) error
+	ForEachLoggedEvent(ctx context.Context, fn func(LoggedEvent) error) error
+	GetUserLoggedEvents(ctx context.Context, userID string) ([]LoggedEvent, error)
+	GetBeersSince(ctx context.Context, teamID, sinceTs string) ([]BeerRow, error)
+	ReplaceBeersSince(ctx context.Context, teamID, sinceTs string, rows []BeerRow) error
+
+	GetBeer(ctx context.Context, id int64) (*Beer, error)
+	ListBeers(ctx context.Context, f BeerFilter) ([]Beer, error)
+	AdminAddBeer(ctx context.Context, teamID, giverID, recipientID string, t time.Time, count int, actor, reason string) (*AuditEntry, error)
+	AdjustBeer(ctx context.Context, id int64, count int, actor, reason string) (*AuditEntry, error)
+	RevokeBeer(ctx context.Context, id int64, actor, reason string) (*AuditEntry, error)
+	ListAuditLog(ctx context.Context, f AuditFilter) ([]AuditEntry, error)
+
+	RebuildDailyRollup(ctx context.Context) (int64, error)
+	DailyRollupDrift(ctx context.Context) (int, error)
+
+	BackupTo(ctx context.Context, path string) error
+	Close() error
 }
 
-func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
-	s := &SQLiteStore{db: db}
-	if err := s.migrate(); err != nil {
-		return nil, err
-	}
-	return s, nil
+// SQLStore is a Store backed by database/sql. The dialect decides placeholder
+// style, schema migrations and the few non-portable expressions. Queries use
+// readDB when set; writes go through writer when set (see store_sqlite.go).
+type SQLStore struct {
+	db      *sql.DB
+	readDB  *sql.DB
+	writer  *sqliteWriter
+	dialect *sqlDialect
+
+	// query timeouts and instrumentation, see store_query.go
+	queryOpts     QueryOptions
+	logger        zerolog.Logger
+	queryDuration *prometheus.HistogramVec
 }
 
-func (s *SQLiteStore) migrate() error {
-	// Ensure simple auxiliary tables exist
-	aux := []string{
-		`CREATE TABLE IF NOT EXISTS emoji_counts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT NOT NULL,
-			emoji TEXT NOT NULL,
-			count INTEGER NOT NULL DEFAULT 0,
-			UNIQUE(user_id, emoji)
-		);`,
-		`CREATE TABLE IF NOT EXISTS processed_events (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			event_id TEXT NOT NULL UNIQUE,
-			ts TEXT NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS user_cache (
-			user_id TEXT PRIMARY KEY,
-			real_name TEXT NOT NULL,
-			profile_image TEXT,
-			updated_at DATETIME NOT NULL
-		);`,
-	}
-	for _, st := range aux {
-		if _, err := s.db.Exec(st); err != nil {
-			return fmt.Errorf("migrate exec: %w", err)
-		}
-	}
-	// ...existing code...
-	// After beers table creation and schema validation, create indexes
-	indexStmts := []string{
-		`CREATE INDEX IF NOT EXISTS idx_beers_giver_id_ts_rfc ON beers (giver_id, ts_rfc);`,
-		`CREATE INDEX IF NOT EXISTS idx_beers_recipient_id_ts_rfc ON beers (recipient_id, ts_rfc);`,
-		`CREATE INDEX IF NOT EXISTS idx_beers_emoji_ts_rfc ON beers (ts_rfc);`,
-		`CREATE INDEX IF NOT EXISTS idx_emoji_counts_user_id_emoji ON emoji_counts (user_id, emoji);`,
-	}
-	// Only run index creation if beers table exists now
-	var beersExists int
-	if err := s.db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='beers'`).Scan(&beersExists); err == nil && beersExists > 0 {
-		for _, st := range indexStmts {
-			if _, err := s.db.Exec(st); err != nil {
-				return fmt.Errorf("migrate index exec: %w", err)
-			}
-		}
-	}
+var _ Store = (*SQLStore)(nil)
 
-	// Desired beers table create statement
-	desiredCreate := `CREATE TABLE beers (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            giver_id TEXT NOT NULL,
-            recipient_id TEXT NOT NULL,
-            ts TEXT NOT NULL, -- original Slack ts string (with fraction)
-            ts_rfc DATETIME NOT NULL, -- parsed RFC3339 time for date queries
-            count INTEGER NOT NULL DEFAULT 1,
-            UNIQUE (giver_id, recipient_id, ts)
-        );`
-
-	// If beers table doesn't exist, create it with the desired schema
-	var exists int
-	if err := s.db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='beers'`).Scan(&exists); err != nil {
-		return fmt.Errorf("migrate check beers exists: %w", err)
-	}
-	if exists == 0 {
-		if _, err := s.db.Exec(desiredCreate); err != nil {
-			return fmt.Errorf("migrate create beers: %w", err)
-		}
-		return nil
-	}
+// NewSQLiteStore returns a store on a SQLite database, migrating it to the latest schema
+func NewSQLiteStore(db *sql.DB) (*SQLStore, error) {
+	return newSQLStore(db, sqliteDialect)
+}
 
-	// beers table exists: ensure required columns and constraints
-	// collect existing columns
-	cols := map[string]bool{}
-	rows, err := s.db.Query(`PRAGMA table_info(beers);`)
-	if err != nil {
-		return fmt.Errorf("migrate pragma: %w", err)
+// NewPostgresStore returns a store on a PostgreSQL database, migrating it to the latest schema
+func NewPostgresStore(db *sql.DB) (*SQLStore, error) {
+	return newSQLStore(db, postgresDialect)
+}
+
+func newSQLStore(db *sql.DB, dialect *sqlDialect) (*SQLStore, error) {
+	s := &SQLStore{
+		db:            db,
+		dialect:       dialect,
+		queryOpts:     queryOptionsFromEnv(),
+		logger:        zerolog.Nop(),
+		queryDuration: newQueryDurationHistogram(),
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var cid int
-		var name string
-		var ctype string
-		var notnull int
-		var dflt sql.NullString
-		var pk int
-		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
-			return fmt.Errorf("migrate scan pragma: %w", err)
-		}
-		cols[name] = true
+	if err := s.migrate(); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
-	// Add missing columns non-destructively
-	if !cols["ts_rfc"] {
-		if _, err := s.db.Exec(`ALTER TABLE beers ADD COLUMN ts_rfc DATETIME;`); err != nil {
-			return fmt.Errorf("migrate add ts_rfc: %w", err)
-		}
-	}
-	if !cols["count"] {
-		if _, err := s.db.Exec(`ALTER TABLE beers ADD COLUMN count INTEGER NOT NULL DEFAULT 1;`); err != nil {
-			return fmt.Errorf("migrate add count: %w", err)
-		}
+// migrate brings the schema to the latest version. See migrations.go.
+func (s *SQLStore) migrate() error {
+	if _, err := MigrateTo(s.db, s.dialect, s.dialect.latestVersion(), ""); err != nil {
+		return fmt.Errorf("migrate: %w", err)
 	}
+	return nil
+}
 
-	// Ensure UNIQUE(giver_id, recipient_id, ts) exists. SQLite doesn't support adding
-	// UNIQUE constraints via ALTER, so if it's missing we recreate the table non-destructively
-	// by aggregating existing rows into the desired schema.
-	var createSQL sql.NullString
-	if err := s.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type='table' AND name='beers'`).Scan(&createSQL); err != nil {
-		return fmt.Errorf("migrate select create sql: %w", err)
+// Close stops the writer, waiting for queued writes, and closes the databases
+func (s *SQLStore) Close() error {
+	if s.writer != nil {
+		s.writer.Close()
 	}
-	if !createSQL.Valid || !strings.Contains(strings.ToUpper(createSQL.String), "UNIQUE") {
-		// Recreate table: create beers_new, copy aggregated data, swap tables
-		tx, err := s.db.Begin()
-		if err != nil {
-			return fmt.Errorf("migrate begin tx: %w", err)
-		}
-		// create new table with desired schema
-		if _, err := tx.Exec(desiredCreate); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("migrate create beers_new: %w", err)
-		}
-		// copy aggregated data into beers (treat missing count as 1 and compute ts_rfc if NULL)
-		copyStmt := `INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count)
-            SELECT giver_id, recipient_id, ts,
-                COALESCE(ts_rfc, datetime(substr(ts,1,instr(ts,'.')-1), 'unixepoch')),
-                COALESCE(SUM(count), COUNT(1))
-            FROM (SELECT * FROM beers) GROUP BY giver_id, recipient_id, ts;`
-		if _, err := tx.Exec(copyStmt); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("migrate copy aggregated: %w", err)
-		}
-		// drop old table and keep the new one under the original name
-		if _, err := tx.Exec(`DROP TABLE IF EXISTS beers;`); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("migrate drop old beers: %w", err)
-		}
-		if _, err := tx.Exec(`ALTER TABLE beers RENAME TO beers_old;`); err == nil {
-			// if rename succeeded unexpectedly, try to rename back
-		}
-		// Note: desiredCreate created a table named 'beers' already; we dropped old table, so commit.
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("migrate commit recreate: %w", err)
-		}
+	var readErr error
+	if s.readDB != nil {
+		readErr = s.readDB.Close()
 	}
-
-	return nil
+	return errors.Join(readErr, s.db.Close())
 }
 
-// MarkEventProcessed records that an external event (by event_id) has been
-// handled. Returns nil if inserted; if the event already exists, returns nil as well.
-func (s *SQLiteStore) MarkEventProcessed(eventID string, ts time.Time) error {
-	_, err := s.db.Exec(`INSERT OR IGNORE INTO processed_events (event_id, ts) VALUES (?, ?);`, eventID, ts.UTC().Format(time.RFC3339))
+// MarkEventProcessed records that an external event (by event_id) from
+// workspace teamID has been handled. Returns nil if inserted; if the event
+// already exists, returns nil as well.
+func (s *SQLStore) MarkEventProcessed(ctx context.Context, teamID, eventID string, ts time.Time) error {
+	_, err := s.exec(ctx, "MarkEventProcessed", `INSERT INTO processed_events (event_id, ts, team_id) VALUES (?, ?, ?) ON CONFLICT (event_id) DO NOTHING`, eventID, ts.UTC().Format(time.RFC3339), teamID)
 	return err
 }
 
-// TryMarkEventProcessed attempts to insert the event id into processed_events.
+// TryMarkEventProcessed attempts to insert the event id from workspace teamID
+// into processed_events.
 // Returns (true, nil) if we recorded the event (i.e. this process should handle it),
 // (false, nil) if the event was already present (another process handled it),
 // or (false, err) on database error.
-func (s *SQLiteStore) TryMarkEventProcessed(eventID string, ts time.Time) (bool, error) {
-	res, err := s.db.Exec(`INSERT OR IGNORE INTO processed_events (event_id, ts) VALUES (?, ?);`, eventID, ts.UTC().Format(time.RFC3339))
-	if err != nil {
-		return false, err
-	}
-	n, err := res.RowsAffected()
+func (s *SQLStore) TryMarkEventProcessed(ctx context.Context, teamID, eventID string, ts time.Time) (bool, error) {
+	n, err := s.exec(ctx, "TryMarkEventProcessed", `INSERT INTO processed_events (event_id, ts, team_id) VALUES (?, ?, ?) ON CONFLICT (event_id) DO NOTHING`, eventID, ts.UTC().Format(time.RFC3339), teamID)
 	if err != nil {
 		return false, err
 	}
@@ -189,9 +177,9 @@ func (s *SQLiteStore) TryMarkEventProcessed(eventID string, ts time.Time) (bool,
 }
 
 // IsEventProcessed returns true if we've already processed the given event id.
-func (s *SQLiteStore) IsEventProcessed(eventID string) (bool, error) {
+func (s *SQLStore) IsEventProcessed(ctx context.Context, eventID string) (bool, error) {
 	var id int
-	err := s.db.QueryRow(`SELECT id FROM processed_events WHERE event_id = ?`, eventID).Scan(&id)
+	err := s.queryRow(ctx, "IsEventProcessed", `SELECT id FROM processed_events WHERE event_id = ?`, eventID).Scan(&id)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
@@ -201,33 +189,35 @@ func (s *SQLiteStore) IsEventProcessed(eventID string) (bool, error) {
 	return true, nil
 }
 
-func (s *SQLiteStore) IncEmoji(userID, emoji string) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+// PruneProcessedEvents deletes up to limit processed_events rows recorded
+// before cutoff and returns how many were removed
+func (s *SQLStore) PruneProcessedEvents(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	return s.exec(ctx, "PruneProcessedEvents", `DELETE FROM processed_events WHERE id IN (SELECT id FROM processed_events WHERE ts < ? LIMIT ?)`, cutoff.UTC().Format(time.RFC3339), limit)
+}
 
-	// try update
-	res, err := tx.Exec(`UPDATE emoji_counts SET count = count + 1 WHERE user_id = ? AND emoji = ?`, userID, emoji)
-	if err != nil {
-		return err
-	}
-	n, err := res.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if n == 0 {
-		if _, err := tx.Exec(`INSERT INTO emoji_counts(user_id, emoji, count) VALUES(?, ?, 1)`, userID, emoji); err != nil {
+func (s *SQLStore) IncEmoji(ctx context.Context, userID, emoji string) error {
+	return s.write(ctx, "IncEmoji", func(ctx context.Context, tx *sql.Tx) error {
+		// try update
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE emoji_counts SET count = count + 1 WHERE user_id = ? AND emoji = ?`), userID, emoji)
+		if err != nil {
 			return err
 		}
-	}
-	return tx.Commit()
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO emoji_counts(user_id, emoji, count) VALUES(?, ?, 1)`), userID, emoji); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (s *SQLiteStore) GetCount(userID, emoji string) (int, error) {
+func (s *SQLStore) GetCount(ctx context.Context, userID, emoji string) (int, error) {
 	var c int
-	err := s.db.QueryRow(`SELECT count FROM emoji_counts WHERE user_id = ? AND emoji = ?`, userID, emoji).Scan(&c)
+	err := s.queryRow(ctx, "GetCount", `SELECT count FROM emoji_counts WHERE user_id = ? AND emoji = ?`, userID, emoji).Scan(&c)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
@@ -243,34 +233,138 @@ func (s *SQLiteStore) GetCount(userID, emoji string) (int, error) {
 // exists, the count will be updated to the provided value (last write wins).
 // AddBeer records a beer-gift event for a single message: it inserts or upserts
 // a row with the provided count keyed by the original Slack ts string (ts).
-func (s *SQLiteStore) AddBeer(giverID, recipientID string, slackTs string, t time.Time, count int) error {
-	_, err := s.db.Exec(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count) VALUES (?, ?, ?, ?, ?) ON CONFLICT(giver_id, recipient_id, ts) DO UPDATE SET count = excluded.count`, giverID, recipientID, slackTs, t.UTC().Format(time.RFC3339), count)
-	return err
+// teamID is the workspace the message was posted in.
+// The beer_daily rollup and, when the count changes, the audit log are updated
+// in the same transaction.
+func (s *SQLStore) AddBeer(ctx context.Context, teamID, giverID, recipientID string, slackTs string, t time.Time, count int) error {
+	return s.write(ctx, "AddBeer", func(ctx context.Context, tx *sql.Tx) error {
+		// an existing row keeps its ts_rfc and workspace, so the rollup delta
+		// lands on its day
+		day := rollupDay(t)
+		var oldCount int
+		var oldRFC, oldTeamID string
+		var revokedAt sql.NullString
+		err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT count, ts_rfc, team_id, revoked_at FROM beers WHERE giver_id = ? AND recipient_id = ? AND ts = ?`), giverID, recipientID, slackTs).Scan(&oldCount, &oldRFC, &oldTeamID, &revokedAt)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return err
+		case revokedAt.Valid:
+			// a revoked beer stays revoked when its message is seen again
+			return nil
+		default:
+			teamID = oldTeamID
+			if len(oldRFC) >= 10 {
+				day = oldRFC[:10]
+			}
+		}
+
+		var id int64
+		if err := tx.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count, team_id) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT(giver_id, recipient_id, ts) DO UPDATE SET count = excluded.count RETURNING id`), giverID, recipientID, slackTs, t.UTC().Format(time.RFC3339), count, teamID).Scan(&id); err != nil {
+			return err
+		}
+		if count == oldCount {
+			return nil
+		}
+		if err := s.addDailyRollup(ctx, tx, day, teamID, giverID, recipientID, count-oldCount, 0); err != nil {
+			return err
+		}
+		b := &Beer{ID: id, TeamID: teamID, GiverID: giverID, RecipientID: recipientID, Ts: slackTs, Time: t.UTC(), Count: count}
+		if old, err := time.Parse(time.RFC3339, oldRFC); err == nil {
+			b.Time = old
+		}
+		entry := auditBeer(auditActorBot, AuditBeerGive, b, oldCount, count, "")
+		return s.appendAudit(ctx, tx, &entry)
+	})
+}
+
+// GetMessageBeers returns the beers recorded for the message giverID sent at
+// slackTs, revoked ones included, as counts per recipient
+func (s *SQLStore) GetMessageBeers(ctx context.Context, giverID, slackTs string) (map[string]int, error) {
+	rows, err := s.query(ctx, "GetMessageBeers", `SELECT recipient_id, count FROM beers WHERE giver_id = ? AND ts = ?`, giverID, slackTs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]int{}
+	for rows.Next() {
+		var recipient string
+		var count int
+		if err := rows.Scan(&recipient, &count); err != nil {
+			return nil, err
+		}
+		out[recipient] = count
+	}
+	return out, rows.Err()
+}
+
+// StatsOptions tunes the stats queries
+type StatsOptions struct {
+	// IncludeRevoked counts revoked beers as well, for audits
+	IncludeRevoked bool
+	// ActiveOnly leaves out beers given or received by deactivated users
+	ActiveOnly bool
+	// Workspace limits stats to beers given in one workspace, or in every
+	// workspace of an Enterprise Grid org when it is an org ID
+	Workspace string
+}
+
+// departedUsers selects the IDs of deactivated users
+const departedUsers = `SELECT user_id FROM user_cache WHERE deleted`
+
+// dailyFilter is the beer_daily condition selecting the rows counted under o,
+// with its args
+func (o StatsOptions) dailyFilter() (string, []interface{}) {
+	filter, args := workspaceFilter("team_id", o.Workspace)
+	if o.ActiveOnly {
+		filter += ` AND giver_id NOT IN (` + departedUsers + `) AND recipient_id NOT IN (` + departedUsers + `)`
+	}
+	return filter, args
+}
+
+// cacheable reports whether the Redis leaderboards, which hold every
+// unrevoked beer of every workspace, answer queries under o
+func (o StatsOptions) cacheable() bool {
+	return !o.IncludeRevoked && !o.ActiveOnly && o.Workspace == ""
+}
+
+// dailyCount is the beer_daily expression counted under o
+func (o StatsOptions) dailyCount() string {
+	if o.IncludeRevoked {
+		return `(count + revoked)`
+	}
+	return `count`
 }
 
-// CountGivenInDateRange returns how many beers the giver gave in the given date range
-func (s *SQLiteStore) CountGivenInDateRange(giverID string, start time.Time, end time.Time) (int, error) {
-	// Use YYYY-MM-DD format for SQLite date() comparison
+// CountGivenInDateRange returns how many beers the giver gave in the given
+// date range, including beers given under IDs merged into theirs. Read from
+// the beer_daily rollup.
+func (s *SQLStore) CountGivenInDateRange(ctx context.Context, giverID string, start time.Time, end time.Time, opts StatsOptions) (int, error) {
 	startStr := start.Format("2006-01-02")
 	endStr := end.Format("2006-01-02")
 
 	var c int
-	query := `SELECT COALESCE(SUM(count), 0) FROM beers WHERE giver_id = ? AND substr(ts_rfc, 1, 10) BETWEEN ? AND ?`
-	err := s.db.QueryRow(query, giverID, startStr, endStr).Scan(&c)
+	filter, filterArgs := opts.dailyFilter()
+	query := `SELECT COALESCE(SUM(` + opts.dailyCount() + `), 0) FROM beer_daily WHERE giver_id = ` + canonicalUser("?") + ` AND day BETWEEN ? AND ?` + filter
+	args := append([]interface{}{giverID, giverID, startStr, endStr}, filterArgs...)
+	err := s.queryRow(ctx, "CountGivenInDateRange", query, args...).Scan(&c)
 	if err != nil {
 		return 0, err
 	}
 	return c, nil
 }
 
-// CountReceivedInDateRange returns total beers received by recipient in the given date range
-func (s *SQLiteStore) CountReceivedInDateRange(recipientID string, start time.Time, end time.Time) (int, error) {
+// CountReceivedInDateRange returns total beers received by recipient in the
+// given date range, including beers received under IDs merged into theirs.
+// Read from the beer_daily rollup.
+func (s *SQLStore) CountReceivedInDateRange(ctx context.Context, recipientID string, start time.Time, end time.Time, opts StatsOptions) (int, error) {
 	var c int
-	// Use YYYY-MM-DD format for SQLite date() comparison
-	query := `SELECT COALESCE(SUM(count), 0) FROM beers WHERE recipient_id = ? AND substr(ts_rfc, 1, 10) BETWEEN ? AND ?`
+	filter, filterArgs := opts.dailyFilter()
+	query := `SELECT COALESCE(SUM(` + opts.dailyCount() + `), 0) FROM beer_daily WHERE recipient_id = ` + canonicalUser("?") + ` AND day BETWEEN ? AND ?` + filter
 	startStr := start.Format("2006-01-02")
 	endStr := end.Format("2006-01-02")
-	err := s.db.QueryRow(query, recipientID, startStr, endStr).Scan(&c)
+	args := append([]interface{}{recipientID, recipientID, startStr, endStr}, filterArgs...)
+	err := s.queryRow(ctx, "CountReceivedInDateRange", query, args...).Scan(&c)
 	if err != nil {
 		return 0, err
 	}
@@ -278,29 +372,32 @@ func (s *SQLiteStore) CountReceivedInDateRange(recipientID string, start time.Ti
 }
 
 // CountGivenOnDate returns how many beers the giver gave on the given date (YYYY-MM-DD)
-func (s *SQLiteStore) CountGivenOnDate(giverID string, date string) (int, error) {
+func (s *SQLStore) CountGivenOnDate(ctx context.Context, giverID string, date string) (int, error) {
 	t, err := time.Parse("2006-01-02", date)
 	if err != nil {
 		return 0, err
 	}
-	return s.CountGivenInDateRange(giverID, t, t)
+	return s.CountGivenInDateRange(ctx, giverID, t, t, StatsOptions{})
 }
 
 // CountReceived returns total beers received by recipient (optionally filtered by date if not empty)
-func (s *SQLiteStore) CountReceived(recipientID string, date string) (int, error) {
+func (s *SQLStore) CountReceived(ctx context.Context, recipientID string, date string) (int, error) {
 	if date == "" {
-		return s.CountReceivedInDateRange(recipientID, time.Time{}, time.Now())
+		return s.CountReceivedInDateRange(ctx, recipientID, time.Time{}, time.Now(), StatsOptions{})
 	}
 	t, err := time.Parse("2006-01-02", date)
 	if err != nil {
 		return 0, err
 	}
-	return s.CountReceivedInDateRange(recipientID, t, t)
+	return s.CountReceivedInDateRange(ctx, recipientID, t, t, StatsOptions{})
 }
 
-// GetAllGivers returns the list of all distinct user IDs that have given at least one beer.
-func (s *SQLiteStore) GetAllGivers() ([]string, error) {
-	rows, err := s.db.Query(`SELECT DISTINCT giver_id FROM beers`)
+// GetAllGivers returns the list of all distinct user IDs that have given at
+// least one beer counted under opts, leaving out users who opted out. Merged
+// users are listed under their canonical ID.
+func (s *SQLStore) GetAllGivers(ctx context.Context, opts StatsOptions) ([]string, error) {
+	filter, args := opts.dailyFilter()
+	rows, err := s.query(ctx, "GetAllGivers", `SELECT DISTINCT giver_id FROM beer_daily WHERE `+opts.dailyCount()+` > 0 AND giver_id NOT IN (`+optedOutUsers+`)`+filter, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -313,12 +410,15 @@ func (s *SQLiteStore) GetAllGivers() ([]string, error) {
 		}
 		out = append(out, id)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
-// GetAllRecipients returns the list of all distinct recipient user IDs that have received at least one beer.
-func (s *SQLiteStore) GetAllRecipients() ([]string, error) {
-	rows, err := s.db.Query(`SELECT DISTINCT recipient_id FROM beers`)
+// GetAllRecipients returns the list of all distinct recipient user IDs that
+// have received at least one beer counted under opts, leaving out users who
+// opted out. Merged users are listed under their canonical ID.
+func (s *SQLStore) GetAllRecipients(ctx context.Context, opts StatsOptions) ([]string, error) {
+	filter, args := opts.dailyFilter()
+	rows, err := s.query(ctx, "GetAllRecipients", `SELECT DISTINCT recipient_id FROM beer_daily WHERE `+opts.dailyCount()+` > 0 AND recipient_id NOT IN (`+optedOutUsers+`)`+filter, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -331,42 +431,7 @@ func (s *SQLiteStore) GetAllRecipients() ([]string, error) {
 		}
 		out = append(out, id)
 	}
-	return out, nil
-}
-
-// CachedUser represents a cached Slack user
-type CachedUser struct {
-	UserID       string
-	RealName     string
-	ProfileImage string
-	UpdatedAt    time.Time
-}
-
-// GetCachedUser retrieves a user from the cache by user ID
-func (s *SQLiteStore) GetCachedUser(userID string) (*CachedUser, error) {
-	var u CachedUser
-	var profileImage sql.NullString
-	var updatedAt string
-	err := s.db.QueryRow(`SELECT user_id, real_name, profile_image, updated_at FROM user_cache WHERE user_id = ?`, userID).Scan(&u.UserID, &u.RealName, &profileImage, &updatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	if profileImage.Valid {
-		u.ProfileImage = profileImage.String
-	}
-	u.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
-	return &u, nil
-}
-
-// SetCachedUser stores or updates a user in the cache
-func (s *SQLiteStore) SetCachedUser(userID, realName, profileImage string) error {
-	_, err := s.db.Exec(`INSERT INTO user_cache (user_id, real_name, profile_image, updated_at) VALUES (?, ?, ?, ?)
-		ON CONFLICT(user_id) DO UPDATE SET real_name = excluded.real_name, profile_image = excluded.profile_image, updated_at = excluded.updated_at`,
-		userID, realName, profileImage, time.Now().UTC().Format(time.RFC3339))
-	return err
+	return out, rows.Err()
 }
 
 // ============================================================================
@@ -381,50 +446,35 @@ type TimelinePoint struct {
 }
 
 // GetTimelineStats returns aggregated beer counts grouped by date within a range.
-// Granularity can be "day", "week", or "month".
-func (s *SQLiteStore) GetTimelineStats(start, end time.Time, granularity string) ([]TimelinePoint, error) {
+// Granularity can be "day", "week", or "month". Reads the beer_daily rollup.
+func (s *SQLStore) GetTimelineStats(ctx context.Context, start, end time.Time, granularity string, opts StatsOptions) ([]TimelinePoint, error) {
 	startStr := start.Format("2006-01-02")
 	endStr := end.Format("2006-01-02")
 
-	fmt.Printf("[STORE] GetTimelineStats: start=%s end=%s granularity=%s\n", startStr, endStr, granularity)
-
 	var dateExpr string
 	switch granularity {
 	case "week":
-		// Group by ISO week (Monday start) - use strftime %W for week number
-		dateExpr = `strftime('%Y-W%W', substr(ts_rfc, 1, 10))`
+		// Group by week (Monday start), numbered like strftime %W
+		dateExpr = s.dialect.weekExpr(`day`)
 	case "month":
-		dateExpr = `strftime('%Y-%m', substr(ts_rfc, 1, 10))`
+		dateExpr = `substr(day, 1, 7)`
 	default: // "day"
-		dateExpr = `substr(ts_rfc, 1, 10)`
+		dateExpr = `day`
 	}
 
+	// every beer is both given and received, so both series share one sum
+	filter, filterArgs := opts.dailyFilter()
 	query := fmt.Sprintf(`
-		WITH dates AS (
-			SELECT DISTINCT %s as period FROM beers 
-			WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
-		),
-		given_counts AS (
-			SELECT %s as period, COALESCE(SUM(count), 0) as total
-			FROM beers WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
-			GROUP BY %s
-		),
-		received_counts AS (
-			SELECT %s as period, COALESCE(SUM(count), 0) as total
-			FROM beers WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
-			GROUP BY %s
-		)
-		SELECT d.period, COALESCE(g.total, 0), COALESCE(r.total, 0)
-		FROM dates d
-		LEFT JOIN given_counts g ON d.period = g.period
-		LEFT JOIN received_counts r ON d.period = r.period
-		ORDER BY d.period
-	`, dateExpr, dateExpr, dateExpr, dateExpr, dateExpr)
-
-	fmt.Printf("[STORE] GetTimelineStats query: %s\n", query)
-	rows, err := s.db.Query(query, startStr, endStr, startStr, endStr, startStr, endStr)
+		SELECT %[1]s as period, COALESCE(SUM(%[2]s), 0), COALESCE(SUM(%[2]s), 0)
+		FROM beer_daily
+		WHERE day BETWEEN ? AND ?%[3]s
+		GROUP BY %[1]s
+		HAVING SUM(%[2]s) > 0
+		ORDER BY period
+	`, dateExpr, opts.dailyCount(), filter)
+
+	rows, err := s.query(ctx, "GetTimelineStats", query, append([]interface{}{startStr, endStr}, filterArgs...)...)
 	if err != nil {
-		fmt.Printf("[STORE] GetTimelineStats query error: %v\n", err)
 		return nil, fmt.Errorf("timeline query: %w", err)
 	}
 	defer rows.Close()
@@ -433,13 +483,11 @@ func (s *SQLiteStore) GetTimelineStats(start, end time.Time, granularity string)
 	for rows.Next() {
 		var p TimelinePoint
 		if err := rows.Scan(&p.Date, &p.Given, &p.Received); err != nil {
-			fmt.Printf("[STORE] GetTimelineStats scan error: %v\n", err)
 			return nil, fmt.Errorf("timeline scan: %w", err)
 		}
 		results = append(results, p)
 	}
-	fmt.Printf("[STORE] GetTimelineStats returning %d results\n", len(results))
-	return results, nil
+	return results, rows.Err()
 }
 
 // QuarterlyStats represents stats for a single quarter
@@ -449,28 +497,28 @@ type QuarterlyStats struct {
 	Count   int `json:"count"`
 }
 
-// GetQuarterlyStats returns beer counts aggregated by quarter for a range of years
-func (s *SQLiteStore) GetQuarterlyStats(startYear, endYear int) ([]QuarterlyStats, error) {
-	fmt.Printf("[STORE] GetQuarterlyStats: startYear=%d endYear=%d\n", startYear, endYear)
+// GetQuarterlyStats returns beer counts aggregated by quarter for a range of
+// years, read from the beer_daily rollup
+func (s *SQLStore) GetQuarterlyStats(ctx context.Context, startYear, endYear int, opts StatsOptions) ([]QuarterlyStats, error) {
+	filter, filterArgs := opts.dailyFilter()
 	query := `
 		SELECT 
-			CAST(strftime('%Y', substr(ts_rfc, 1, 10)) AS INTEGER) as year,
+			CAST(substr(day, 1, 4) AS INTEGER) as year,
 			CASE 
-				WHEN CAST(strftime('%m', substr(ts_rfc, 1, 10)) AS INTEGER) BETWEEN 1 AND 3 THEN 1
-				WHEN CAST(strftime('%m', substr(ts_rfc, 1, 10)) AS INTEGER) BETWEEN 4 AND 6 THEN 2
-				WHEN CAST(strftime('%m', substr(ts_rfc, 1, 10)) AS INTEGER) BETWEEN 7 AND 9 THEN 3
+				WHEN CAST(substr(day, 6, 2) AS INTEGER) BETWEEN 1 AND 3 THEN 1
+				WHEN CAST(substr(day, 6, 2) AS INTEGER) BETWEEN 4 AND 6 THEN 2
+				WHEN CAST(substr(day, 6, 2) AS INTEGER) BETWEEN 7 AND 9 THEN 3
 				ELSE 4
 			END as quarter,
-			COALESCE(SUM(count), 0) as total
-		FROM beers
-		WHERE CAST(strftime('%Y', substr(ts_rfc, 1, 10)) AS INTEGER) BETWEEN ? AND ?
+			COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+		FROM beer_daily
+		WHERE CAST(substr(day, 1, 4) AS INTEGER) BETWEEN ? AND ?` + filter + `
 		GROUP BY year, quarter
 		ORDER BY year, quarter
 	`
 
-	rows, err := s.db.Query(query, startYear, endYear)
+	rows, err := s.query(ctx, "GetQuarterlyStats", query, append([]interface{}{startYear, endYear}, filterArgs...)...)
 	if err != nil {
-		fmt.Printf("[STORE] GetQuarterlyStats query error: %v\n", err)
 		return nil, fmt.Errorf("quarterly query: %w", err)
 	}
 	defer rows.Close()
@@ -479,19 +527,19 @@ func (s *SQLiteStore) GetQuarterlyStats(startYear, endYear int) ([]QuarterlyStat
 	for rows.Next() {
 		var q QuarterlyStats
 		if err := rows.Scan(&q.Year, &q.Quarter, &q.Count); err != nil {
-			fmt.Printf("[STORE] GetQuarterlyStats scan error: %v\n", err)
 			return nil, fmt.Errorf("quarterly scan: %w", err)
 		}
 		results = append(results, q)
 	}
-	fmt.Printf("[STORE] GetQuarterlyStats returning %d results\n", len(results))
-	return results, nil
+	return results, rows.Err()
 }
 
 // TopUserStats represents a user with their beer count
 type TopUserStats struct {
 	UserID string `json:"userId"`
 	Count  int    `json:"count"`
+	// Departed is set for deactivated users
+	Departed bool `json:"departed,omitempty"`
 }
 
 // TopUsersResult contains top givers and recipients
@@ -500,25 +548,28 @@ type TopUsersResult struct {
 	Recipients []TopUserStats `json:"recipients"`
 }
 
-// GetTopUsers returns the top N givers and recipients in a date range
-func (s *SQLiteStore) GetTopUsers(start, end time.Time, limit int) (*TopUsersResult, error) {
+// GetTopUsers returns the top N givers and recipients in a date range, read
+// from the beer_daily rollup. Users who opted out are left out of the lists.
+func (s *SQLStore) GetTopUsers(ctx context.Context, start, end time.Time, limit int, opts StatsOptions) (*TopUsersResult, error) {
 	startStr := start.Format("2006-01-02")
 	endStr := end.Format("2006-01-02")
 
-	fmt.Printf("[STORE] GetTopUsers: start=%s end=%s limit=%d\n", startStr, endStr, limit)
+	filter, filterArgs := opts.dailyFilter()
+	args := append([]interface{}{startStr, endStr}, filterArgs...)
+	args = append(args, limit)
 
 	// Get top givers
 	giversQuery := `
-		SELECT giver_id, COALESCE(SUM(count), 0) as total
-		FROM beers
-		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
+		SELECT giver_id, COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+		FROM beer_daily
+		WHERE day BETWEEN ? AND ? AND giver_id NOT IN (` + optedOutUsers + `)` + filter + `
 		GROUP BY giver_id
+		HAVING SUM(` + opts.dailyCount() + `) > 0
 		ORDER BY total DESC
 		LIMIT ?
 	`
-	giversRows, err := s.db.Query(giversQuery, startStr, endStr, limit)
+	giversRows, err := s.query(ctx, "GetTopUsers", giversQuery, args...)
 	if err != nil {
-		fmt.Printf("[STORE] GetTopUsers givers query error: %v\n", err)
 		return nil, fmt.Errorf("top givers query: %w", err)
 	}
 	defer giversRows.Close()
@@ -531,19 +582,22 @@ func (s *SQLiteStore) GetTopUsers(start, end time.Time, limit int) (*TopUsersRes
 		}
 		givers = append(givers, u)
 	}
+	if err := giversRows.Err(); err != nil {
+		return nil, fmt.Errorf("top givers query: %w", err)
+	}
 
 	// Get top recipients
 	recipientsQuery := `
-		SELECT recipient_id, COALESCE(SUM(count), 0) as total
-		FROM beers
-		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
+		SELECT recipient_id, COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+		FROM beer_daily
+		WHERE day BETWEEN ? AND ? AND recipient_id NOT IN (` + optedOutUsers + `)` + filter + `
 		GROUP BY recipient_id
+		HAVING SUM(` + opts.dailyCount() + `) > 0
 		ORDER BY total DESC
 		LIMIT ?
 	`
-	recipientsRows, err := s.db.Query(recipientsQuery, startStr, endStr, limit)
+	recipientsRows, err := s.query(ctx, "GetTopUsers", recipientsQuery, args...)
 	if err != nil {
-		fmt.Printf("[STORE] GetTopUsers recipients query error: %v\n", err)
 		return nil, fmt.Errorf("top recipients query: %w", err)
 	}
 	defer recipientsRows.Close()
@@ -556,8 +610,10 @@ func (s *SQLiteStore) GetTopUsers(start, end time.Time, limit int) (*TopUsersRes
 		}
 		recipients = append(recipients, u)
 	}
+	if err := recipientsRows.Err(); err != nil {
+		return nil, fmt.Errorf("top recipients query: %w", err)
+	}
 
-	fmt.Printf("[STORE] GetTopUsers returning %d givers, %d recipients\n", len(givers), len(recipients))
 	return &TopUsersResult{Givers: givers, Recipients: recipients}, nil
 }
 
@@ -567,24 +623,23 @@ type HeatmapPoint struct {
 	Count int    `json:"count"`
 }
 
-// GetHeatmapStats returns daily beer counts for a calendar heatmap view
-func (s *SQLiteStore) GetHeatmapStats(start, end time.Time) ([]HeatmapPoint, error) {
+// GetHeatmapStats returns daily beer counts for a calendar heatmap view, read from the beer_daily rollup
+func (s *SQLStore) GetHeatmapStats(ctx context.Context, start, end time.Time, opts StatsOptions) ([]HeatmapPoint, error) {
 	startStr := start.Format("2006-01-02")
 	endStr := end.Format("2006-01-02")
 
-	fmt.Printf("[STORE] GetHeatmapStats: start=%s end=%s\n", startStr, endStr)
-
+	filter, filterArgs := opts.dailyFilter()
 	query := `
-		SELECT substr(ts_rfc, 1, 10) as date, COALESCE(SUM(count), 0) as total
-		FROM beers
-		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
-		GROUP BY date
-		ORDER BY date
+		SELECT day, COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+		FROM beer_daily
+		WHERE day BETWEEN ? AND ?` + filter + `
+		GROUP BY day
+		HAVING SUM(` + opts.dailyCount() + `) > 0
+		ORDER BY day
 	`
 
-	rows, err := s.db.Query(query, startStr, endStr)
+	rows, err := s.query(ctx, "GetHeatmapStats", query, append([]interface{}{startStr, endStr}, filterArgs...)...)
 	if err != nil {
-		fmt.Printf("[STORE] GetHeatmapStats query error: %v\n", err)
 		return nil, fmt.Errorf("heatmap query: %w", err)
 	}
 	defer rows.Close()
@@ -593,13 +648,11 @@ func (s *SQLiteStore) GetHeatmapStats(start, end time.Time) ([]HeatmapPoint, err
 	for rows.Next() {
 		var p HeatmapPoint
 		if err := rows.Scan(&p.Date, &p.Count); err != nil {
-			fmt.Printf("[STORE] GetHeatmapStats scan error: %v\n", err)
 			return nil, fmt.Errorf("heatmap scan: %w", err)
 		}
 		results = append(results, p)
 	}
-	fmt.Printf("[STORE] GetHeatmapStats returning %d results\n", len(results))
-	return results, nil
+	return results, rows.Err()
 }
 
 // PairStats represents a giver-recipient pair with their total beer count
@@ -607,27 +660,31 @@ type PairStats struct {
 	Giver     string `json:"giver"`
 	Recipient string `json:"recipient"`
 	Count     int    `json:"count"`
+	// GiverDeparted and RecipientDeparted are set for deactivated users
+	GiverDeparted     bool `json:"giver_departed,omitempty"`
+	RecipientDeparted bool `json:"recipient_departed,omitempty"`
 }
 
-// GetPairStats returns the top giver→recipient pairs for network visualization
-func (s *SQLiteStore) GetPairStats(start, end time.Time, limit int) ([]PairStats, error) {
+// GetPairStats returns the top giver→recipient pairs for network
+// visualization, read from the beer_daily rollup. Pairs with a user who opted
+// out are left out.
+func (s *SQLStore) GetPairStats(ctx context.Context, start, end time.Time, limit int, opts StatsOptions) ([]PairStats, error) {
 	startStr := start.Format("2006-01-02")
 	endStr := end.Format("2006-01-02")
 
-	fmt.Printf("[STORE] GetPairStats: start=%s end=%s limit=%d\n", startStr, endStr, limit)
-
+	filter, filterArgs := opts.dailyFilter()
 	query := `
-		SELECT giver_id, recipient_id, COALESCE(SUM(count), 0) as total
-		FROM beers
-		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ?
+		SELECT giver_id, recipient_id, COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+		FROM beer_daily
+		WHERE day BETWEEN ? AND ? AND giver_id NOT IN (` + optedOutUsers + `) AND recipient_id NOT IN (` + optedOutUsers + `)` + filter + `
 		GROUP BY giver_id, recipient_id
+		HAVING SUM(` + opts.dailyCount() + `) > 0
 		ORDER BY total DESC
 		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, startStr, endStr, limit)
+	rows, err := s.query(ctx, "GetPairStats", query, append(append([]interface{}{startStr, endStr}, filterArgs...), limit)...)
 	if err != nil {
-		fmt.Printf("[STORE] GetPairStats query error: %v\n", err)
 		return nil, fmt.Errorf("pairs query: %w", err)
 	}
 	defer rows.Close()
@@ -636,11 +693,9 @@ func (s *SQLiteStore) GetPairStats(start, end time.Time, limit int) ([]PairStats
 	for rows.Next() {
 		var p PairStats
 		if err := rows.Scan(&p.Giver, &p.Recipient, &p.Count); err != nil {
-			fmt.Printf("[STORE] GetPairStats scan error: %v\n", err)
 			return nil, fmt.Errorf("pairs scan: %w", err)
 		}
 		results = append(results, p)
 	}
-	fmt.Printf("[STORE] GetPairStats returning %d results\n", len(results))
-	return results, nil
+	return results, rows.Err()
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidMerge is returned when merging a user into themselves, directly
+// or through an earlier merge
+var ErrInvalidMerge = errors.New("cannot merge a user into itself")
+
+// ErrAliasNotFound is returned when unmerging a user who was never merged
+var ErrAliasNotFound = errors.New("user is not merged")
+
+// UserAlias is a user ID merged into another, canonical one
+type UserAlias struct {
+	AliasID     string `json:"alias_id"`
+	CanonicalID string `json:"canonical_id"`
+	MergedAt    string `json:"merged_at"`
+}
+
+// canonicalUser is the SQL expression resolving the user ID in expr to the
+// ID it was merged into
+func canonicalUser(expr string) string {
+	return `COALESCE((SELECT canonical_id FROM user_aliases WHERE alias_id = ` + expr + `), ` + expr + `)`
+}
+
+// CanonicalUserID returns the ID userID was merged into, or userID itself
+func (s *SQLStore) CanonicalUserID(ctx context.Context, userID string) (string, error) {
+	var id string
+	if err := s.queryRow(ctx, "CanonicalUserID", `SELECT `+canonicalUser("?"), userID, userID).Scan(&id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetUserAliases returns every merged user ID, grouped by canonical ID
+func (s *SQLStore) GetUserAliases(ctx context.Context) ([]UserAlias, error) {
+	rows, err := s.query(ctx, "GetUserAliases", `SELECT alias_id, canonical_id, merged_at FROM user_aliases ORDER BY canonical_id, alias_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []UserAlias
+	for rows.Next() {
+		var a UserAlias
+		if err := rows.Scan(&a.AliasID, &a.CanonicalID, &a.MergedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// MergeUsers makes aliasID an alias of canonicalID, so every stat counts the
+// alias's beers for the canonical user. Beers keep their original IDs, which
+// lets UnmergeUser undo the merge; the beer_daily rollup is rebuilt with the
+// canonical IDs. Users already merged into aliasID move along, and merging
+// into an alias merges into its canonical user. The audit entry records the
+// alias as GiverID and the canonical user as RecipientID.
+func (s *SQLStore) MergeUsers(ctx context.Context, aliasID, canonicalID, actor, reason string) (*AuditEntry, error) {
+	var entry AuditEntry
+	err := s.writeUnbounded(ctx, "MergeUsers", func(ctx context.Context, tx *sql.Tx) error {
+		var target string
+		if err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+canonicalUser("?")), canonicalID, canonicalID).Scan(&target); err != nil {
+			return fmt.Errorf("resolve %s: %w", canonicalID, err)
+		}
+		if target == aliasID {
+			return ErrInvalidMerge
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE user_aliases SET canonical_id = ? WHERE canonical_id = ?`), target, aliasID); err != nil {
+			return fmt.Errorf("move aliases of %s: %w", aliasID, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO user_aliases (alias_id, canonical_id, merged_at) VALUES (?, ?, ?)
+			ON CONFLICT (alias_id) DO UPDATE SET canonical_id = excluded.canonical_id, merged_at = excluded.merged_at`),
+			aliasID, target, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("add alias: %w", err)
+		}
+		if _, err := s.rebuildDailyRollupSince(ctx, tx, ""); err != nil {
+			return err
+		}
+		entry = AuditEntry{Actor: actor, Action: AuditUserMerge, GiverID: aliasID, RecipientID: target, Reason: reason}
+		return s.appendAudit(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("merge users: %w", err)
+	}
+	return &entry, nil
+}
+
+// UnmergeUser undoes MergeUsers: aliasID counts as a user of its own again
+func (s *SQLStore) UnmergeUser(ctx context.Context, aliasID, actor, reason string) (*AuditEntry, error) {
+	var entry AuditEntry
+	err := s.writeUnbounded(ctx, "UnmergeUser", func(ctx context.Context, tx *sql.Tx) error {
+		var canonicalID string
+		err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT canonical_id FROM user_aliases WHERE alias_id = ?`), aliasID).Scan(&canonicalID)
+		if err == sql.ErrNoRows {
+			return ErrAliasNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM user_aliases WHERE alias_id = ?`), aliasID); err != nil {
+			return fmt.Errorf("remove alias: %w", err)
+		}
+		if _, err := s.rebuildDailyRollupSince(ctx, tx, ""); err != nil {
+			return err
+		}
+		entry = AuditEntry{Actor: actor, Action: AuditUserUnmerge, GiverID: aliasID, RecipientID: canonicalID, Reason: reason}
+		return s.appendAudit(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unmerge user: %w", err)
+	}
+	return &entry, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditBeerGive     = "beer.give"     // the bot recorded or updated a beer from Slack
+	AuditBeerImport   = "beer.import"   // a beer was imported from a file
+	AuditBeerAdd      = "beer.add"      // an admin added a beer
+	AuditBeerAdjust   = "beer.adjust"   // an admin changed a beer's count
+	AuditBeerRevoke   = "beer.revoke"   // an admin removed a beer
+	AuditBeersRebuild = "beers.rebuild" // beers were re-derived from the event log
+	AuditUserErase    = "user.erase"    // a user's data was anonymized
+	AuditUserMerge    = "user.merge"    // a user ID was merged into another
+	AuditUserUnmerge  = "user.unmerge"  // a merge was undone
+)
+
+// Audit log actors for changes not made through the admin API
+const (
+	auditActorBot     = "bot"
+	auditActorImport  = "import"
+	auditActorRebuild = "rebuild"
+)
+
+// AuditEntry is one row of the append-only audit log. Beer changes carry the
+// beer's identity and its count before and after the change.
+type AuditEntry struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Actor       string     `json:"actor"`
+	Action      string     `json:"action"`
+	BeerID      int64      `json:"beer_id,omitempty"`
+	GiverID     string     `json:"giver_id,omitempty"`
+	RecipientID string     `json:"recipient_id,omitempty"`
+	Ts          string     `json:"ts,omitempty"`
+	BeerTime    *time.Time `json:"beer_time,omitempty"`
+	OldCount    int        `json:"old_count"`
+	NewCount    int        `json:"new_count"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// Delta is the change in beers the entry records
+func (e *AuditEntry) Delta() int {
+	return e.NewCount - e.OldCount
+}
+
+// AuditFilter narrows ListAuditLog. Zero fields match everything.
+type AuditFilter struct {
+	Action string
+	Actor  string
+	// UserID matches entries where the user gave or received the beer
+	UserID string
+	BeerID int64
+	// Before returns entries with a smaller id, for paging
+	Before int64
+	Limit  int
+}
+
+// auditBeer builds the audit entry for a change to beer b
+func auditBeer(actor, action string, b *Beer, oldCount, newCount int, reason string) AuditEntry {
+	at := b.Time
+	return AuditEntry{
+		Actor:       actor,
+		Action:      action,
+		BeerID:      b.ID,
+		GiverID:     b.GiverID,
+		RecipientID: b.RecipientID,
+		Ts:          b.Ts,
+		BeerTime:    &at,
+		OldCount:    oldCount,
+		NewCount:    newCount,
+		Reason:      reason,
+	}
+}
+
+// appendAudit records e in the audit log as part of tx and sets its id and time
+func (s *SQLStore) appendAudit(ctx context.Context, tx *sql.Tx, e *AuditEntry) error {
+	e.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	var beerID sql.NullInt64
+	if e.BeerID != 0 {
+		beerID = sql.NullInt64{Int64: e.BeerID, Valid: true}
+	}
+	beerTime := ""
+	if e.BeerTime != nil {
+		beerTime = e.BeerTime.UTC().Format(time.RFC3339)
+	}
+	err := tx.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO audit_log (created_at, actor, action, beer_id, giver_id, recipient_id, ts, beer_time, old_count, new_count, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+		e.CreatedAt.Format(time.RFC3339), e.Actor, e.Action, beerID, e.GiverID, e.RecipientID, e.Ts, beerTime, e.OldCount, e.NewCount, e.Reason).Scan(&e.ID)
+	if err != nil {
+		return fmt.Errorf("append audit log: %w", err)
+	}
+	return nil
+}
+
+// ListAuditLog returns audit entries matching f, newest first
+func (s *SQLStore) ListAuditLog(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	if f.Action != "" {
+		where = append(where, `action = ?`)
+		args = append(args, f.Action)
+	}
+	if f.Actor != "" {
+		where = append(where, `actor = ?`)
+		args = append(args, f.Actor)
+	}
+	if f.UserID != "" {
+		where = append(where, `(giver_id = ? OR recipient_id = ?)`)
+		args = append(args, f.UserID, f.UserID)
+	}
+	if f.BeerID != 0 {
+		where = append(where, `beer_id = ?`)
+		args = append(args, f.BeerID)
+	}
+	if f.Before != 0 {
+		where = append(where, `id < ?`)
+		args = append(args, f.Before)
+	}
+	query := `SELECT id, created_at, actor, action, beer_id, giver_id, recipient_id, ts, beer_time, old_count, new_count, reason FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.query(ctx, "ListAuditLog", query+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("audit log query: %w", err)
+	}
+	defer rows.Close()
+
+	out := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var createdAt, beerTime string
+		var beerID sql.NullInt64
+		if err := rows.Scan(&e.ID, &createdAt, &e.Actor, &e.Action, &beerID, &e.GiverID, &e.RecipientID, &e.Ts, &beerTime, &e.OldCount, &e.NewCount, &e.Reason); err != nil {
+			return nil, fmt.Errorf("audit log scan: %w", err)
+		}
+		e.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		e.BeerID = beerID.Int64
+		if t, err := time.Parse(time.RFC3339, beerTime); err == nil {
+			e.BeerTime = &t
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// benchmarkStore seeds a store with two years of beers between 50 users who
+// each thank a handful of teammates, builds the rollup, and returns the range
+func benchmarkStore(b *testing.B, beers int) (*SQLStore, time.Time, time.Time) {
+	b.Helper()
+	store := newTestStore(b)
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		b.Fatalf("begin: %v", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		b.Fatalf("prepare: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	end := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+	start := end.AddDate(-2, 0, 0)
+	span := end.Sub(start)
+	for i := 0; i < beers; i++ {
+		at := start.Add(time.Duration(rng.Int63n(int64(span))))
+		g := rng.Intn(50)
+		giver := fmt.Sprintf("U%03d", g)
+		recipient := fmt.Sprintf("U%03d", (g+1+rng.Intn(4))%50)
+		ts := fmt.Sprintf("%d.%06d", at.Unix(), i)
+		if _, err := stmt.Exec(giver, recipient, ts, at.Format(time.RFC3339), 1+rng.Intn(3)); err != nil {
+			b.Fatalf("seed: %v", err)
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		b.Fatalf("commit: %v", err)
+	}
+	if _, err := store.RebuildDailyRollup(b.Context()); err != nil {
+		b.Fatalf("rollup: %v", err)
+	}
+	return store, start, end
+}
+
+// The pre-rollup queries, kept here as the baseline the rollup is measured against
+const (
+	benchBeersTopGivers = `SELECT giver_id, COALESCE(SUM(count), 0) as total FROM beers
+		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ? GROUP BY giver_id ORDER BY total DESC LIMIT ?`
+	benchBeersTopRecipients = `SELECT recipient_id, COALESCE(SUM(count), 0) as total FROM beers
+		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ? GROUP BY recipient_id ORDER BY total DESC LIMIT ?`
+	benchBeersHeatmap = `SELECT substr(ts_rfc, 1, 10) as date, COALESCE(SUM(count), 0) as total FROM beers
+		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ? GROUP BY date ORDER BY date`
+	benchBeersPairs = `SELECT giver_id, recipient_id, COALESCE(SUM(count), 0) as total FROM beers
+		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ? GROUP BY giver_id, recipient_id ORDER BY total DESC LIMIT ?`
+	benchBeersTimeline = `SELECT strftime('%Y-%m', substr(ts_rfc, 1, 10)) as period, COALESCE(SUM(count), 0) FROM beers
+		WHERE substr(ts_rfc, 1, 10) BETWEEN ? AND ? GROUP BY period ORDER BY period`
+)
+
+func benchQuery(b *testing.B, store *SQLStore, query string, args ...interface{}) {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		b.Fatalf("query: %v", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+}
+
+// BenchmarkStats compares each stats query on the raw beers table ("beers")
+// with the rollup-backed store method ("rollup"), all-time and for the last 30 days
+func BenchmarkStats(b *testing.B) {
+	store, start, end := benchmarkStore(b, 100000)
+	ranges := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"all", start, end},
+		{"30d", end.AddDate(0, 0, -30), end},
+	}
+
+	for _, r := range ranges {
+		start, end := r.start, r.end
+		from, to := start.Format("2006-01-02"), end.Format("2006-01-02")
+		cases := []struct {
+			name   string
+			beers  func()
+			rollup func() error
+		}{
+			{"TopUsers", func() {
+				benchQuery(b, store, benchBeersTopGivers, from, to, 10)
+				benchQuery(b, store, benchBeersTopRecipients, from, to, 10)
+			}, func() error { _, err := store.GetTopUsers(b.Context(), start, end, 10, StatsOptions{}); return err }},
+			{"Heatmap", func() { benchQuery(b, store, benchBeersHeatmap, from, to) },
+				func() error { _, err := store.GetHeatmapStats(b.Context(), start, end, StatsOptions{}); return err }},
+			{"Pairs", func() { benchQuery(b, store, benchBeersPairs, from, to, 50) },
+				func() error { _, err := store.GetPairStats(b.Context(), start, end, 50, StatsOptions{}); return err }},
+			{"Timeline", func() { benchQuery(b, store, benchBeersTimeline, from, to) },
+				func() error {
+					_, err := store.GetTimelineStats(b.Context(), start, end, "month", StatsOptions{})
+					return err
+				}},
+		}
+		for _, c := range cases {
+			b.Run(c.name+"/"+r.name+"/beers", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					c.beers()
+				}
+			})
+			b.Run(c.name+"/"+r.name+"/rollup", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := c.rollup(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkAddBeer(b *testing.B) {
+	store := newTestStore(b)
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.AddBeer(b.Context(), "", "U1", "U2", fmt.Sprintf("%d.%06d", at.Unix(), i), at, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
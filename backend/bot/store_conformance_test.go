@@ -0,0 +1,829 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPostgresTestStore opens a store in a fresh schema on the server named by
+// BEERBOT_TEST_POSTGRES_DSN, skipping the test when it is not set. The schema
+// is dropped when the test finishes.
+func newPostgresTestStore(t *testing.T) Store {
+	t.Helper()
+	dsn := os.Getenv("BEERBOT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("BEERBOT_TEST_POSTGRES_DSN not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("bwm_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("parse dsn: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewPostgresStore(db)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	return store
+}
+
+func TestStoreConformance_SQLite(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) Store { return newTestStore(t) })
+}
+
+func TestStoreConformance_Postgres(t *testing.T) {
+	testStoreConformance(t, newPostgresTestStore)
+}
+
+// testStoreConformance runs the behaviour every Store implementation must share
+func testStoreConformance(t *testing.T, newStore func(t *testing.T) Store) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatalf("parse %s: %v", s, err)
+		}
+		return d.Add(12 * time.Hour)
+	}
+
+	t.Run("ProcessedEvents", func(t *testing.T) {
+		store := newStore(t)
+		old := time.Now().Add(-48 * time.Hour)
+
+		first, err := store.TryMarkEventProcessed(t.Context(), "", "ev-1", old)
+		if err != nil || !first {
+			t.Fatalf("first mark: %v %v", first, err)
+		}
+		again, err := store.TryMarkEventProcessed(t.Context(), "", "ev-1", old)
+		if err != nil || again {
+			t.Fatalf("second mark: %v %v", again, err)
+		}
+		if err := store.MarkEventProcessed(t.Context(), "", "ev-2", time.Now()); err != nil {
+			t.Fatalf("mark: %v", err)
+		}
+		if ok, err := store.IsEventProcessed(t.Context(), "ev-2"); err != nil || !ok {
+			t.Fatalf("is processed: %v %v", ok, err)
+		}
+		if ok, err := store.IsEventProcessed(t.Context(), "ev-3"); err != nil || ok {
+			t.Fatalf("unknown event reported processed: %v %v", ok, err)
+		}
+
+		n, err := store.PruneProcessedEvents(t.Context(), time.Now().Add(-time.Hour), 10)
+		if err != nil || n != 1 {
+			t.Fatalf("prune: %d %v", n, err)
+		}
+		if ok, _ := store.IsEventProcessed(t.Context(), "ev-1"); ok {
+			t.Fatalf("pruned event still present")
+		}
+	})
+
+	t.Run("EmojiCounts", func(t *testing.T) {
+		store := newStore(t)
+		for i := 0; i < 3; i++ {
+			if err := store.IncEmoji(t.Context(), "U1", ":beer:"); err != nil {
+				t.Fatalf("inc: %v", err)
+			}
+		}
+		if c, err := store.GetCount(t.Context(), "U1", ":beer:"); err != nil || c != 3 {
+			t.Fatalf("count: %d %v", c, err)
+		}
+		if c, err := store.GetCount(t.Context(), "U2", ":beer:"); err != nil || c != 0 {
+			t.Fatalf("missing count: %d %v", c, err)
+		}
+	})
+
+	t.Run("Beers", func(t *testing.T) {
+		store := newStore(t)
+		beers := []struct {
+			giver, recipient, ts, date string
+			count                      int
+		}{
+			{"U1", "U2", "1.1", "2023-01-01", 2}, // Sunday: week 00
+			{"U1", "U3", "1.2", "2023-01-02", 1}, // Monday: week 01
+			{"U2", "U1", "1.3", "2023-04-15", 4},
+			{"U1", "U2", "1.4", "2023-12-31", 1},
+		}
+		for _, b := range beers {
+			if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, day(b.date), b.count); err != nil {
+				t.Fatalf("add beer: %v", err)
+			}
+		}
+		// upsert: last write wins
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1.1", day("2023-01-01"), 3); err != nil {
+			t.Fatalf("upsert beer: %v", err)
+		}
+
+		if c, _ := store.CountGivenOnDate(t.Context(), "U1", "2023-01-01"); c != 3 {
+			t.Fatalf("given on date: %d", c)
+		}
+		if c, _ := store.CountGivenInDateRange(t.Context(), "U1", day("2023-01-01"), day("2023-12-31"), StatsOptions{}); c != 5 {
+			t.Fatalf("given in range: %d", c)
+		}
+		if c, _ := store.CountReceivedInDateRange(t.Context(), "U2", day("2023-01-01"), day("2023-12-31"), StatsOptions{}); c != 4 {
+			t.Fatalf("received in range: %d", c)
+		}
+		if c, _ := store.CountReceived(t.Context(), "U1", "2023-04-15"); c != 4 {
+			t.Fatalf("received on date: %d", c)
+		}
+		if givers, _ := store.GetAllGivers(t.Context(), StatsOptions{}); len(givers) != 2 {
+			t.Fatalf("givers: %v", givers)
+		}
+		if recipients, _ := store.GetAllRecipients(t.Context(), StatsOptions{}); len(recipients) != 3 {
+			t.Fatalf("recipients: %v", recipients)
+		}
+
+		weeks, err := store.GetTimelineStats(t.Context(), day("2023-01-01"), day("2023-01-08"), "week", StatsOptions{})
+		if err != nil {
+			t.Fatalf("weekly timeline: %v", err)
+		}
+		if len(weeks) != 2 || weeks[0].Date != "2023-W00" || weeks[0].Given != 3 || weeks[1].Date != "2023-W01" {
+			t.Fatalf("unexpected weekly timeline: %+v", weeks)
+		}
+		months, err := store.GetTimelineStats(t.Context(), day("2023-01-01"), day("2023-12-31"), "month", StatsOptions{})
+		if err != nil {
+			t.Fatalf("monthly timeline: %v", err)
+		}
+		if len(months) != 3 || months[0].Date != "2023-01" || months[0].Given != 4 {
+			t.Fatalf("unexpected monthly timeline: %+v", months)
+		}
+
+		quarters, err := store.GetQuarterlyStats(t.Context(), 2023, 2023, StatsOptions{})
+		if err != nil {
+			t.Fatalf("quarterly: %v", err)
+		}
+		want := []QuarterlyStats{{2023, 1, 4}, {2023, 2, 4}, {2023, 4, 1}}
+		if len(quarters) != len(want) {
+			t.Fatalf("unexpected quarters: %+v", quarters)
+		}
+		for i := range want {
+			if quarters[i] != want[i] {
+				t.Fatalf("unexpected quarters: %+v", quarters)
+			}
+		}
+
+		top, err := store.GetTopUsers(t.Context(), day("2023-01-01"), day("2023-12-31"), 1, StatsOptions{})
+		if err != nil {
+			t.Fatalf("top users: %v", err)
+		}
+		if len(top.Givers) != 1 || top.Givers[0].UserID != "U1" || top.Givers[0].Count != 5 {
+			t.Fatalf("unexpected top givers: %+v", top.Givers)
+		}
+		if len(top.Recipients) != 1 || top.Recipients[0].Count != 4 {
+			t.Fatalf("unexpected top recipients: %+v", top.Recipients)
+		}
+
+		heat, err := store.GetHeatmapStats(t.Context(), day("2023-01-01"), day("2023-01-31"), StatsOptions{})
+		if err != nil || len(heat) != 2 || heat[0].Date != "2023-01-01" || heat[0].Count != 3 {
+			t.Fatalf("unexpected heatmap: %+v %v", heat, err)
+		}
+
+		pairs, err := store.GetPairStats(t.Context(), day("2023-01-01"), day("2023-12-31"), 10, StatsOptions{})
+		if err != nil || len(pairs) != 3 || pairs[0].Count != 4 {
+			t.Fatalf("unexpected pairs: %+v %v", pairs, err)
+		}
+	})
+
+	t.Run("UserDirectory", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.SetCachedUser(t.Context(), "U1", "Ada", "img1"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		users := []CachedUser{
+			{UserID: "U1", RealName: "Ada Lovelace", ProfileImage: "img2", DisplayName: "ada", Title: "Analyst", TZ: "Europe/London", Email: "ada@example.com", Profile: map[string]string{"Team": "Engines"}},
+			{UserID: "B1", RealName: "Beer Bot", IsBot: true},
+			{UserID: "U2", RealName: "Gone", Deleted: true},
+		}
+		if n, err := store.SyncUserDirectory(t.Context(), users); err != nil || n != 3 {
+			t.Fatalf("sync: %d %v", n, err)
+		}
+		got, err := store.GetCachedUsers(t.Context(), []string{"U1", "B1", "U2", "U3"})
+		if err != nil || len(got) != 3 {
+			t.Fatalf("unexpected cached users: %+v %v", got, err)
+		}
+		u := got["U1"]
+		if u.RealName != "Ada Lovelace" || u.ProfileImage != "img2" || u.DisplayName != "ada" || u.Title != "Analyst" || u.TZ != "Europe/London" ||
+			u.Email != "ada@example.com" || u.Profile["Team"] != "Engines" || u.SyncedAt.IsZero() || u.IsBot || u.Deleted {
+			t.Fatalf("unexpected synced user: %+v", u)
+		}
+		if !got["B1"].IsBot || !got["U2"].Deleted {
+			t.Fatalf("expected bot and deleted flags: %+v %+v", got["B1"], got["U2"])
+		}
+		// a lazy cache write keeps the synced attributes
+		if err := store.SetCachedUser(t.Context(), "U1", "Ada L", "img3"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if u, _ := store.GetCachedUser(t.Context(), "U1"); u == nil || u.RealName != "Ada L" || u.Email != "ada@example.com" {
+			t.Fatalf("unexpected cached user: %+v", u)
+		}
+	})
+
+	t.Run("ActiveOnly", func(t *testing.T) {
+		store := newStore(t)
+		if _, err := store.SyncUserDirectory(t.Context(), []CachedUser{{UserID: "U1"}, {UserID: "U2", Deleted: true}, {UserID: "U3", Guest: true}}); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		for _, b := range []struct {
+			giver, recipient, ts string
+		}{{"U1", "U2", "1672574400.000100"}, {"U1", "U3", "1672574400.000200"}, {"U2", "U3", "1672574400.000300"}} {
+			if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, day("2023-01-01"), 1); err != nil {
+				t.Fatalf("add beer: %v", err)
+			}
+		}
+		from, to := day("2023-01-01"), day("2023-01-02")
+		all, err := store.GetTopUsers(t.Context(), from, to, 10, StatsOptions{})
+		if err != nil || len(all.Recipients) != 2 || len(all.Givers) != 2 {
+			t.Fatalf("unexpected recipients: %+v %v", all, err)
+		}
+		// beers to or from a deactivated user are left out; guests still count
+		active, err := store.GetTopUsers(t.Context(), from, to, 10, StatsOptions{ActiveOnly: true})
+		if err != nil || len(active.Recipients) != 1 || active.Recipients[0].UserID != "U3" || active.Recipients[0].Count != 1 ||
+			len(active.Givers) != 1 || active.Givers[0].UserID != "U1" {
+			t.Fatalf("unexpected active recipients: %+v %v", active, err)
+		}
+		if n, _ := store.CountGivenInDateRange(t.Context(), "U1", from, from, StatsOptions{ActiveOnly: true}); n != 1 {
+			t.Fatalf("expected 1 active beer given, got %d", n)
+		}
+	})
+
+	t.Run("Teams", func(t *testing.T) {
+		store := newStore(t)
+		assign := func(source string, a ...TeamAssignment) int {
+			t.Helper()
+			n, err := store.AssignTeams(t.Context(), a, source)
+			if err != nil {
+				t.Fatalf("assign: %v", err)
+			}
+			return n
+		}
+		if n := assign(teamSourceAdmin, TeamAssignment{"U1", "Alpha", day("2023-01-01")}, TeamAssignment{"U2", "Beta", day("2023-01-01")}); n != 2 {
+			t.Fatalf("expected 2 changes, got %d", n)
+		}
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1672920000.000100", day("2023-01-05"), 2); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		// moving teams keeps January with Alpha
+		if n := assign(teamSourceAdmin, TeamAssignment{"U1", "Beta", day("2023-02-01")}); n != 1 {
+			t.Fatalf("expected the move recorded, got %d", n)
+		}
+		if n := assign(teamSourceAdmin, TeamAssignment{"U1", "Beta", day("2023-03-01")}); n != 0 {
+			t.Fatalf("expected no change for the same team, got %d", n)
+		}
+		// the Slack profile does not override an admin's choice
+		if n := assign(teamSourceSlack, TeamAssignment{"U1", "Gamma", day("2023-03-01")}); n != 0 {
+			t.Fatalf("expected slack assignment skipped, got %d", n)
+		}
+		if err := store.AddBeer(t.Context(), "", "U1", "U3", "1675598400.000100", day("2023-02-05"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+
+		history, err := store.GetTeamHistory(t.Context(), "U1")
+		if err != nil || len(history) != 2 || history[0].Team != "Alpha" || history[0].To != "2023-02-01" ||
+			history[1].Team != "Beta" || history[1].From != "2023-02-01" || history[1].To != "" || history[1].Source != teamSourceAdmin {
+			t.Fatalf("unexpected history: %+v %v", history, err)
+		}
+
+		top, err := store.GetTopTeams(t.Context(), day("2023-01-01"), day("2023-02-28"), StatsOptions{})
+		if err != nil {
+			t.Fatalf("top teams: %v", err)
+		}
+		if len(top.Givers) != 2 || top.Givers[0] != (TeamStats{Team: "Alpha", Count: 2}) || top.Givers[1] != (TeamStats{Team: "Beta", Count: 1}) {
+			t.Fatalf("unexpected giving teams: %+v", top.Givers)
+		}
+		// U3 has no team
+		if len(top.Recipients) != 1 || top.Recipients[0] != (TeamStats{Team: "Beta", Count: 2}) {
+			t.Fatalf("unexpected receiving teams: %+v", top.Recipients)
+		}
+
+		sizes, err := store.GetTeamSizes(t.Context(), day("2023-01-10"), day("2023-01-10"))
+		if err != nil || len(sizes) != 2 || sizes["Alpha"] != 1 || sizes["Beta"] != 1 {
+			t.Fatalf("unexpected january sizes: %v %v", sizes, err)
+		}
+		if sizes, _ := store.GetTeamSizes(t.Context(), day("2023-01-01"), day("2023-02-28")); sizes["Alpha"] != 1 || sizes["Beta"] != 2 {
+			t.Fatalf("unexpected sizes: %v", sizes)
+		}
+
+		timeline, err := store.GetTeamTimelineStats(t.Context(), day("2023-01-01"), day("2023-02-28"), "month", "", StatsOptions{})
+		want := []TeamTimelinePoint{
+			{Date: "2023-01", Team: "Alpha", Given: 2},
+			{Date: "2023-01", Team: "Beta", Received: 2},
+			{Date: "2023-02", Team: "Beta", Given: 1},
+		}
+		if err != nil || len(timeline) != len(want) {
+			t.Fatalf("unexpected timeline: %+v %v", timeline, err)
+		}
+		for i := range want {
+			if timeline[i] != want[i] {
+				t.Fatalf("timeline %d: got %+v, want %+v", i, timeline[i], want[i])
+			}
+		}
+		if beta, _ := store.GetTeamTimelineStats(t.Context(), day("2023-01-01"), day("2023-02-28"), "month", "Beta", StatsOptions{}); len(beta) != 2 {
+			t.Fatalf("unexpected Beta timeline: %+v", beta)
+		}
+
+		// U3 has no team, so that beer is unassigned
+		flows, err := store.GetTeamFlows(t.Context(), day("2023-01-01"), day("2023-02-28"), StatsOptions{})
+		if err != nil || len(flows) != 2 || flows[0] != (TeamFlow{"Alpha", "Beta", 2}) || flows[1] != (TeamFlow{"Beta", "", 1}) {
+			t.Fatalf("unexpected team flows: %+v %v", flows, err)
+		}
+
+		// leaving a team closes the membership
+		if n := assign(teamSourceAdmin, TeamAssignment{"U2", "", day("2023-03-01")}); n != 1 {
+			t.Fatalf("expected U2 to leave, got %d", n)
+		}
+		if sizes, _ := store.GetTeamSizes(t.Context(), day("2023-03-10"), day("2023-03-10")); sizes["Beta"] != 1 {
+			t.Fatalf("unexpected march sizes: %v", sizes)
+		}
+	})
+
+	t.Run("Privacy", func(t *testing.T) {
+		store := newStore(t)
+		for _, b := range []struct {
+			giver, recipient, ts string
+		}{{"U1", "U2", "1672574400.000100"}, {"U2", "U3", "1672574400.000200"}} {
+			if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, day("2023-01-01"), 1); err != nil {
+				t.Fatalf("add beer: %v", err)
+			}
+		}
+		if err := store.SetOptOut(t.Context(), "U2", true); err != nil {
+			t.Fatalf("opt out: %v", err)
+		}
+		if out, err := store.IsOptedOut(t.Context(), "U2"); err != nil || !out {
+			t.Fatalf("expected U2 opted out: %v %v", out, err)
+		}
+		from, to := day("2023-01-01"), day("2023-01-02")
+		// opted out users leave the leaderboards but still count
+		givers, err := store.GetAllGivers(t.Context(), StatsOptions{})
+		if err != nil || len(givers) != 1 || givers[0] != "U1" {
+			t.Fatalf("unexpected givers: %v %v", givers, err)
+		}
+		top, err := store.GetTopUsers(t.Context(), from, to, 10, StatsOptions{})
+		if err != nil || len(top.Givers) != 1 || top.Givers[0].UserID != "U1" || len(top.Recipients) != 1 || top.Recipients[0].UserID != "U3" {
+			t.Fatalf("unexpected top users: %+v %v", top, err)
+		}
+		if pairs, err := store.GetPairStats(t.Context(), from, to, 10, StatsOptions{}); err != nil || len(pairs) != 0 {
+			t.Fatalf("expected no public pairs: %+v %v", pairs, err)
+		}
+		if n, _ := store.CountGivenInDateRange(t.Context(), "U2", from, from, StatsOptions{}); n != 1 {
+			t.Fatalf("expected U2's beer counted, got %d", n)
+		}
+		if err := store.SetOptOut(t.Context(), "U2", false); err != nil {
+			t.Fatalf("opt in: %v", err)
+		}
+		if givers, _ := store.GetAllGivers(t.Context(), StatsOptions{}); len(givers) != 2 {
+			t.Fatalf("expected U2 back on the leaderboard: %v", givers)
+		}
+
+		if _, err := store.SyncUserDirectory(t.Context(), []CachedUser{{UserID: "U2", RealName: "Grace"}}); err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		if err := store.AppendEventLog(t.Context(), "", "e1", "C1", "U1", "1672574400.000100", []byte(`{"user":"U1","text":"<@U2> :beer:"}`)); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		erasure, err := store.EraseUser(t.Context(), "U2", "admin", "gdpr request")
+		if err != nil || erasure.Beers != 2 || erasure.Events != 1 || !strings.HasPrefix(erasure.Pseudonym, "X") {
+			t.Fatalf("unexpected erasure: %+v %v", erasure, err)
+		}
+		if n, _ := store.CountReceivedInDateRange(t.Context(), "U2", from, from, StatsOptions{}); n != 0 {
+			t.Fatalf("expected no beers left for U2, got %d", n)
+		}
+		if n, _ := store.CountReceivedInDateRange(t.Context(), erasure.Pseudonym, from, from, StatsOptions{}); n != 1 {
+			t.Fatalf("expected the beer kept under the pseudonym, got %d", n)
+		}
+		if u, err := store.GetCachedUser(t.Context(), "U2"); err != nil || u != nil {
+			t.Fatalf("expected cached profile deleted: %+v %v", u, err)
+		}
+		if err := store.ForEachLoggedEvent(t.Context(), func(e LoggedEvent) error {
+			if strings.Contains(string(e.Payload), "U2") {
+				t.Fatalf("payload not scrubbed: %s", e.Payload)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		if givers, _ := store.GetAllGivers(t.Context(), StatsOptions{}); len(givers) != 1 || givers[0] != "U1" {
+			t.Fatalf("expected the pseudonym hidden: %v", givers)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("unexpected drift %d: %v", drift, err)
+		}
+	})
+
+	t.Run("Aliases", func(t *testing.T) {
+		store := newStore(t)
+		for _, b := range []struct {
+			giver, recipient, ts string
+		}{{"U1", "U3", "1672574400.000100"}, {"U2", "U3", "1672574400.000200"}, {"U3", "U1", "1672574400.000300"}} {
+			if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, day("2023-01-01"), 1); err != nil {
+				t.Fatalf("add beer: %v", err)
+			}
+		}
+		entry, err := store.MergeUsers(t.Context(), "U1", "U2", "admin", "new account")
+		if err != nil || entry.Action != AuditUserMerge || entry.GiverID != "U1" || entry.RecipientID != "U2" {
+			t.Fatalf("unexpected merge: %+v %v", entry, err)
+		}
+		// beers added after the merge count for the canonical user as well
+		if err := store.AddBeer(t.Context(), "", "U1", "U3", "1672660800.000100", day("2023-01-02"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		from, to := day("2023-01-01"), day("2023-01-02")
+		top, err := store.GetTopUsers(t.Context(), from, to, 10, StatsOptions{})
+		if err != nil || len(top.Givers) != 2 || top.Givers[0] != (TopUserStats{UserID: "U2", Count: 3}) ||
+			len(top.Recipients) != 2 || top.Recipients[1] != (TopUserStats{UserID: "U2", Count: 1}) {
+			t.Fatalf("unexpected top users: %+v %v", top, err)
+		}
+		for _, id := range []string{"U1", "U2"} {
+			if n, _ := store.CountGivenInDateRange(t.Context(), id, from, to, StatsOptions{}); n != 3 {
+				t.Fatalf("expected 3 beers given by %s, got %d", id, n)
+			}
+		}
+		if givers, _ := store.GetAllGivers(t.Context(), StatsOptions{}); len(givers) != 2 || givers[0] == "U1" || givers[1] == "U1" {
+			t.Fatalf("expected the alias resolved: %v", givers)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("unexpected drift %d: %v", drift, err)
+		}
+
+		if _, err := store.MergeUsers(t.Context(), "U2", "U1", "admin", "loop"); !errors.Is(err, ErrInvalidMerge) {
+			t.Fatalf("expected ErrInvalidMerge, got %v", err)
+		}
+		// merging into an alias merges into its canonical user
+		if _, err := store.MergeUsers(t.Context(), "U4", "U1", "admin", "another account"); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+		aliases, err := store.GetUserAliases(t.Context())
+		if err != nil || len(aliases) != 2 || aliases[0].AliasID != "U1" || aliases[1].AliasID != "U4" || aliases[1].CanonicalID != "U2" {
+			t.Fatalf("unexpected aliases: %+v %v", aliases, err)
+		}
+
+		if _, err := store.UnmergeUser(t.Context(), "U1", "admin", "mistake"); err != nil {
+			t.Fatalf("unmerge: %v", err)
+		}
+		if _, err := store.UnmergeUser(t.Context(), "U1", "admin", "again"); !errors.Is(err, ErrAliasNotFound) {
+			t.Fatalf("expected ErrAliasNotFound, got %v", err)
+		}
+		if n, _ := store.CountGivenInDateRange(t.Context(), "U2", from, to, StatsOptions{}); n != 1 {
+			t.Fatalf("expected 1 beer given by U2 after unmerge, got %d", n)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("unexpected drift %d: %v", drift, err)
+		}
+	})
+
+	t.Run("MergedSelfPairs", func(t *testing.T) {
+		store := newStore(t)
+		for _, b := range []struct {
+			giver, recipient, ts string
+		}{{"U1", "U2", "1672574400.000100"}, {"U2", "U1", "1672574400.000200"}, {"U1", "U3", "1672574400.000300"}} {
+			if err := store.AddBeer(t.Context(), "", b.giver, b.recipient, b.ts, day("2023-01-01"), 1); err != nil {
+				t.Fatalf("add beer: %v", err)
+			}
+		}
+		if _, err := store.MergeUsers(t.Context(), "U1", "U2", "admin", "new account"); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+		// beers between the merged IDs, before or after the merge, are not
+		// a gift to oneself
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1672660800.000100", day("2023-01-02"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		from, to := day("2023-01-01"), day("2023-01-02")
+		pairs, err := store.GetPairStats(t.Context(), from, to, 10, StatsOptions{})
+		if err != nil || len(pairs) != 1 || pairs[0] != (PairStats{Giver: "U2", Recipient: "U3", Count: 1}) {
+			t.Fatalf("unexpected pairs: %+v %v", pairs, err)
+		}
+		top, err := store.GetTopUsers(t.Context(), from, to, 10, StatsOptions{})
+		if err != nil || len(top.Givers) != 1 || top.Givers[0] != (TopUserStats{UserID: "U2", Count: 1}) ||
+			len(top.Recipients) != 1 || top.Recipients[0].UserID != "U3" {
+			t.Fatalf("unexpected top users: %+v %v", top, err)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("unexpected drift %d: %v", drift, err)
+		}
+
+		// unmerging brings the beers between them back
+		if _, err := store.UnmergeUser(t.Context(), "U1", "admin", "mistake"); err != nil {
+			t.Fatalf("unmerge: %v", err)
+		}
+		if n, _ := store.CountReceivedInDateRange(t.Context(), "U2", from, to, StatsOptions{}); n != 2 {
+			t.Fatalf("expected 2 beers received by U2 after unmerge, got %d", n)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("unexpected drift %d: %v", drift, err)
+		}
+	})
+
+	t.Run("Workspaces", func(t *testing.T) {
+		store := newStore(t)
+		// a beer recorded before the bot knew its workspace
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1672574400.000100", day("2023-01-01"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		if claimed, err := store.ClaimUnscopedRows(t.Context(), "T1"); err != nil || claimed != 1 {
+			t.Fatalf("claim: %d %v", claimed, err)
+		}
+		for _, b := range []struct {
+			team, giver, recipient, ts string
+		}{{"T1", "U1", "U3", "1672574400.000200"}, {"T2", "U4", "U5", "1672574400.000300"}, {"T3", "U6", "U4", "1672574400.000400"}} {
+			if err := store.AddBeer(t.Context(), b.team, b.giver, b.recipient, b.ts, day("2023-01-01"), 1); err != nil {
+				t.Fatalf("add beer: %v", err)
+			}
+		}
+		for _, w := range []Workspace{{TeamID: "T1", Name: "Acme"}, {TeamID: "T2", Name: "Globex", EnterpriseID: "E1"}, {TeamID: "T3", Name: "Initech", EnterpriseID: "E1"}} {
+			if err := store.SaveWorkspace(t.Context(), w); err != nil {
+				t.Fatalf("save workspace: %v", err)
+			}
+		}
+		workspaces, err := store.GetWorkspaces(t.Context())
+		if err != nil || len(workspaces) != 3 || workspaces[1].EnterpriseID != "E1" {
+			t.Fatalf("unexpected workspaces: %+v %v", workspaces, err)
+		}
+
+		from, to := day("2023-01-01"), day("2023-01-01")
+		for ws, want := range map[string]int{"": 4, "T1": 2, "T2": 1, "E1": 2, "T9": 0} {
+			top, err := store.GetTopUsers(t.Context(), from, to, 10, StatsOptions{Workspace: ws})
+			if err != nil {
+				t.Fatalf("top users in %q: %v", ws, err)
+			}
+			total := 0
+			for _, g := range top.Givers {
+				total += g.Count
+			}
+			if total != want {
+				t.Fatalf("expected %d beers in %q, got %d", want, ws, total)
+			}
+		}
+		if givers, _ := store.GetAllGivers(t.Context(), StatsOptions{Workspace: "T1"}); len(givers) != 1 || givers[0] != "U1" {
+			t.Fatalf("unexpected givers in T1: %v", givers)
+		}
+		if n, _ := store.CountReceivedInDateRange(t.Context(), "U4", from, to, StatsOptions{Workspace: "T2"}); n != 0 {
+			t.Fatalf("expected no beers received by U4 in T2, got %d", n)
+		}
+		beers, err := store.ListBeers(t.Context(), BeerFilter{Workspace: "E1"})
+		if err != nil || len(beers) != 2 || beers[0].TeamID == "T1" || beers[1].TeamID == "T1" {
+			t.Fatalf("unexpected beers in E1: %+v %v", beers, err)
+		}
+		// workspace IDs are bound, not spliced into the query
+		if beers, err := store.ListBeers(t.Context(), BeerFilter{Workspace: "T1' OR '1' = '1"}); err != nil || len(beers) != 0 {
+			t.Fatalf("expected no beers for a quoted workspace ID: %+v %v", beers, err)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("unexpected drift %d: %v", drift, err)
+		}
+	})
+
+	t.Run("UserCache", func(t *testing.T) {
+		store := newStore(t)
+		if u, err := store.GetCachedUser(t.Context(), "U1"); err != nil || u != nil {
+			t.Fatalf("expected cache miss: %+v %v", u, err)
+		}
+		if err := store.SetCachedUser(t.Context(), "U1", "Ada", "img1"); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+		if err := store.SetCachedUser(t.Context(), "U1", "Ada L", "img2"); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		u, err := store.GetCachedUser(t.Context(), "U1")
+		if err != nil || u == nil || u.RealName != "Ada L" || u.ProfileImage != "img2" || u.UpdatedAt.IsZero() {
+			t.Fatalf("unexpected cached user: %+v %v", u, err)
+		}
+
+		// exports join beers with the cached names
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1672574400.000100", day("2023-01-01"), 2); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		var rows []ExportBeer
+		if err := store.ForEachBeer(t.Context(), day("2023-01-01"), day("2023-01-01"), "", func(b ExportBeer) error {
+			rows = append(rows, b)
+			return nil
+		}); err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		if len(rows) != 1 || rows[0].GiverName != "Ada L" || rows[0].RecipientName != "" || rows[0].Count != 2 || !rows[0].Time.Equal(day("2023-01-01")) {
+			t.Fatalf("unexpected export rows: %+v", rows)
+		}
+	})
+
+	t.Run("DeadLetters", func(t *testing.T) {
+		store := newStore(t)
+		id1, err := store.AddDeadLetter(t.Context(), "env-1", []byte(testMessagePayload), "boom")
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		id2, err := store.AddDeadLetter(t.Context(), "env-2", []byte(testMessagePayload), "boom")
+		if err != nil || id2 <= id1 {
+			t.Fatalf("add second: %d %v", id2, err)
+		}
+		if err := store.RecordDeadLetterAttempt(t.Context(), id1, nil); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+
+		all, err := store.ListDeadLetters(t.Context(), "", 10)
+		if err != nil || len(all) != 2 || all[0].ID != id2 {
+			t.Fatalf("unexpected list: %+v %v", all, err)
+		}
+		pending, err := store.ListDeadLetters(t.Context(), DeadLetterPending, 10)
+		if err != nil || len(pending) != 1 || pending[0].ID != id2 {
+			t.Fatalf("unexpected pending list: %+v %v", pending, err)
+		}
+		if err := store.RecordDeadLetterAttempt(t.Context(), id2, errors.New("again")); err != nil {
+			t.Fatalf("record failure: %v", err)
+		}
+		dl, err := store.GetDeadLetter(t.Context(), id2)
+		if err != nil || dl == nil || dl.Error != "again" || dl.Attempts != 1 || string(dl.Payload) != testMessagePayload {
+			t.Fatalf("unexpected dead letter: %+v %v", dl, err)
+		}
+		if missing, err := store.GetDeadLetter(t.Context(), id2+100); err != nil || missing != nil {
+			t.Fatalf("expected nil for unknown id: %+v %v", missing, err)
+		}
+	})
+
+	t.Run("EventLog", func(t *testing.T) {
+		store := newStore(t)
+		for _, e := range []struct{ id, ts string }{{"e2", "2.0"}, {"e1", "1.0"}, {"e1", "1.0"}} {
+			if err := store.AppendEventLog(t.Context(), "", e.id, "C1", "U1", e.ts, []byte(`{}`)); err != nil {
+				t.Fatalf("append: %v", err)
+			}
+		}
+		var ids []string
+		if err := store.ForEachLoggedEvent(t.Context(), func(e LoggedEvent) error {
+			ids = append(ids, e.EventID)
+			return nil
+		}); err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		if len(ids) != 2 || ids[0] != "e1" || ids[1] != "e2" {
+			t.Fatalf("unexpected log order: %v", ids)
+		}
+		if err := store.AppendEventLog(t.Context(), "", "e3", "C1", "U9", "1.5", []byte(`{}`)); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if mine, err := store.GetUserLoggedEvents(t.Context(), "U1"); err != nil || len(mine) != 2 || mine[0].EventID != "e1" || mine[1].EventID != "e2" {
+			t.Fatalf("unexpected events of U1: %+v %v", mine, err)
+		}
+		if none, err := store.GetUserLoggedEvents(t.Context(), "U404"); err != nil || len(none) != 0 {
+			t.Fatalf("expected no events: %+v %v", none, err)
+		}
+
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1.0", day("2023-01-01"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "2.0", day("2023-01-02"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		if err := store.ReplaceBeersSince(t.Context(), "", "2.0", []BeerRow{{GiverID: "U1", RecipientID: "U3", Ts: "2.5", TsRFC: day("2023-01-02"), Count: 2}}); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+		rows, err := store.GetBeersSince(t.Context(), "", "1.0")
+		if err != nil || len(rows) != 2 || rows[1].RecipientID != "U3" || rows[1].Count != 2 || !rows[1].TsRFC.Equal(day("2023-01-02")) {
+			t.Fatalf("unexpected beers: %+v %v", rows, err)
+		}
+	})
+
+	t.Run("Corrections", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1.0", day("2023-01-01"), 2); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		if err := store.AddBeer(t.Context(), "", "U1", "U3", "2.0", day("2023-01-01"), 1); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+		beers, err := store.ListBeers(t.Context(), BeerFilter{UserID: "U2"})
+		if err != nil || len(beers) != 1 || beers[0].Count != 2 || beers[0].Source != beerSourceSlack {
+			t.Fatalf("unexpected beers: %+v %v", beers, err)
+		}
+
+		adjusted, err := store.AdjustBeer(t.Context(), beers[0].ID, 3, "admin:ops", "missed an emoji")
+		if err != nil || adjusted.OldCount != 2 || adjusted.NewCount != 3 || adjusted.Delta() != 1 || !adjusted.BeerTime.Equal(day("2023-01-01")) {
+			t.Fatalf("adjust: %+v %v", adjusted, err)
+		}
+		added, err := store.AdminAddBeer(t.Context(), "", "U3", "U2", day("2023-01-01"), 1, "admin", "given in person")
+		if err != nil || added.BeerID == 0 || added.NewCount != 1 {
+			t.Fatalf("admin add: %+v %v", added, err)
+		}
+		// the same moment again gets its own ts
+		again, err := store.AdminAddBeer(t.Context(), "", "U3", "U2", day("2023-01-01"), 1, "admin", "given in person")
+		if err != nil || again.BeerID == added.BeerID || again.Ts == added.Ts {
+			t.Fatalf("second admin add: %+v %v", again, err)
+		}
+		revoked, err := store.RevokeBeer(t.Context(), beers[0].ID, "admin", "duplicate")
+		if err != nil || revoked.Delta() != -3 {
+			t.Fatalf("revoke: %+v %v", revoked, err)
+		}
+		if _, err := store.RevokeBeer(t.Context(), beers[0].ID, "admin", "duplicate"); !errors.Is(err, ErrBeerRevoked) {
+			t.Fatalf("expected ErrBeerRevoked, got %v", err)
+		}
+		if _, err := store.AdjustBeer(t.Context(), beers[0].ID, 1, "admin", "typo"); !errors.Is(err, ErrBeerRevoked) {
+			t.Fatalf("expected ErrBeerRevoked, got %v", err)
+		}
+		if _, err := store.RevokeBeer(t.Context(), beers[0].ID+100, "admin", "typo"); !errors.Is(err, ErrBeerNotFound) {
+			t.Fatalf("expected ErrBeerNotFound, got %v", err)
+		}
+		if b, err := store.GetBeer(t.Context(), beers[0].ID); err != nil || b == nil || b.RevokedAt == nil || b.RevokedBy != "admin" || b.RevokeReason != "duplicate" || b.Count != 3 {
+			t.Fatalf("expected the beer kept as revoked: %+v %v", b, err)
+		}
+		// a redelivered message does not bring a revoked beer back
+		if err := store.AddBeer(t.Context(), "", "U1", "U2", "1.0", day("2023-01-01"), 2); err != nil {
+			t.Fatalf("re-add revoked beer: %v", err)
+		}
+		if got, _ := store.CountReceived(t.Context(), "U2", "2023-01-01"); got != 2 {
+			t.Fatalf("expected 2 beers received after corrections, got %d", got)
+		}
+		if got, _ := store.CountReceivedInDateRange(t.Context(), "U2", day("2023-01-01"), day("2023-01-01"), StatsOptions{IncludeRevoked: true}); got != 5 {
+			t.Fatalf("expected 5 beers received including revoked, got %d", got)
+		}
+		if listed, _ := store.ListBeers(t.Context(), BeerFilter{UserID: "U2"}); len(listed) != 2 {
+			t.Fatalf("expected revoked beers left out of the list, got %+v", listed)
+		}
+		if listed, _ := store.ListBeers(t.Context(), BeerFilter{UserID: "U2", IncludeRevoked: true}); len(listed) != 3 {
+			t.Fatalf("expected revoked beers listed on request, got %+v", listed)
+		}
+		top, err := store.GetTopUsers(t.Context(), day("2023-01-01"), day("2023-01-01"), 10, StatsOptions{})
+		if err != nil || len(top.Givers) != 2 || top.Givers[0].UserID != "U3" || top.Givers[0].Count != 2 {
+			t.Fatalf("expected the revoked beer left out of top givers: %+v %v", top, err)
+		}
+		top, err = store.GetTopUsers(t.Context(), day("2023-01-01"), day("2023-01-01"), 10, StatsOptions{IncludeRevoked: true})
+		if err != nil || top.Givers[0].UserID != "U1" || top.Givers[0].Count != 4 {
+			t.Fatalf("expected the revoked beer in top givers on request: %+v %v", top, err)
+		}
+		if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+			t.Fatalf("rollup drift: %d %v", drift, err)
+		}
+
+		all, err := store.ListAuditLog(t.Context(), AuditFilter{})
+		if err != nil || len(all) != 6 {
+			t.Fatalf("expected 6 audit entries, got %d %v", len(all), err)
+		}
+		if all[0].Action != AuditBeerRevoke || all[0].Reason != "duplicate" || all[5].Action != AuditBeerGive || all[5].Actor != auditActorBot {
+			t.Fatalf("unexpected audit order: %+v", all)
+		}
+		byBeer, err := store.ListAuditLog(t.Context(), AuditFilter{BeerID: beers[0].ID})
+		if err != nil || len(byBeer) != 3 {
+			t.Fatalf("expected 3 entries for the beer, got %+v %v", byBeer, err)
+		}
+		page, err := store.ListAuditLog(t.Context(), AuditFilter{Actor: "admin", Before: all[0].ID, Limit: 1})
+		if err != nil || len(page) != 1 || page[0].ID != again.ID {
+			t.Fatalf("unexpected page: %+v %v", page, err)
+		}
+
+		// an unchanged redelivery is not a mutation
+		if err := store.AddBeer(t.Context(), "", "U1", "U3", "2.0", day("2023-01-01"), 1); err != nil {
+			t.Fatalf("re-add beer: %v", err)
+		}
+		if gives, _ := store.ListAuditLog(t.Context(), AuditFilter{Action: AuditBeerGive}); len(gives) != 2 {
+			t.Fatalf("expected 2 give entries, got %d", len(gives))
+		}
+	})
+}
+
+func TestDialectRebind(t *testing.T) {
+	q := `SELECT '?' FROM t WHERE a = ? AND b IN (?, ?)`
+	if got := sqliteDialect.rebind(q); got != q {
+		t.Fatalf("sqlite rebind changed query: %s", got)
+	}
+	want := `SELECT '?' FROM t WHERE a = $1 AND b IN ($2, $3)`
+	if got := postgresDialect.rebind(q); got != want {
+		t.Fatalf("postgres rebind = %s, want %s", got, want)
+	}
+}
+
+func TestDialectMigrationsMatch(t *testing.T) {
+	if len(sqliteDialect.migrations) != len(postgresDialect.migrations) {
+		t.Fatalf("sqlite has %d migrations, postgres %d", len(sqliteDialect.migrations), len(postgresDialect.migrations))
+	}
+	for i, m := range sqliteDialect.migrations {
+		pg := postgresDialect.migrations[i]
+		if m.Version != pg.Version || m.Name != pg.Name {
+			t.Fatalf("migration %d differs: sqlite %d %q, postgres %d %q", i, m.Version, m.Name, pg.Version, pg.Name)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// beerSourceAdmin tags beers added through the admin API
+const beerSourceAdmin = "admin"
+
+// ErrBeerNotFound is returned when correcting a beer id that does not exist
+var ErrBeerNotFound = errors.New("beer not found")
+
+// ErrBeerRevoked is returned when correcting a beer that was already revoked
+var ErrBeerRevoked = errors.New("beer already revoked")
+
+// Beer is a beers row with its id, as listed and corrected by admins
+type Beer struct {
+	ID          int64     `json:"id"`
+	TeamID      string    `json:"team_id"`
+	GiverID     string    `json:"giver_id"`
+	RecipientID string    `json:"recipient_id"`
+	Ts          string    `json:"ts"`
+	Time        time.Time `json:"time"`
+	Count       int       `json:"count"`
+	Source      string    `json:"source"`
+	// RevokedAt is set once the beer is revoked; revoked beers are kept but
+	// not counted
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy    string     `json:"revoked_by,omitempty"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+}
+
+// BeerFilter narrows ListBeers. Zero fields match everything.
+type BeerFilter struct {
+	// UserID matches beers the user gave or received
+	UserID string
+	// Workspace matches beers given in a workspace, or in any workspace of
+	// an Enterprise Grid org
+	Workspace string
+	// Start and End are inclusive dates
+	Start, End time.Time
+	// Limit defaults to 100; a negative limit lists every beer
+	Limit int
+	// IncludeRevoked lists revoked beers too
+	IncludeRevoked bool
+}
+
+const beerColumns = `id, team_id, giver_id, recipient_id, ts, ts_rfc, count, source, revoked_at, revoked_by, revoke_reason`
+
+func scanBeer(scan func(dest ...interface{}) error) (*Beer, error) {
+	var b Beer
+	var tsRFC string
+	var revokedAt sql.NullString
+	if err := scan(&b.ID, &b.TeamID, &b.GiverID, &b.RecipientID, &b.Ts, &tsRFC, &b.Count, &b.Source, &revokedAt, &b.RevokedBy, &b.RevokeReason); err != nil {
+		return nil, err
+	}
+	b.Time, _ = time.Parse(time.RFC3339, tsRFC)
+	if t, err := time.Parse(time.RFC3339, revokedAt.String); err == nil {
+		b.RevokedAt = &t
+	}
+	return &b, nil
+}
+
+// GetBeer returns the beer with id, or nil if it does not exist
+func (s *SQLStore) GetBeer(ctx context.Context, id int64) (*Beer, error) {
+	b, err := scanBeer(s.queryRow(ctx, "GetBeer", `SELECT `+beerColumns+` FROM beers WHERE id = ?`, id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return b, err
+}
+
+// ListBeers returns beers matching f, newest first
+func (s *SQLStore) ListBeers(ctx context.Context, f BeerFilter) ([]Beer, error) {
+	query := `SELECT ` + beerColumns + ` FROM beers WHERE 1 = 1`
+	var args []interface{}
+	if !f.IncludeRevoked {
+		query += ` AND revoked_at IS NULL`
+	}
+	if f.UserID != "" {
+		query += ` AND (giver_id = ? OR recipient_id = ?)`
+		args = append(args, f.UserID, f.UserID)
+	}
+	filter, filterArgs := workspaceFilter("team_id", f.Workspace)
+	query += filter
+	args = append(args, filterArgs...)
+	if !f.Start.IsZero() {
+		query += ` AND ts_rfc >= ?`
+		args = append(args, f.Start.Format("2006-01-02"))
+	}
+	if !f.End.IsZero() {
+		query += ` AND ts_rfc < ?`
+		args = append(args, f.End.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+	query += ` ORDER BY ts_rfc DESC, id DESC`
+	switch {
+	case f.Limit == 0:
+		query += ` LIMIT 100`
+	case f.Limit > 0:
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+	rows, err := s.query(ctx, "ListBeers", query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list beers: %w", err)
+	}
+	defer rows.Close()
+
+	out := []Beer{}
+	for rows.Next() {
+		b, err := scanBeer(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("list beers scan: %w", err)
+		}
+		out = append(out, *b)
+	}
+	return out, rows.Err()
+}
+
+// activeBeerInTx loads a beer that is not revoked inside a write transaction
+func (s *SQLStore) activeBeerInTx(ctx context.Context, tx *sql.Tx, id int64) (*Beer, error) {
+	b, err := scanBeer(tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+beerColumns+` FROM beers WHERE id = ?`), id).Scan)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrBeerNotFound
+	case err != nil:
+		return nil, err
+	case b.RevokedAt != nil:
+		return nil, ErrBeerRevoked
+	}
+	return b, nil
+}
+
+// AdminAddBeer records count beers from giverID to recipientID at t in
+// workspace teamID on behalf of actor. The beer gets a ts derived from t that is not yet taken by the
+// pair, so several beers can be added for the same moment.
+func (s *SQLStore) AdminAddBeer(ctx context.Context, teamID, giverID, recipientID string, t time.Time, count int, actor, reason string) (*AuditEntry, error) {
+	var entry AuditEntry
+	err := s.write(ctx, "AdminAddBeer", func(ctx context.Context, tx *sql.Tx) error {
+		b := &Beer{TeamID: teamID, GiverID: giverID, RecipientID: recipientID, Time: t.UTC().Truncate(time.Second), Count: count, Source: beerSourceAdmin}
+		for micro := t.Nanosecond() / 1000; b.ID == 0; micro++ {
+			if micro > 999999 {
+				return fmt.Errorf("no free ts left in second %d", t.Unix())
+			}
+			b.Ts = fmt.Sprintf("%d.%06d", t.Unix(), micro)
+			err := tx.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count, source, team_id) VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (giver_id, recipient_id, ts) DO NOTHING RETURNING id`),
+				b.GiverID, b.RecipientID, b.Ts, b.Time.Format(time.RFC3339), b.Count, b.Source, b.TeamID).Scan(&b.ID)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("insert beer: %w", err)
+			}
+		}
+		if err := s.addDailyRollup(ctx, tx, rollupDay(b.Time), teamID, giverID, recipientID, count, 0); err != nil {
+			return err
+		}
+		entry = auditBeer(actor, AuditBeerAdd, b, 0, count, reason)
+		return s.appendAudit(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("add beer: %w", err)
+	}
+	return &entry, nil
+}
+
+// AdjustBeer sets the count of beer id on behalf of actor
+func (s *SQLStore) AdjustBeer(ctx context.Context, id int64, count int, actor, reason string) (*AuditEntry, error) {
+	var entry AuditEntry
+	err := s.write(ctx, "AdjustBeer", func(ctx context.Context, tx *sql.Tx) error {
+		b, err := s.activeBeerInTx(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE beers SET count = ? WHERE id = ?`), count, id); err != nil {
+			return fmt.Errorf("update beer: %w", err)
+		}
+		if err := s.addDailyRollup(ctx, tx, rollupDay(b.Time), b.TeamID, b.GiverID, b.RecipientID, count-b.Count, 0); err != nil {
+			return err
+		}
+		entry = auditBeer(actor, AuditBeerAdjust, b, b.Count, count, reason)
+		return s.appendAudit(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("adjust beer %d: %w", id, err)
+	}
+	return &entry, nil
+}
+
+// RevokeBeer revokes beer id on behalf of actor. The row is kept with who
+// revoked it and why, stops counting in stats, and a rebuild from the event
+// log does not bring it back.
+func (s *SQLStore) RevokeBeer(ctx context.Context, id int64, actor, reason string) (*AuditEntry, error) {
+	var entry AuditEntry
+	err := s.write(ctx, "RevokeBeer", func(ctx context.Context, tx *sql.Tx) error {
+		b, err := s.activeBeerInTx(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := s.revokeBeerInTx(ctx, tx, b, actor, reason); err != nil {
+			return err
+		}
+		entry = auditBeer(actor, AuditBeerRevoke, b, b.Count, 0, reason)
+		return s.appendAudit(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("revoke beer %d: %w", id, err)
+	}
+	return &entry, nil
+}
+
+// revokeBeerInTx marks b revoked and moves its count to the revoked side of
+// the rollup
+func (s *SQLStore) revokeBeerInTx(ctx context.Context, tx *sql.Tx, b *Beer, actor, reason string) error {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE beers SET revoked_at = ?, revoked_by = ?, revoke_reason = ? WHERE id = ?`),
+		time.Now().UTC().Format(time.RFC3339), actor, reason, b.ID); err != nil {
+		return fmt.Errorf("revoke beer: %w", err)
+	}
+	return s.addDailyRollup(ctx, tx, rollupDay(b.Time), b.TeamID, b.GiverID, b.RecipientID, -b.Count, b.Count)
+}
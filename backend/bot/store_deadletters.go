@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Dead-letter statuses
+const (
+	DeadLetterPending  = "pending"
+	DeadLetterReplayed = "replayed"
+)
+
+// DeadLetter is a Slack event that failed processing, kept with its raw payload
+type DeadLetter struct {
+	ID        int64           `json:"id"`
+	EventID   string          `json:"event_id"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Error     string          `json:"error"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// AddDeadLetter stores a failed event and returns its id
+func (s *SQLStore) AddDeadLetter(ctx context.Context, eventID string, payload json.RawMessage, errMsg string) (int64, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var id int64
+	err := s.write(ctx, "AddDeadLetter", func(ctx context.Context, tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO dead_letter_events (event_id, payload, error, status, attempts, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?) RETURNING id`),
+			eventID, string(payload), errMsg, DeadLetterPending, now, now).Scan(&id)
+	})
+	return id, err
+}
+
+// ListDeadLetters returns dead-lettered events, newest first, without payloads.
+// An empty status returns events in any status.
+func (s *SQLStore) ListDeadLetters(ctx context.Context, status string, limit int) ([]DeadLetter, error) {
+	query := `SELECT id, event_id, error, status, attempts, created_at, updated_at FROM dead_letter_events`
+	args := []interface{}{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	rows, err := s.query(ctx, "ListDeadLetters", query+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DeadLetter{}
+	for rows.Next() {
+		var d DeadLetter
+		var createdAt, updatedAt string
+		if err := rows.Scan(&d.ID, &d.EventID, &d.Error, &d.Status, &d.Attempts, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		d.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		d.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// GetDeadLetter returns a single dead-lettered event including its payload,
+// or nil if it does not exist
+func (s *SQLStore) GetDeadLetter(ctx context.Context, id int64) (*DeadLetter, error) {
+	var d DeadLetter
+	var payload, createdAt, updatedAt string
+	err := s.queryRow(ctx, "GetDeadLetter", `SELECT id, event_id, payload, error, status, attempts, created_at, updated_at FROM dead_letter_events WHERE id = ?`, id).
+		Scan(&d.ID, &d.EventID, &payload, &d.Error, &d.Status, &d.Attempts, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	d.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	d.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return &d, nil
+}
+
+// RecordDeadLetterAttempt records the outcome of a replay. A nil replayErr
+// marks the event replayed; otherwise it stays pending with the new error.
+func (s *SQLStore) RecordDeadLetterAttempt(ctx context.Context, id int64, replayErr error) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if replayErr == nil {
+		_, err := s.exec(ctx, "RecordDeadLetterAttempt", `UPDATE dead_letter_events SET status = ?, attempts = attempts + 1, updated_at = ? WHERE id = ?`, DeadLetterReplayed, now, id)
+		return err
+	}
+	_, err := s.exec(ctx, "RecordDeadLetterAttempt", `UPDATE dead_letter_events SET error = ?, attempts = attempts + 1, updated_at = ? WHERE id = ?`, replayErr.Error(), now, id)
+	return err
+}
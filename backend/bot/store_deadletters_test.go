@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// newTestStore opens a fresh SQLite store in a temp directory
+func newTestStore(t testing.TB) *SQLStore {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=1")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	return store
+}
+
+const testMessagePayload = `{
+	"type": "event_callback",
+	"team_id": "T1",
+	"event_id": "Ev1",
+	"event": {
+		"type": "message",
+		"channel": "C1",
+		"user": "U1",
+		"text": "<@U2> :beer:",
+		"ts": "1700000000.000100"
+	}
+}`
+
+func TestDeadLetters_Lifecycle(t *testing.T) {
+	store := newTestStore(t)
+
+	id, err := store.AddDeadLetter(t.Context(), "env-1", []byte(testMessagePayload), "database is locked")
+	if err != nil {
+		t.Fatalf("add dead letter: %v", err)
+	}
+
+	pending, err := store.ListDeadLetters(t.Context(), DeadLetterPending, 10)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != id || pending[0].Payload != nil {
+		t.Fatalf("unexpected pending list: %+v", pending)
+	}
+
+	dl, err := store.GetDeadLetter(t.Context(), id)
+	if err != nil || dl == nil {
+		t.Fatalf("get dead letter: %v %v", dl, err)
+	}
+	if dl.EventID != "env-1" || dl.Error != "database is locked" || len(dl.Payload) == 0 {
+		t.Fatalf("unexpected dead letter: %+v", dl)
+	}
+
+	if err := store.RecordDeadLetterAttempt(t.Context(), id, errors.New("still broken")); err != nil {
+		t.Fatalf("record failed attempt: %v", err)
+	}
+	dl, _ = store.GetDeadLetter(t.Context(), id)
+	if dl.Status != DeadLetterPending || dl.Attempts != 1 || dl.Error != "still broken" {
+		t.Fatalf("unexpected state after failed attempt: %+v", dl)
+	}
+
+	if err := store.RecordDeadLetterAttempt(t.Context(), id, nil); err != nil {
+		t.Fatalf("record successful attempt: %v", err)
+	}
+	dl, _ = store.GetDeadLetter(t.Context(), id)
+	if dl.Status != DeadLetterReplayed || dl.Attempts != 2 {
+		t.Fatalf("unexpected state after replay: %+v", dl)
+	}
+
+	if missing, err := store.GetDeadLetter(t.Context(), id+1); err != nil || missing != nil {
+		t.Fatalf("expected nil for unknown id, got %+v %v", missing, err)
+	}
+}
+
+func TestParseMessageEventPayload(t *testing.T) {
+	ev, err := parseMessageEventPayload([]byte(testMessagePayload))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if ev.User != "U1" || ev.Channel != "C1" || ev.TimeStamp != "1700000000.000100" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	if _, err := parseMessageEventPayload([]byte(`{"type":"event_callback","event":{"type":"app_mention"}}`)); err == nil {
+		t.Fatalf("expected error for non-message event")
+	}
+}
+
+// failingBeerStore fails AddBeer for one recipient until it is cleared
+type failingBeerStore struct {
+	*SQLStore
+	failFor string
+}
+
+func (s *failingBeerStore) AddBeer(ctx context.Context, teamID, giverID, recipientID string, slackTs string, t time.Time, count int) error {
+	if recipientID == s.failFor {
+		return errors.New("database is locked")
+	}
+	return s.SQLStore.AddBeer(ctx, teamID, giverID, recipientID, slackTs, t, count)
+}
+
+// redisCommandRecorder answers every Redis command without a server and
+// records the sorted set increments per member
+type redisCommandRecorder struct {
+	mu         sync.Mutex
+	increments map[string]int
+}
+
+func (r *redisCommandRecorder) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (r *redisCommandRecorder) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return r.ProcessPipelineHook(nil)(ctx, []redis.Cmder{cmd})
+	}
+}
+
+func (r *redisCommandRecorder) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, cmd := range cmds {
+			if args := cmd.Args(); cmd.Name() == "zincrby" && len(args) == 4 {
+				r.increments[fmt.Sprint(args[1], " ", args[3])]++
+			}
+		}
+		return nil
+	}
+}
+
+func TestReplayDeadLetter_PartialFailure(t *testing.T) {
+	store := &failingBeerStore{SQLStore: newTestStore(t), failFor: "U3"}
+	rec := &redisCommandRecorder{increments: map[string]int{}}
+	client := redis.NewClient(&redis.Options{Addr: "redis.invalid:6379"})
+	client.AddHook(rec)
+	cache := &RedisUserCache{client: client, logger: zerolog.Nop(), circuitBreaker: NewCircuitBreaker(3, time.Minute)}
+	fake := &RecordingSlack{}
+	// U1 gave 3 beers earlier that day; the message uses the remaining 2
+	if err := store.SQLStore.AddBeer(t.Context(), "T1", "U1", "U4", "1700000000.000001", time.Unix(1700000000, 0), 3); err != nil {
+		t.Fatal(err)
+	}
+	ep := NewEventProcessor(store, fake, cache, "C1", ":beer:", 5, zerolog.Nop(), nil, nil)
+	ep.SetWorkspace("T1")
+
+	payload := strings.Replace(testMessagePayload, `"<@U2> :beer:"`, `"<@U2> :beer: <@U3> :beer:"`, 1)
+	outer, err := slackevents.ParseEvent(json.RawMessage(payload), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.HandleEvent(socketmode.Event{
+		Type:    socketmode.EventTypeEventsAPI,
+		Data:    outer,
+		Request: &socketmode.Request{Type: socketmode.RequestTypeEventsAPI, EnvelopeID: "Ev1", Payload: json.RawMessage(payload)},
+	})
+	pending, err := store.ListDeadLetters(t.Context(), DeadLetterPending, 10)
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected one dead letter: %+v %v", pending, err)
+	}
+	if msgs := fake.Messages(); len(msgs) != 1 || msgs[0].Text != "<@U1> gave 1 beer to <@U2>!" {
+		t.Fatalf("unexpected messages after the failed attempt: %+v", msgs)
+	}
+	recorded := rec.increments["leaderboard:recipients:all-time U2"]
+	if recorded == 0 {
+		t.Fatalf("expected U2's beer in redis: %v", rec.increments)
+	}
+
+	store.failFor = ""
+	if err := ep.ReplayDeadLetter(t.Context(), pending[0].ID); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	msgs := fake.Messages()
+	if len(msgs) != 2 || msgs[1].Text != "<@U1> gave 1 beer to <@U3>!" {
+		t.Fatalf("expected only U3 to be confirmed on replay: %+v", msgs)
+	}
+	if got := rec.increments["leaderboard:recipients:all-time U2"]; got != recorded {
+		t.Fatalf("U2 counted again in redis: %d increments, want %d", got, recorded)
+	}
+	if got := rec.increments["leaderboard:recipients:all-time U3"]; got != recorded {
+		t.Fatalf("U3 not counted in redis: %d increments, want %d", got, recorded)
+	}
+	if got := rec.increments["leaderboard:givers:all-time U1"]; got != 2*recorded {
+		t.Fatalf("U1 given count off in redis: %d increments, want %d", got, 2*recorded)
+	}
+	beers, err := store.ListBeers(t.Context(), BeerFilter{UserID: "U1"})
+	if err != nil || len(beers) != 3 {
+		t.Fatalf("expected beers for U2, U3 and U4: %+v %v", beers, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// sqlDialect captures the differences between the SQL databases SQLStore can
+// run on. Queries are written with ? placeholders and portable SQL; anything
+// that can't be expressed portably lives here.
+type sqlDialect struct {
+	name string
+	// numbered placeholders ($1, $2, ...) instead of ?
+	numbered bool
+	// weekExpr maps a YYYY-MM-DD expression to a YYYY-Www week label (Monday start)
+	weekExpr   func(day string) string
+	migrations []schemaMigration
+	// hasUserTables reports whether the database holds tables besides schema_migrations
+	hasUserTables func(db *sql.DB) bool
+	// backup writes a copy of the database before migrating; "" when not supported
+	backup func(db *sql.DB, dir, label string) (string, error)
+	// lockMigrations keeps other processes from migrating until unlock is
+	// called; nil when each migration's transaction is enough
+	lockMigrations func(db *sql.DB) (unlock func(), err error)
+}
+
+var sqliteDialect = &sqlDialect{
+	name: "sqlite",
+	weekExpr: func(day string) string {
+		return `strftime('%Y-W%W', ` + day + `)`
+	},
+	migrations:    schemaMigrations,
+	hasUserTables: sqliteHasUserTables,
+	backup:        backupDatabase,
+}
+
+var postgresDialect = &sqlDialect{
+	name:     "postgres",
+	numbered: true,
+	// same numbering as SQLite's %W: weeks start on Monday and days before
+	// the first Monday of the year are week 00
+	weekExpr: func(day string) string {
+		d := `CAST(` + day + ` AS DATE)`
+		return `to_char(` + d + `, 'YYYY') || '-W' || lpad(CAST((CAST(extract(doy FROM ` + d + `) AS INTEGER) + 6 - (CAST(extract(dow FROM ` + d + `) AS INTEGER) + 6) % 7) / 7 AS TEXT), 2, '0')`
+	},
+	migrations:    postgresMigrations,
+	hasUserTables: postgresHasUserTables,
+	backup: func(*sql.DB, string, string) (string, error) {
+		// managed Postgres is backed up by the provider (PITR / pg_dump)
+		return "", nil
+	},
+	lockMigrations: postgresLockMigrations,
+}
+
+// latestVersion returns the highest known migration version for the dialect
+func (d *sqlDialect) latestVersion() int {
+	return d.migrations[len(d.migrations)-1].Version
+}
+
+// rebind rewrites ? placeholders for dialects with numbered placeholders.
+// Question marks inside quoted strings are left alone.
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// dialectForDSN picks the dialect and database/sql driver for a DSN. Postgres
+// URLs select PostgreSQL; anything else is treated as a SQLite file path.
+func dialectForDSN(dsn string) (*sqlDialect, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect, "postgres"
+	}
+	return sqliteDialect, "sqlite3"
+}
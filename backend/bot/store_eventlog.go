@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LoggedEvent is a raw Slack message event from the append-only event log
+type LoggedEvent struct {
+	ID         int64
+	TeamID     string
+	EventID    string
+	Channel    string
+	UserID     string
+	Ts         string
+	Payload    json.RawMessage
+	ReceivedAt time.Time
+}
+
+// BeerRow is a single row of the beers table
+type BeerRow struct {
+	TeamID      string    `json:"team_id,omitempty"`
+	GiverID     string    `json:"giver_id"`
+	RecipientID string    `json:"recipient_id"`
+	Ts          string    `json:"ts"`
+	TsRFC       time.Time `json:"ts_rfc"`
+	Count       int       `json:"count"`
+}
+
+// AppendEventLog stores the raw payload of an accepted message event from
+// workspace teamID. The log is append-only; appending an event id that is
+// already present is a no-op.
+func (s *SQLStore) AppendEventLog(ctx context.Context, teamID, eventID, channel, userID, ts string, payload json.RawMessage) error {
+	_, err := s.exec(ctx, "AppendEventLog", `INSERT INTO event_log (event_id, channel, user_id, ts, payload, received_at, team_id) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (event_id) DO NOTHING`,
+		eventID, channel, userID, ts, string(payload), time.Now().UTC().Format(time.RFC3339), teamID)
+	return err
+}
+
+const loggedEventColumns = `id, team_id, event_id, channel, user_id, ts, payload, received_at`
+
+// ForEachLoggedEvent calls fn for every logged event in Slack ts order
+func (s *SQLStore) ForEachLoggedEvent(ctx context.Context, fn func(LoggedEvent) error) error {
+	rows, err := s.stream(ctx, "ForEachLoggedEvent", `SELECT `+loggedEventColumns+` FROM event_log ORDER BY ts, id`)
+	if err != nil {
+		return fmt.Errorf("event log query: %w", err)
+	}
+	defer rows.Close()
+	return scanLoggedEvents(rows, fn)
+}
+
+// GetUserLoggedEvents returns the logged messages sent by userID in Slack ts order
+func (s *SQLStore) GetUserLoggedEvents(ctx context.Context, userID string) ([]LoggedEvent, error) {
+	rows, err := s.query(ctx, "GetUserLoggedEvents", `SELECT `+loggedEventColumns+` FROM event_log WHERE user_id = ? ORDER BY ts, id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("user event log query: %w", err)
+	}
+	defer rows.Close()
+	var out []LoggedEvent
+	err = scanLoggedEvents(rows, func(e LoggedEvent) error {
+		out = append(out, e)
+		return nil
+	})
+	return out, err
+}
+
+// scanLoggedEvents calls fn for each event_log row selected with loggedEventColumns
+func scanLoggedEvents(rows *storeRows, fn func(LoggedEvent) error) error {
+	for rows.Next() {
+		var e LoggedEvent
+		var payload, receivedAt string
+		if err := rows.Scan(&e.ID, &e.TeamID, &e.EventID, &e.Channel, &e.UserID, &e.Ts, &payload, &receivedAt); err != nil {
+			return fmt.Errorf("event log scan: %w", err)
+		}
+		e.Payload = json.RawMessage(payload)
+		e.ReceivedAt, _ = time.Parse(time.RFC3339, receivedAt)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetBeersSince returns all unrevoked beers from Slack given in workspace
+// teamID whose ts is at or after sinceTs. Imported beers are left out: they
+// have no events to be rebuilt from.
+func (s *SQLStore) GetBeersSince(ctx context.Context, teamID, sinceTs string) ([]BeerRow, error) {
+	rows, err := s.stream(ctx, "GetBeersSince", `SELECT team_id, giver_id, recipient_id, ts, ts_rfc, count FROM beers WHERE team_id = ? AND ts >= ? AND source = ? AND revoked_at IS NULL ORDER BY ts, giver_id, recipient_id`, teamID, sinceTs, beerSourceSlack)
+	if err != nil {
+		return nil, fmt.Errorf("beers since query: %w", err)
+	}
+	defer rows.Close()
+
+	var out []BeerRow
+	for rows.Next() {
+		var b BeerRow
+		var tsRFC string
+		if err := rows.Scan(&b.TeamID, &b.GiverID, &b.RecipientID, &b.Ts, &tsRFC, &b.Count); err != nil {
+			return nil, fmt.Errorf("beers since scan: %w", err)
+		}
+		b.TsRFC, _ = time.Parse(time.RFC3339, tsRFC)
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// rebuiltBeer is an existing Slack beer as seen by ReplaceBeersSince
+type rebuiltBeer struct {
+	*Beer
+	adjusted bool
+	derived  bool
+}
+
+// ReplaceBeersSince atomically makes the Slack beers of workspace teamID with
+// ts >= sinceTs match rows and recomputes the affected beer_daily days. Changed counts are
+// updated, new beers inserted, and beers no longer derived are revoked by
+// "rebuild", so a later rebuild can bring them back. Imported beers and admin
+// corrections are kept: adjusted beers keep their count and beers revoked by
+// an admin stay revoked. The replacement is recorded in the audit log.
+func (s *SQLStore) ReplaceBeersSince(ctx context.Context, teamID, sinceTs string, rows []BeerRow) error {
+	return s.writeUnbounded(ctx, "ReplaceBeersSince", func(ctx context.Context, tx *sql.Tx) error {
+		existing, err := s.slackBeersSince(ctx, tx, teamID, sinceTs)
+		if err != nil {
+			return err
+		}
+
+		insert, err := tx.PrepareContext(ctx, s.dialect.rebind(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count, team_id) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (giver_id, recipient_id, ts) DO NOTHING`))
+		if err != nil {
+			return err
+		}
+		defer insert.Close()
+		removed, added := 0, 0
+		for _, b := range rows {
+			old, ok := existing[beerKey{b.GiverID, b.RecipientID, b.Ts}]
+			if !ok {
+				res, err := insert.ExecContext(ctx, b.GiverID, b.RecipientID, b.Ts, b.TsRFC.UTC().Format(time.RFC3339), b.Count, teamID)
+				if err != nil {
+					return fmt.Errorf("insert beer: %w", err)
+				}
+				if n, _ := res.RowsAffected(); n > 0 {
+					added += b.Count
+				}
+				continue
+			}
+			old.derived = true
+			switch {
+			case old.RevokedAt != nil && old.RevokedBy == auditActorRebuild:
+				if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE beers SET count = ?, revoked_at = NULL, revoked_by = '', revoke_reason = '' WHERE id = ?`), b.Count, old.ID); err != nil {
+					return fmt.Errorf("restore beer: %w", err)
+				}
+				added += b.Count
+			case old.RevokedAt != nil || old.adjusted || old.Count == b.Count:
+			default:
+				if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE beers SET count = ? WHERE id = ?`), b.Count, old.ID); err != nil {
+					return fmt.Errorf("update beer: %w", err)
+				}
+				removed += old.Count
+				added += b.Count
+			}
+		}
+
+		revokedAt := time.Now().UTC().Format(time.RFC3339)
+		for _, old := range existing {
+			if old.derived || old.adjusted || old.RevokedAt != nil {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE beers SET revoked_at = ?, revoked_by = ?, revoke_reason = ? WHERE id = ?`),
+				revokedAt, auditActorRebuild, "no longer derived from the event log", old.ID); err != nil {
+				return fmt.Errorf("revoke beer: %w", err)
+			}
+			removed += old.Count
+		}
+
+		// beers before sinceTs can share its day, so recompute the whole day
+		sinceDay := ""
+		if since, err := parseSlackTimestamp(sinceTs); err == nil {
+			sinceDay = rollupDay(since)
+		}
+		if _, err := s.rebuildDailyRollupSince(ctx, tx, sinceDay); err != nil {
+			return err
+		}
+		entry := AuditEntry{Actor: auditActorRebuild, Action: AuditBeersRebuild, Ts: sinceTs, OldCount: removed, NewCount: added, Reason: "re-derived from the event log"}
+		return s.appendAudit(ctx, tx, &entry)
+	})
+}
+
+// slackBeersSince loads the Slack beers of workspace teamID with ts >= sinceTs,
+// revoked or not, noting which ones an admin adjusted
+func (s *SQLStore) slackBeersSince(ctx context.Context, tx *sql.Tx, teamID, sinceTs string) (map[beerKey]*rebuiltBeer, error) {
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(`SELECT `+beerColumns+`,
+		EXISTS (SELECT 1 FROM audit_log WHERE audit_log.beer_id = beers.id AND audit_log.action = ?)
+		FROM beers WHERE team_id = ? AND ts >= ? AND source = ?`), AuditBeerAdjust, teamID, sinceTs, beerSourceSlack)
+	if err != nil {
+		return nil, fmt.Errorf("beers since query: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[beerKey]*rebuiltBeer{}
+	for rows.Next() {
+		var adjusted bool
+		b, err := scanBeer(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &adjusted)...)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("beers since scan: %w", err)
+		}
+		out[beerKey{b.GiverID, b.RecipientID, b.Ts}] = &rebuiltBeer{Beer: b, adjusted: adjusted}
+	}
+	return out, rows.Err()
+}
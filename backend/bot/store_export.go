@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ExportBeer is one beers row with the giver's and recipient's cached names.
+// Names are empty for users that were never resolved.
+type ExportBeer struct {
+	TeamID        string    `json:"team_id,omitempty"`
+	Ts            string    `json:"ts"`
+	Time          time.Time `json:"time"`
+	GiverID       string    `json:"giver_id"`
+	GiverName     string    `json:"giver_name"`
+	RecipientID   string    `json:"recipient_id"`
+	RecipientName string    `json:"recipient_name"`
+	Count         int       `json:"count"`
+	Source        string    `json:"source"`
+}
+
+// ForEachBeer calls fn for every unrevoked beer given between start and end
+// (inclusive dates) in time order, in workspace if it is set. Rows are read
+// one at a time, so fn can stream them out.
+func (s *SQLStore) ForEachBeer(ctx context.Context, start, end time.Time, workspace string, fn func(ExportBeer) error) error {
+	// compare ts_rfc directly rather than substr() so the ts_rfc index is used
+	from := start.Format("2006-01-02")
+	until := end.AddDate(0, 0, 1).Format("2006-01-02")
+	filter, filterArgs := workspaceFilter("b.team_id", workspace)
+	rows, err := s.stream(ctx, "ForEachBeer", `SELECT b.team_id, b.ts, b.ts_rfc, b.giver_id, COALESCE(g.real_name, ''), b.recipient_id, COALESCE(r.real_name, ''), b.count, b.source
+		FROM beers b
+		LEFT JOIN user_cache g ON g.user_id = b.giver_id
+		LEFT JOIN user_cache r ON r.user_id = b.recipient_id
+		WHERE b.ts_rfc >= ? AND b.ts_rfc < ? AND b.revoked_at IS NULL`+filter+`
+		ORDER BY b.ts_rfc, b.id`, append([]interface{}{from, until}, filterArgs...)...)
+	if err != nil {
+		return fmt.Errorf("export beers query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b ExportBeer
+		var tsRFC string
+		if err := rows.Scan(&b.TeamID, &b.Ts, &tsRFC, &b.GiverID, &b.GiverName, &b.RecipientID, &b.RecipientName, &b.Count, &b.Source); err != nil {
+			return fmt.Errorf("export beers scan: %w", err)
+		}
+		b.Time, _ = time.Parse(time.RFC3339, tsRFC)
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -32,18 +32,18 @@ func TestGetAllGiversAndRecipients(t *testing.T) {
 
 	// insert some beers
 	now := time.Now()
-	if err := store.AddBeer("giver1", "recipientA", "1000.1", now, 1); err != nil {
+	if err := store.AddBeer(t.Context(), "", "giver1", "recipientA", "1000.1", now, 1); err != nil {
 		t.Fatalf("addbeer: %v", err)
 	}
-	if err := store.AddBeer("giver2", "recipientA", "1000.2", now, 2); err != nil {
+	if err := store.AddBeer(t.Context(), "", "giver2", "recipientA", "1000.2", now, 2); err != nil {
 		t.Fatalf("addbeer: %v", err)
 	}
 	// duplicate giver1 to another recipient
-	if err := store.AddBeer("giver1", "recipientB", "1000.3", now, 1); err != nil {
+	if err := store.AddBeer(t.Context(), "", "giver1", "recipientB", "1000.3", now, 1); err != nil {
 		t.Fatalf("addbeer: %v", err)
 	}
 
-	givers, err := store.GetAllGivers()
+	givers, err := store.GetAllGivers(t.Context(), StatsOptions{})
 	if err != nil {
 		t.Fatalf("get all givers: %v", err)
 	}
@@ -56,7 +56,7 @@ func TestGetAllGiversAndRecipients(t *testing.T) {
 		t.Fatalf("unexpected givers list: %v", givers)
 	}
 
-	recipients, err := store.GetAllRecipients()
+	recipients, err := store.GetAllRecipients(t.Context(), StatsOptions{})
 	if err != nil {
 		t.Fatalf("get all recipients: %v", err)
 	}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// beerSourceSlack tags beers recorded from Slack events; imported beers carry
+// the source named at import time
+const beerSourceSlack = "slack"
+
+// errImportDryRun rolls back a dry-run import after its inserts were counted
+var errImportDryRun = errors.New("import dry run")
+
+// ImportBeers inserts rows tagged with source into their workspaces, skipping any whose
+// (giver_id, recipient_id, ts) already exists, and returns how many were
+// inserted. Each inserted beer is recorded in the audit log. The import is one
+// transaction; with dryRun it is rolled back, so the count is what a real
+// import would insert.
+func (s *SQLStore) ImportBeers(ctx context.Context, rows []BeerRow, source string, dryRun bool) (int, error) {
+	inserted := 0
+	err := s.writeUnbounded(ctx, "ImportBeers", func(ctx context.Context, tx *sql.Tx) error {
+		inserted = 0
+		stmt, err := tx.PrepareContext(ctx, s.dialect.rebind(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count, source, team_id) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (giver_id, recipient_id, ts) DO NOTHING RETURNING id`))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, b := range rows {
+			var id int64
+			err := stmt.QueryRowContext(ctx, b.GiverID, b.RecipientID, b.Ts, b.TsRFC.UTC().Format(time.RFC3339), b.Count, source, b.TeamID).Scan(&id)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("insert beer: %w", err)
+			}
+			inserted++
+			if err := s.addDailyRollup(ctx, tx, rollupDay(b.TsRFC), b.TeamID, b.GiverID, b.RecipientID, b.Count, 0); err != nil {
+				return err
+			}
+			beer := &Beer{ID: id, TeamID: b.TeamID, GiverID: b.GiverID, RecipientID: b.RecipientID, Ts: b.Ts, Time: b.TsRFC.UTC(), Count: b.Count, Source: source}
+			entry := auditBeer(auditActorImport, AuditBeerImport, beer, 0, b.Count, "imported from "+source)
+			if err := s.appendAudit(ctx, tx, &entry); err != nil {
+				return err
+			}
+		}
+		if dryRun {
+			return errImportDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errImportDryRun) {
+		err = nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("import beers: %w", err)
+	}
+	return inserted, nil
+}
+
+// FindCachedUsersByName returns the IDs of cached users whose real name
+// matches name, ignoring case
+func (s *SQLStore) FindCachedUsersByName(ctx context.Context, name string) ([]string, error) {
+	rows, err := s.query(ctx, "FindCachedUsersByName", `SELECT user_id FROM user_cache WHERE LOWER(real_name) = ? ORDER BY user_id`, strings.ToLower(name))
+	if err != nil {
+		return nil, fmt.Errorf("find users by name: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("find users by name scan: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// optedOutUsers selects the IDs of users who opted out of public leaderboards
+const optedOutUsers = `SELECT user_id FROM user_privacy`
+
+// SetOptOut records whether a user is hidden from public leaderboards. Their
+// beers still count in aggregates.
+func (s *SQLStore) SetOptOut(ctx context.Context, userID string, optOut bool) error {
+	if !optOut {
+		_, err := s.exec(ctx, "SetOptOut", `DELETE FROM user_privacy WHERE user_id = ?`, userID)
+		return err
+	}
+	_, err := s.exec(ctx, "SetOptOut", `INSERT INTO user_privacy (user_id, opted_out_at) VALUES (?, ?) ON CONFLICT (user_id) DO NOTHING`, userID, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// IsOptedOut reports whether a user opted out of public leaderboards
+func (s *SQLStore) IsOptedOut(ctx context.Context, userID string) (bool, error) {
+	var id string
+	err := s.queryRow(ctx, "IsOptedOut", `SELECT user_id FROM user_privacy WHERE user_id = ?`, userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetOptedOutUsers returns the users who opted out of public leaderboards
+func (s *SQLStore) GetOptedOutUsers(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.query(ctx, "GetOptedOutUsers", optedOutUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out[id] = true
+	}
+	return out, rows.Err()
+}
+
+// UserErasure reports what EraseUser changed
+type UserErasure struct {
+	Pseudonym string `json:"pseudonym"`
+	Beers     int64  `json:"beers"`
+	Events    int64  `json:"events"`
+}
+
+// newPseudonym returns a random ID that replaces an erased user. It looks
+// like a Slack ID so the event log still parses, but starts with X, which
+// Slack doesn't use.
+func newPseudonym() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "X" + strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// EraseUser anonymizes a user: every reference to them in beers, the rollup,
+// the audit log, teams, aliases, the event log and dead letters is replaced
+// with a random pseudonym, and their cached profile is deleted. Beers keep
+// counting in aggregates under the pseudonym, which is hidden from public
+// leaderboards.
+func (s *SQLStore) EraseUser(ctx context.Context, userID, actor, reason string) (*UserErasure, error) {
+	pseudonym, err := newPseudonym()
+	if err != nil {
+		return nil, fmt.Errorf("pseudonym: %w", err)
+	}
+	e := &UserErasure{Pseudonym: pseudonym}
+
+	// payloads mention users as JSON strings and as <@U123> or <@U123|name>
+	scrub := func(column string) string {
+		return `REPLACE(REPLACE(REPLACE(` + column + `, ?, ?), ?, ?), ?, ?)`
+	}
+	scrubArgs := []interface{}{
+		`"` + userID + `"`, `"` + pseudonym + `"`,
+		`<@` + userID + `>`, `<@` + pseudonym + `>`,
+		`<@` + userID + `|`, `<@` + pseudonym + `|`,
+	}
+	like := "%" + userID + "%"
+
+	err = s.writeUnbounded(ctx, "EraseUser", func(ctx context.Context, tx *sql.Tx) error {
+		exec := func(query string, args ...interface{}) (int64, error) {
+			res, err := tx.ExecContext(ctx, s.dialect.rebind(query), args...)
+			if err != nil {
+				return 0, err
+			}
+			return res.RowsAffected()
+		}
+		for _, column := range []string{"giver_id", "recipient_id"} {
+			n, err := exec(`UPDATE beers SET `+column+` = ? WHERE `+column+` = ?`, pseudonym, userID)
+			if err != nil {
+				return fmt.Errorf("anonymize beers: %w", err)
+			}
+			e.Beers += n
+			for _, table := range []string{"beer_daily", "audit_log"} {
+				if _, err := exec(`UPDATE `+table+` SET `+column+` = ? WHERE `+column+` = ?`, pseudonym, userID); err != nil {
+					return fmt.Errorf("anonymize %s: %w", table, err)
+				}
+			}
+		}
+		for _, table := range []string{"team_members", "emoji_counts", "event_log"} {
+			if _, err := exec(`UPDATE `+table+` SET user_id = ? WHERE user_id = ?`, pseudonym, userID); err != nil {
+				return fmt.Errorf("anonymize %s: %w", table, err)
+			}
+		}
+		n, err := exec(`UPDATE event_log SET payload = `+scrub("payload")+` WHERE payload LIKE ?`, append(scrubArgs, like)...)
+		if err != nil {
+			return fmt.Errorf("scrub event_log: %w", err)
+		}
+		e.Events = n
+		if _, err := exec(`UPDATE dead_letter_events SET payload = `+scrub("payload")+` WHERE payload LIKE ?`, append(scrubArgs, like)...); err != nil {
+			return fmt.Errorf("scrub dead_letter_events: %w", err)
+		}
+		// fallback event ids are msg|channel|user|ts
+		if _, err := exec(`UPDATE processed_events SET event_id = REPLACE(event_id, ?, ?) WHERE event_id LIKE ?`, "|"+userID+"|", "|"+pseudonym+"|", "msg|%|"+userID+"|%"); err != nil {
+			return fmt.Errorf("anonymize processed_events: %w", err)
+		}
+		for _, column := range []string{"alias_id", "canonical_id"} {
+			if _, err := exec(`UPDATE user_aliases SET `+column+` = ? WHERE `+column+` = ?`, pseudonym, userID); err != nil {
+				return fmt.Errorf("anonymize user_aliases: %w", err)
+			}
+		}
+		for _, table := range []string{"user_cache", "user_privacy"} {
+			if _, err := exec(`DELETE FROM `+table+` WHERE user_id = ?`, userID); err != nil {
+				return fmt.Errorf("delete from %s: %w", table, err)
+			}
+		}
+		// the pseudonym stays off public leaderboards
+		if _, err := exec(`INSERT INTO user_privacy (user_id, opted_out_at) VALUES (?, ?)`, pseudonym, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("hide pseudonym: %w", err)
+		}
+		entry := AuditEntry{Actor: actor, Action: AuditUserErase, GiverID: pseudonym, Reason: reason}
+		return s.appendAudit(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("erase user: %w", err)
+	}
+	return e, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// QueryOptions bounds and instruments the store's database calls
+type QueryOptions struct {
+	// Timeout caps each query and write transaction; 0 disables it. Exports,
+	// imports, rebuilds and other bulk operations are not capped.
+	Timeout time.Duration
+	// SlowThreshold logs calls that take at least this long; 0 disables it
+	SlowThreshold time.Duration
+}
+
+// queryOptionsFromEnv returns the default query options, overridden by
+// DB_QUERY_TIMEOUT and DB_SLOW_QUERY
+func queryOptionsFromEnv() QueryOptions {
+	opts := QueryOptions{Timeout: 10 * time.Second, SlowThreshold: 500 * time.Millisecond}
+	if env := os.Getenv("DB_QUERY_TIMEOUT"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			opts.Timeout = v
+		}
+	}
+	if env := os.Getenv("DB_SLOW_QUERY"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			opts.SlowThreshold = v
+		}
+	}
+	return opts
+}
+
+// StoreOptions configures openStore
+type StoreOptions struct {
+	SQLite SQLiteOptions
+	Query  QueryOptions
+	// Logger receives slow-query and timeout warnings, and every call at debug level
+	Logger zerolog.Logger
+}
+
+// storeOptionsFromEnv returns the SQLite and query options from the
+// environment, with logging disabled
+func storeOptionsFromEnv() StoreOptions {
+	return StoreOptions{SQLite: sqliteOptionsFromEnv(), Query: queryOptionsFromEnv(), Logger: zerolog.Nop()}
+}
+
+func newQueryDurationHistogram() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bwm_db_query_duration_seconds",
+		Help:    "Time spent in store database calls, by store operation",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 9),
+	}, []string{"op"})
+}
+
+// instrument sets the query options and logger, and registers the query
+// duration histogram on reg when non-nil
+func (s *SQLStore) instrument(opts QueryOptions, logger zerolog.Logger, reg prometheus.Registerer) {
+	s.queryOpts = opts
+	s.logger = logger
+	if reg != nil {
+		reg.MustRegister(s.queryDuration)
+	}
+}
+
+// begin starts the store call op, bounding ctx by the query timeout unless
+// the call is a bulk one. The returned func must be called once the call has
+// finished: it releases the timeout, records the duration and logs slow and
+// timed out calls.
+func (s *SQLStore) begin(ctx context.Context, op string, bounded bool) (context.Context, func(err error)) {
+	start := time.Now()
+	cancel := context.CancelFunc(func() {})
+	if bounded && s.queryOpts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.queryOpts.Timeout)
+	}
+	finished := false
+	return ctx, func(err error) {
+		if finished {
+			return
+		}
+		finished = true
+		cancel()
+		d := time.Since(start)
+		s.queryDuration.WithLabelValues(op).Observe(d.Seconds())
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			s.logger.Warn().Str("op", op).Dur("duration", d).Dur("timeout", s.queryOpts.Timeout).Msg("query timed out")
+		case s.queryOpts.SlowThreshold > 0 && d >= s.queryOpts.SlowThreshold:
+			s.logger.Warn().Str("op", op).Dur("duration", d).Err(err).Msg("slow query")
+		default:
+			s.logger.Debug().Str("op", op).Dur("duration", d).Err(err).Msg("query")
+		}
+	}
+}
+
+// storeRows finishes its store call when closed
+type storeRows struct {
+	*sql.Rows
+	done func(err error)
+}
+
+func (r *storeRows) Close() error {
+	err := r.Rows.Close()
+	r.done(r.Rows.Err())
+	return err
+}
+
+// storeRow finishes its store call once scanned
+type storeRow struct {
+	row  *sql.Row
+	done func(err error)
+}
+
+func (r *storeRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if err == sql.ErrNoRows {
+		r.done(nil)
+	} else {
+		r.done(err)
+	}
+	return err
+}
+
+func (s *SQLStore) reader() *sql.DB {
+	if s.readDB != nil {
+		return s.readDB
+	}
+	return s.db
+}
+
+// query runs a read query bounded by the query timeout
+func (s *SQLStore) query(ctx context.Context, op, query string, args ...interface{}) (*storeRows, error) {
+	return s.queryRows(ctx, op, true, query, args...)
+}
+
+// stream runs a read query without the query timeout, for iterations whose
+// callback may take long such as exports
+func (s *SQLStore) stream(ctx context.Context, op, query string, args ...interface{}) (*storeRows, error) {
+	return s.queryRows(ctx, op, false, query, args...)
+}
+
+func (s *SQLStore) queryRows(ctx context.Context, op string, bounded bool, query string, args ...interface{}) (*storeRows, error) {
+	ctx, done := s.begin(ctx, op, bounded)
+	rows, err := s.reader().QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	return &storeRows{Rows: rows, done: done}, nil
+}
+
+func (s *SQLStore) queryRow(ctx context.Context, op, query string, args ...interface{}) *storeRow {
+	ctx, done := s.begin(ctx, op, true)
+	return &storeRow{row: s.reader().QueryRowContext(ctx, s.dialect.rebind(query), args...), done: done}
+}
+
+// write runs fn in a write transaction bounded by the query timeout, on the
+// writer goroutine when there is one. Statements in fn should use the ctx it
+// is given.
+func (s *SQLStore) write(ctx context.Context, op string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return s.writeTx(ctx, op, true, fn)
+}
+
+// writeUnbounded is write without the query timeout, for bulk changes
+func (s *SQLStore) writeUnbounded(ctx context.Context, op string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return s.writeTx(ctx, op, false, fn)
+}
+
+func (s *SQLStore) writeTx(ctx context.Context, op string, bounded bool, fn func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	ctx, done := s.begin(ctx, op, bounded)
+	defer func() { done(err) }()
+
+	if s.writer != nil {
+		return s.writer.Do(ctx, func(tx *sql.Tx) error { return fn(ctx, tx) })
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// exec runs a single write statement and returns its rows affected
+func (s *SQLStore) exec(ctx context.Context, op, query string, args ...interface{}) (int64, error) {
+	var n int64
+	err := s.write(ctx, op, func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n, err
+}
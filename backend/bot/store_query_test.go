@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+func TestSQLStore_QueryContext(t *testing.T) {
+	store := newTestStore(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := store.CountGivenOnDate(ctx, "U1", "2024-01-01"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled read, got %v", err)
+	}
+	if err := store.AddBeer(ctx, "", "U1", "U2", "1.000001", time.Now(), 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled write, got %v", err)
+	}
+
+	var logs bytes.Buffer
+	store.instrument(QueryOptions{Timeout: time.Nanosecond}, zerolog.New(&logs), nil)
+	if _, err := store.CountGivenOnDate(t.Context(), "U1", "2024-01-01"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the query timeout, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "query timed out") {
+		t.Fatalf("expected a timeout warning, got %s", logs.String())
+	}
+
+	// bulk calls are not bounded by the timeout
+	if _, err := store.RebuildDailyRollup(t.Context()); err != nil {
+		t.Fatalf("rebuild rollup: %v", err)
+	}
+}
+
+func TestSQLStore_SlowQueryMetrics(t *testing.T) {
+	store := newTestStore(t)
+	reg := prometheus.NewRegistry()
+	var logs bytes.Buffer
+	store.instrument(QueryOptions{Timeout: time.Second, SlowThreshold: time.Nanosecond}, zerolog.New(&logs), reg)
+
+	if err := store.AddBeer(t.Context(), "", "U1", "U2", "1.000001", time.Now(), 1); err != nil {
+		t.Fatalf("add beer: %v", err)
+	}
+	if _, err := store.GetAllGivers(t.Context(), StatsOptions{}); err != nil {
+		t.Fatalf("givers: %v", err)
+	}
+	if !strings.Contains(logs.String(), "slow query") {
+		t.Fatalf("expected slow query logs, got %s", logs.String())
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	ops := map[string]uint64{}
+	for _, mf := range families {
+		if mf.GetName() != "bwm_db_query_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "op" {
+					ops[l.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	if ops["AddBeer"] != 1 || ops["GetAllGivers"] != 1 {
+		t.Fatalf("unexpected query duration samples: %v", ops)
+	}
+}
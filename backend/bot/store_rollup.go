@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// beerDailyRollupStatements create beer_daily and fill it from beers. The
+// statements are portable, so both dialects share them.
+var beerDailyRollupStatements = []string{
+	`CREATE TABLE IF NOT EXISTS beer_daily (
+		day TEXT NOT NULL,
+		giver_id TEXT NOT NULL,
+		recipient_id TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (day, giver_id, recipient_id)
+	);`,
+	`CREATE INDEX IF NOT EXISTS idx_beer_daily_giver_day ON beer_daily (giver_id, day);`,
+	`CREATE INDEX IF NOT EXISTS idx_beer_daily_recipient_day ON beer_daily (recipient_id, day);`,
+	beerDailyBackfill,
+}
+
+// beerDailyBackfill aggregates every existing beer into beer_daily. Groups
+// that sum to zero have no rollup row.
+const beerDailyBackfill = `INSERT INTO beer_daily (day, giver_id, recipient_id, count)
+	SELECT substr(ts_rfc, 1, 10), giver_id, recipient_id, SUM(count)
+	FROM beers
+	GROUP BY substr(ts_rfc, 1, 10), giver_id, recipient_id
+	HAVING SUM(count) <> 0`
+
+// addDailyRollup adds delta beers and revokedDelta revoked beers to a
+// day/workspace/giver/recipient rollup row, removing the row once both drop
+// to zero. Merged users are counted under their canonical ID, and beers
+// between two IDs of the same user are not counted.
+func (s *SQLStore) addDailyRollup(ctx context.Context, tx *sql.Tx, day, teamID, giverID, recipientID string, delta, revokedDelta int) error {
+	if delta == 0 && revokedDelta == 0 {
+		return nil
+	}
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+canonicalUser("?")+`, `+canonicalUser("?")), giverID, giverID, recipientID, recipientID).Scan(&giverID, &recipientID); err != nil {
+		return fmt.Errorf("resolve aliases: %w", err)
+	}
+	if giverID == recipientID {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO beer_daily (day, team_id, giver_id, recipient_id, count, revoked) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (day, team_id, giver_id, recipient_id) DO UPDATE SET count = beer_daily.count + excluded.count, revoked = beer_daily.revoked + excluded.revoked`),
+		day, teamID, giverID, recipientID, delta, revokedDelta); err != nil {
+		return fmt.Errorf("update beer_daily: %w", err)
+	}
+	if delta < 0 || revokedDelta < 0 {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM beer_daily WHERE day = ? AND team_id = ? AND giver_id = ? AND recipient_id = ? AND count <= 0 AND revoked <= 0`),
+			day, teamID, giverID, recipientID); err != nil {
+			return fmt.Errorf("trim beer_daily: %w", err)
+		}
+	}
+	return nil
+}
+
+// beerDailyGroups aggregates beers per day, workspace, giver and recipient
+// into active and revoked counts, as stored in beer_daily. Merged users are
+// grouped under their canonical ID; beers between two IDs of the same user
+// are left out.
+const beerDailyGroups = `SELECT substr(ts_rfc, 1, 10) AS day, team_id,
+		COALESCE(ga.canonical_id, giver_id) AS giver_id,
+		COALESCE(ra.canonical_id, recipient_id) AS recipient_id,
+		SUM(CASE WHEN revoked_at IS NULL THEN count ELSE 0 END) AS active,
+		SUM(CASE WHEN revoked_at IS NULL THEN 0 ELSE count END) AS revoked
+	FROM beers
+	LEFT JOIN user_aliases ga ON ga.alias_id = giver_id
+	LEFT JOIN user_aliases ra ON ra.alias_id = recipient_id
+	WHERE substr(ts_rfc, 1, 10) >= ? AND COALESCE(ga.canonical_id, giver_id) <> COALESCE(ra.canonical_id, recipient_id)
+	GROUP BY substr(ts_rfc, 1, 10), team_id, COALESCE(ga.canonical_id, giver_id), COALESCE(ra.canonical_id, recipient_id)
+	HAVING SUM(count) <> 0`
+
+// rebuildDailyRollupSince recomputes beer_daily for every day on or after sinceDay
+func (s *SQLStore) rebuildDailyRollupSince(ctx context.Context, tx *sql.Tx, sinceDay string) (int64, error) {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM beer_daily WHERE day >= ?`), sinceDay); err != nil {
+		return 0, fmt.Errorf("clear beer_daily: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO beer_daily (day, team_id, giver_id, recipient_id, count, revoked) `+beerDailyGroups), sinceDay)
+	if err != nil {
+		return 0, fmt.Errorf("fill beer_daily: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// RebuildDailyRollup recomputes the whole beer_daily table from beers and
+// returns the number of rollup rows written
+func (s *SQLStore) RebuildDailyRollup(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.writeUnbounded(ctx, "RebuildDailyRollup", func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		n, err = s.rebuildDailyRollupSince(ctx, tx, "")
+		return err
+	})
+	return n, err
+}
+
+// DailyRollupDrift counts day/workspace/giver/recipient groups where beer_daily
+// disagrees with beers, including groups missing on either side. It scans
+// both tables, so it runs without the query timeout.
+func (s *SQLStore) DailyRollupDrift(ctx context.Context) (int, error) {
+	rows, err := s.stream(ctx, "DailyRollupDrift", `
+		WITH agg AS (`+beerDailyGroups+`)
+		SELECT
+			(SELECT COUNT(1) FROM agg a LEFT JOIN beer_daily d
+				ON d.day = a.day AND d.team_id = a.team_id AND d.giver_id = a.giver_id AND d.recipient_id = a.recipient_id
+				WHERE d.count IS NULL OR d.count <> a.active OR d.revoked <> a.revoked)
+			+
+			(SELECT COUNT(1) FROM beer_daily d LEFT JOIN agg a
+				ON d.day = a.day AND d.team_id = a.team_id AND d.giver_id = a.giver_id AND d.recipient_id = a.recipient_id
+				WHERE a.active IS NULL)`, "")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int
+	if rows.Next() {
+		err = rows.Scan(&n)
+	}
+	return n, errors.Join(err, rows.Err())
+}
+
+// rollupDay returns the beer_daily day key for a beer time
+func rollupDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// runRollupCommand implements `bot rollup`: it recomputes beer_daily from
+// beers, or with -check only reports how many rollup groups have drifted.
+func runRollupCommand(args []string) {
+	fs := flag.NewFlagSet("rollup", flag.ExitOnError)
+	dsn := fs.String("db", databaseDSN(), "sqlite database path or postgres:// URL")
+	check := fs.Bool("check", false, "report drift between beers and beer_daily without rebuilding")
+	_ = fs.Parse(args)
+
+	store, err := openStore(*dsn, storeOptionsFromEnv(), nil)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if *check {
+		drift, err := store.DailyRollupDrift(ctx)
+		if err != nil {
+			log.Fatalf("check rollup: %v", err)
+		}
+		fmt.Printf("beer_daily: %d drifted groups\n", drift)
+		if drift > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	start := time.Now()
+	n, err := store.RebuildDailyRollup(ctx)
+	if err != nil {
+		log.Fatalf("rebuild rollup: %v", err)
+	}
+	fmt.Printf("beer_daily rebuilt: %d rows in %s\n", n, time.Since(start).Round(time.Millisecond))
+}
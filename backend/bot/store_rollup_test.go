@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestDailyRollup_MaintainedByWrites(t *testing.T) {
+	store := newTestStore(t)
+	t1, _ := parseSlackTimestamp("1700000000.000100")
+	t2, _ := parseSlackTimestamp("1700000100.000100")
+
+	mustAdd := func(giver, recipient, ts string, at time.Time, count int) {
+		t.Helper()
+		if err := store.AddBeer(t.Context(), "", giver, recipient, ts, at, count); err != nil {
+			t.Fatalf("add beer: %v", err)
+		}
+	}
+	mustAdd("U1", "U2", "1700000000.000100", t1, 2)
+	mustAdd("U1", "U2", "1700000100.000100", t2, 1)
+	mustAdd("U3", "U2", "1700000100.000100", t2, 1)
+	// upserts move the rollup by the difference, down to removing the row
+	mustAdd("U1", "U2", "1700000000.000100", t1, 1)
+	mustAdd("U3", "U2", "1700000100.000100", t2, 0)
+
+	pairs, err := store.GetPairStats(t.Context(), t1, t1, 10, StatsOptions{})
+	if err != nil || len(pairs) != 1 || pairs[0].Count != 2 {
+		t.Fatalf("unexpected pairs: %+v %v", pairs, err)
+	}
+	var rows int
+	if err := store.db.QueryRow(`SELECT COUNT(1) FROM beer_daily`).Scan(&rows); err != nil || rows != 1 {
+		t.Fatalf("expected the zeroed rollup row removed, got %d rows %v", rows, err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("drift after writes: %d %v", drift, err)
+	}
+
+	if err := store.ReplaceBeersSince(t.Context(), "", "1700000100.000100", []BeerRow{{GiverID: "U4", RecipientID: "U1", Ts: "1700000200.000100", TsRFC: t2, Count: 3}}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("drift after replace: %d %v", drift, err)
+	}
+	heat, err := store.GetHeatmapStats(t.Context(), t1, t1, StatsOptions{})
+	if err != nil || len(heat) != 1 || heat[0].Count != 4 {
+		t.Fatalf("unexpected heatmap: %+v %v", heat, err)
+	}
+}
+
+func TestDailyRollup_BackfillAndRebuild(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "rollup.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	// beers written before the rollup existed are backfilled by the migration
+	if _, err := MigrateTo(db, sqliteDialect, 4, ""); err != nil {
+		t.Fatalf("migrate to v4: %v", err)
+	}
+	for i, ts := range []string{"2024-01-01T10:00:00Z", "2024-01-01T11:00:00Z", "2024-01-02T10:00:00Z"} {
+		if _, err := db.Exec(`INSERT INTO beers (giver_id, recipient_id, ts, ts_rfc, count) VALUES ('U1', 'U2', ?, ?, 2)`, fmt.Sprintf("%d.0", i), ts); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	day := func(s string) time.Time { d, _ := time.Parse("2006-01-02", s); return d }
+	timeline, err := store.GetTimelineStats(t.Context(), day("2024-01-01"), day("2024-01-31"), "day", StatsOptions{})
+	if err != nil || len(timeline) != 2 || timeline[0].Given != 4 || timeline[1].Received != 2 {
+		t.Fatalf("unexpected timeline: %+v %v", timeline, err)
+	}
+
+	if _, err := db.Exec(`UPDATE beer_daily SET count = 99 WHERE day = '2024-01-02'`); err != nil {
+		t.Fatalf("corrupt rollup: %v", err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 1 {
+		t.Fatalf("expected one drifted group, got %d %v", drift, err)
+	}
+	if n, err := store.RebuildDailyRollup(t.Context()); err != nil || n != 2 {
+		t.Fatalf("rebuild: %d %v", n, err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("drift after rebuild: %d %v", drift, err)
+	}
+}
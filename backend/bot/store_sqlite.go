@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SQLiteOptions tunes how a SQLite database file is opened
+type SQLiteOptions struct {
+	// WAL enables write-ahead logging so readers don't block the writer
+	WAL bool
+	// BusyTimeout is how long a connection waits for a lock before failing
+	BusyTimeout time.Duration
+	// ReadConns bounds the read-only connection pool used by queries
+	ReadConns int
+	// WriteQueue is how many writes may wait for the writer goroutine
+	WriteQueue int
+	// WriteBatch is the most writes committed in one transaction; 0 disables
+	// the writer goroutine and writes go straight to the write connection
+	WriteBatch int
+	// WriteBatchWait is how long the writer waits for more writes before
+	// committing a batch that isn't full; 0 commits whatever is queued
+	WriteBatchWait time.Duration
+}
+
+// sqliteOptionsFromEnv returns the default SQLite options, overridden by
+// SQLITE_WAL, SQLITE_BUSY_TIMEOUT, SQLITE_READ_CONNS, SQLITE_WRITE_QUEUE,
+// SQLITE_WRITE_BATCH and SQLITE_WRITE_BATCH_WAIT
+func sqliteOptionsFromEnv() SQLiteOptions {
+	opts := SQLiteOptions{
+		WAL:         true,
+		BusyTimeout: 5 * time.Second,
+		ReadConns:   4,
+		WriteQueue:  256,
+		WriteBatch:  32,
+	}
+	if env := os.Getenv("SQLITE_WAL"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			opts.WAL = v
+		}
+	}
+	if env := os.Getenv("SQLITE_BUSY_TIMEOUT"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			opts.BusyTimeout = v
+		}
+	}
+	if env := os.Getenv("SQLITE_READ_CONNS"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			opts.ReadConns = v
+		}
+	}
+	if env := os.Getenv("SQLITE_WRITE_QUEUE"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			opts.WriteQueue = v
+		}
+	}
+	if env := os.Getenv("SQLITE_WRITE_BATCH"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			opts.WriteBatch = v
+		}
+	}
+	if env := os.Getenv("SQLITE_WRITE_BATCH_WAIT"); env != "" {
+		if v, err := time.ParseDuration(env); err == nil {
+			opts.WriteBatchWait = v
+		}
+	}
+	return opts
+}
+
+// sqliteDSN builds the go-sqlite3 DSN for path. The read pool opens the file
+// read-only and leaves the journal mode, which is persistent, to the writer.
+func sqliteDSN(path string, opts SQLiteOptions, readOnly bool) string {
+	q := url.Values{}
+	q.Set("_busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10))
+	if readOnly {
+		q.Set("mode", "ro")
+		return "file:" + path + "?" + q.Encode()
+	}
+	if opts.WAL {
+		q.Set("_journal_mode", "WAL")
+		q.Set("_synchronous", "NORMAL")
+	}
+	// take the write lock up front so transactions never fail on lock upgrade
+	q.Set("_txlock", "immediate")
+	return "file:" + path + "?" + q.Encode()
+}
+
+// sqliteIsTemporary reports whether path names a temporary or in-memory
+// database, which exists only on the connection that created it
+func sqliteIsTemporary(path string) bool {
+	return path == "" || strings.Contains(path, ":memory:")
+}
+
+// openSQLiteStore migrates the SQLite file at path through its write
+// connection, then adds a read-only pool for queries and, unless disabled, a
+// batching writer goroutine
+func openSQLiteStore(write *sql.DB, path string, opts SQLiteOptions, reg prometheus.Registerer) (*SQLStore, error) {
+	write.SetMaxOpenConns(1)
+	store, err := NewSQLiteStore(write)
+	if err != nil {
+		return nil, err
+	}
+
+	// the read pool is opened after migrating so the file and WAL exist
+	read, err := sql.Open("sqlite3", sqliteDSN(path, opts, true))
+	if err != nil {
+		return nil, fmt.Errorf("open read pool: %w", err)
+	}
+	if opts.ReadConns > 0 {
+		read.SetMaxOpenConns(opts.ReadConns)
+		read.SetMaxIdleConns(opts.ReadConns)
+	}
+	store.readDB = read
+
+	if opts.WriteBatch > 0 {
+		store.writer = newSQLiteWriter(write, opts.WriteQueue, opts.WriteBatch, opts.WriteBatchWait, reg)
+	}
+	return store, nil
+}
+
+// errWriterClosed is returned for writes submitted after the store is closed
+var errWriterClosed = errors.New("sqlite writer closed")
+
+type writeJob struct {
+	ctx    context.Context
+	fn     func(tx *sql.Tx) error
+	queued time.Time
+	result chan error
+}
+
+// sqliteWriter funnels every write through one goroutine. Writes queued
+// together are committed in a single transaction, each inside its own
+// savepoint so one failing write doesn't undo the others.
+type sqliteWriter struct {
+	db        *sql.DB
+	jobs      chan *writeJob
+	maxBatch  int
+	batchWait time.Duration
+	done      chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	queueWait prometheus.Histogram
+	batchSize prometheus.Histogram
+	commitDur prometheus.Histogram
+}
+
+func newSQLiteWriter(db *sql.DB, queueSize, maxBatch int, batchWait time.Duration, reg prometheus.Registerer) *sqliteWriter {
+	w := &sqliteWriter{
+		db:        db,
+		jobs:      make(chan *writeJob, queueSize),
+		maxBatch:  maxBatch,
+		batchWait: batchWait,
+		done:      make(chan struct{}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_db_write_queue_wait_seconds",
+			Help:    "Time a database write waits for the writer goroutine",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_db_write_batch_size",
+			Help:    "Number of writes committed per transaction",
+			Buckets: []float64{1, 2, 4, 8, 16, 32, 64, 128},
+		}),
+		commitDur: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_db_write_batch_duration_seconds",
+			Help:    "Time to execute and commit a batch of writes",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	if reg != nil {
+		depth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "bwm_db_write_queue_depth",
+			Help: "Number of database writes waiting for the writer goroutine",
+		}, func() float64 { return float64(len(w.jobs)) })
+		reg.MustRegister(w.queueWait, w.batchSize, w.commitDur, depth)
+	}
+	go w.run()
+	return w
+}
+
+// Do runs fn in a write transaction on the writer goroutine and waits for it
+// to commit. A job whose ctx is done before it runs is dropped with ctx's error.
+func (w *sqliteWriter) Do(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	job := &writeJob{ctx: ctx, fn: fn, queued: time.Now(), result: make(chan error, 1)}
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return errWriterClosed
+	}
+	select {
+	case w.jobs <- job:
+	case <-ctx.Done():
+		w.mu.RUnlock()
+		return ctx.Err()
+	}
+	w.mu.RUnlock()
+	return <-job.result
+}
+
+// Close stops accepting writes and waits for queued ones to commit
+func (w *sqliteWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.jobs)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *sqliteWriter) run() {
+	defer close(w.done)
+	for job := range w.jobs {
+		batch := w.collect(job)
+		w.commit(batch)
+	}
+}
+
+// collect gathers up to maxBatch jobs, waiting at most batchWait for more
+func (w *sqliteWriter) collect(first *writeJob) []*writeJob {
+	batch := []*writeJob{first}
+	var timeout <-chan time.Time
+	if w.batchWait > 0 {
+		timer := time.NewTimer(w.batchWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < w.maxBatch {
+		if timeout == nil {
+			select {
+			case job, ok := <-w.jobs:
+				if !ok {
+					return batch
+				}
+				batch = append(batch, job)
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case job, ok := <-w.jobs:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, job)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (w *sqliteWriter) commit(batch []*writeJob) {
+	start := time.Now()
+	for _, job := range batch {
+		w.queueWait.Observe(start.Sub(job.queued).Seconds())
+	}
+	w.batchSize.Observe(float64(len(batch)))
+	defer func() { w.commitDur.Observe(time.Since(start).Seconds()) }()
+
+	errs := make([]error, len(batch))
+	fail := func(err error) {
+		for _, job := range batch {
+			job.result <- err
+		}
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		fail(err)
+		return
+	}
+	for i, job := range batch {
+		if err := job.ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		if len(batch) == 1 {
+			errs[i] = job.fn(tx)
+			break
+		}
+		errs[i] = runInSavepoint(tx, job.fn)
+	}
+	if len(batch) == 1 && errs[0] != nil {
+		tx.Rollback()
+		fail(errs[0])
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		fail(err)
+		return
+	}
+	for i, job := range batch {
+		job.result <- errs[i]
+	}
+}
+
+// runInSavepoint runs fn so that its changes are undone if it fails, without
+// aborting the surrounding transaction
+func runInSavepoint(tx *sql.Tx, fn func(tx *sql.Tx) error) error {
+	if _, err := tx.Exec(`SAVEPOINT write_job`); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if _, rbErr := tx.Exec(`ROLLBACK TO write_job`); rbErr != nil {
+			return errors.Join(err, rbErr)
+		}
+		_, _ = tx.Exec(`RELEASE write_job`)
+		return err
+	}
+	_, err := tx.Exec(`RELEASE write_job`)
+	return err
+}
+
+// ErrBackupUnsupported is returned by BackupTo on databases without an online backup API
+var ErrBackupUnsupported = errors.New("online backup is only supported for SQLite")
+
+// BackupTo writes a consistent snapshot of the database to path using
+// SQLite's online backup API. With WAL the copy is taken under a read
+// transaction, so writes carry on while it runs.
+func (s *SQLStore) BackupTo(ctx context.Context, path string) error {
+	if s.dialect != sqliteDialect {
+		return ErrBackupUnsupported
+	}
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open backup file: %w", err)
+	}
+	defer destConn.Close()
+	srcConn, err := s.reader().Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			destSQLite, ok := destRaw.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return ErrBackupUnsupported
+			}
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("start backup: %w", err)
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return fmt.Errorf("backup step: %w", err)
+			}
+			return backup.Finish()
+		})
+	})
+}
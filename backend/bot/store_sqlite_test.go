@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newWALTestStore opens a SQLite file the way the bot does: WAL, a read pool
+// and the batching writer
+func newWALTestStore(t *testing.T, opts SQLiteOptions) *SQLStore {
+	t.Helper()
+	storeOpts := storeOptionsFromEnv()
+	storeOpts.SQLite = opts
+	store, err := openStore(filepath.Join(t.TempDir(), "wal.db"), storeOpts, nil)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store.(*SQLStore)
+}
+
+func TestStoreConformance_SQLiteWAL(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) Store { return newWALTestStore(t, sqliteOptionsFromEnv()) })
+}
+
+func TestSQLiteStore_ConcurrentWrites(t *testing.T) {
+	opts := sqliteOptionsFromEnv()
+	opts.WriteBatch = 16
+	opts.WriteBatchWait = 2 * time.Millisecond
+	store := newWALTestStore(t, opts)
+
+	var mode string
+	if err := store.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("expected WAL journal mode, got %q %v", mode, err)
+	}
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.AddBeer(t.Context(), "", fmt.Sprintf("U%d", i%10), "U99", fmt.Sprintf("%d.%06d", at.Unix(), i), at, 1)
+		}(i)
+		// readers run alongside the writer
+		go func() {
+			defer wg.Done()
+			_, err := store.GetTopUsers(t.Context(), at, at, 5, StatsOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent access: %v", err)
+		}
+	}
+
+	if got, err := store.CountReceivedInDateRange(t.Context(), "U99", at, at, StatsOptions{}); err != nil || got != 100 {
+		t.Fatalf("expected 100 beers, got %d %v", got, err)
+	}
+	if drift, err := store.DailyRollupDrift(t.Context()); err != nil || drift != 0 {
+		t.Fatalf("rollup drift: %d %v", drift, err)
+	}
+}
+
+func TestSQLiteWriter_FailedWriteIsolated(t *testing.T) {
+	store := newTestStore(t)
+	store.db.SetMaxOpenConns(1)
+	// a long wait with a batch of three makes all three writes share a transaction
+	w := newSQLiteWriter(store.db, 8, 3, time.Second, nil)
+	defer w.Close()
+
+	insert := func(id string, fail bool) func(tx *sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`INSERT INTO processed_events (event_id, ts) VALUES (?, '2024-01-01T00:00:00Z')`, id); err != nil {
+				return err
+			}
+			if fail {
+				return errors.New("boom")
+			}
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]error, 3)
+	for i, fail := range []bool{false, true, false} {
+		wg.Add(1)
+		go func(i int, fail bool) {
+			defer wg.Done()
+			results[i] = w.Do(t.Context(), insert(fmt.Sprintf("ev-%d", i), fail))
+		}(i, fail)
+	}
+	wg.Wait()
+
+	if results[0] != nil || results[2] != nil || results[1] == nil {
+		t.Fatalf("unexpected results: %v", results)
+	}
+	for i, want := range []bool{true, false, true} {
+		if got, _ := store.IsEventProcessed(t.Context(), fmt.Sprintf("ev-%d", i)); got != want {
+			t.Fatalf("ev-%d present=%v, want %v", i, got, want)
+		}
+	}
+
+	w.Close()
+	if err := w.Do(t.Context(), insert("late", false)); !errors.Is(err, errWriterClosed) {
+		t.Fatalf("expected errWriterClosed, got %v", err)
+	}
+}
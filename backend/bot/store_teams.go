@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Team membership sources. Memberships from the Slack profile never replace
+// ones set by an admin or a CSV upload.
+const (
+	teamSourceSlack = "slack"
+	teamSourceCSV   = "csv"
+	teamSourceAdmin = "admin"
+)
+
+// TeamMembership is one period a user spent in a team. From and To are
+// YYYY-MM-DD days; To is exclusive and empty while the membership is current.
+type TeamMembership struct {
+	UserID string `json:"userId"`
+	Team   string `json:"team"`
+	From   string `json:"from"`
+	To     string `json:"to,omitempty"`
+	Source string `json:"source"`
+}
+
+// TeamAssignment moves a user into Team from the day of From on. An empty
+// Team takes the user out of their team.
+type TeamAssignment struct {
+	UserID string
+	Team   string
+	From   time.Time
+}
+
+// teamJoin joins beer_daily rows to the team, as alias, the user in column
+// was in on that day
+func teamJoin(alias, column string) string {
+	return ` JOIN team_members ` + alias + ` ON ` + alias + `.user_id = ` + column + ` AND day >= ` + alias + `.valid_from AND (` + alias + `.valid_to IS NULL OR day < ` + alias + `.valid_to)`
+}
+
+// AssignTeams records team changes in one transaction and returns how many
+// memberships changed. Assignments are applied in date order; each one
+// replaces the user's history from its day on, so moving teams keeps the past.
+// Assignments to the user's current team are skipped, as are Slack
+// assignments for users whose team was set by another source.
+func (s *SQLStore) AssignTeams(ctx context.Context, assignments []TeamAssignment, source string) (int, error) {
+	sorted := append([]TeamAssignment(nil), assignments...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].From.Before(sorted[j].From) })
+
+	changed := 0
+	err := s.writeUnbounded(ctx, "AssignTeams", func(ctx context.Context, tx *sql.Tx) error {
+		changed = 0
+		for _, a := range sorted {
+			var team, currentSource string
+			err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT team, source FROM team_members WHERE user_id = ? AND valid_to IS NULL`), a.UserID).Scan(&team, &currentSource)
+			switch {
+			case err == sql.ErrNoRows:
+				if a.Team == "" {
+					continue
+				}
+			case err != nil:
+				return fmt.Errorf("current team of %s: %w", a.UserID, err)
+			case team == a.Team:
+				continue
+			case source == teamSourceSlack && currentSource != teamSourceSlack:
+				continue
+			}
+
+			day := rollupDay(a.From)
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM team_members WHERE user_id = ? AND valid_from >= ?`), a.UserID, day); err != nil {
+				return fmt.Errorf("replace teams of %s: %w", a.UserID, err)
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE team_members SET valid_to = ? WHERE user_id = ? AND (valid_to IS NULL OR valid_to > ?)`), day, a.UserID, day); err != nil {
+				return fmt.Errorf("close team of %s: %w", a.UserID, err)
+			}
+			if a.Team != "" {
+				if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO team_members (user_id, team, valid_from, source) VALUES (?, ?, ?, ?)`), a.UserID, a.Team, day, source); err != nil {
+					return fmt.Errorf("add team of %s: %w", a.UserID, err)
+				}
+			}
+			changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("assign teams: %w", err)
+	}
+	return changed, nil
+}
+
+// GetTeamHistory returns a user's team memberships, oldest first
+func (s *SQLStore) GetTeamHistory(ctx context.Context, userID string) ([]TeamMembership, error) {
+	rows, err := s.query(ctx, "GetTeamHistory", `SELECT user_id, team, valid_from, valid_to, source FROM team_members WHERE user_id = ? ORDER BY valid_from`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TeamMembership
+	for rows.Next() {
+		var m TeamMembership
+		var to sql.NullString
+		if err := rows.Scan(&m.UserID, &m.Team, &m.From, &to, &m.Source); err != nil {
+			return nil, err
+		}
+		m.To = to.String
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// GetTeamSizes returns how many users belonged to each team at some point
+// between start and end
+func (s *SQLStore) GetTeamSizes(ctx context.Context, start, end time.Time) (map[string]int, error) {
+	rows, err := s.query(ctx, "GetTeamSizes", `
+		SELECT team, COUNT(DISTINCT user_id)
+		FROM team_members
+		WHERE valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)
+		GROUP BY team
+	`, end.Format("2006-01-02"), start.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("team sizes query: %w", err)
+	}
+	defer rows.Close()
+	out := map[string]int{}
+	for rows.Next() {
+		var team string
+		var n int
+		if err := rows.Scan(&team, &n); err != nil {
+			return nil, fmt.Errorf("team sizes scan: %w", err)
+		}
+		out[team] = n
+	}
+	return out, rows.Err()
+}
+
+// TeamStats is a team with its beer count. Members and the per-capita counts
+// are filled in by the API.
+type TeamStats struct {
+	Team      string  `json:"team"`
+	Count     int     `json:"count"`
+	Members   int     `json:"members"`
+	PerCapita float64 `json:"perCapita,omitempty"`
+}
+
+// TopTeamsResult contains the giving and receiving teams
+type TopTeamsResult struct {
+	Givers     []TeamStats `json:"givers"`
+	Recipients []TeamStats `json:"recipients"`
+}
+
+// GetTopTeams returns every team's beers given and received in a date range,
+// most first. Each beer counts for the teams its giver and recipient were in
+// on the day it was given. Read from the beer_daily rollup.
+func (s *SQLStore) GetTopTeams(ctx context.Context, start, end time.Time, opts StatsOptions) (*TopTeamsResult, error) {
+	startStr := start.Format("2006-01-02")
+	endStr := end.Format("2006-01-02")
+
+	filter, filterArgs := opts.dailyFilter()
+	args := append([]interface{}{startStr, endStr}, filterArgs...)
+	result := &TopTeamsResult{}
+	for _, side := range []struct {
+		column string
+		dst    *[]TeamStats
+	}{{"giver_id", &result.Givers}, {"recipient_id", &result.Recipients}} {
+		query := `
+			SELECT m.team, COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+			FROM beer_daily` + teamJoin("m", side.column) + `
+			WHERE day BETWEEN ? AND ?` + filter + `
+			GROUP BY m.team
+			HAVING SUM(` + opts.dailyCount() + `) > 0
+			ORDER BY total DESC, m.team
+		`
+		rows, err := s.query(ctx, "GetTopTeams", query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("top teams query: %w", err)
+		}
+		for rows.Next() {
+			var t TeamStats
+			if err := rows.Scan(&t.Team, &t.Count); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("top teams scan: %w", err)
+			}
+			*side.dst = append(*side.dst, t)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("top teams query: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// TeamTimelinePoint is one team's beers given and received in a period
+type TeamTimelinePoint struct {
+	Date              string  `json:"date"`
+	Team              string  `json:"team"`
+	Given             int     `json:"given"`
+	Received          int     `json:"received"`
+	Members           int     `json:"members"`
+	GivenPerCapita    float64 `json:"givenPerCapita,omitempty"`
+	ReceivedPerCapita float64 `json:"receivedPerCapita,omitempty"`
+}
+
+// GetTeamTimelineStats returns beers given and received per team and period,
+// like GetTimelineStats. An empty team returns every team.
+func (s *SQLStore) GetTeamTimelineStats(ctx context.Context, start, end time.Time, granularity, team string, opts StatsOptions) ([]TeamTimelinePoint, error) {
+	startStr := start.Format("2006-01-02")
+	endStr := end.Format("2006-01-02")
+
+	var dateExpr string
+	switch granularity {
+	case "week":
+		dateExpr = s.dialect.weekExpr(`day`)
+	case "month":
+		dateExpr = `substr(day, 1, 7)`
+	default: // "day"
+		dateExpr = `day`
+	}
+
+	filter, filterArgs := opts.dailyFilter()
+	teamFilter := ``
+	args := append([]interface{}{startStr, endStr}, filterArgs...)
+	if team != "" {
+		teamFilter = ` AND m.team = ?`
+		args = append(args, team)
+	}
+	args = append(args, args...)
+
+	query := fmt.Sprintf(`
+		SELECT period, team, SUM(given), SUM(received)
+		FROM (
+			SELECT %[1]s AS period, m.team AS team, %[2]s AS given, 0 AS received
+			FROM beer_daily%[4]s
+			WHERE day BETWEEN ? AND ?%[3]s%[6]s
+			UNION ALL
+			SELECT %[1]s AS period, m.team AS team, 0 AS given, %[2]s AS received
+			FROM beer_daily%[5]s
+			WHERE day BETWEEN ? AND ?%[3]s%[6]s
+		) team_beers
+		GROUP BY period, team
+		HAVING SUM(given) > 0 OR SUM(received) > 0
+		ORDER BY period, team
+	`, dateExpr, opts.dailyCount(), filter, teamJoin("m", "giver_id"), teamJoin("m", "recipient_id"), teamFilter)
+
+	rows, err := s.query(ctx, "GetTeamTimelineStats", query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("team timeline query: %w", err)
+	}
+	defer rows.Close()
+
+	var results []TeamTimelinePoint
+	for rows.Next() {
+		var p TeamTimelinePoint
+		if err := rows.Scan(&p.Date, &p.Team, &p.Given, &p.Received); err != nil {
+			return nil, fmt.Errorf("team timeline scan: %w", err)
+		}
+		results = append(results, p)
+	}
+	return results, rows.Err()
+}
+
+// TeamFlow is the number of beers members of one team gave to another.
+// Giver or Recipient is empty for users without a team.
+type TeamFlow struct {
+	Giver     string `json:"giver"`
+	Recipient string `json:"recipient"`
+	Count     int    `json:"count"`
+}
+
+// GetTeamFlows returns beers given between teams in a date range, from the
+// same beer_daily rows as GetPairStats. Each beer counts for the teams its
+// giver and recipient were in on the day it was given.
+func (s *SQLStore) GetTeamFlows(ctx context.Context, start, end time.Time, opts StatsOptions) ([]TeamFlow, error) {
+	filter, filterArgs := opts.dailyFilter()
+	query := `
+		SELECT COALESCE(g.team, ''), COALESCE(r.team, ''), COALESCE(SUM(` + opts.dailyCount() + `), 0) as total
+		FROM beer_daily
+		LEFT` + teamJoin("g", "giver_id") + `
+		LEFT` + teamJoin("r", "recipient_id") + `
+		WHERE day BETWEEN ? AND ?` + filter + `
+		GROUP BY COALESCE(g.team, ''), COALESCE(r.team, '')
+		HAVING SUM(` + opts.dailyCount() + `) > 0
+		ORDER BY 1, 2
+	`
+	rows, err := s.query(ctx, "GetTeamFlows", query, append([]interface{}{start.Format("2006-01-02"), end.Format("2006-01-02")}, filterArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("team flows query: %w", err)
+	}
+	defer rows.Close()
+
+	var results []TeamFlow
+	for rows.Next() {
+		var f TeamFlow
+		if err := rows.Scan(&f.Giver, &f.Recipient, &f.Count); err != nil {
+			return nil, fmt.Errorf("team flows scan: %w", err)
+		}
+		results = append(results, f)
+	}
+	return results, rows.Err()
+}
@@ -33,21 +33,21 @@ func TestSQLiteStore_IncGet(t *testing.T) {
     user := "U123"
     emoji := "beer"
 
-    if c, _ := s.GetCount(user, emoji); c != 0 {
+    if c, _ := s.GetCount(t.Context(), user, emoji); c != 0 {
         t.Fatalf("expected 0, got %d", c)
     }
 
-    if err := s.IncEmoji(user, emoji); err != nil {
+    if err := s.IncEmoji(t.Context(), user, emoji); err != nil {
         t.Fatalf("inc1: %v", err)
     }
-    if c, _ := s.GetCount(user, emoji); c != 1 {
+    if c, _ := s.GetCount(t.Context(), user, emoji); c != 1 {
         t.Fatalf("expected 1, got %d", c)
     }
 
-    if err := s.IncEmoji(user, emoji); err != nil {
+    if err := s.IncEmoji(t.Context(), user, emoji); err != nil {
         t.Fatalf("inc2: %v", err)
     }
-    if c, _ := s.GetCount(user, emoji); c != 2 {
+    if c, _ := s.GetCount(t.Context(), user, emoji); c != 2 {
         t.Fatalf("expected 2, got %d", c)
     }
 }
@@ -72,15 +72,15 @@ func TestSQLiteStore_Beers(t *testing.T) {
     ts2 := fmt.Sprintf("%d.000000", now.Add(time.Second).Unix())
 
     // simulate two separate message events each giving 1 beer
-    if err := s.AddBeer(giver, recv, ts1, now, 1); err != nil { t.Fatalf("addbeer: %v", err) }
-    if err := s.AddBeer(giver, recv, ts2, now.Add(time.Second), 1); err != nil { t.Fatalf("addbeer2: %v", err) }
+    if err := s.AddBeer(t.Context(), "", giver, recv, ts1, now, 1); err != nil { t.Fatalf("addbeer: %v", err) }
+    if err := s.AddBeer(t.Context(), "", giver, recv, ts2, now.Add(time.Second), 1); err != nil { t.Fatalf("addbeer2: %v", err) }
 
     date := now.UTC().Format("2006-01-02")
-    g, err := s.CountGivenOnDate(giver, date)
+    g, err := s.CountGivenOnDate(t.Context(), giver, date)
     if err != nil { t.Fatalf("count given: %v", err) }
     if g != 2 { t.Fatalf("expected 2 given, got %d", g) }
 
-    r, err := s.CountReceived(recv, "")
+    r, err := s.CountReceived(t.Context(), recv, "")
     if err != nil { t.Fatalf("count recv: %v", err) }
     if r != 2 { t.Fatalf("expected 2 received, got %d", r) }
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CachedUser represents a cached Slack user. Users seen by the directory sync
+// carry their full profile; users cached lazily only have a name and image.
+type CachedUser struct {
+	UserID string `json:"user_id"`
+	// TeamID is the workspace the user was synced from
+	TeamID       string    `json:"team_id"`
+	RealName     string    `json:"real_name"`
+	ProfileImage string    `json:"profile_image"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	DisplayName string `json:"display_name"`
+	Title       string `json:"title"`
+	TZ          string `json:"tz"`
+	Email       string `json:"email"`
+	IsBot       bool   `json:"is_bot"`
+	Deleted     bool   `json:"deleted"`
+	// Guest is set for single- and multi-channel guests and for users from
+	// other organizations (Slack Connect)
+	Guest bool `json:"guest"`
+	// Profile holds the remaining profile fields (names, phone, status and
+	// the workspace's custom fields, keyed by label)
+	Profile map[string]string `json:"profile"`
+	// SyncedAt is when Slack last sent the full user; zero if never
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// Name is the name to show for u: the real name, else the display name
+func (u *CachedUser) Name() string {
+	if u.RealName != "" {
+		return u.RealName
+	}
+	return u.DisplayName
+}
+
+const cachedUserColumns = `user_id, real_name, profile_image, updated_at, display_name, title, tz, email, is_bot, deleted, guest, profile, synced_at, team_id`
+
+func scanCachedUser(scan func(dest ...interface{}) error) (*CachedUser, error) {
+	var u CachedUser
+	var profileImage sql.NullString
+	var updatedAt, profile, syncedAt string
+	if err := scan(&u.UserID, &u.RealName, &profileImage, &updatedAt, &u.DisplayName, &u.Title, &u.TZ, &u.Email, &u.IsBot, &u.Deleted, &u.Guest, &profile, &syncedAt, &u.TeamID); err != nil {
+		return nil, err
+	}
+	u.ProfileImage = profileImage.String
+	u.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	u.SyncedAt, _ = time.Parse(time.RFC3339, syncedAt)
+	_ = json.Unmarshal([]byte(profile), &u.Profile)
+	return &u, nil
+}
+
+// GetCachedUser retrieves a user from the cache by user ID
+func (s *SQLStore) GetCachedUser(ctx context.Context, userID string) (*CachedUser, error) {
+	u, err := scanCachedUser(s.queryRow(ctx, "GetCachedUser", `SELECT `+cachedUserColumns+` FROM user_cache WHERE user_id = ?`, userID).Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetCachedUsers retrieves the cached users among userIDs, keyed by ID
+func (s *SQLStore) GetCachedUsers(ctx context.Context, userIDs []string) (map[string]*CachedUser, error) {
+	out := make(map[string]*CachedUser, len(userIDs))
+	if len(userIDs) == 0 {
+		return out, nil
+	}
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+	query := `SELECT ` + cachedUserColumns + ` FROM user_cache WHERE user_id IN (?` + strings.Repeat(`, ?`, len(userIDs)-1) + `)`
+	rows, err := s.query(ctx, "GetCachedUsers", query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cached users query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := scanCachedUser(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("cached users scan: %w", err)
+		}
+		out[u.UserID] = u
+	}
+	return out, rows.Err()
+}
+
+// SetCachedUser stores or updates a user's name and image in the cache
+func (s *SQLStore) SetCachedUser(ctx context.Context, userID, realName, profileImage string) error {
+	_, err := s.exec(ctx, "SetCachedUser", `INSERT INTO user_cache (user_id, real_name, profile_image, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET real_name = excluded.real_name, profile_image = excluded.profile_image, updated_at = excluded.updated_at`,
+		userID, realName, profileImage, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// upsertCachedUser writes a full user_cache row, as returned by Slack
+const upsertCachedUser = `INSERT INTO user_cache (` + cachedUserColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET real_name = excluded.real_name, profile_image = excluded.profile_image, updated_at = excluded.updated_at,
+		display_name = excluded.display_name, title = excluded.title, tz = excluded.tz, email = excluded.email,
+		is_bot = excluded.is_bot, deleted = excluded.deleted, guest = excluded.guest, profile = excluded.profile, synced_at = excluded.synced_at,
+		team_id = excluded.team_id`
+
+// cachedUserArgs returns the upsertCachedUser arguments for u, stamped with now
+func cachedUserArgs(u *CachedUser, now string) []interface{} {
+	profile, err := json.Marshal(u.Profile)
+	if err != nil || u.Profile == nil {
+		profile = []byte(`{}`)
+	}
+	return []interface{}{u.UserID, u.RealName, u.ProfileImage, now, u.DisplayName, u.Title, u.TZ, u.Email, u.IsBot, u.Deleted, u.Guest, string(profile), now, u.TeamID}
+}
+
+// SaveCachedUser stores a full user record received from Slack
+func (s *SQLStore) SaveCachedUser(ctx context.Context, u CachedUser) error {
+	_, err := s.exec(ctx, "SaveCachedUser", upsertCachedUser, cachedUserArgs(&u, time.Now().UTC().Format(time.RFC3339))...)
+	return err
+}
+
+// DeleteCachedUser removes a user from the cache; the next lookup or sync
+// fetches it again
+func (s *SQLStore) DeleteCachedUser(ctx context.Context, userID string) error {
+	_, err := s.exec(ctx, "DeleteCachedUser", `DELETE FROM user_cache WHERE user_id = ?`, userID)
+	return err
+}
+
+// SyncUserDirectory stores the users returned by a users.list sync in one
+// transaction and returns how many were written. Users missing from the list
+// are left as they are.
+func (s *SQLStore) SyncUserDirectory(ctx context.Context, users []CachedUser) (int, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	err := s.writeUnbounded(ctx, "SyncUserDirectory", func(ctx context.Context, tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, s.dialect.rebind(upsertCachedUser))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i := range users {
+			if _, err := stmt.ExecContext(ctx, cachedUserArgs(&users[i], now)...); err != nil {
+				return fmt.Errorf("store user %s: %w", users[i].UserID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("sync user directory: %w", err)
+	}
+	return len(users), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// workspaceIDPattern matches Slack workspace (T…) and Enterprise Grid org (E…) IDs
+var workspaceIDPattern = regexp.MustCompile(`^[TE][A-Z0-9]+$`)
+
+// Workspace is a Slack workspace the bot is installed in
+type Workspace struct {
+	TeamID string `json:"team_id"`
+	Name   string `json:"name"`
+	// EnterpriseID is the Enterprise Grid org the workspace belongs to, if any
+	EnterpriseID string    `json:"enterprise_id,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// workspaceFilter is the condition on the team_id column selecting the rows
+// of workspace, with its args: a workspace ID, or an Enterprise Grid org ID
+// for all of the org's workspaces
+func workspaceFilter(column, workspace string) (string, []interface{}) {
+	if workspace == "" {
+		return ``, nil
+	}
+	if strings.HasPrefix(workspace, "E") {
+		return ` AND ` + column + ` IN (SELECT team_id FROM workspaces WHERE enterprise_id = ?)`, []interface{}{workspace}
+	}
+	return ` AND ` + column + ` = ?`, []interface{}{workspace}
+}
+
+// SaveWorkspace records a workspace the bot connected to
+func (s *SQLStore) SaveWorkspace(ctx context.Context, w Workspace) error {
+	_, err := s.exec(ctx, "SaveWorkspace", `INSERT INTO workspaces (team_id, name, enterprise_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (team_id) DO UPDATE SET name = excluded.name, enterprise_id = excluded.enterprise_id, updated_at = excluded.updated_at`,
+		w.TeamID, w.Name, w.EnterpriseID, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetWorkspaces returns every workspace the bot connected to, by name
+func (s *SQLStore) GetWorkspaces(ctx context.Context) ([]Workspace, error) {
+	rows, err := s.query(ctx, "GetWorkspaces", `SELECT team_id, name, enterprise_id, updated_at FROM workspaces ORDER BY name, team_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Workspace
+	for rows.Next() {
+		var w Workspace
+		var updatedAt string
+		if err := rows.Scan(&w.TeamID, &w.Name, &w.EnterpriseID, &updatedAt); err != nil {
+			return nil, err
+		}
+		w.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+// ClaimUnscopedRows assigns beers, users and events recorded before the bot
+// knew its workspace to teamID, and returns how many beers moved. Installs
+// that started out with a single workspace call it for that workspace.
+func (s *SQLStore) ClaimUnscopedRows(ctx context.Context, teamID string) (int64, error) {
+	var beers int64
+	err := s.writeUnbounded(ctx, "ClaimUnscopedRows", func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE beers SET team_id = ? WHERE team_id = ''`), teamID)
+		if err != nil {
+			return fmt.Errorf("claim beers: %w", err)
+		}
+		if beers, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		for _, table := range []string{"user_cache", "processed_events", "event_log"} {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE `+table+` SET team_id = ? WHERE team_id = ''`), teamID); err != nil {
+				return fmt.Errorf("claim %s: %w", table, err)
+			}
+		}
+		if beers == 0 {
+			return nil
+		}
+		_, err = s.rebuildDailyRollupSince(ctx, tx, "")
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("claim unscoped rows: %w", err)
+	}
+	return beers, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TeamImportReport summarises a team upload
+type TeamImportReport struct {
+	Rows       int             `json:"rows"`
+	Changed    int             `json:"changed"`
+	Invalid    []ImportProblem `json:"invalid,omitempty"`
+	Unresolved []string        `json:"unresolved,omitempty"`
+}
+
+// teamFromProfile reads a user's team from a profile field: "title" or the ID
+// of a custom field
+func teamFromProfile(u CachedUser, field string) string {
+	if field == "title" {
+		return strings.TrimSpace(u.Title)
+	}
+	return strings.TrimSpace(u.Profile[field])
+}
+
+// importTeams reads user, team and optional from columns from r (CSV or a
+// JSON array) and assigns the teams. Users may be Slack IDs, emails or names.
+func importTeams(ctx context.Context, store Store, users emailLookup, r io.Reader, format string) (*TeamImportReport, error) {
+	records, err := readImportRecords(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &TeamImportReport{Rows: len(records)}
+	resolver := newUserResolver(store, users)
+	unresolved := map[string]bool{}
+	now := time.Now()
+	var assignments []TeamAssignment
+	for i, rec := range records {
+		problem := func(err error) {
+			report.Invalid = append(report.Invalid, ImportProblem{Row: i + 1, Error: err.Error()})
+		}
+		userID, err := resolver.resolve(ctx, rec["user"])
+		if err != nil {
+			unresolved[strings.TrimSpace(rec["user"])] = true
+			problem(err)
+			continue
+		}
+		from := now
+		if v := strings.TrimSpace(rec["from"]); v != "" {
+			if from, err = parseImportTime(v, ""); err != nil {
+				problem(err)
+				continue
+			}
+		}
+		assignments = append(assignments, TeamAssignment{UserID: userID, Team: strings.TrimSpace(rec["team"]), From: from})
+	}
+
+	for v := range unresolved {
+		if v != "" {
+			report.Unresolved = append(report.Unresolved, v)
+		}
+	}
+	sort.Strings(report.Unresolved)
+
+	report.Changed, err = store.AssignTeams(ctx, assignments, teamSourceCSV)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// perCapita divides count by members, rounded to two decimals
+func perCapita(count, members int) float64 {
+	if members == 0 {
+		return 0
+	}
+	return math.Round(float64(count)/float64(members)*100) / 100
+}
+
+// TeamsHandler lists teams with their number of members
+// Query params: day (YYYY-MM-DD, default today)
+func (h *APIHandlers) TeamsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "teams").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	day := time.Now().UTC()
+	if v := r.URL.Query().Get("day"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			http.Error(w, "day must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = t
+	}
+
+	sizes, err := h.store.GetTeamSizes(r.Context(), day, day)
+	if err != nil {
+		h.logger.Error().Str("handler", "teams").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	teams := make([]TeamStats, 0, len(sizes))
+	for team, n := range sizes {
+		teams = append(teams, TeamStats{Team: team, Members: n})
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Team < teams[j].Team })
+
+	h.logger.Info().Str("handler", "teams").Int("teams", len(teams)).Msg("request completed")
+	writeJSON(w, h.logger, "teams", http.StatusOK, teams)
+}
+
+// TopTeamsHandler returns the top N giving and receiving teams
+// Query params: start, end (YYYY-MM-DD), limit (default 20), per_capita
+func (h *APIHandlers) TopTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "top_teams").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	start, end, err := parseDateRangeFromParams(r)
+	if err != nil {
+		h.logger.Warn().Str("handler", "top_teams").Err(err).Msg("invalid date range")
+		http.Error(w, "invalid or missing date range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 100 {
+		limit = v
+	}
+	byCapita, _ := strconv.ParseBool(r.URL.Query().Get("per_capita"))
+
+	data, err := h.store.GetTopTeams(r.Context(), start, end, statsOptionsFromParams(r))
+	if err != nil {
+		h.logger.Error().Str("handler", "top_teams").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sizes, err := h.store.GetTeamSizes(r.Context(), start, end)
+	if err != nil {
+		h.logger.Error().Str("handler", "top_teams").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, list := range []*[]TeamStats{&data.Givers, &data.Recipients} {
+		for i := range *list {
+			t := &(*list)[i]
+			t.Members = sizes[t.Team]
+			if byCapita {
+				t.PerCapita = perCapita(t.Count, t.Members)
+			}
+		}
+		if byCapita {
+			sort.SliceStable(*list, func(i, j int) bool { return (*list)[i].PerCapita > (*list)[j].PerCapita })
+		}
+		if len(*list) > limit {
+			*list = (*list)[:limit]
+		}
+	}
+
+	h.logger.Info().Str("handler", "top_teams").Int("givers", len(data.Givers)).Int("recipients", len(data.Recipients)).Msg("request completed")
+	writeJSON(w, h.logger, "top_teams", http.StatusOK, data)
+}
+
+// TeamTimelineHandler returns beers given and received per team over time
+// Query params: start, end (YYYY-MM-DD), granularity (day|week|month), team, per_capita
+func (h *APIHandlers) TeamTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "team_timeline").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	start, end, err := parseDateRangeFromParams(r)
+	if err != nil {
+		h.logger.Warn().Str("handler", "team_timeline").Err(err).Msg("invalid date range")
+		http.Error(w, "invalid or missing date range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+	if granularity != "day" && granularity != "week" && granularity != "month" {
+		http.Error(w, "granularity must be day, week, or month", http.StatusBadRequest)
+		return
+	}
+	byCapita, _ := strconv.ParseBool(r.URL.Query().Get("per_capita"))
+
+	data, err := h.store.GetTeamTimelineStats(r.Context(), start, end, granularity, r.URL.Query().Get("team"), statsOptionsFromParams(r))
+	if err != nil {
+		h.logger.Error().Str("handler", "team_timeline").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sizes, err := h.store.GetTeamSizes(r.Context(), start, end)
+	if err != nil {
+		h.logger.Error().Str("handler", "team_timeline").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range data {
+		p := &data[i]
+		p.Members = sizes[p.Team]
+		if byCapita {
+			p.GivenPerCapita = perCapita(p.Given, p.Members)
+			p.ReceivedPerCapita = perCapita(p.Received, p.Members)
+		}
+	}
+	if data == nil {
+		data = []TeamTimelinePoint{}
+	}
+
+	h.logger.Info().Str("handler", "team_timeline").Int("points", len(data)).Str("granularity", granularity).Msg("request completed")
+	writeJSON(w, h.logger, "team_timeline", http.StatusOK, data)
+}
+
+// UserTeamsHandler returns a user's team history
+// Path params: id (Slack user ID)
+func (h *APIHandlers) UserTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "user_teams").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	history, err := h.store.GetTeamHistory(r.Context(), userID)
+	if err != nil {
+		h.logger.Error().Str("handler", "user_teams").Str("userID", userID).Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []TeamMembership{}
+	}
+	writeJSON(w, h.logger, "user_teams", http.StatusOK, history)
+}
+
+// SetUserTeamHandler moves a user to a team and returns their team history
+// Path params: id (Slack user ID). Body: {"team" (empty to leave), "from" (YYYY-MM-DD, default today)}
+func (h *APIHandlers) SetUserTeamHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "set_user_team").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	userID := r.PathValue("id")
+	if !slackUserIDPattern.MatchString(userID) {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Team string `json:"team"`
+		From string `json:"from"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCorrectionBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	from := time.Now()
+	if body.From != "" {
+		t, err := time.Parse("2006-01-02", body.From)
+		if err != nil {
+			http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+
+	if _, err := h.store.AssignTeams(r.Context(), []TeamAssignment{{UserID: userID, Team: strings.TrimSpace(body.Team), From: from}}, teamSourceAdmin); err != nil {
+		h.logger.Error().Str("handler", "set_user_team").Str("userID", userID).Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.logger.Info().Str("handler", "set_user_team").Str("userID", userID).Str("team", body.Team).Msg("request completed")
+	h.UserTeamsHandler(w, r)
+}
+
+// ImportTeamsHandler assigns teams from a CSV or JSON request body with user,
+// team and optional from columns
+// Query params: format (csv|json, default from Content-Type)
+func (h *APIHandlers) ImportTeamsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "import_teams").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = importCSV
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			format = importJSON
+		}
+	}
+	var users emailLookup
+	if h.slackClient != nil {
+		users = h.slackClient
+	}
+	report, err := importTeams(r.Context(), h.store, users, http.MaxBytesReader(w, r.Body, maxImportBytes), format)
+	if err != nil {
+		h.logger.Warn().Str("handler", "import_teams").Err(err).Msg("import failed")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.logger.Info().Str("handler", "import_teams").Int("rows", report.Rows).Int("changed", report.Changed).Int("invalid", len(report.Invalid)).Msg("request completed")
+	writeJSON(w, h.logger, "import_teams", http.StatusOK, report)
+}
+
+// TeamMatrix is the team×team matrix of beer flows: Matrix[i][j] is how many
+// beers members of Teams[i] gave to members of Teams[j]. Beers to or from
+// users without a team are only counted in Unassigned.
+type TeamMatrix struct {
+	Teams          []string `json:"teams"`
+	Matrix         [][]int  `json:"matrix"`
+	InTeam         int      `json:"inTeam"`
+	CrossTeam      int      `json:"crossTeam"`
+	Unassigned     int      `json:"unassigned"`
+	InTeamRatio    float64  `json:"inTeamRatio"`
+	CrossTeamRatio float64  `json:"crossTeamRatio"`
+}
+
+// buildTeamMatrix arranges team flows into a square matrix with teams sorted by name
+func buildTeamMatrix(flows []TeamFlow) *TeamMatrix {
+	m := &TeamMatrix{Teams: []string{}, Matrix: [][]int{}}
+	seen := map[string]bool{}
+	for _, f := range flows {
+		if f.Giver == "" || f.Recipient == "" {
+			m.Unassigned += f.Count
+			continue
+		}
+		for _, team := range []string{f.Giver, f.Recipient} {
+			if !seen[team] {
+				seen[team] = true
+				m.Teams = append(m.Teams, team)
+			}
+		}
+	}
+	sort.Strings(m.Teams)
+	index := make(map[string]int, len(m.Teams))
+	for i, team := range m.Teams {
+		index[team] = i
+		m.Matrix = append(m.Matrix, make([]int, len(m.Teams)))
+	}
+
+	for _, f := range flows {
+		if f.Giver == "" || f.Recipient == "" {
+			continue
+		}
+		m.Matrix[index[f.Giver]][index[f.Recipient]] += f.Count
+		if f.Giver == f.Recipient {
+			m.InTeam += f.Count
+		} else {
+			m.CrossTeam += f.Count
+		}
+	}
+	if total := m.InTeam + m.CrossTeam; total > 0 {
+		m.InTeamRatio = math.Round(float64(m.InTeam)/float64(total)*1000) / 1000
+		m.CrossTeamRatio = math.Round(float64(m.CrossTeam)/float64(total)*1000) / 1000
+	}
+	return m
+}
+
+// TeamMatrixHandler returns the team×team matrix of beer flows with in-team
+// and cross-team ratios
+// Query params: start, end (YYYY-MM-DD)
+func (h *APIHandlers) TeamMatrixHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Info().Str("handler", "team_matrix").Str("method", r.Method).Str("path", r.URL.Path).Str("query", r.URL.RawQuery).Msg("request received")
+
+	start, end, err := parseDateRangeFromParams(r)
+	if err != nil {
+		h.logger.Warn().Str("handler", "team_matrix").Err(err).Msg("invalid date range")
+		http.Error(w, "invalid or missing date range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flows, err := h.store.GetTeamFlows(r.Context(), start, end, statsOptionsFromParams(r))
+	if err != nil {
+		h.logger.Error().Str("handler", "team_matrix").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := buildTeamMatrix(flows)
+
+	h.logger.Info().Str("handler", "team_matrix").Int("teams", len(data.Teams)).Msg("request completed")
+	writeJSON(w, h.logger, "team_matrix", http.StatusOK, data)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestImportTeams(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.SetCachedUser(t.Context(), "U2", "Grace Hopper", ""); err != nil {
+		t.Fatalf("cache user: %v", err)
+	}
+	csv := "user,team,from\nU1,Alpha,2023-01-01\nGrace Hopper,Beta,2023-01-01\nU1,Beta,2023-06-01\nNobody,Alpha,\nU3,Alpha,someday\n"
+	report, err := importTeams(t.Context(), store, nil, strings.NewReader(csv), importCSV)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if report.Rows != 5 || report.Changed != 3 || len(report.Invalid) != 2 || len(report.Unresolved) != 1 || report.Unresolved[0] != "Nobody" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	history, _ := store.GetTeamHistory(t.Context(), "U1")
+	if len(history) != 2 || history[0].To != "2023-06-01" || history[1].Team != "Beta" || history[1].Source != teamSourceCSV {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+}
+
+func TestUserDirectorySyncTeams(t *testing.T) {
+	store := newTestStore(t)
+	var lister fakeUserLister
+	decodeSlackJSON(t, `[
+		{"id": "U1", "real_name": "U1", "profile": {"real_name": "U1"}},
+		{"id": "U2", "real_name": "U2", "profile": {"real_name": "U2"}},
+		{"id": "U3", "deleted": true, "profile": {"real_name": "U3"}},
+		{"id": "U4", "real_name": "U4", "profile": {"real_name": "U4"}}
+	]`, &lister.users)
+	decodeSlackJSON(t, `{"fields": [
+		{"id": "Xf01", "ordering": 0, "label": "Department", "hint": "", "type": "text", "possible_values": null, "options": null, "is_hidden": false},
+		{"id": "Xf02", "ordering": 1, "label": "Office", "hint": "", "type": "text", "possible_values": null, "options": null, "is_hidden": false}
+	]}`, &lister.team)
+	// U4's profile can't be read, so it keeps its team
+	decodeSlackJSON(t, `{
+		"U1": {"real_name": "U1", "fields": {"Xf01": {"value": "Alpha", "alt": ""}, "Xf02": {"value": "Berlin", "alt": ""}}},
+		"U2": {"real_name": "U2", "fields": {"Xf02": {"value": "Paris", "alt": ""}}}
+	}`, &lister.profiles)
+
+	sync := NewUserDirectorySync(store, &lister, nil, 0, zerolog.Nop(), nil)
+	sync.SetTeamField("department")
+	if _, err := store.AssignTeams(t.Context(), []TeamAssignment{{UserID: "U3", Team: "Alpha", From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}, {UserID: "U4", Team: "Beta", From: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}}, teamSourceSlack); err != nil {
+		t.Fatalf("assign: %v", err)
+	}
+	if _, err := sync.SyncOnce(t.Context()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if h, _ := store.GetTeamHistory(t.Context(), "U1"); len(h) != 1 || h[0].Team != "Alpha" || h[0].Source != teamSourceSlack {
+		t.Fatalf("unexpected U1 teams: %+v", h)
+	}
+	if h, _ := store.GetTeamHistory(t.Context(), "U2"); len(h) != 0 {
+		t.Fatalf("expected no team for a blank field: %+v", h)
+	}
+	if h, _ := store.GetTeamHistory(t.Context(), "U4"); len(h) != 1 || h[0].Team != "Beta" || h[0].To != "" {
+		t.Fatalf("expected U4 to keep its team: %+v", h)
+	}
+	// deactivated users leave their team
+	if h, _ := store.GetTeamHistory(t.Context(), "U3"); len(h) != 1 || h[0].To == "" {
+		t.Fatalf("expected U3's team closed: %+v", h)
+	}
+}
+
+func TestBuildTeamMatrix(t *testing.T) {
+	m := buildTeamMatrix([]TeamFlow{
+		{Giver: "Beta", Recipient: "Alpha", Count: 2},
+		{Giver: "Alpha", Recipient: "Alpha", Count: 3},
+		{Giver: "Beta", Recipient: "Gamma", Count: 1},
+		{Giver: "Gamma", Recipient: "", Count: 4},
+	})
+	if strings.Join(m.Teams, ",") != "Alpha,Beta,Gamma" {
+		t.Fatalf("unexpected teams: %v", m.Teams)
+	}
+	want := [][]int{{3, 0, 0}, {2, 0, 1}, {0, 0, 0}}
+	for i := range want {
+		for j := range want[i] {
+			if m.Matrix[i][j] != want[i][j] {
+				t.Fatalf("matrix: got %v, want %v", m.Matrix, want)
+			}
+		}
+	}
+	if m.InTeam != 3 || m.CrossTeam != 3 || m.Unassigned != 4 || m.InTeamRatio != 0.5 || m.CrossTeamRatio != 0.5 {
+		t.Fatalf("unexpected totals: %+v", m)
+	}
+	if empty := buildTeamMatrix(nil); len(empty.Teams) != 0 || empty.InTeamRatio != 0 {
+		t.Fatalf("unexpected empty matrix: %+v", empty)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+)
+
+// userDirectoryPageSize is the users.list page size; Slack recommends at most 200
+const userDirectoryPageSize = 200
+
+// userLister lists every member of the workspace (users.list) and reads the
+// custom profile fields users.list leaves out: their definitions
+// (team.profile.get) and each user's values (users.profile.get).
+// *slack.Client implements it and pages through the results.
+type userLister interface {
+	GetUsersContext(ctx context.Context, options ...slack.GetUsersOption) ([]slack.User, error)
+	GetTeamProfileContext(ctx context.Context, teamID ...string) (*slack.TeamProfile, error)
+	GetUserProfileContext(ctx context.Context, params *slack.GetUserProfileParameters) (*slack.UserProfile, error)
+}
+
+// UserDirectorySync periodically copies the Slack user directory into
+// user_cache, so names, avatars and user attributes are served from local
+// data instead of one users.info call per user.
+type UserDirectorySync struct {
+	store      Store
+	users      userLister
+	redisCache *RedisUserCache
+	interval   time.Duration
+	teamField  string
+	logger     zerolog.Logger
+	synced     prometheus.Gauge
+	failures   prometheus.Counter
+	lastRun    prometheus.Gauge
+	duration   prometheus.Histogram
+}
+
+// NewUserDirectorySync creates a directory sync. redisCache may be nil.
+// Metrics are registered on reg when non-nil.
+func NewUserDirectorySync(store Store, users userLister, redisCache *RedisUserCache, interval time.Duration, logger zerolog.Logger, reg prometheus.Registerer) *UserDirectorySync {
+	s := &UserDirectorySync{
+		store:      store,
+		users:      users,
+		redisCache: redisCache,
+		interval:   interval,
+		logger:     logger,
+		synced: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bwm_user_sync_users",
+			Help: "Number of users stored by the last user directory sync",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bwm_user_sync_failures_total",
+			Help: "Number of failed user directory syncs",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "bwm_user_sync_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful user directory sync",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_user_sync_duration_seconds",
+			Help:    "Duration of user directory syncs",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(s.synced, s.failures, s.lastRun, s.duration)
+	}
+	return s
+}
+
+// SetTeamField makes each sync assign users to the team named in this profile
+// field: "title", or the label or ID of a custom field. Empty disables it.
+func (s *UserDirectorySync) SetTeamField(field string) {
+	s.teamField = field
+}
+
+// cachedUserFromSlack maps a users.list entry or the user of a user event
+// onto a user_cache row
+func cachedUserFromSlack(u slack.User) CachedUser {
+	realName := u.RealName
+	if realName == "" {
+		// deactivated users keep their name only in the profile
+		realName = u.Profile.RealName
+	}
+	profile := map[string]string{}
+	for key, value := range map[string]string{
+		"first_name":   u.Profile.FirstName,
+		"last_name":    u.Profile.LastName,
+		"phone":        u.Profile.Phone,
+		"status_text":  u.Profile.StatusText,
+		"status_emoji": u.Profile.StatusEmoji,
+	} {
+		if value != "" {
+			profile[key] = value
+		}
+	}
+	// custom fields are keyed by field ID (Xf...): Slack's user objects carry
+	// no labels, which only team.profile.get returns
+	for id, field := range u.Profile.Fields.ToMap() {
+		profile[id] = field.Value
+	}
+	return CachedUser{
+		UserID:       u.ID,
+		TeamID:       u.TeamID,
+		RealName:     realName,
+		ProfileImage: u.Profile.Image192,
+		DisplayName:  u.Profile.DisplayName,
+		Title:        u.Profile.Title,
+		TZ:           u.TZ,
+		Email:        u.Profile.Email,
+		IsBot:        u.IsBot || u.ID == "USLACKBOT",
+		Deleted:      u.Deleted,
+		Guest:        u.IsRestricted || u.IsUltraRestricted || u.IsStranger,
+		Profile:      profile,
+	}
+}
+
+// saveSlackUser stores a single user received from Slack in user_cache and
+// refreshes its Redis entry, so changes show up right away
+func saveSlackUser(ctx context.Context, store Store, redisCache *RedisUserCache, su slack.User) (CachedUser, error) {
+	u := cachedUserFromSlack(su)
+	if err := store.SaveCachedUser(ctx, u); err != nil {
+		return u, fmt.Errorf("save user %s: %w", u.UserID, err)
+	}
+	if redisCache == nil {
+		return u, nil
+	}
+	if u.Name() == "" {
+		return u, redisCache.DeleteUser(ctx, u.UserID)
+	}
+	return u, redisCache.SetUser(ctx, u.UserID, u.Name(), u.ProfileImage)
+}
+
+// SyncOnce stores the full user directory and returns how many users were written
+func (s *UserDirectorySync) SyncOnce(ctx context.Context) (int, error) {
+	start := time.Now()
+	list, err := s.users.GetUsersContext(ctx, slack.GetUsersOptionLimit(userDirectoryPageSize))
+	if err != nil {
+		s.failures.Inc()
+		return 0, err
+	}
+
+	// a custom team field is looked up by its ID, as users carry no labels
+	teamField := s.teamField
+	if teamField != "" && teamField != "title" {
+		if teamField, err = s.resolveProfileField(ctx); err != nil {
+			s.logger.Warn().Err(err).Str("field", s.teamField).Msg("cannot resolve team profile field, teams not updated")
+		}
+	}
+
+	users := make([]CachedUser, 0, len(list))
+	toCache := make(map[string]UserCacheData, len(list))
+	var teams []TeamAssignment
+	for _, u := range list {
+		cu := cachedUserFromSlack(u)
+		readTeam := teamField != "" && !cu.IsBot
+		if readTeam && teamField != "title" && !cu.Deleted {
+			if err := s.loadCustomFields(ctx, &cu); err != nil {
+				if ctx.Err() != nil {
+					return 0, ctx.Err()
+				}
+				s.logger.Warn().Err(err).Str("user", cu.UserID).Msg("cannot read custom profile fields, keeping team")
+				readTeam = false
+			}
+		}
+		users = append(users, cu)
+		if cu.Name() != "" {
+			toCache[cu.UserID] = UserCacheData{RealName: cu.Name(), ProfileImage: cu.ProfileImage}
+		}
+		if !readTeam {
+			continue
+		}
+		// deactivated users leave their team; a blank field keeps the old one
+		team := teamFromProfile(cu, teamField)
+		if cu.Deleted {
+			team = ""
+		} else if team == "" {
+			continue
+		}
+		teams = append(teams, TeamAssignment{UserID: cu.UserID, Team: team, From: start})
+	}
+	n, err := s.store.SyncUserDirectory(ctx, users)
+	if err != nil {
+		s.failures.Inc()
+		return 0, err
+	}
+	if s.redisCache != nil {
+		if err := s.redisCache.SetUsers(ctx, toCache); err != nil {
+			s.logger.Warn().Err(err).Msg("failed to cache synced users to redis")
+		}
+	}
+	if len(teams) > 0 {
+		changed, err := s.store.AssignTeams(ctx, teams, teamSourceSlack)
+		if err != nil {
+			s.failures.Inc()
+			return n, err
+		}
+		if changed > 0 {
+			s.logger.Info().Int("changed", changed).Str("field", s.teamField).Msg("updated teams from slack profiles")
+		}
+	}
+
+	s.synced.Set(float64(n))
+	s.duration.Observe(time.Since(start).Seconds())
+	s.lastRun.SetToCurrentTime()
+	return n, nil
+}
+
+// resolveProfileField returns the ID of the custom profile field the team
+// field names, by label (case-insensitive) or ID
+func (s *UserDirectorySync) resolveProfileField(ctx context.Context) (string, error) {
+	profile, err := s.users.GetTeamProfileContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("team.profile.get: %w", err)
+	}
+	for _, f := range profile.Fields {
+		if f.ID == s.teamField || strings.EqualFold(f.Label, s.teamField) {
+			return f.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no custom profile field %q", s.teamField)
+}
+
+// loadCustomFields reads a user's custom profile field values with
+// users.profile.get into u.Profile, keyed by field ID. Rate limited calls are
+// retried after the delay Slack asks for.
+func (s *UserDirectorySync) loadCustomFields(ctx context.Context, u *CachedUser) error {
+	for {
+		profile, err := s.users.GetUserProfileContext(ctx, &slack.GetUserProfileParameters{UserID: u.UserID})
+		var limited *slack.RateLimitedError
+		if errors.As(err, &limited) {
+			select {
+			case <-time.After(limited.RetryAfter):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("users.profile.get: %w", err)
+		}
+		if u.Profile == nil {
+			u.Profile = map[string]string{}
+		}
+		for id, field := range profile.Fields.ToMap() {
+			u.Profile[id] = field.Value
+		}
+		return nil
+	}
+}
+
+// Run syncs immediately and then on every interval until ctx is done
+func (s *UserDirectorySync) Run(ctx context.Context) {
+	s.logger.Info().Dur("interval", s.interval).Msg("starting user directory sync")
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := s.SyncOnce(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("user directory sync failed")
+		} else {
+			s.logger.Info().Int("users", n).Msg("synced user directory")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.logger.Info().Msg("user directory sync stopping")
+			return
+		}
+	}
+}
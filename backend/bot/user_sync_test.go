@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// fakeUserLister answers like Slack does: users.list entries carry no custom
+// profile fields, team.profile.get holds their labels and users.profile.get
+// each user's values keyed by field ID
+type fakeUserLister struct {
+	users    []slack.User
+	team     slack.TeamProfile
+	profiles map[string]slack.UserProfile
+}
+
+func (f *fakeUserLister) GetUsersContext(ctx context.Context, options ...slack.GetUsersOption) ([]slack.User, error) {
+	return f.users, nil
+}
+
+func (f *fakeUserLister) GetTeamProfileContext(ctx context.Context, teamID ...string) (*slack.TeamProfile, error) {
+	return &f.team, nil
+}
+
+func (f *fakeUserLister) GetUserProfileContext(ctx context.Context, params *slack.GetUserProfileParameters) (*slack.UserProfile, error) {
+	p, ok := f.profiles[params.UserID]
+	if !ok {
+		return nil, errors.New("user_not_found")
+	}
+	return &p, nil
+}
+
+// decodeSlackJSON decodes a Slack API response fragment into v
+func decodeSlackJSON(t *testing.T, data string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+}
+
+func TestUserDirectorySync(t *testing.T) {
+	store := newTestStore(t)
+
+	var lister fakeUserLister
+	decodeSlackJSON(t, `[
+		{"id": "U1", "real_name": "Ada Lovelace", "tz": "Europe/London", "profile": {"display_name": "ada", "title": "Analyst", "email": "ada@example.com", "image_192": "img", "first_name": "Ada"}},
+		{"id": "U2", "deleted": true, "profile": {"real_name": "Grace Hopper"}},
+		{"id": "B1", "real_name": "Beer Bot", "is_bot": true}
+	]`, &lister.users)
+
+	sync := NewUserDirectorySync(store, &lister, nil, 0, zerolog.Nop(), nil)
+	if n, err := sync.SyncOnce(t.Context()); err != nil || n != 3 {
+		t.Fatalf("sync: %d %v", n, err)
+	}
+
+	u, err := store.GetCachedUser(t.Context(), "U1")
+	if err != nil || u == nil || u.DisplayName != "ada" || u.Title != "Analyst" || u.Email != "ada@example.com" || u.TZ != "Europe/London" ||
+		u.ProfileImage != "img" || u.Profile["first_name"] != "Ada" {
+		t.Fatalf("unexpected synced user: %+v %v", u, err)
+	}
+	// deactivated users keep the name from their profile
+	if u, _ := store.GetCachedUser(t.Context(), "U2"); u == nil || !u.Deleted || u.Name() != "Grace Hopper" {
+		t.Fatalf("unexpected deleted user: %+v", u)
+	}
+	if u, _ := store.GetCachedUser(t.Context(), "B1"); u == nil || !u.IsBot {
+		t.Fatalf("unexpected bot user: %+v", u)
+	}
+}
+
+func handleUserEvent(t *testing.T, ep *EventProcessor, payload string) {
+	t.Helper()
+	data, err := slackevents.ParseEvent(json.RawMessage(payload), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		t.Fatalf("parse event: %v", err)
+	}
+	ep.HandleEvent(socketmode.Event{
+		Type:    socketmode.EventTypeEventsAPI,
+		Data:    data,
+		Request: &socketmode.Request{Type: string(socketmode.EventTypeEventsAPI), Payload: json.RawMessage(payload)},
+	})
+}
+
+func TestUserEvents(t *testing.T) {
+	store := newTestStore(t)
+	ep := NewEventProcessor(store, &RecordingSlack{}, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, nil)
+
+	handleUserEvent(t, ep, `{"type":"event_callback","event":{"type":"team_join","user":{"id":"U1","real_name":"Ada","tz":"Europe/London","profile":{"display_name":"ada","email":"ada@example.com","image_192":"img1"}}}}`)
+	u, err := store.GetCachedUser(t.Context(), "U1")
+	if err != nil || u == nil || u.RealName != "Ada" || u.Email != "ada@example.com" || u.ProfileImage != "img1" || u.TZ != "Europe/London" {
+		t.Fatalf("unexpected user after team_join: %+v %v", u, err)
+	}
+
+	handleUserEvent(t, ep, `{"type":"event_callback","event":{"type":"user_change","user":{"id":"U1","real_name":"Ada Lovelace","deleted":true,"profile":{"title":"Analyst","image_192":"img2","fields":{"Xf01":{"value":"Engines","alt":""}}}}}}`)
+	u, err = store.GetCachedUser(t.Context(), "U1")
+	// custom fields are stored by field ID
+	if err != nil || u == nil || u.RealName != "Ada Lovelace" || u.ProfileImage != "img2" || u.Title != "Analyst" || !u.Deleted || u.Profile["Xf01"] != "Engines" {
+		t.Fatalf("unexpected user after user_change: %+v %v", u, err)
+	}
+
+	if err := store.DeleteCachedUser(t.Context(), "U1"); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if u, _ := store.GetCachedUser(t.Context(), "U1"); u != nil {
+		t.Fatalf("expected the user purged, got %+v", u)
+	}
+}
+
+func TestEligibility(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.SyncUserDirectory(t.Context(), []CachedUser{{UserID: "U2"}, {UserID: "B1", IsBot: true}, {UserID: "U3", Guest: true}, {UserID: "U4", Deleted: true}}); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	fake := &RecordingSlack{}
+	ep := NewEventProcessor(store, fake, nil, "C1", ":beer:", 10, zerolog.Nop(), nil, nil)
+	ep.SetEligibility(EligibilityRules{RejectBots: true, RejectGuests: true, RejectDeactivated: true})
+
+	handleUserEvent(t, ep, `{"type":"event_callback","event":{"type":"message","channel":"C1","user":"U1","text":"<@U2> :beer: <@B1> :beer: <@U3> :beer: <@U4> :beer: <@U5> :beer:","ts":"1700000000.000100"}}`)
+
+	want := map[string]bool{
+		"Sorry <@U1>, <@B1> is a bot, so they can't receive beers.":                       true,
+		"Sorry <@U1>, <@U3> is a guest, so they can't receive beers.":                     true,
+		"Sorry <@U1>, <@U4> is no longer in this workspace, so they can't receive beers.": true,
+	}
+	for _, m := range fake.Messages() {
+		delete(want, m.Text)
+	}
+	if len(want) != 0 {
+		t.Fatalf("missing rejections %v in %+v", want, fake.Messages())
+	}
+	day, _ := parseSlackTimestamp("1700000000.000100")
+	// users missing from the cache are eligible
+	for id, expected := range map[string]int{"U2": 1, "U5": 1, "B1": 0, "U3": 0, "U4": 0} {
+		if got, _ := store.CountReceivedInDateRange(t.Context(), id, day, day, StatsOptions{}); got != expected {
+			t.Fatalf("%s: expected %d beers, got %d", id, expected, got)
+		}
+	}
+
+	// bots and deactivated users can't give beers
+	handleUserEvent(t, ep, `{"type":"event_callback","event":{"type":"message","channel":"C1","user":"U4","text":"<@U2> :beer:","ts":"1700000100.000100"}}`)
+	if got, _ := store.CountGivenInDateRange(t.Context(), "U4", day, day, StatsOptions{}); got != 0 {
+		t.Fatalf("expected no beers from a deactivated user, got %d", got)
+	}
+}
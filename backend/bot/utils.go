@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/rs/zerolog"
 )
 
 // parseDateRangeFromParams parses day=, start=, end= from query params. If only day is set, returns that day. If start/end are set, returns the range. If none, returns error.
@@ -36,6 +40,16 @@ func parseDateRangeFromParams(r *http.Request) (time.Time, time.Time, error) {
 	return time.Time{}, time.Time{}, fmt.Errorf("must provide either day=YYYY-MM-DD or start=YYYY-MM-DD&end=YYYY-MM-DD")
 }
 
+// statsOptionsFromParams reads include_revoked=, active_only= and workspace=
+// from query params. Revoked beers are left out unless include_revoked is
+// true; beers of deactivated users are left out when active_only is true.
+// workspace is checked by workspaceMiddleware.
+func statsOptionsFromParams(r *http.Request) StatsOptions {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("include_revoked"))
+	activeOnly, _ := strconv.ParseBool(r.URL.Query().Get("active_only"))
+	return StatsOptions{IncludeRevoked: include, ActiveOnly: activeOnly, Workspace: r.URL.Query().Get("workspace")}
+}
+
 // parseSlackTimestamp parses Slack timestamps of the form "1234567890.123456"
 // and returns a time.Time preserving fractional seconds.
 func parseSlackTimestamp(ts string) (time.Time, error) {
@@ -78,3 +92,17 @@ func getQuarterNumber(t time.Time) int {
 func getQuarterStartMonth(quarterNum int) time.Month {
 	return time.Month((quarterNum-1)*3 + 1)
 }
+
+// writeJSON encodes v into a buffer first so encoding errors can still be
+// reported as a 500, then writes it with the given status code
+func writeJSON(w http.ResponseWriter, logger zerolog.Logger, handler string, status int, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		logger.Error().Str("handler", handler).Err(err).Msg("failed to encode response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// ErrPoolClosed is returned when submitting to a pool that is draining or stopped
+var ErrPoolClosed = errors.New("event worker pool closed")
+
+// poolJob is a unit of work queued on a worker
+type poolJob struct {
+	key      string
+	fn       func()
+	enqueued time.Time
+}
+
+// EventWorkerPool runs event handlers on a fixed set of workers. Jobs are
+// partitioned by key (the giver's user ID) so that all work for one user runs
+// sequentially on the same worker, which keeps per-user ordering and daily
+// limit checks correct while unrelated users are processed in parallel.
+type EventWorkerPool struct {
+	queues    []chan poolJob
+	wg        sync.WaitGroup
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	senders   sync.WaitGroup
+	logger    zerolog.Logger
+	depth     *prometheus.GaugeVec
+	wait      prometheus.Histogram
+	duration  prometheus.Histogram
+	submitted prometheus.Counter
+}
+
+// NewEventWorkerPool starts a pool with the given number of workers, each with
+// a bounded queue of queueSize jobs. Metrics are registered on reg when non-nil.
+func NewEventWorkerPool(workers, queueSize int, logger zerolog.Logger, reg prometheus.Registerer) *EventWorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	p := &EventWorkerPool{
+		queues: make([]chan poolJob, workers),
+		done:   make(chan struct{}),
+		logger: logger,
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bwm_event_queue_depth",
+			Help: "Number of events waiting in each worker queue",
+		}, []string{"worker"}),
+		wait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_event_queue_wait_seconds",
+			Help:    "Time events spend queued before a worker picks them up",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bwm_event_handle_duration_seconds",
+			Help:    "Time spent handling a single event",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		submitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bwm_events_queued_total",
+			Help: "Number of events submitted to the worker pool",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(p.depth, p.wait, p.duration, p.submitted)
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan poolJob, queueSize)
+		p.wg.Add(1)
+		go p.run(i)
+	}
+
+	logger.Info().Int("workers", workers).Int("queueSize", queueSize).Msg("event worker pool started")
+	return p
+}
+
+// Submit queues fn on the worker owning key. It blocks while that worker's
+// queue is full, applying backpressure to the caller, until ctx is done or
+// the pool shuts down.
+func (p *EventWorkerPool) Submit(ctx context.Context, key string, fn func()) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrPoolClosed
+	}
+	// Shutdown closes the queues only once every sender has left
+	p.senders.Add(1)
+	p.mu.RUnlock()
+	defer p.senders.Done()
+
+	idx := p.partition(key)
+	job := poolJob{key: key, fn: fn, enqueued: time.Now()}
+	select {
+	case p.queues[idx] <- job:
+		p.submitted.Inc()
+		p.depth.WithLabelValues(strconv.Itoa(idx)).Inc()
+		return nil
+	case <-p.done:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting new jobs and waits for queued and in-flight jobs to
+// finish. Submitters blocked on a full queue return ErrPoolClosed right away.
+// It returns ctx.Err() if the deadline passes before the drain completes.
+func (p *EventWorkerPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	first := !p.closed
+	if first {
+		p.closed = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+	if first {
+		p.senders.Wait()
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.logger.Info().Msg("event worker pool drained")
+		return nil
+	case <-ctx.Done():
+		p.logger.Warn().Err(ctx.Err()).Msg("event worker pool drain timed out")
+		return ctx.Err()
+	}
+}
+
+// partition maps a key to a worker index
+func (p *EventWorkerPool) partition(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// run consumes one worker queue until it is closed
+func (p *EventWorkerPool) run(idx int) {
+	defer p.wg.Done()
+	label := strconv.Itoa(idx)
+	for job := range p.queues[idx] {
+		p.depth.WithLabelValues(label).Dec()
+		p.wait.Observe(time.Since(job.enqueued).Seconds())
+
+		start := time.Now()
+		p.execute(job)
+		p.duration.Observe(time.Since(start).Seconds())
+	}
+	p.logger.Debug().Int("worker", idx).Msg("event worker stopped")
+}
+
+// execute runs a job, recovering from panics so one bad event can't kill a worker
+func (p *EventWorkerPool) execute(job poolJob) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			p.logger.Error().Interface("panic", rec).Str("key", job.key).Msg("event handler panicked")
+		}
+	}()
+	job.fn()
+}
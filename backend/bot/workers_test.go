@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestEventWorkerPool_OrderPerKey(t *testing.T) {
+	pool := NewEventWorkerPool(4, 8, zerolog.Nop(), nil)
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	keys := []string{"U1", "U2", "U3"}
+	for i := 0; i < 50; i++ {
+		for _, key := range keys {
+			key, i := key, i
+			if err := pool.Submit(context.Background(), key, func() {
+				mu.Lock()
+				seen[key] = append(seen[key], i)
+				mu.Unlock()
+			}); err != nil {
+				t.Fatalf("submit: %v", err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	for _, key := range keys {
+		got := seen[key]
+		if len(got) != 50 {
+			t.Fatalf("key %s: expected 50 jobs, got %d", key, len(got))
+		}
+		for i, v := range got {
+			if v != i {
+				t.Fatalf("key %s: out of order at %d: %v", key, i, got)
+			}
+		}
+	}
+}
+
+func TestEventWorkerPool_DrainAndClose(t *testing.T) {
+	pool := NewEventWorkerPool(1, 4, zerolog.Nop(), nil)
+
+	release := make(chan struct{})
+	var done int
+	var mu sync.Mutex
+	for i := 0; i < 3; i++ {
+		if err := pool.Submit(context.Background(), "U1", func() {
+			<-release
+			mu.Lock()
+			done++
+			mu.Unlock()
+		}); err != nil {
+			t.Fatalf("submit: %v", err)
+		}
+	}
+
+	// a drain with an expired deadline reports the timeout
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.Shutdown(expired); err == nil {
+		t.Fatalf("expected drain timeout while jobs are blocked")
+	}
+
+	if err := pool.Submit(context.Background(), "U1", func() {}); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+
+	close(release)
+	ctx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := pool.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if done != 3 {
+		t.Fatalf("expected 3 drained jobs, got %d", done)
+	}
+}
+
+func TestEventWorkerPool_ShutdownReleasesBlockedSubmit(t *testing.T) {
+	pool := NewEventWorkerPool(1, 1, zerolog.Nop(), nil)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := pool.Submit(context.Background(), "U1", func() { close(started); <-release }); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	<-started
+	if err := pool.Submit(context.Background(), "U1", func() {}); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+
+	// the queue is full, so this submit blocks until the pool shuts down
+	blocked := make(chan error, 1)
+	go func() { blocked <- pool.Submit(context.Background(), "U1", func() {}) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_ = pool.Shutdown(ctx)
+	select {
+	case err := <-blocked:
+		if err != ErrPoolClosed {
+			t.Fatalf("expected ErrPoolClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked submit was not released by shutdown")
+	}
+
+	close(release)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := pool.Shutdown(ctx2); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/slack-go/slack"
+)
+
+// WorkspaceConfig holds the tokens and channel of one Slack workspace install
+type WorkspaceConfig struct {
+	BotToken string `json:"bot_token"`
+	AppToken string `json:"app_token"`
+	Channel  string `json:"channel"`
+}
+
+// loadWorkspaceConfigs returns primary, if its tokens are set, followed by the
+// installs listed in the JSON file at path, if path is set. App tokens are
+// only needed for socket mode.
+func loadWorkspaceConfigs(path string, primary WorkspaceConfig, socketMode bool) ([]WorkspaceConfig, error) {
+	var configs []WorkspaceConfig
+	if primary.BotToken != "" || primary.AppToken != "" {
+		configs = append(configs, primary)
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read workspaces file: %w", err)
+		}
+		var listed []WorkspaceConfig
+		if err := json.Unmarshal(data, &listed); err != nil {
+			return nil, fmt.Errorf("parse workspaces file: %w", err)
+		}
+		configs = append(configs, listed...)
+	}
+	for i, c := range configs {
+		if c.BotToken == "" || c.Channel == "" {
+			return nil, fmt.Errorf("workspace %d: bot_token and channel are required", i+1)
+		}
+		if socketMode && c.AppToken == "" {
+			return nil, fmt.Errorf("workspace %d: app_token is required in socket mode", i+1)
+		}
+	}
+	return configs, nil
+}
+
+// workspaceInstall is a workspace the bot runs in, with its Slack connection
+// and the processor handling its events
+type workspaceInstall struct {
+	Workspace
+	manager   *SlackConnectionManager
+	processor *EventProcessor
+}
+
+// identifyWorkspace asks Slack which workspace the bot token belongs to
+func identifyWorkspace(ctx context.Context, client *slack.Client) (Workspace, error) {
+	resp, err := client.AuthTestContext(ctx)
+	if err != nil {
+		return Workspace{}, fmt.Errorf("auth test: %w", err)
+	}
+	return Workspace{TeamID: resp.TeamID, Name: resp.Team, EnterpriseID: resp.EnterpriseID}, nil
+}
+
+// SetWorkspaceProcessors sets the event processor of every workspace the bot
+// runs in, keyed by team id. Dead letters are replayed by the processor of
+// the workspace they came from.
+func (h *APIHandlers) SetWorkspaceProcessors(processors map[string]*EventProcessor) {
+	h.processors = processors
+}
+
+// defaultWorkspace is the workspace of the primary event processor, used when
+// a request does not name one. Without a processor (API-only processes) it is
+// the only workspace recorded, if there is exactly one.
+func (h *APIHandlers) defaultWorkspace(ctx context.Context) string {
+	if h.eventProcessor != nil {
+		return h.eventProcessor.workspace
+	}
+	workspaces, err := h.store.GetWorkspaces(ctx)
+	if err != nil || len(workspaces) != 1 {
+		return ""
+	}
+	return workspaces[0].TeamID
+}
+
+// processorFor returns the event processor of the workspace the payload of
+// dead letter id came from, falling back to the primary processor
+func (h *APIHandlers) processorFor(ctx context.Context, id int64) *EventProcessor {
+	dl, err := h.store.GetDeadLetter(ctx, id)
+	if err != nil || dl == nil {
+		return h.eventProcessor
+	}
+	var envelope struct {
+		TeamID string `json:"team_id"`
+	}
+	if err := json.Unmarshal(dl.Payload, &envelope); err != nil {
+		return h.eventProcessor
+	}
+	if ep, ok := h.processors[envelope.TeamID]; ok {
+		return ep
+	}
+	return h.eventProcessor
+}
+
+// WorkspacesHandler lists the workspaces the bot is installed in
+func (h *APIHandlers) WorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Debug().Str("handler", "workspaces").Str("method", r.Method).Str("path", r.URL.Path).Msg("request received")
+
+	list, err := h.store.GetWorkspaces(r.Context())
+	if err != nil {
+		h.logger.Error().Str("handler", "workspaces").Err(err).Msg("database error")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		list = []Workspace{}
+	}
+
+	h.logger.Info().Str("handler", "workspaces").Int("count", len(list)).Msg("request completed")
+	writeJSON(w, h.logger, "workspaces", http.StatusOK, list)
+}
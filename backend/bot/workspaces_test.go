@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadWorkspaceConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workspaces.json")
+	if err := os.WriteFile(path, []byte(`[{"bot_token": "xoxb-2", "app_token": "xapp-2", "channel": "C2"}]`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	primary := WorkspaceConfig{BotToken: "xoxb-1", AppToken: "xapp-1", Channel: "C1"}
+	configs, err := loadWorkspaceConfigs(path, primary, true)
+	if err != nil || len(configs) != 2 || configs[0] != primary || configs[1].Channel != "C2" {
+		t.Fatalf("unexpected configs: %+v %v", configs, err)
+	}
+
+	// the primary install is optional when a file lists the workspaces
+	if configs, err := loadWorkspaceConfigs(path, WorkspaceConfig{Channel: "C1"}, true); err != nil || len(configs) != 1 {
+		t.Fatalf("unexpected configs: %+v %v", configs, err)
+	}
+	if _, err := loadWorkspaceConfigs("", WorkspaceConfig{BotToken: "xoxb-1", AppToken: "xapp-1"}, true); err == nil {
+		t.Fatalf("expected a missing channel to be rejected")
+	}
+	// app tokens are only needed for socket mode
+	noAppToken := WorkspaceConfig{BotToken: "xoxb-1", Channel: "C1"}
+	if _, err := loadWorkspaceConfigs("", noAppToken, true); err == nil {
+		t.Fatalf("expected a missing app token to be rejected in socket mode")
+	}
+	if configs, err := loadWorkspaceConfigs("", noAppToken, false); err != nil || len(configs) != 1 {
+		t.Fatalf("unexpected configs in http mode: %+v %v", configs, err)
+	}
+}